@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Output formats for the end of a run, see --output
+const (
+	outputText   = "text"
+	outputGitHub = "github"
+)
+
+// resolveOutputFormat returns the --output format to use. Without the flag, runs inside GitHub
+// Actions (GITHUB_ACTIONS=true) get annotations.
+func resolveOutputFormat(flag string) (string, error) {
+	switch flag {
+	case outputText, outputGitHub:
+		return flag, nil
+	case "":
+		if os.Getenv("GITHUB_ACTIONS") == "true" {
+			return outputGitHub, nil
+		}
+		return outputText, nil
+	}
+	return "", fmt.Errorf("--output must be %q or %q, got: %s", outputText, outputGitHub, flag)
+}
+
+// githubAnnotations returns a GitHub Actions ::error command for each failure in result, pointing
+// at the block's line so it shows up inline on the pull request. filePaths are the files the run
+// was given, used to turn a block's file name back into a path.
+func githubAnnotations(result DocciResult, filePaths []string) []string {
+	if result.Success {
+		return nil
+	}
+
+	var annotations []string
+	for _, verr := range result.ValidationErrors {
+		annotations = append(annotations, githubAnnotation(annotationFile(verr.File, filePaths), verr.Line, verr.Error()))
+	}
+	if result.ExecError != nil {
+		annotations = append(annotations, githubAnnotation(annotationFile(result.ExecError.File, filePaths), result.ExecError.Line, result.ExecError.Error()))
+	}
+
+	// failures without a block, like a parse error or docci-assert-faster-than, get one annotation
+	// on the file with the message docci printed
+	if len(annotations) == 0 {
+		message := strings.TrimSpace(result.Stderr)
+		if message == "" {
+			message = fmt.Sprintf("docci failed with exit code %d", result.ExitCode)
+		}
+		annotations = append(annotations, githubAnnotation(annotationFile("", filePaths), 0, message))
+	}
+	return annotations
+}
+
+// githubAnnotation formats a single ::error workflow command. file and line are left out when unknown.
+func githubAnnotation(file string, line int, message string) string {
+	var props []string
+	if file != "" {
+		props = append(props, "file="+escapeAnnotationProperty(file))
+		if line > 0 {
+			props = append(props, fmt.Sprintf("line=%d", line))
+		}
+	}
+	props = append(props, "title=docci")
+	return fmt.Sprintf("::error %s::%s", strings.Join(props, ","), escapeAnnotationData(message))
+}
+
+// annotationFile maps a block's file name to the path GitHub expects, relative to the repository
+// root. Single-file runs leave the block's file name empty, and merged runs only keep the base
+// name, so both are looked up in filePaths.
+func annotationFile(fileName string, filePaths []string) string {
+	path := ""
+	if fileName == "" {
+		if len(filePaths) == 1 {
+			path = filePaths[0]
+		}
+	} else {
+		for _, candidate := range filePaths {
+			if filepath.Base(candidate) == fileName {
+				path = candidate
+				break
+			}
+		}
+	}
+	if path == "" {
+		return fileName
+	}
+
+	root := os.Getenv("GITHUB_WORKSPACE")
+	if root == "" {
+		root, _ = os.Getwd()
+	}
+	if rel, err := filepath.Rel(root, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return path
+}
+
+// escapeAnnotationData escapes a workflow command message so newlines survive
+func escapeAnnotationData(s string) string {
+	s = strings.ReplaceAll(s, "%", "%25")
+	s = strings.ReplaceAll(s, "\r", "%0D")
+	return strings.ReplaceAll(s, "\n", "%0A")
+}
+
+// escapeAnnotationProperty escapes a workflow command property, which also ends at ':' and ','
+func escapeAnnotationProperty(s string) string {
+	s = escapeAnnotationData(s)
+	s = strings.ReplaceAll(s, ":", "%3A")
+	return strings.ReplaceAll(s, ",", "%2C")
+}
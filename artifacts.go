@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reecepbcups/docci/logger"
+	"github.com/reecepbcups/docci/parser"
+)
+
+// collectArtifacts copies every docci-artifact path or glob into dir once the script has run.
+// Relative paths resolve against the block's docci-cwd, or the directory the script ran in (runDir,
+// the process's own when empty). Files keep their relative path under dir, absolute paths are
+// copied by base name. Patterns that match nothing are logged and skipped, so a failed run still
+// collects whatever it produced.
+func collectArtifacts(blocks []parser.CodeBlock, dir string, runDir string) error {
+	log := logger.GetLogger()
+
+	wd := runDir
+	if wd == "" {
+		var err error
+		if wd, err = os.Getwd(); err != nil {
+			return fmt.Errorf("get working directory: %w", err)
+		}
+	}
+
+	for _, block := range blocks {
+		base := wd
+		if block.WorkingDir != "" {
+			base = block.WorkingDir
+			if !filepath.IsAbs(base) {
+				base = filepath.Join(wd, base)
+			}
+		}
+
+		for _, pattern := range block.Artifacts {
+			full := pattern
+			if !filepath.IsAbs(full) {
+				full = filepath.Join(base, pattern)
+			}
+			matches, err := filepath.Glob(full)
+			if err != nil {
+				return fmt.Errorf("docci-artifact %s: %w", pattern, err)
+			}
+			if len(matches) == 0 {
+				log.Warn("docci-artifact matched no files", "block", block.Index, "path", pattern)
+				continue
+			}
+
+			for _, match := range matches {
+				dest := filepath.Join(dir, filepath.Base(match))
+				if rel, err := filepath.Rel(base, match); err == nil && !filepath.IsAbs(pattern) && !strings.HasPrefix(rel, "..") {
+					dest = filepath.Join(dir, rel)
+				}
+				if err := copyArtifact(match, dest); err != nil {
+					return fmt.Errorf("collect artifact %s: %w", match, err)
+				}
+				log.Info("Collected artifact", "path", match, "dest", dest)
+			}
+		}
+	}
+	return nil
+}
+
+// copyArtifact copies a file, or a directory recursively, to dest
+func copyArtifact(src, dest string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				return os.MkdirAll(filepath.Join(dest, rel), 0755)
+			}
+			return copyFile(path, filepath.Join(dest, rel), fi.Mode())
+		})
+	}
+	return copyFile(src, dest, info.Mode())
+}
+
+// copyFile copies a single file, creating dest's parent directories
+func copyFile(src, dest string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
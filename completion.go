@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/reecepbcups/docci/parser"
+	"github.com/spf13/cobra"
+)
+
+// logLevels are the values accepted by --log-level
+var logLevels = []string{"debug", "info", "warn", "error", "fatal", "panic", "off"}
+
+var completionCmd = &cobra.Command{
+	Use:   "completion [bash|zsh|fish|powershell]",
+	Short: "Generate a shell completion script",
+	Long: `Generate a completion script for your shell. For example:
+
+  bash:       source <(docci completion bash)
+  zsh:        docci completion zsh > "${fpath[1]}/_docci"
+  fish:       docci completion fish > ~/.config/fish/completions/docci.fish
+  powershell: docci completion powershell | Out-String | Invoke-Expression`,
+	DisableFlagsInUseLine: true,
+	ValidArgs:             []string{"bash", "zsh", "fish", "powershell"},
+	Args:                  cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		switch args[0] {
+		case "bash":
+			return rootCmd.GenBashCompletionV2(os.Stdout, true)
+		case "zsh":
+			return rootCmd.GenZshCompletion(os.Stdout)
+		case "fish":
+			return rootCmd.GenFishCompletion(os.Stdout, true)
+		case "powershell":
+			return rootCmd.GenPowerShellCompletionWithDesc(os.Stdout)
+		}
+		return fmt.Errorf("unsupported shell: %s", args[0])
+	},
+}
+
+// completeMarkdownFiles completes markdown files and JSON configs for commands taking a document
+func completeMarkdownFiles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return []string{"md", "json"}, cobra.ShellCompDirectiveFilterFileExt
+}
+
+// completeTagNames completes docci tag names and aliases
+func completeTagNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var matches []string
+	for _, name := range parser.AllTagNames() {
+		if strings.HasPrefix(name, toComplete) {
+			matches = append(matches, name)
+		}
+	}
+	return matches, cobra.ShellCompDirectiveNoFileComp
+}
+
+// registerCompletions wires argument and flag completions onto the commands
+func registerCompletions() {
+	runCmd.ValidArgsFunction = completeMarkdownFiles
+	validateCmd.ValidArgsFunction = completeMarkdownFiles
+	checkCmd.ValidArgsFunction = completeMarkdownFiles
+	tagsCmd.ValidArgsFunction = completeTagNames
+
+	_ = rootCmd.RegisterFlagCompletionFunc("log-level", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return logLevels, cobra.ShellCompDirectiveNoFileComp
+	})
+	_ = runCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{outputText, outputGitHub}, cobra.ShellCompDirectiveNoFileComp
+	})
+	_ = runCmd.RegisterFlagCompletionFunc("working-dir", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return nil, cobra.ShellCompDirectiveFilterDirs
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/reecepbcups/docci/executor"
+	"github.com/reecepbcups/docci/logger"
+	"github.com/reecepbcups/docci/parser"
+	"github.com/reecepbcups/docci/types"
+)
+
+// confirmInput is where confirmation answers are read from (overridable in tests)
+var confirmInput io.Reader = os.Stdin
+
+// isInteractive reports whether stdin is attached to a terminal (overridable in tests)
+var isInteractive = executor.StdinIsTerminal
+
+// confirmBlocks prompts for every docci-confirm block before the script is built.
+// Declined blocks are removed from the returned slice. When stdin is not interactive
+// the run only proceeds if opts.AssumeYes is set.
+func confirmBlocks(blocks []parser.CodeBlock, opts types.DocciOpts) ([]parser.CodeBlock, error) {
+	log := logger.GetLogger()
+
+	if opts.AssumeYes || opts.DebugMode {
+		return blocks, nil
+	}
+
+	var reader *bufio.Reader
+	confirmed := make([]parser.CodeBlock, 0, len(blocks))
+	for _, block := range blocks {
+		if !block.Confirm {
+			confirmed = append(confirmed, block)
+			continue
+		}
+
+		if !isInteractive() {
+			return nil, fmt.Errorf("block %d (line %d) requires confirmation (docci-confirm) but stdin is not interactive, use --yes to proceed",
+				block.Index, block.LineNumber)
+		}
+
+		if reader == nil {
+			reader = bufio.NewReader(confirmInput)
+		}
+
+		fmt.Fprintf(os.Stderr, "\nBlock %d (line %d%s) requires confirmation:\n%s", block.Index, block.LineNumber, formatFileName(block.FileName), block.Content)
+		fmt.Fprint(os.Stderr, "Run this block? [y/N]: ")
+
+		answer, err := reader.ReadString('\n')
+		if err != nil && answer == "" {
+			return nil, fmt.Errorf("read confirmation for block %d: %w", block.Index, err)
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			confirmed = append(confirmed, block)
+		default:
+			log.Warn("Skipping block, not confirmed", "block", block.Index, "line", block.LineNumber)
+		}
+	}
+
+	return confirmed, nil
+}
+
+// formatFileName returns a ", file" suffix for prompts when the block came from a named file
+func formatFileName(fileName string) string {
+	if fileName != "" {
+		return ", " + fileName
+	}
+	return ""
+}
@@ -1,24 +1,49 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/reecepbcups/docci/executor"
+	"github.com/reecepbcups/docci/hooks"
 	"github.com/reecepbcups/docci/logger"
 	"github.com/reecepbcups/docci/parser"
 	"github.com/reecepbcups/docci/types"
 )
 
+// Exit codes set on DocciResult.ExitCode so callers can tell failure kinds apart
+const (
+	ExitCodeExecutionError  = 1 // a command in the document broke
+	ExitCodeValidationError = 2 // the document's expectations did not match (output or assert-failure)
+	ExitCodeParseError      = 3 // the document could not be read or parsed
+)
+
 // DocciResult contains the complete result of running a docci file
 type DocciResult struct {
 	Success          bool
 	ExitCode         int
 	Stdout           string
 	Stderr           string
-	ValidationErrors []error
+	ValidationErrors []*executor.ValidationError
+	ExecError        *executor.ExecError // set when a block failed the script unexpectedly
+	Titles           map[string]string   // front-matter titles keyed by file path
+	BlockCount       int                 // blocks scheduled to run, whether or not the run reached them
+	Skipped          []parser.CodeBlock  // blocks left out of the run, with SkipReason set
+	OutputEnv        map[string]string   // docci-output-to-env variables and the trimmed output of their block
+	BlockStdout      map[int]string      // each block's stdout by index, before docci-strip-ansi, docci-trim-output or docci-output-sort
+	BlockStderr      map[int]string      // each block's stderr by index
+	BailedAt         int                 // block a docci-bail-unless guard stopped the run before, 0 if the run was not stopped
+	BlockFiles       map[int]string      // path of the markdown file each scheduled block came from, by index
+	BlockOutput      map[int]string      // what each block that started wrote to stdout and then stderr, including the block the run stopped in
+	Warnings         map[int]int         // exit code of each failed block that did not stop the run (docci-warn-only, or one docci-skip-on-failure-of blocks depend on), by index
 }
 
 // RunDocciFile executes all the logic for processing a docci markdown file
@@ -30,8 +55,16 @@ func RunDocciFile(filePath string) DocciResult {
 	})
 }
 
-// RunDocciFileWithOptions executes all the logic for processing a docci markdown file with options
+// RunDocciFileWithOptions executes all the logic for processing a docci markdown file with options,
+// including the working directory, log level and pre, on-failure and cleanup commands they set
 func RunDocciFileWithOptions(filePath string, opts types.DocciOpts) DocciResult {
+	return runWithLifecycle([]string{filePath}, opts, func(filePaths []string, opts types.DocciOpts) DocciResult {
+		return runDocciFile(filePaths[0], opts)
+	})
+}
+
+// runDocciFile is RunDocciFileWithOptions without what runWithLifecycle does around the run
+func runDocciFile(filePath string, opts types.DocciOpts) DocciResult {
 	log := logger.GetLogger()
 
 	// Read the file into a string
@@ -41,110 +74,61 @@ func RunDocciFileWithOptions(filePath string, opts types.DocciOpts) DocciResult
 		log.Error("Failed to read file", "error", err.Error())
 		return DocciResult{
 			Success:  false,
-			ExitCode: 1,
+			ExitCode: ExitCodeParseError,
 			Stderr:   fmt.Sprintf("Error reading file: %s", err.Error()),
 		}
 	}
 
 	// Parse code blocks with metadata
 	log.Debug("Parsing code blocks from markdown")
-	blocks, err := parser.ParseCodeBlocks(string(markdown))
+	blocks, skipped, err := parser.ParseCodeBlocksWithOptions(string(markdown), filePath, "", opts)
 	if err != nil {
 		log.Error("Failed to parse code blocks", "error", err.Error())
 		return DocciResult{
 			Success:  false,
-			ExitCode: 1,
+			ExitCode: ExitCodeParseError,
 			Stderr:   fmt.Sprintf("Error parsing code blocks: %s", err.Error()),
 		}
 	}
 
 	log.Debug("Found code blocks", "count", len(blocks))
 
-	// Build executable script with validation markers
-	log.Debug("Building executable script")
-	script, validationMap, assertFailureMap := parser.BuildExecutableScriptWithOptions(blocks, opts)
-
-	// If in debug mode, print script and exit
-	if opts.DebugMode {
-		log.Info("Debug mode: printing script (not executing)")
-		fmt.Print(script)
-		return DocciResult{
-			Success:  true,
-			ExitCode: 0,
-		}
-	}
-
-	// Execute the script
-	log.Debug("Executing script")
-	resp, err := executor.Exec(script)
-	if err != nil {
+	if err := prepareBlocks(blocks, filepath.Dir(filePath), opts); err != nil {
+		log.Error("Failed to prepare code blocks", "error", err.Error())
 		return DocciResult{
 			Success:  false,
-			ExitCode: 1,
-			Stderr:   fmt.Sprintf("execute script: %v", err),
+			ExitCode: ExitCodeParseError,
+			Stderr:   fmt.Sprintf("Error parsing code blocks: %s", err.Error()),
 		}
 	}
 
-	// Check assert-failure blocks
-	if len(assertFailureMap) > 0 {
-		log.Debug("Checking assert-failure expectations")
-		// If we have assert-failure blocks, we expect the script to fail
-		if resp.Error == nil {
-			log.Error("Expected script to fail due to assert-failure tag, but it succeeded")
-			return DocciResult{
-				Success:  false,
-				ExitCode: 1,
-				Stdout:   resp.Stdout,
-				Stderr:   "Error: Expected script to fail with non-zero exit code due to docci-assert-failure tag, but it succeeded",
-			}
-		}
-		log.Info("✓ Code block failed as expected due to docci-assert-failure tag")
-		// Script failed as expected, continue processing
-	} else if resp.Error != nil {
-		// No assert-failure blocks, so error is unexpected
-		log.Error("Unexpected script execution failure", "error", resp.Error.Error())
+	frontMatter, err := parser.ParseFrontMatter(string(markdown))
+	if err != nil {
+		log.Error("Failed to parse front matter", "error", err.Error())
 		return DocciResult{
 			Success:  false,
-			ExitCode: 1,
-			Stdout:   resp.Stdout,
-			Stderr:   fmt.Sprintf("Error executing code block: %s", resp.Error.Error()),
+			ExitCode: ExitCodeParseError,
+			Stderr:   fmt.Sprintf("Error parsing front matter: %s", err.Error()),
 		}
 	}
 
-	// Parse block outputs from the stdout
-	log.Debug("Parsing block outputs")
-	blockOutputs := executor.ParseBlockOutputs(resp.Stdout)
-
-	// Validate outputs if there are any validation requirements
-	var validationErrors []error
-	if len(validationMap) > 0 {
-		log.Debug("Validating output expectations", "count", len(validationMap))
-		validationErrors = executor.ValidateOutputs(blockOutputs, validationMap)
-		if len(validationErrors) > 0 {
-			log.Error("Found validation errors", "count", len(validationErrors))
-			errorMsg := "\n=== Validation Errors ===\n"
-			for _, err := range validationErrors {
-				errorMsg += fmt.Sprintf("❌ %s\n", err.Error())
-			}
-			return DocciResult{
-				Success:          false,
-				ExitCode:         1,
-				Stdout:           resp.Stdout,
-				Stderr:           errorMsg,
-				ValidationErrors: validationErrors,
-			}
+	titles := make(map[string]string)
+	if frontMatter.Title != "" {
+		titles[filePath] = frontMatter.Title
+		if !opts.DebugMode {
+			printTitleBanner(stdoutWriter(opts), frontMatter.Title)
 		}
-		log.Debug("All validations passed")
 	}
 
-	log.Debug("Script execution completed successfully")
-	return DocciResult{
-		Success:          true,
-		ExitCode:         0,
-		Stdout:           resp.Stdout,
-		Stderr:           resp.Stderr,
-		ValidationErrors: nil,
+	result := executeBlocks(blocks, opts, "code block")
+	result.Titles = titles
+	result.BlockCount = len(blocks)
+	result.Skipped = skipped
+	result.BlockFiles = make(map[int]string, len(blocks))
+	for _, block := range blocks {
+		result.BlockFiles[block.Index] = filePath
 	}
+	return result
 }
 
 // RunDocciCommand runs a docci file and handles output/exit like the main function
@@ -160,10 +144,10 @@ func RunDocciCommand(filePath string) {
 	if result.Success && len(result.ValidationErrors) == 0 {
 		// Check if there were any validations that passed
 		markdown, _ := os.ReadFile(filePath)
-		blocks, _ := parser.ParseCodeBlocks(string(markdown))
+		blocks, _, _ := parser.ParseCodeBlocksWithIncludes(string(markdown), filePath, "")
 		hasValidations := false
 		for _, block := range blocks {
-			if block.OutputContains != "" || block.AssertFailure {
+			if block.OutputContains != "" || block.OutputCount != nil || block.AssertFailure {
 				hasValidations = true
 				break
 			}
@@ -187,16 +171,27 @@ func RunDocciFiles(filePaths []string) DocciResult {
 	})
 }
 
-// RunDocciFilesWithOptions merges multiple markdown files and executes them as one with options
+// RunDocciFilesWithOptions merges multiple markdown files and executes them as one with options,
+// including the working directory, log level and pre, on-failure and cleanup commands they set
 func RunDocciFilesWithOptions(filePaths []string, opts types.DocciOpts) DocciResult {
+	return runWithLifecycle(filePaths, opts, func(filePaths []string, opts types.DocciOpts) DocciResult {
+		return runDocciFiles(filePaths, opts)
+	})
+}
+
+// runDocciFiles is RunDocciFilesWithOptions without what runWithLifecycle does around the run
+func runDocciFiles(filePaths []string, opts types.DocciOpts) DocciResult {
 	log := logger.GetLogger()
 
 	log.Debug("Merging markdown files", "count", len(filePaths))
 
-	var allBlocks []parser.CodeBlock
-	globalIndex := 1
-
-	// Parse all files and collect blocks with filename metadata
+	// Read every file up front so docci-order front matter can decide the run order
+	type mergeFile struct {
+		path        string
+		markdown    string
+		frontMatter parser.FrontMatter
+	}
+	files := make([]mergeFile, 0, len(filePaths))
 	for _, filePath := range filePaths {
 		log.Debug("Reading file", "path", filePath)
 		markdown, err := os.ReadFile(filePath)
@@ -204,44 +199,525 @@ func RunDocciFilesWithOptions(filePaths []string, opts types.DocciOpts) DocciRes
 			log.Error("Failed to read file", "path", filePath, "error", err.Error())
 			return DocciResult{
 				Success:  false,
-				ExitCode: 1,
+				ExitCode: ExitCodeParseError,
 				Stderr:   fmt.Sprintf("Error reading file %s: %s", filePath, err.Error()),
 			}
 		}
 
+		frontMatter, err := parser.ParseFrontMatter(string(markdown))
+		if err != nil {
+			log.Error("Failed to parse front matter", "path", filePath, "error", err.Error())
+			return DocciResult{
+				Success:  false,
+				ExitCode: ExitCodeParseError,
+				Stderr:   fmt.Sprintf("Error parsing front matter from %s: %s", filePath, err.Error()),
+			}
+		}
+		files = append(files, mergeFile{path: filePath, markdown: string(markdown), frontMatter: frontMatter})
+	}
+
+	// Lower docci-order runs first; argument order breaks ties
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].frontMatter.Order < files[j].frontMatter.Order
+	})
+
+	var allBlocks, allSkipped []parser.CodeBlock
+	globalIndex := 1
+	titles := make(map[string]string)
+	blockFiles := make(map[int]string)
+	orderedPaths := make([]string, 0, len(files))
+
+	// Parse all files and collect blocks with filename metadata
+	for _, file := range files {
+		filePath := file.path
+		orderedPaths = append(orderedPaths, filePath)
+
 		// Parse code blocks with filename metadata
 		log.Debug("Parsing code blocks", "path", filePath)
 		fileName := filepath.Base(filePath)
-		blocks, err := parser.ParseCodeBlocksWithFileName(string(markdown), fileName)
+		blocks, skipped, err := parser.ParseCodeBlocksWithOptions(file.markdown, filePath, fileName, opts)
 		if err != nil {
 			log.Error("Failed to parse code blocks", "path", filePath, "error", err.Error())
 			return DocciResult{
 				Success:  false,
-				ExitCode: 1,
+				ExitCode: ExitCodeParseError,
 				Stderr:   fmt.Sprintf("Error parsing code blocks from %s: %s", filePath, err.Error()),
 			}
 		}
 
+		if err := prepareBlocks(blocks, filepath.Dir(filePath), opts); err != nil {
+			log.Error("Failed to prepare code blocks", "path", filePath, "error", err.Error())
+			return DocciResult{
+				Success:  false,
+				ExitCode: ExitCodeParseError,
+				Stderr:   fmt.Sprintf("Error parsing code blocks from %s: %s", filePath, err.Error()),
+			}
+		}
+
+		if file.frontMatter.Title != "" {
+			titles[filePath] = file.frontMatter.Title
+		}
+
 		// Reindex blocks to ensure global uniqueness
 		for i := range blocks {
 			blocks[i].Index = globalIndex
+			blockFiles[globalIndex] = filePath
 			globalIndex++
 		}
 
 		allBlocks = append(allBlocks, blocks...)
+		allSkipped = append(allSkipped, skipped...)
 		log.Debug("Found code blocks in file", "count", len(blocks), "path", filePath)
 	}
 
 	log.Debug("Total merged blocks", "count", len(allBlocks))
 
+	// Print a banner for each titled file in run order
+	if !opts.DebugMode {
+		for _, filePath := range orderedPaths {
+			if title, ok := titles[filePath]; ok {
+				printTitleBanner(stdoutWriter(opts), title)
+			}
+		}
+	}
+
+	result := executeBlocks(allBlocks, opts, "merged code blocks")
+	result.Titles = titles
+	result.BlockCount = len(allBlocks)
+	result.Skipped = allSkipped
+	result.BlockFiles = blockFiles
+	if result.Success && !opts.DebugMode {
+		fileList := strings.Join(orderedPaths, ", ")
+		log.Info("Successfully executed merged files", "files", fileList)
+	}
+	return result
+}
+
+// skipSummary describes how many blocks ran and why the others were skipped, e.g.
+// "Ran 5 of 12 blocks, skipped 7 (docci-os: 4, docci-ignore: 3)". It is empty when nothing was skipped.
+func skipSummary(result DocciResult) string {
+	if len(result.Skipped) == 0 {
+		return ""
+	}
+
+	counts := make(map[string]int)
+	var tags []string
+	for _, block := range result.Skipped {
+		tag, _, _ := strings.Cut(block.SkipReason, "=")
+		if counts[tag] == 0 {
+			tags = append(tags, tag)
+		}
+		counts[tag]++
+	}
+	// Most common reason first, ties in the order they were found
+	sort.SliceStable(tags, func(i, j int) bool {
+		return counts[tags[i]] > counts[tags[j]]
+	})
+
+	reasons := make([]string, len(tags))
+	for i, tag := range tags {
+		reasons[i] = fmt.Sprintf("%s: %d", tag, counts[tag])
+	}
+	total := result.BlockCount + len(result.Skipped)
+	return fmt.Sprintf("Ran %d of %d blocks, skipped %d (%s)", result.BlockCount, total, len(result.Skipped), strings.Join(reasons, ", "))
+}
+
+// stdoutWriter returns where a run writes its output, opts.Stdout or os.Stdout when it is nil
+func stdoutWriter(opts types.DocciOpts) io.Writer {
+	if opts.Stdout != nil {
+		return opts.Stdout
+	}
+	return os.Stdout
+}
+
+// stderrWriter returns where a run writes its errors, opts.Stderr or os.Stderr when it is nil
+func stderrWriter(opts types.DocciOpts) io.Writer {
+	if opts.Stderr != nil {
+		return opts.Stderr
+	}
+	return os.Stderr
+}
+
+// printTitleBanner writes a file's front-matter title as a banner at the start of a run
+func printTitleBanner(w io.Writer, title string) {
+	border := strings.Repeat("=", len([]rune(title))+8)
+	fmt.Fprintf(w, "%s\n=== %s ===\n%s\n", border, title, border)
+}
+
+// printNumberedScript writes the generated script with line numbers, so bash errors like
+// "line 42: foo: command not found" can be matched to the script docci ran
+func printNumberedScript(w io.Writer, script string) {
+	lines := strings.Split(strings.TrimSuffix(script, "\n"), "\n")
+	width := len(strconv.Itoa(len(lines)))
+	fmt.Fprintln(w, "\n=== Generated script ===")
+	for i, line := range lines {
+		fmt.Fprintf(w, "%*d | %s\n", width, i+1, line)
+	}
+	fmt.Fprintln(w, "=== End of generated script ===")
+}
+
+// printVerboseValidations writes a pass/fail line for every block with an output expectation
+func printVerboseValidations(w io.Writer, blockOutputs map[int]string, validationMap map[int]string) {
+	indexes := make([]int, 0, len(validationMap))
+	for idx := range validationMap {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+
+	for _, idx := range indexes {
+		if strings.Contains(blockOutputs[idx], validationMap[idx]) {
+			fmt.Fprintf(w, "✓ Block %d output contains %q\n", idx, validationMap[idx])
+		} else {
+			fmt.Fprintf(w, "✗ Block %d output does not contain %q\n", idx, validationMap[idx])
+		}
+	}
+}
+
+// validateBlockOutputs checks each block's output against its expectations and adds the failures
+// the script reported itself (scriptErrors). A block's decodeErrors replace its other errors.
+func validateBlockOutputs(blocks []parser.CodeBlock, blockOutputs map[int]string, validationMap map[int]string, decodeErrors, scriptErrors []*executor.ValidationError, verbose bool) []*executor.ValidationError {
+	log := logger.GetLogger()
+	countMap := outputCountMap(blocks)
+	boundsMap := outputBoundsMap(blocks)
+	lineCounts := lineCountMap(blocks)
+	schemaMap := outputSchemaMap(blocks)
+	jsonEqualsMap := outputJSONEqualsMap(blocks)
+	if len(validationMap) == 0 && len(countMap) == 0 && len(boundsMap) == 0 && len(lineCounts) == 0 && len(schemaMap) == 0 && len(jsonEqualsMap) == 0 && len(decodeErrors) == 0 && len(scriptErrors) == 0 {
+		return nil
+	}
+
+	log.Debug("Validating output expectations", "count", len(validationMap)+len(countMap)+len(boundsMap)+len(lineCounts)+len(schemaMap)+len(jsonEqualsMap))
+	validationErrors := executor.ValidateOutputs(blockOutputs, validationMap, countMap, boundsMap)
+	validationErrors = append(validationErrors, executor.ValidateLineCounts(blockOutputs, lineCounts)...)
+	validationErrors = append(validationErrors, executor.ValidateJSONSchemas(blockOutputs, schemaMap)...)
+	validationErrors = append(validationErrors, executor.ValidateJSONEquals(blockOutputs, jsonEqualsMap)...)
+	validationErrors = append(validationErrors, scriptErrors...)
+	// output that did not decode is only reported once, not once per check on the encoded text
+	validationErrors = slices.DeleteFunc(validationErrors, func(verr *executor.ValidationError) bool {
+		return slices.ContainsFunc(decodeErrors, func(derr *executor.ValidationError) bool { return derr.BlockIndex == verr.BlockIndex })
+	})
+	validationErrors = append(decodeErrors, validationErrors...)
+	// Point each error back at its source block
+	for _, verr := range validationErrors {
+		verr.FullOutput = verbose
+		for _, block := range blocks {
+			if block.Index == verr.BlockIndex {
+				verr.File = block.FileName
+				verr.Line = block.LineNumber
+				break
+			}
+		}
+	}
+	if len(validationErrors) == 0 {
+		log.Debug("All validations passed")
+	}
+	return validationErrors
+}
+
+// fireHooks reports every block to h in order, with the validation errors of its output checks.
+// Blocks after the one that failed the script never ran, so they are not reported.
+func fireHooks(h hooks.Hooks, blocks []parser.CodeBlock, blockOutputs map[int]string, validationErrors []*executor.ValidationError, execErr error) {
+	for _, block := range blocks {
+		info := hooks.BlockInfo{
+			Index:      block.Index,
+			Language:   block.Language,
+			FileName:   block.FileName,
+			LineNumber: block.LineNumber,
+			Content:    block.Content,
+			Background: block.Background,
+		}
+
+		output, ok := blockOutputs[block.Index]
+		if !ok && !block.Background {
+			if execErr == nil {
+				continue
+			}
+			// The block without an end marker is the one that stopped the script
+			h.OnBlockStart(info)
+			h.OnBlockEnd(info, "", execErr)
+			return
+		}
+
+		h.OnBlockStart(info)
+		var failed []error
+		for _, verr := range validationErrors {
+			if verr.BlockIndex == block.Index {
+				h.OnValidationFailure(info, verr.Expected, output)
+				failed = append(failed, verr)
+			}
+		}
+		h.OnBlockEnd(info, output, errors.Join(failed...))
+	}
+}
+
+// outputSchemaMap maps block index to its docci-output-json-schema file
+func outputSchemaMap(blocks []parser.CodeBlock) map[int]string {
+	schemaMap := make(map[int]string)
+	for _, block := range blocks {
+		if block.JSONSchema != "" {
+			schemaMap[block.Index] = block.JSONSchema
+		}
+	}
+	return schemaMap
+}
+
+// outputJSONEqualsMap maps block index to its docci-assert-json-equals-file file
+func outputJSONEqualsMap(blocks []parser.CodeBlock) map[int]string {
+	jsonMap := make(map[int]string)
+	for _, block := range blocks {
+		if block.JSONEqualsFile != "" {
+			jsonMap[block.Index] = block.JSONEqualsFile
+		}
+	}
+	return jsonMap
+}
+
+// outputCountMap maps block index to its docci-output-contains-count expectation
+func outputCountMap(blocks []parser.CodeBlock) map[int]types.OutputCount {
+	countMap := make(map[int]types.OutputCount)
+	for _, block := range blocks {
+		if block.OutputCount != nil {
+			countMap[block.Index] = *block.OutputCount
+		}
+	}
+	return countMap
+}
+
+// outputBoundsMap maps block index to its docci-output-starts-with and docci-output-ends-with expectations
+func outputBoundsMap(blocks []parser.CodeBlock) map[int]types.OutputBounds {
+	boundsMap := make(map[int]types.OutputBounds)
+	for _, block := range blocks {
+		if block.OutputPrefix != "" || block.OutputSuffix != "" {
+			boundsMap[block.Index] = types.OutputBounds{Prefix: block.OutputPrefix, Suffix: block.OutputSuffix}
+		}
+	}
+	return boundsMap
+}
+
+// lineCountMap maps block index to its docci-assert-line-count expectation
+func lineCountMap(blocks []parser.CodeBlock) map[int]types.LineCount {
+	countMap := make(map[int]types.LineCount)
+	for _, block := range blocks {
+		if block.LineCount != nil {
+			countMap[block.Index] = *block.LineCount
+		}
+	}
+	return countMap
+}
+
+// stripBlockOutputsANSI removes ANSI escape sequences from the captured output of every block with
+// docci-strip-ansi, or of all blocks when all is set, so validation matches plain text
+func stripBlockOutputsANSI(blocks []parser.CodeBlock, blockOutputs map[int]string, all bool) {
+	for _, block := range blocks {
+		if output, ok := blockOutputs[block.Index]; ok && (all || block.StripANSI) {
+			blockOutputs[block.Index] = executor.StripANSI(output)
+		}
+	}
+}
+
+// fasterThanFailures reports each docci-assert-faster-than block that did not run faster than its
+// baseline. Comparisons where either block has no duration, because it was skipped or the run
+// stopped early, are left out.
+func fasterThanFailures(blocks []parser.CodeBlock, durations map[int]float64) []string {
+	var failures []string
+	for _, block := range blocks {
+		if block.FasterThan == "" {
+			continue
+		}
+		baseline, ok := parser.FasterThanBaseline(blocks, block)
+		if !ok {
+			continue
+		}
+		took, ok := durations[block.Index]
+		baselineTook, baselineOk := durations[baseline.Index]
+		if !ok || !baselineOk {
+			logger.GetLogger().Warn("Skipping docci-assert-faster-than, a block has no duration", "block", block.Index, "baseline", baseline.Name)
+			continue
+		}
+		if took >= baselineTook {
+			failures = append(failures, fmt.Sprintf("block %d (line %d) took %.3fs, expected it to be faster than block %d (%s) which took %.3fs",
+				block.Index, block.LineNumber, took, baseline.Index, baseline.Name, baselineTook))
+		}
+	}
+	return failures
+}
+
+// trimBlockOutputs keeps only the docci-trim-output lines of each block's captured output
+func trimBlockOutputs(blocks []parser.CodeBlock, blockOutputs map[int]string) {
+	for _, block := range blocks {
+		if output, ok := blockOutputs[block.Index]; ok && block.TrimOutputLines > 0 {
+			blockOutputs[block.Index] = executor.TrimLines(output, block.TrimOutputLines, block.TrimOutputFrom == "tail")
+		}
+	}
+}
+
+// decodeBlockOutputs decodes the captured output of every block with docci-decode-output. A block
+// whose output does not decode keeps it as is and is reported instead.
+func decodeBlockOutputs(blocks []parser.CodeBlock, blockOutputs map[int]string) []*executor.ValidationError {
+	var errors []*executor.ValidationError
+	for _, block := range blocks {
+		output, ok := blockOutputs[block.Index]
+		if !ok || block.DecodeOutput == "" {
+			continue
+		}
+		decoded, err := executor.DecodeOutput(output, block.DecodeOutput)
+		if err != nil {
+			errors = append(errors, &executor.ValidationError{BlockIndex: block.Index, Actual: output, DecodeErr: err.Error()})
+			continue
+		}
+		blockOutputs[block.Index] = decoded
+	}
+	return errors
+}
+
+// sortBlockOutputs sorts the lines of the captured output of every block with docci-output-sort
+func sortBlockOutputs(blocks []parser.CodeBlock, blockOutputs map[int]string) {
+	for _, block := range blocks {
+		if output, ok := blockOutputs[block.Index]; ok && block.OutputSort {
+			blockOutputs[block.Index] = executor.SortLines(output)
+		}
+	}
+}
+
+// prepareBlocks resolves the stdin files, fixtures and JSON schemas blocks read from next to their
+// markdown file and substitutes --base-url into them
+func prepareBlocks(blocks []parser.CodeBlock, markdownDir string, opts types.DocciOpts) error {
+	if err := parser.ResolveStdinFiles(blocks, markdownDir); err != nil {
+		return err
+	}
+	if err := parser.ResolveFixtures(blocks, markdownDir); err != nil {
+		return err
+	}
+	if err := parser.ResolveJSONSchemas(blocks, markdownDir); err != nil {
+		return err
+	}
+	if err := parser.ResolveJSONEqualsFiles(blocks, markdownDir); err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if block.JSONSchema != "" {
+			if _, err := executor.CompileJSONSchema(block.JSONSchema); err != nil {
+				return fmt.Errorf("block %d (line %d): %w", block.Index, block.LineNumber, err)
+			}
+		}
+		if block.JSONEqualsFile != "" {
+			if _, err := executor.LoadExpectedJSON(block.JSONEqualsFile); err != nil {
+				return fmt.Errorf("block %d (line %d): %w", block.Index, block.LineNumber, err)
+			}
+		}
+	}
+	return parser.ApplyBaseURL(blocks, opts.BaseURL)
+}
+
+// blockOutputEnv maps each docci-output-to-env variable to its block's trimmed output. Blocks that
+// never ran are left out.
+func blockOutputEnv(blocks []parser.CodeBlock, blockOutputs map[int]string) map[string]string {
+	var env map[string]string
+	for _, block := range blocks {
+		if block.OutputToEnv == "" {
+			continue
+		}
+		output, ok := blockOutputs[block.Index]
+		if !ok {
+			continue
+		}
+		if env == nil {
+			env = make(map[string]string)
+		}
+		env[block.OutputToEnv] = strings.TrimSpace(output)
+	}
+	return env
+}
+
+// reachedBlocks drops the blocks a stopped run never reached, along with their docci-output-contains
+// expectations. Background blocks have no output markers, so they are kept.
+func reachedBlocks(blocks []parser.CodeBlock, blockOutputs map[int]string, validationMap map[int]string) ([]parser.CodeBlock, map[int]string) {
+	var reached []parser.CodeBlock
+	reachedValidations := make(map[int]string)
+	for _, block := range blocks {
+		if _, ok := blockOutputs[block.Index]; !ok && !block.Background {
+			continue
+		}
+		reached = append(reached, block)
+		if expected, ok := validationMap[block.Index]; ok {
+			reachedValidations[block.Index] = expected
+		}
+	}
+	return reached, reachedValidations
+}
+
+// splitBlockOutput joins what each block wrote to stdout and to stderr, for showing a block's
+// output after the run
+func splitBlockOutput(resp executor.ExecResponse, names map[string]int) map[int]string {
+	output := executor.SplitBlockOutput(resp.Stdout, names)
+	for index, stderr := range executor.SplitBlockOutput(resp.Stderr, names) {
+		output[index] += stderr
+	}
+	return output
+}
+
+// failedBlock returns the first non-background block without an end marker,
+// which is the block that stopped the script when it exited early
+func failedBlock(blocks []parser.CodeBlock, blockOutputs map[int]string) (parser.CodeBlock, bool) {
+	for _, block := range blocks {
+		if block.Background {
+			continue
+		}
+		if _, ok := blockOutputs[block.Index]; !ok {
+			return block, true
+		}
+	}
+	return parser.CodeBlock{}, false
+}
+
+// executeBlocks builds the script for the given blocks, runs it and validates the outputs.
+// label describes the blocks in error messages (e.g. "code block" or "merged code blocks").
+func executeBlocks(blocks []parser.CodeBlock, opts types.DocciOpts, label string) DocciResult {
+	if (opts.PerBlock || opts.Step) && !opts.DebugMode {
+		return runEachBlock(blocks, opts, label)
+	}
+	return runBlocks(blocks, opts, label, "")
+}
+
+// runBlocks is executeBlocks for one script. With a blockState file the script restores the
+// variables and directory saved there first, and saves its own at the end, see runEachBlock.
+func runBlocks(blocks []parser.CodeBlock, opts types.DocciOpts, label string, blockState string) (result DocciResult) {
+	log := logger.GetLogger()
+
+	// Ask for confirmation of any docci-confirm blocks before anything runs
+	blocks, err := confirmBlocks(blocks, opts)
+	if err != nil {
+		log.Error("Confirmation failed", "error", err.Error())
+		return DocciResult{
+			Success:  false,
+			ExitCode: ExitCodeExecutionError,
+			Stderr:   fmt.Sprintf("Error confirming code blocks: %s", err.Error()),
+		}
+	}
+
 	// Build executable script with validation markers
-	log.Debug("Building executable script from merged blocks")
-	script, validationMap, assertFailureMap := parser.BuildExecutableScriptWithOptions(allBlocks, opts)
+	log.Debug("Building executable script")
+	build := parser.BuildExecutableScriptWithOptions
+	if opts.PowerShell {
+		build = parser.BuildPowerShellScript
+	}
+	script, validationMap, assertFailureMap := build(blocks, opts)
+	if blockState != "" {
+		script = wrapBlockScript(script, blockState)
+	}
+
+	if opts.PrintScriptOnFail {
+		defer func() {
+			if !result.Success {
+				printNumberedScript(stderrWriter(opts), script)
+			}
+		}()
+	}
 
 	// If in debug mode, print script and exit
 	if opts.DebugMode {
 		log.Info("Debug mode: printing script (not executing)")
-		fmt.Print(script)
+		fmt.Fprint(stdoutWriter(opts), script)
 		return DocciResult{
 			Success:  true,
 			ExitCode: 0,
@@ -249,72 +725,159 @@ func RunDocciFilesWithOptions(filePaths []string, opts types.DocciOpts) DocciRes
 	}
 
 	// Execute the script
-	log.Debug("Executing merged script")
-	resp, err := executor.Exec(script)
+	log.Debug("Executing script")
+	resp, err := executor.ExecWithOptions(script, opts)
 	if err != nil {
 		return DocciResult{
 			Success:  false,
-			ExitCode: 1,
+			ExitCode: ExitCodeExecutionError,
 			Stderr:   fmt.Sprintf("execute script: %v", err),
 		}
 	}
 
-	// Check assert-failure blocks
+	// Parse block outputs from the stdout
+	log.Debug("Parsing block outputs")
+	blockOutputs := executor.ParseBlockOutputs(resp.Stdout, parser.MarkerNames(blocks))
+	blockStdout := maps.Clone(blockOutputs)
+	blockStderr := executor.ParseBlockStderr(resp.Stderr, parser.MarkerNames(blocks))
+	stripBlockOutputsANSI(blocks, blockOutputs, opts.StripANSI)
+	decodeErrors := decodeBlockOutputs(blocks, blockOutputs)
+	trimBlockOutputs(blocks, blockOutputs)
+	sortBlockOutputs(blocks, blockOutputs)
+
+	// A docci-bail-unless guard ends the run on purpose, so the blocks it never reached are left
+	// out of the checks below instead of being reported as missing output
+	execErr := resp.Error
+	bailIndex, bailed := executor.ParseBail(resp.Stdout)
+	if bailed {
+		log.Info("Run stopped by docci-bail-unless", "block", bailIndex)
+		blocks, validationMap = reachedBlocks(blocks, blockOutputs, validationMap)
+		assertFailureMap = nil
+		execErr = nil
+	}
+
+	// docci-warn-only blocks and blocks others depend on did not stop the run when they failed, so
+	// their failures are only logged
+	warnings := executor.ParseWarnings(resp.Stdout)
+	for _, block := range blocks {
+		exitCode, ok := warnings[block.Index]
+		if !ok {
+			continue
+		}
+		if block.WarnOnly {
+			log.Warn("Block failed, continuing because of docci-warn-only", "block", block.Index, "line", block.LineNumber, "exit_code", exitCode)
+		} else {
+			log.Warn("Block failed, skipping the blocks that depend on it", "block", block.Index, "line", block.LineNumber, "name", block.Name, "exit_code", exitCode)
+		}
+	}
+
+	// Hand docci-output-to-env values to the cleanup commands and the block output to library
+	// callers, whichever way the run ends
+	outputEnv := blockOutputEnv(blocks, blockOutputs)
+	defer func() {
+		result.OutputEnv = outputEnv
+		result.BlockStdout = blockStdout
+		result.BlockStderr = blockStderr
+		result.BailedAt = bailIndex
+		result.Warnings = warnings
+		result.BlockOutput = splitBlockOutput(resp, parser.MarkerNames(blocks))
+	}()
+
+	// Collect artifacts whether or not the run succeeded
+	if opts.ArtifactDir != "" && opts.RemoteHost != "" {
+		log.Warn("Skipping artifact collection, files stay on the remote host", "host", opts.RemoteHost)
+	} else if opts.ArtifactDir != "" {
+		if err := collectArtifacts(blocks, opts.ArtifactDir, opts.WorkingDir); err != nil {
+			log.Warn("Failed to collect artifacts", "error", err.Error())
+		}
+	}
+
+	// Check the output expectations up front so the hooks see every failed check
+	scriptErrors := append(executor.ParseTranscriptMismatches(resp.Stdout), executor.ParseAssertionFailures(resp.Stdout)...)
+	validationErrors := validateBlockOutputs(blocks, blockOutputs, validationMap, decodeErrors, scriptErrors, opts.Verbose)
+
+	// Report each block to the hooks before deciding the overall result
+	if opts.Hooks != nil {
+		fireHooks(opts.Hooks, blocks, blockOutputs, validationErrors, execErr)
+	}
+
+	// docci-bail-code stops the run with its own exit code, which is passed on as is
+	if bailed && resp.Error != nil {
+		return DocciResult{
+			Success:  false,
+			ExitCode: int(resp.ExitCode),
+			Stdout:   resp.Stdout,
+			Stderr:   fmt.Sprintf("Run stopped before block %d by docci-bail-unless (exit code %d)", bailIndex, resp.ExitCode),
+		}
+	}
+
+	// Check assert-failure blocks. An unmet expectation is reported together with any output
+	// validation errors below, so one run shows every problem with the document.
+	var assertFailureMsg string
 	if len(assertFailureMap) > 0 {
 		log.Debug("Checking assert-failure expectations")
 		// If we have assert-failure blocks, we expect the script to fail
 		if resp.Error == nil {
 			log.Error("Expected script to fail due to assert-failure tag, but it succeeded")
-			return DocciResult{
-				Success:  false,
-				ExitCode: 1,
-				Stdout:   resp.Stdout,
-				Stderr:   "Error: Expected script to fail with non-zero exit code due to docci-assert-failure tag, but it succeeded",
-			}
+			assertFailureMsg = "Error: Expected script to fail with non-zero exit code due to docci-assert-failure tag, but it succeeded\n"
+		} else {
+			log.Info("✓ Code block failed as expected due to docci-assert-failure tag")
 		}
-		log.Info("✓ Code block failed as expected due to docci-assert-failure tag")
-		// Script failed as expected, continue processing
+		// Validate whatever output was captured either way
 	} else if resp.Error != nil {
 		// No assert-failure blocks, so error is unexpected
 		log.Error("Unexpected script execution failure", "error", resp.Error.Error())
+		execErr := &executor.ExecError{ExitCode: int(resp.ExitCode), Err: resp.Error}
+		stderr := fmt.Sprintf("Error executing %s: %s", label, resp.Error.Error())
+		if block, ok := failedBlock(blocks, blockOutputs); ok {
+			execErr.Block = block.Index
+			execErr.File = block.FileName
+			execErr.Line = block.LineNumber
+			execErr.Message = block.ExitMessage
+		}
+		// Tell the reader how to fix the failure, after the block's own error output
+		if execErr.Message != "" {
+			fmt.Fprintf(stderrWriter(opts), "\n❗ Block %d (line %d%s) failed: %s\n\n", execErr.Block, execErr.Line, formatFileName(execErr.File), execErr.Message)
+			stderr += "\n" + execErr.Message
+		}
 		return DocciResult{
-			Success:  false,
-			ExitCode: 1,
-			Stdout:   resp.Stdout,
-			Stderr:   fmt.Sprintf("Error executing merged code blocks: %s", resp.Error.Error()),
+			Success:   false,
+			ExitCode:  ExitCodeExecutionError,
+			Stdout:    resp.Stdout,
+			Stderr:    stderr,
+			ExecError: execErr,
 		}
 	}
 
-	// Parse block outputs from the stdout
-	log.Debug("Parsing block outputs")
-	blockOutputs := executor.ParseBlockOutputs(resp.Stdout)
+	if opts.Verbose {
+		printVerboseValidations(stdoutWriter(opts), blockOutputs, validationMap)
+	}
+
+	fasterThanMsg := ""
+	for _, failure := range fasterThanFailures(blocks, executor.ParseBlockDurations(resp.Stdout, parser.MarkerNames(blocks))) {
+		log.Error("docci-assert-faster-than failed", "error", failure)
+		fasterThanMsg += "Error: " + failure + "\n"
+	}
 
-	// Validate outputs if there are any validation requirements
-	var validationErrors []error
-	if len(validationMap) > 0 {
-		log.Debug("Validating output expectations", "count", len(validationMap))
-		validationErrors = executor.ValidateOutputs(blockOutputs, validationMap)
+	if assertFailureMsg != "" || fasterThanMsg != "" || len(validationErrors) > 0 {
+		errorMsg := assertFailureMsg + fasterThanMsg
 		if len(validationErrors) > 0 {
 			log.Error("Found validation errors", "count", len(validationErrors))
-			errorMsg := "\n=== Validation Errors ===\n"
+			errorMsg += "\n=== Validation Errors ===\n"
 			for _, err := range validationErrors {
 				errorMsg += fmt.Sprintf("❌ %s\n", err.Error())
 			}
-			return DocciResult{
-				Success:          false,
-				ExitCode:         1,
-				Stdout:           resp.Stdout,
-				Stderr:           errorMsg,
-				ValidationErrors: validationErrors,
-			}
 		}
-		log.Debug("All validations passed")
+		return DocciResult{
+			Success:          false,
+			ExitCode:         ExitCodeValidationError,
+			Stdout:           resp.Stdout,
+			Stderr:           errorMsg,
+			ValidationErrors: validationErrors,
+		}
 	}
 
-	log.Debug("Merged script execution completed successfully")
-	fileList := strings.Join(filePaths, ", ")
-	log.Info("Successfully executed merged files", "files", fileList)
-
+	log.Debug("Script execution completed successfully")
 	return DocciResult{
 		Success:          true,
 		ExitCode:         0,
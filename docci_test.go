@@ -1,11 +1,20 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+
+	"github.com/reecepbcups/docci/executor"
+	"github.com/reecepbcups/docci/hooks"
+	"github.com/reecepbcups/docci/logger"
+	"github.com/reecepbcups/docci/parser"
+	"github.com/reecepbcups/docci/types"
+	"github.com/stretchr/testify/require"
 )
 
 // TestMain runs before all tests and allows global setup/teardown
@@ -28,6 +37,7 @@ type TestExpectation struct {
 	ShouldPanic      bool   // true if we expect this test to panic/exit
 	ExpectedInStderr string // string that should be present in stderr (implies ShouldFail=true)
 	ExpectedInStdout string // string that should be present in stdout (optional)
+	ExpectedExitCode int    // exit code the run should report (optional)
 }
 
 // TestExpectations defines the expected behavior for test files that should fail
@@ -35,13 +45,85 @@ type TestExpectation struct {
 var TestExpectations = map[string]TestExpectation{
 	"background-error-test.md": {
 		ExpectedInStderr: "Cannot use both docci-output-contains and docci-background",
+		ExpectedExitCode: ExitCodeParseError,
 	},
 	"assert-failure-unexpected-success.md": {
 		ExpectedInStderr: "Expected script to fail with non-zero exit code due to docci-assert-failure tag, but it succeeded",
+		ExpectedExitCode: ExitCodeValidationError,
+	},
+	"required-missing.md": {
+		ExpectedInStderr: "block is docci-required but would be skipped by docci-if-installed=nonexistent-fake-command",
+		ExpectedExitCode: ExitCodeParseError,
 	},
 	"test-background-kill-invalid.md": {
 		ExpectedInStderr: "references a non-existent background process. Available background process indexes: [2]",
 	},
+	"after-all-on-failure.md": {
+		ExpectedInStderr: "Error executing code block",
+		ExpectedInStdout: "after-all teardown ran",
+		ExpectedExitCode: ExitCodeExecutionError,
+	},
+	"background-expect-log-timeout.md": {
+		ExpectedInStderr: "Error executing code block",
+		ExpectedInStdout: "Timeout waiting for background block 1 to log 'never printed' after 1 seconds",
+	},
+	"validation-mismatch.md": {
+		ExpectedInStderr: "output does not contain expected string 'Goodbye'",
+		ExpectedExitCode: ExitCodeValidationError,
+	},
+	"skip-on-failure-of.md": {
+		ExpectedInStdout: "block 'plugin' did not succeed",
+	},
+	"measure-memory.md": {
+		ExpectedInStdout: "Background block 1 peak memory:",
+	},
+	"assert-file-exists-missing.md": {
+		ExpectedInStderr: "block 1: assertion failed: expected file /tmp/docci_never_created_artifact to exist",
+		ExpectedExitCode: ExitCodeValidationError,
+	},
+	"assert-no-change-modified.md": {
+		ExpectedInStderr: "block 1: assertion failed: changed /tmp/docci_no_change_log.txt when run again",
+		ExpectedExitCode: ExitCodeValidationError,
+	},
+	"expect-duration-slow.md": {
+		ExpectedInStderr: "block 1: assertion failed: expected duration < 0.5s, took 1",
+		ExpectedExitCode: ExitCodeValidationError,
+	},
+	"transcript-mismatch.md": {
+		ExpectedInStderr: "block 1: output of transcript command 'echo \"version 2\"' does not match the transcript\nExpected:\nversion 1\nActual:\nversion 2",
+		ExpectedExitCode: ExitCodeValidationError,
+	},
+	"output-contains-count-mismatch.md": {
+		ExpectedInStderr: "expected 'PASS' 3 time(s) in output, found 2",
+		ExpectedExitCode: ExitCodeValidationError,
+	},
+	"matrix-mismatch.md": {
+		ExpectedInStderr: "Error executing code block",
+		ExpectedExitCode: ExitCodeExecutionError,
+	},
+	"poll-until-timeout.md": {
+		ExpectedInStderr: "Error executing code block",
+		ExpectedExitCode: ExitCodeExecutionError,
+	},
+	"background-startup-failure.md": {
+		ExpectedInStderr: "Error executing code block",
+		ExpectedExitCode: ExitCodeExecutionError,
+	},
+	"fixture-missing.md": {
+		ExpectedInStderr: "docci-fixture source",
+		ExpectedExitCode: ExitCodeParseError,
+	},
+	"stdin-file-missing.md": {
+		ExpectedInStderr: "docci-stdin-file",
+		ExpectedExitCode: ExitCodeParseError,
+	},
+	"block-working-dir-missing.md": {
+		ExpectedInStderr: "Error executing code block",
+		ExpectedExitCode: ExitCodeExecutionError,
+	},
+	"confirm-test.md": {
+		ExpectedInStderr: "requires confirmation (docci-confirm) but stdin is not interactive",
+	},
 }
 
 // ServerEndpointTestExpectations defines expectations for server_endpoint examples
@@ -109,6 +191,11 @@ func validateTestResult(t *testing.T, result TestResult, expectations map[string
 		}
 	}
 
+	// Check exit code expectations (only if we have an expectation)
+	if hasExpectation && expectation.ExpectedExitCode != 0 && result.Result.ExitCode != expectation.ExpectedExitCode {
+		failures = append(failures, fmt.Sprintf("%s: expected exit code %d but got %d", result.FileName, expectation.ExpectedExitCode, result.Result.ExitCode))
+	}
+
 	// Log success
 	if result.Result.Success {
 		t.Logf("✓ %s: succeeded as expected", result.FileName)
@@ -283,3 +370,784 @@ func TestMultiFileExample(t *testing.T) {
 		t.Errorf("multi-1: expected abc123 to appear in stdout for environment persistence test")
 	}
 }
+
+func TestConfirmBlocks(t *testing.T) {
+	origInteractive, origInput := isInteractive, confirmInput
+	defer func() { isInteractive, confirmInput = origInteractive, origInput }()
+
+	blocks := []parser.CodeBlock{
+		{Index: 1, Content: "echo keep\n"},
+		{Index: 2, Content: "rm -rf /tmp/a\n", Confirm: true},
+		{Index: 3, Content: "rm -rf /tmp/b\n", Confirm: true},
+	}
+
+	// --yes keeps every block without prompting
+	confirmed, err := confirmBlocks(blocks, types.DocciOpts{AssumeYes: true})
+	require.NoError(t, err)
+	require.Len(t, confirmed, 3)
+
+	// non-interactive without --yes is an error
+	isInteractive = func() bool { return false }
+	_, err = confirmBlocks(blocks, types.DocciOpts{})
+	require.ErrorContains(t, err, "use --yes to proceed")
+
+	// interactive answers decide which blocks remain
+	isInteractive = func() bool { return true }
+	confirmInput = strings.NewReader("y\nn\n")
+	confirmed, err = confirmBlocks(blocks, types.DocciOpts{})
+	require.NoError(t, err)
+	require.Len(t, confirmed, 2)
+	require.Equal(t, 1, confirmed[0].Index)
+	require.Equal(t, 2, confirmed[1].Index)
+}
+
+func TestFrontMatterTitle(t *testing.T) {
+	path := "examples/front-matter-title.md"
+	var stdout strings.Builder
+	result := RunDocciFileWithOptions(path, types.DocciOpts{Stdout: &stdout})
+	require.True(t, result.Success, result.Stderr)
+	require.Equal(t, "Front Matter Title Test", result.Titles[path])
+	require.Contains(t, stdout.String(), "=== Front Matter Title Test ===")
+
+	result = RunDocciFile("examples/base.md")
+	require.Empty(t, result.Titles)
+}
+
+func TestInitScaffold(t *testing.T) {
+	dir := t.TempDir()
+
+	written, err := writeInitFiles(dir, false, true)
+	require.NoError(t, err)
+	require.Len(t, written, 2)
+
+	// the sample lists every tag and runs successfully
+	sample, err := os.ReadFile(written[0])
+	require.NoError(t, err)
+	for _, tag := range parser.GetAllTagsInfo() {
+		require.Contains(t, string(sample), "`"+tag.Name+"`")
+	}
+	result := RunDocciFileWithOptions(written[0], types.DocciOpts{HideBackgroundLogs: true})
+	require.True(t, result.Success, result.Stderr)
+
+	// refuses to overwrite unless forced
+	_, err = writeInitFiles(dir, false, false)
+	require.ErrorContains(t, err, "already exists, use --force to overwrite")
+	_, err = writeInitFiles(dir, true, true)
+	require.NoError(t, err)
+}
+
+// recordingHooks records every hook event as a short string
+type recordingHooks struct {
+	events []string
+}
+
+func (r *recordingHooks) OnBlockStart(block hooks.BlockInfo) {
+	r.events = append(r.events, fmt.Sprintf("start %d", block.Index))
+}
+
+func (r *recordingHooks) OnBlockEnd(block hooks.BlockInfo, output string, err error) {
+	r.events = append(r.events, fmt.Sprintf("end %d %q %v", block.Index, output, err != nil))
+}
+
+func (r *recordingHooks) OnValidationFailure(block hooks.BlockInfo, expected string, actual string) {
+	r.events = append(r.events, fmt.Sprintf("validation %d %q %q", block.Index, expected, actual))
+}
+
+func TestHooks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hooks.md")
+	markdown := "```bash\necho first\n```\n\n" +
+		"```bash docci-output-contains=\"missing\"\necho second\n```\n\n" +
+		"```bash docci-assert-line-count=2 docci-output-ends-with=\"done\"\necho third\n```\n\n" +
+		"```bash\nexit 3\n```\n\n" +
+		"```bash\necho never\n```\n"
+	require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+
+	rec := &recordingHooks{}
+	result := RunDocciFileWithOptions(path, types.DocciOpts{Hooks: rec})
+	require.False(t, result.Success)
+	require.Equal(t, []string{
+		"start 1", `end 1 "first" false`,
+		"start 2", `validation 2 "missing" "second"`, `end 2 "second" true`,
+		"start 3", `validation 3 "done" "third"`, `validation 3 "" "third"`, `end 3 "third" true`,
+		"start 4", `end 4 "" true`,
+	}, rec.events)
+
+	// NoopHooks can be embedded to implement only some events
+	var _ hooks.Hooks = struct{ hooks.NoopHooks }{}
+}
+
+func TestStructuredErrors(t *testing.T) {
+	result := RunDocciFile("examples/validation-mismatch.md")
+	require.Equal(t, ExitCodeValidationError, result.ExitCode)
+	require.Nil(t, result.ExecError)
+	require.Len(t, result.ValidationErrors, 1)
+	verr := result.ValidationErrors[0]
+	require.Equal(t, 1, verr.BlockIndex)
+	require.Equal(t, 6, verr.Line)
+	require.Equal(t, "Goodbye", verr.Expected)
+	require.Equal(t, "Hello World", verr.Actual)
+	require.False(t, verr.Missing)
+
+	result = RunDocciFiles([]string{"examples/base.md", "examples/block-working-dir-missing.md"})
+	require.Equal(t, ExitCodeExecutionError, result.ExitCode)
+	require.Empty(t, result.ValidationErrors)
+	require.NotNil(t, result.ExecError)
+	require.NotZero(t, result.ExecError.ExitCode)
+	require.Equal(t, "block-working-dir-missing.md", result.ExecError.File)
+	require.Equal(t, 5, result.ExecError.Line)
+	require.Greater(t, result.ExecError.Block, 1)
+	require.ErrorContains(t, result.ExecError, "exit status")
+}
+
+func TestMergedFileOrder(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, frontMatter, echo string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(frontMatter+"```bash\necho "+echo+"\n```\n"), 0644))
+		return path
+	}
+	a := write("a.md", "", "from-a")
+	b := write("b.md", "---\ndocci-order: -1\n---\n", "from-b")
+	c := write("c.md", "", "from-c")
+	d := write("d.md", "---\ndocci-order: 5\n---\n", "from-d")
+
+	result := RunDocciFiles([]string{d, a, c, b})
+	require.True(t, result.Success, result.Stderr)
+	var order []int
+	for _, name := range []string{"from-b", "from-a", "from-c", "from-d"} {
+		order = append(order, strings.Index(result.Stdout, name+"\n"))
+	}
+	require.IsIncreasing(t, order)
+
+	bad := write("bad.md", "---\ndocci-order: soon\n---\n", "never")
+	result = RunDocciFiles([]string{a, bad})
+	require.Equal(t, ExitCodeParseError, result.ExitCode)
+	require.Contains(t, result.Stderr, "docci-order must be an integer")
+}
+
+func TestPrintNumberedScript(t *testing.T) {
+	var buf strings.Builder
+	lines := strings.Repeat("echo line\n", 11)
+	printNumberedScript(&buf, lines)
+	out := buf.String()
+	require.Contains(t, out, "=== Generated script ===")
+	require.Contains(t, out, "\n 1 | echo line\n")
+	require.Contains(t, out, "\n11 | echo line\n")
+	require.NotContains(t, out, "12 |")
+
+	// the script is only dumped for failed runs
+	result := RunDocciFileWithOptions("examples/validation-mismatch.md", types.DocciOpts{PrintScriptOnFail: true})
+	require.False(t, result.Success)
+}
+
+func TestOutputCountValidationError(t *testing.T) {
+	result := RunDocciFile("examples/output-contains-count-mismatch.md")
+	require.Len(t, result.ValidationErrors, 1)
+	verr := result.ValidationErrors[0]
+	require.True(t, verr.CountMismatch)
+	require.Equal(t, "PASS", verr.Expected)
+	require.Equal(t, 3, verr.ExpectedCount)
+	require.Equal(t, 2, verr.ActualCount)
+}
+
+func TestFailureEnv(t *testing.T) {
+	result := RunDocciFile("examples/validation-mismatch.md")
+	require.False(t, result.Success)
+	env := failureEnv(result)
+	require.Contains(t, env, fmt.Sprintf("DOCCI_EXIT_CODE=%d", result.ExitCode))
+	require.Contains(t, env, fmt.Sprintf("DOCCI_FAILED_BLOCK=%d", result.ValidationErrors[0].BlockIndex))
+
+	// failures outside a block leave the block variables empty
+	env = failureEnv(DocciResult{ExitCode: 3})
+	require.Equal(t, []string{"DOCCI_EXIT_CODE=3", "DOCCI_FAILED_BLOCK=", "DOCCI_FAILED_FILE=", "DOCCI_FAILED_LINE="}, env)
+}
+
+func TestRunContextEnv(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env.out")
+	env, err := runEnv([]string{"/docs/a.md", "/docs/b.md"}, "")
+	require.NoError(t, err)
+
+	runPreCommands([]string{`echo "pre $DOCCI_FILES $DOCCI_WORKING_DIR" >> ` + out}, env, "bash", "")
+	runCleanupCommands([]string{`echo "cleanup $DOCCI_SUCCESS $DOCCI_EXIT_CODE" >> ` + out},
+		append(env, resultEnv(DocciResult{Success: false, ExitCode: 2})...), "bash", "")
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "pre /docs/a.md,/docs/b.md "+wd+"\ncleanup false 2\n", string(data))
+}
+
+func TestCollectArtifacts(t *testing.T) {
+	work := t.TempDir()
+	artifacts := t.TempDir()
+	markdown := fmt.Sprintf("```bash docci-cwd=%q docci-artifact=\"dist/*.txt,report.json\"\n", work) +
+		"mkdir -p dist\necho a > dist/a.txt\necho b > dist/b.txt\n```\n" +
+		fmt.Sprintf("```bash docci-artifact=%q\necho crash > %s/crash.log\nexit 1\n```\n", work+"/*.log", work)
+	path := filepath.Join(t.TempDir(), "artifacts.md")
+	require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+
+	// artifacts are collected even though the second block fails, missing ones are skipped
+	result := RunDocciFileWithOptions(path, types.DocciOpts{ArtifactDir: artifacts})
+	require.False(t, result.Success)
+
+	for file, content := range map[string]string{"dist/a.txt": "a\n", "dist/b.txt": "b\n", "crash.log": "crash\n"} {
+		data, err := os.ReadFile(filepath.Join(artifacts, file))
+		require.NoError(t, err, file)
+		require.Equal(t, content, string(data))
+	}
+	_, err := os.Stat(filepath.Join(artifacts, "report.json"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestAssertFailureAggregatesValidations(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, markdown string) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+		return path
+	}
+
+	// an assert-failure block that succeeds is reported alongside other blocks' output mismatches
+	result := RunDocciFile(write("unexpected-success.md",
+		"```bash docci-output-contains=\"Goodbye\"\necho Hello\n```\n"+
+			"```bash docci-assert-failure\ntrue\n```\n"))
+	require.Equal(t, ExitCodeValidationError, result.ExitCode)
+	require.Contains(t, result.Stderr, "Expected script to fail with non-zero exit code")
+	require.Contains(t, result.Stderr, "=== Validation Errors ===")
+	require.Len(t, result.ValidationErrors, 1)
+	require.Equal(t, 1, result.ValidationErrors[0].BlockIndex)
+
+	// an expected failure still validates the output captured before it
+	result = RunDocciFile(write("expected-failure.md",
+		"```bash docci-output-contains=\"Goodbye\"\necho Hello\n```\n"+
+			"```bash docci-assert-failure\nexit 1\n```\n"))
+	require.Equal(t, ExitCodeValidationError, result.ExitCode)
+	require.NotContains(t, result.Stderr, "Expected script to fail")
+	require.Len(t, result.ValidationErrors, 1)
+	require.Equal(t, "Hello", result.ValidationErrors[0].Actual)
+}
+
+func TestSkipSummary(t *testing.T) {
+	require.Empty(t, skipSummary(DocciResult{BlockCount: 3}))
+
+	result := DocciResult{BlockCount: 5, Skipped: []parser.CodeBlock{
+		{SkipReason: "docci-ignore"},
+		{SkipReason: "docci-os=macos"},
+		{SkipReason: "docci-os=windows"},
+	}}
+	require.Equal(t, "Ran 5 of 8 blocks, skipped 3 (docci-os: 2, docci-ignore: 1)", skipSummary(result))
+
+	result = RunDocciFile("examples/if-installed-test.md")
+	require.True(t, result.Success, result.Stderr)
+	require.Equal(t, 1, result.BlockCount)
+	require.Len(t, result.Skipped, 1)
+	require.Equal(t, "docci-if-installed=nonexistent-fake-command", result.Skipped[0].SkipReason)
+}
+
+func TestBaseURL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "base-url.md")
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-output-contains=\"https://staging.example.com/health\"\necho \"${BASE_URL}/health\"\n```\n"), 0644))
+
+	result := RunDocciFileWithOptions(path, types.DocciOpts{})
+	require.Equal(t, ExitCodeParseError, result.ExitCode)
+	require.Contains(t, result.Stderr, "no --base-url was provided")
+
+	result = RunDocciFileWithOptions(path, types.DocciOpts{BaseURL: "https://staging.example.com"})
+	require.True(t, result.Success, result.Stderr)
+}
+
+func TestOutputToEnv(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "output-to-env.md")
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-output-to-env=CONTAINER_ID\necho '  abc123  '\n```\n"+
+		"```bash\nexit 1\n```\n"+
+		"```bash docci-output-to-env=NEVER_SET\necho unreachable\n```\n"), 0644))
+
+	// the output is available even though a later block failed
+	result := RunDocciFile(path)
+	require.False(t, result.Success)
+	require.Equal(t, map[string]string{"CONTAINER_ID": "abc123"}, result.OutputEnv)
+	require.Contains(t, failureEnv(result), "CONTAINER_ID=abc123")
+
+	out := filepath.Join(dir, "cleanup.out")
+	runCleanupCommands([]string{`echo "rm $CONTAINER_ID" > ` + out}, resultEnv(result), "bash", "")
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "rm abc123\n", string(data))
+}
+
+func TestOutputSort(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "output-sort.md")
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-output-sort docci-output-contains=\"apple\\nbanana\\ncherry\"\nprintf 'cherry\\napple\\nbanana\\n'\n```\n"), 0644))
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+
+	// the expected lines have to be written in sorted order
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-output-sort docci-output-contains=\"cherry\\napple\"\nprintf 'cherry\\napple\\n'\n```\n"), 0644))
+	result = RunDocciFile(path)
+	require.False(t, result.Success)
+	require.Equal(t, ExitCodeValidationError, result.ExitCode)
+}
+
+func TestTrimOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trim-output.md")
+	block := "echo 'retrying after error'\necho 'done'\n```\n"
+
+	// the progress line is not part of the validated output
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-trim-output=tail:1 docci-output-contains=\"done\" docci-output-contains-count=\"retrying:0\"\n"+block), 0644))
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-trim-output=head:1 docci-output-contains=\"done\"\n"+block), 0644))
+	result = RunDocciFile(path)
+	require.False(t, result.Success)
+	require.Equal(t, ExitCodeValidationError, result.ExitCode)
+}
+
+func TestAssertFasterThan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "faster-than.md")
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-name=baseline\nsleep 0.3\n```\n```bash docci-assert-faster-than=baseline\ntrue\n```\n"), 0644))
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-name=baseline\ntrue\n```\n```bash docci-assert-faster-than=baseline\nsleep 0.3\n```\n"), 0644))
+	result = RunDocciFile(path)
+	require.False(t, result.Success)
+	require.Equal(t, ExitCodeValidationError, result.ExitCode)
+	require.Contains(t, result.Stderr, "block 2 (line 4) took")
+	require.Contains(t, result.Stderr, "expected it to be faster than block 1 (baseline) which took")
+}
+
+func TestBlockStdoutStderr(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "streams.md")
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-output-contains=\"out 1\"\necho 'out 1'\necho 'err 1' >&2\n```\n"+
+		"```bash\necho 'out 2'\n```\n"), 0644))
+
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+	require.Equal(t, map[int]string{1: "out 1", 2: "out 2"}, result.BlockStdout)
+	require.Equal(t, map[int]string{1: "err 1", 2: ""}, result.BlockStderr)
+
+	// merged output still tells the two streams apart
+	result = RunDocciFileWithOptions(path, types.DocciOpts{MergeOutput: true})
+	require.True(t, result.Success, result.Stderr)
+	require.Equal(t, map[int]string{1: "out 1", 2: "out 2"}, result.BlockStdout)
+	require.Equal(t, map[int]string{1: "err 1", 2: ""}, result.BlockStderr)
+}
+
+func TestBailUnless(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bail.md")
+	markdown := "```bash docci-output-contains=\"first\"\necho first\n```\n" +
+		"```bash docci-bail-unless=\"test 1 = ${DOCCI_BAIL_TEST:-0}\" docci-bail-message=\"needs DOCCI_BAIL_TEST\" docci-output-contains=\"second\"\necho second\n```\n" +
+		"```bash docci-output-contains=\"third\"\necho third\n```\n"
+	require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+
+	// the guard fails, so the run stops cleanly and the unreached checks are skipped
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+	require.Equal(t, 2, result.BailedAt)
+	require.Contains(t, result.Stdout, "Stopping before block 2: needs DOCCI_BAIL_TEST")
+	require.NotContains(t, result.Stdout, "third")
+
+	t.Setenv("DOCCI_BAIL_TEST", "1")
+	result = RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+	require.Zero(t, result.BailedAt)
+	require.Contains(t, result.Stdout, "third")
+
+	// a bail code is passed on as the run's exit code
+	require.NoError(t, os.WriteFile(path, []byte("```bash\necho first\n```\n```bash docci-bail-unless=false docci-bail-code=78\necho second\n```\n"), 0644))
+	result = RunDocciFile(path)
+	require.False(t, result.Success)
+	require.Equal(t, 78, result.ExitCode)
+	require.Equal(t, 2, result.BailedAt)
+}
+
+func TestGitHubAnnotations(t *testing.T) {
+	t.Setenv("GITHUB_WORKSPACE", "/repo")
+	path := "/repo/docs/guide.md"
+
+	result := DocciResult{ValidationErrors: []*executor.ValidationError{{BlockIndex: 2, Line: 42, Expected: "ok", Actual: "50% done\nfailed"}}}
+	require.Equal(t, []string{
+		"::error file=docs/guide.md,line=42,title=docci::block 2: output does not contain expected string 'ok'%0AActual output:%0A50%25 done%0Afailed",
+	}, githubAnnotations(result, []string{path}))
+
+	// merged runs only keep the base name, which is matched back to its path
+	result = DocciResult{ExitCode: 1, ExecError: &executor.ExecError{Block: 3, File: "guide.md", Line: 7, Err: errors.New("exit status 1")}}
+	require.Equal(t, []string{"::error file=docs/guide.md,line=7,title=docci::block 3: exit status 1"}, githubAnnotations(result, []string{"/repo/a.md", path}))
+
+	result = DocciResult{ExitCode: 3, Stderr: "Error parsing code blocks: line 3: unknown tag"}
+	require.Equal(t, []string{"::error file=docs/guide.md,title=docci::Error parsing code blocks: line 3: unknown tag"}, githubAnnotations(result, []string{path}))
+
+	require.Empty(t, githubAnnotations(DocciResult{Success: true}, []string{path}))
+
+	t.Setenv("GITHUB_ACTIONS", "true")
+	format, err := resolveOutputFormat("")
+	require.NoError(t, err)
+	require.Equal(t, outputGitHub, format)
+	format, err = resolveOutputFormat("text")
+	require.NoError(t, err)
+	require.Equal(t, outputText, format)
+	_, err = resolveOutputFormat("json")
+	require.Error(t, err)
+}
+
+func TestStepBlocks(t *testing.T) {
+	origInteractive, origInput := isInteractive, confirmInput
+	defer func() { isInteractive, confirmInput = origInteractive, origInput }()
+
+	dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "step.md")
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-name=setup\nexport STEP_VAR=kept\nLOCAL_VAR=lost\ncd "+dir+"\n```\n"+
+		"```bash\necho skipped\n```\n"+
+		"```bash docci-skip-on-failure-of=setup docci-output-contains=\"kept  "+dir+"\"\necho \"$STEP_VAR $LOCAL_VAR $PWD\"\n```\n"+
+		"```bash\necho never\n```\n"), 0644))
+
+	isInteractive = func() bool { return false }
+	result := RunDocciFileWithOptions(path, types.DocciOpts{Step: true})
+	require.False(t, result.Success)
+	require.Contains(t, result.Stderr, "interactive terminal")
+
+	// run, skip, an unknown answer that is asked again, run, quit
+	isInteractive = func() bool { return true }
+	confirmInput = strings.NewReader("\ns\nx\n\nq\n")
+	result = RunDocciFileWithOptions(path, types.DocciOpts{Step: true})
+	require.True(t, result.Success, result.Stderr)
+	require.Equal(t, "kept  "+dir, result.BlockStdout[3])
+	require.NotContains(t, result.BlockStdout, 2)
+	require.NotContains(t, result.BlockStdout, 4)
+}
+
+func TestPerBlock(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(t.TempDir(), "per-block.md")
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-after-all\necho teardown\n```\n"+
+		"```bash\nexport KEPT=yes\nNOT_KEPT=no\ncd "+dir+"\n```\n"+
+		"```bash docci-output-contains=\"yes  "+dir+"\"\necho \"$KEPT ${NOT_KEPT:-} $PWD\"\n```\n"), 0644))
+
+	result := RunDocciFileWithOptions(path, types.DocciOpts{PerBlock: true})
+	require.True(t, result.Success, result.Stderr)
+	require.Equal(t, "yes  "+dir, result.BlockStdout[3])
+	// the after-all block runs last
+	require.Greater(t, strings.Index(result.Stdout, "teardown"), strings.Index(result.Stdout, "yes  "+dir))
+
+	// a failing block stops the run and is reported like in the merged script
+	require.NoError(t, os.WriteFile(path, []byte("```bash\nfalse\n```\n```bash\necho never\n```\n"), 0644))
+	result = RunDocciFileWithOptions(path, types.DocciOpts{PerBlock: true})
+	require.False(t, result.Success)
+	require.Equal(t, ExitCodeExecutionError, result.ExitCode)
+	require.Equal(t, 1, result.ExecError.Block)
+	require.NotContains(t, result.Stdout, "never")
+
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-background\nsleep 1\n```\n"), 0644))
+	result = RunDocciFileWithOptions(path, types.DocciOpts{PerBlock: true})
+	require.False(t, result.Success)
+	require.Contains(t, result.Stderr, "docci-background blocks cannot run one block at a time")
+}
+
+func TestOutputJSONSchema(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "schemas"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "schemas", "user.json"), []byte(`{"type": "object", "required": ["name"], "properties": {"name": {"type": "string"}}}`), 0644))
+	path := filepath.Join(dir, "api.md")
+
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-output-json-schema=\"schemas/user.json\"\necho '{\"name\": \"docci\"}'\n```\n"), 0644))
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-output-json-schema=\"schemas/user.json\"\necho '{\"name\": 1}'\n```\n"), 0644))
+	result = RunDocciFile(path)
+	require.False(t, result.Success)
+	require.Equal(t, ExitCodeValidationError, result.ExitCode)
+	require.Contains(t, result.Stderr, "/name: expected string, but got number")
+	require.Equal(t, 1, result.ValidationErrors[0].Line)
+
+	// a missing schema is caught before anything runs
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-output-json-schema=\"schemas/missing.json\"\necho '{}'\n```\n"), 0644))
+	result = RunDocciFile(path)
+	require.Equal(t, ExitCodeParseError, result.ExitCode)
+	require.Contains(t, result.Stderr, "docci-output-json-schema")
+}
+
+func TestDocciInclude(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "shared"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "shared", "setup.md"), []byte("```bash docci-output-contains=\"from setup\"\nexport GREETING=hi\necho from setup\n```\n"), 0644))
+	path := filepath.Join(dir, "guide.md")
+	require.NoError(t, os.WriteFile(path, []byte("<!-- docci-include: shared/setup.md -->\n```bash docci-output-contains=\"hi there\"\necho \"$GREETING there\"\n```\n"), 0644))
+
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+	require.Equal(t, 2, result.BlockCount)
+	require.Contains(t, result.BlockStdout[1], "from setup")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "shared", "setup.md"), []byte("<!-- docci-include: ../guide.md -->\n"), 0644))
+	result = RunDocciFile(path)
+	require.Equal(t, ExitCodeParseError, result.ExitCode)
+	require.Contains(t, result.Stderr, "docci-include cycle: guide.md -> setup.md -> guide.md")
+}
+
+func TestVarsFromOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.md")
+	markdown := "```bash docci-vars-from-output=\"TOKEN=token: ([a-z0-9]+)\" docci-vars-from-output=\"USER_ID=id-[0-9]+\" docci-cwd=/\n" +
+		"echo 'token: abc123'\necho 'created id-42'\n```\n" +
+		"```bash docci-output-contains=\"abc123 id-42\"\necho \"$TOKEN $USER_ID\"\n```\n"
+	require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+	// the block's own output is still shown and validated
+	require.Contains(t, result.BlockStdout[1], "token: abc123")
+
+	// a variable without a matching line fails the block instead of exporting an empty value
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-vars-from-output=\"TOKEN=token: (.+)\"\necho nothing\n```\n```bash\necho never\n```\n"), 0644))
+	result = RunDocciFile(path)
+	require.False(t, result.Success)
+	require.Equal(t, 1, result.ExecError.Block)
+	require.NotContains(t, result.Stdout, "never")
+}
+
+func TestRetryWhileOutput(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "status.md")
+	counter := filepath.Join(dir, "attempts")
+	// the status is pending for the first two attempts
+	markdown := "```bash docci-retry-while-output=\"status: (pending|creating)\" docci-retry=5 docci-retry-delay=0\n" +
+		"n=$(cat " + counter + " 2>/dev/null || echo 0); echo $((n+1)) > " + counter + "\n" +
+		"if [ $n -lt 2 ]; then echo 'status: pending'; else echo 'status: ready'; fi\n```\n"
+	require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+	attempts, err := os.ReadFile(counter)
+	require.NoError(t, err)
+	require.Equal(t, "3\n", string(attempts))
+
+	// a status that never changes fails once the retries are used up
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-retry-while-output=pending docci-retry=1 docci-retry-delay=0\necho pending\n```\n"), 0644))
+	result = RunDocciFile(path)
+	require.False(t, result.Success)
+	require.Contains(t, result.Stdout, "Block 1 output still matches pending")
+}
+
+func TestClearScreen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "demo.md")
+	require.NoError(t, os.WriteFile(path, []byte("```bash\necho one\n```\n```bash docci-clear-screen docci-output-contains=\"two\"\necho two\n```\n"), 0644))
+
+	// CI logs are left alone without --allow-clear
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+	require.NotContains(t, result.Stdout, "\033[2J")
+
+	result = RunDocciFileWithOptions(path, types.DocciOpts{AllowClear: true})
+	require.True(t, result.Success, result.Stderr)
+	require.Contains(t, result.Stdout, "### DOCCI_BLOCK_END_1 ###\n\033[H\033[2J\n### DOCCI_BLOCK_START_2 ###")
+	// the escape sequence is not part of the block's output
+	require.Equal(t, "two", result.BlockStdout[2])
+}
+
+func TestRunOptionsLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "doc.md")
+	out := filepath.Join(dir, "hooks.out")
+	require.NoError(t, os.WriteFile(path, []byte("```bash\necho ran > ran.txt\n```\n"), 0644))
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	// a relative file path stays relative to the process's directory, while the script and the
+	// commands run in the working directory
+	rel, err := filepath.Rel(wd, path)
+	require.NoError(t, err)
+	opts := types.DocciOpts{
+		WorkingDir:        dir,
+		PreCommands:       []string{`echo pre >> hooks.out`},
+		CleanupCommands:   []string{`echo "cleanup $DOCCI_SUCCESS" >> hooks.out`},
+		OnFailureCommands: []string{`echo "failure $DOCCI_FAILED_BLOCK" >> hooks.out`},
+	}
+	result := RunDocciFileWithOptions(rel, opts)
+	require.True(t, result.Success, result.Stderr)
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "pre\ncleanup true\n", string(data))
+	require.FileExists(t, filepath.Join(dir, "ran.txt"))
+
+	// the process's own directory is left alone
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	require.Equal(t, wd, cwd)
+
+	// the log level only applies to the run
+	previous := logger.GetLogger()
+	result = RunDocciFileWithOptions(path, types.DocciOpts{LogLevel: "error"})
+	require.True(t, result.Success, result.Stderr)
+	require.Same(t, previous, logger.GetLogger())
+
+	// failures run the on-failure commands before cleanup
+	require.NoError(t, os.Remove(out))
+	require.NoError(t, os.WriteFile(path, []byte("```bash\nfalse\n```\n"), 0644))
+	result = RunDocciFileWithOptions(path, opts)
+	require.False(t, result.Success)
+	data, err = os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "pre\nfailure 1\ncleanup false\n", string(data))
+
+	// cleanup is left out after a successful run when asked to
+	require.NoError(t, os.Remove(out))
+	require.NoError(t, os.WriteFile(path, []byte("```bash\necho ran\n```\n"), 0644))
+	opts.SkipCleanupOnSuccess = true
+	result = RunDocciFileWithOptions(path, opts)
+	require.True(t, result.Success, result.Stderr)
+	data, err = os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "pre\n", string(data))
+
+	result = RunDocciFileWithOptions(path, types.DocciOpts{WorkingDir: filepath.Join(dir, "missing")})
+	require.False(t, result.Success)
+	require.Equal(t, ExitCodeParseError, result.ExitCode)
+	require.Contains(t, result.Stderr, "run directory not found")
+}
+
+func TestAssertJSONEquals(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "user.json"), []byte("{\"name\": \"docci\", \"roles\": [\"admin\", \"dev\"], \"id\": 1}\n"), 0644))
+	path := filepath.Join(dir, "api.md")
+
+	// key order, whitespace and number formatting do not matter
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-assert-json-equals-file=user.json\necho '{\"id\": 1.0, \"roles\": [\"admin\",\"dev\"], \"name\": \"docci\"}'\n```\n"), 0644))
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-assert-json-equals-file=user.json\necho '{\"id\": 1, \"roles\": [\"admin\", \"viewer\"], \"name\": \"docci\"}'\n```\n"), 0644))
+	result = RunDocciFile(path)
+	require.Equal(t, ExitCodeValidationError, result.ExitCode)
+	require.Contains(t, result.Stderr, `/roles/1: expected "dev", got "viewer"`)
+
+	// an expected file that is not JSON is caught before anything runs
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "user.json"), []byte("{"), 0644))
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-assert-json-equals-file=user.json\necho never\n```\n"), 0644))
+	result = RunDocciFile(path)
+	require.Equal(t, ExitCodeParseError, result.ExitCode)
+	require.Contains(t, result.Stderr, "is not valid JSON")
+}
+
+func TestDecodeOutput(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token.md")
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-decode-output=base64 docci-output-contains=\"user=docci\"\nprintf 'user=docci' | base64\n```\n"), 0644))
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+	// the block's own output is left encoded
+	require.Contains(t, result.BlockStdout[1], "dXNlcj1kb2NjaQ==")
+
+	// output that does not decode is reported once, instead of as a failed contains check
+	require.NoError(t, os.WriteFile(path, []byte("```bash docci-decode-output=base64 docci-output-contains=\"user=docci\"\necho 'not base64!'\n```\n"), 0644))
+	result = RunDocciFile(path)
+	require.Equal(t, ExitCodeValidationError, result.ExitCode)
+	require.Len(t, result.ValidationErrors, 1)
+	require.Contains(t, result.Stderr, "block 1: output is not valid base64: illegal base64 data")
+}
+
+func TestStdinFromPrevious(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pipeline.md")
+	markdown := "```bash docci-output-contains=\"3 lines\"\nprintf 'x\\ny\\nz\\n'\necho '3 lines'\n```\n" +
+		"```bash docci-stdin-from-previous docci-output-contains=\"4\"\nwc -l | tr -d ' '\n```\n" +
+		"```bash docci-output-contains=\"still here\"\necho still here\n```\n"
+	require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+	require.Equal(t, "4", strings.TrimSpace(result.BlockStdout[2]))
+}
+
+func TestExitMessage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "docker.md")
+	markdown := "```bash docci-exit-message=\"Make sure Docker is running.\"\necho checking\n```\n" +
+		"```bash docci-exit-message=\"Start the daemon with: dockerd &\"\nfalse\n```\n"
+	require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+	var stdout, stderr strings.Builder
+	result := RunDocciFileWithOptions(path, types.DocciOpts{Stdout: &stdout, Stderr: &stderr})
+	require.Equal(t, ExitCodeExecutionError, result.ExitCode)
+	require.Contains(t, stderr.String(), "❗ Block 2 (line 4) failed: Start the daemon with: dockerd &")
+	// only the block that failed has its message shown
+	require.Equal(t, 2, result.ExecError.Block)
+	require.Equal(t, "Start the daemon with: dockerd &", result.ExecError.Message)
+	require.Contains(t, result.Stderr, "Start the daemon with: dockerd &")
+	require.NotContains(t, result.Stderr, "Make sure Docker is running.")
+}
+
+func TestSummaryOnly(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.md")
+	b := filepath.Join(dir, "b.md")
+	c := filepath.Join(dir, "c.md")
+	require.NoError(t, os.WriteFile(a, []byte("```bash\necho from a\n```\n"), 0644))
+	require.NoError(t, os.WriteFile(b, []byte("```bash\necho setup b\n```\n```bash\necho broken b >&2\nfalse\n```\n"), 0644))
+	require.NoError(t, os.WriteFile(c, []byte("```bash\necho from c\n```\n"), 0644))
+
+	// block output goes to the writers instead of the terminal
+	var stdout, stderr strings.Builder
+	result := RunDocciFilesWithOptions([]string{a, b, c}, types.DocciOpts{Stdout: &stdout, Stderr: &stderr})
+	require.False(t, result.Success)
+	require.Contains(t, stdout.String(), "from a")
+	require.Contains(t, stderr.String(), "broken b")
+
+	summaries := fileSummaries(result)
+	require.Equal(t, []fileSummary{
+		{path: a, status: "passed", blocks: []int{1}},
+		{path: b, status: "failed", blocks: []int{2, 3}},
+		{path: c, status: "not run", blocks: []int{4}},
+	}, summaries)
+
+	var out strings.Builder
+	printRunSummary(&out, result)
+	require.Contains(t, out.String(), "=== Summary: 1 passed, 1 failed, 1 not run ===")
+	require.Contains(t, out.String(), "=== Output of "+b+" ===\n--- block 2 ---\nsetup b\n--- block 3 ---\nbroken b\n")
+	require.NotContains(t, out.String(), "from a")
+	require.Contains(t, out.String(), "=== Errors ===")
+}
+
+func TestOutputStartsEndsWith(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bounds.md")
+	markdown := "```bash docci-output-starts-with=\"Building\" docci-output-ends-with=\"ok\"\necho Building app\necho build ok\n```\n" +
+		"```bash docci-output-starts-with=\"Tests\"\necho Running tests\necho 3 passed\n```\n"
+	require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+	result := RunDocciFile(path)
+	require.Equal(t, ExitCodeValidationError, result.ExitCode)
+	require.Len(t, result.ValidationErrors, 1)
+	require.Equal(t, 2, result.ValidationErrors[0].BlockIndex)
+	require.Contains(t, result.Stderr, "output does not start with 'Tests'\nActual first line(s) of output:\nRunning tests")
+}
+
+func TestAssertLineCount(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+	path := filepath.Join(dir, "files.md")
+	markdown := "```bash docci-assert-line-count=3\nls " + dir + "/*.txt\n```\n" +
+		"```bash docci-assert-line-count=\">=2\"\necho one\necho\necho two\n```\n"
+	require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+	result := RunDocciFile(path)
+	require.True(t, result.Success, result.Stderr)
+
+	markdown = "```bash docci-assert-line-count=\"<2\"\necho one\necho two\n```\n"
+	require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+	result = RunDocciFile(path)
+	require.Equal(t, ExitCodeValidationError, result.ExitCode)
+	require.Contains(t, result.Stderr, "block 1: expected fewer than 2 non-empty line(s) in output, found 2")
+}
+
+func TestWarnOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "optional.md")
+	markdown := "```bash docci-warn-only docci-output-contains=\"trying\"\necho trying the beta API\nexit 3\necho not reached\n```\n" +
+		"```bash docci-output-contains=\"still running\"\necho still running\n```\n" +
+		"```bash docci-warn-only\necho optional step passed\n```\n"
+	require.NoError(t, os.WriteFile(path, []byte(markdown), 0644))
+	result := RunDocciFile(path)
+	// the failure is only a warning, so the run goes on and still succeeds
+	require.True(t, result.Success, result.Stderr)
+	require.Equal(t, 0, result.ExitCode)
+	require.Equal(t, map[int]int{1: 3}, result.Warnings)
+	require.Equal(t, "trying the beta API", strings.TrimSpace(result.BlockStdout[1]))
+	require.Contains(t, result.BlockStdout[2], "still running")
+}
@@ -0,0 +1,12 @@
+package executor
+
+import "regexp"
+
+// ansiRe matches ANSI escape sequences: CSI sequences like colors and cursor movement ("\x1b[1;32m"),
+// OSC sequences like terminal titles and hyperlinks, and short escapes like charset switches ("\x1b(B")
+var ansiRe = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\x07\x1b]*(?:\x07|\x1b\\)|\x1b[ -/]*[0-~]`)
+
+// StripANSI removes ANSI escape sequences so colored output can be matched against plain text
+func StripANSI(s string) string {
+	return ansiRe.ReplaceAllString(s, "")
+}
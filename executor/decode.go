@@ -0,0 +1,31 @@
+package executor
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// DecodeOutput decodes a block's output from encoding before it is validated. Only "base64" is
+// supported. Whitespace is ignored, so wrapped output like base64's 76-column lines decodes too,
+// and both the standard and URL-safe alphabets are accepted with or without padding.
+func DecodeOutput(output string, encoding string) (string, error) {
+	if encoding != "base64" {
+		return "", fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	data := strings.Join(strings.Fields(output), "")
+	if data == "" {
+		return "", fmt.Errorf("output is empty")
+	}
+	var firstErr error
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		decoded, err := enc.DecodeString(data)
+		if err == nil {
+			return string(decoded), nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", firstErr
+}
@@ -0,0 +1,172 @@
+package executor
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ValidationError is returned when a block's output does not meet its docci-output-contains expectation
+type ValidationError struct {
+	BlockIndex int
+	File       string // source markdown file name, empty for single-file runs
+	Line       int    // line of the block's opening fence, 0 when unknown
+	Expected   string
+	Actual     string
+	Missing    bool // the block produced no output markers (it never ran to completion)
+
+	// Set for docci-output-contains-count mismatches, ExpectedCount and ActualCount for
+	// docci-assert-line-count mismatches too
+	CountMismatch bool
+	ExpectedCount int
+	ActualCount   int
+	LineCountOp   string // the docci-assert-line-count comparison: ==, <, <=, > or >=
+
+	// Set for docci-output-json-schema failures
+	Schema       string   // path of the schema the output was checked against
+	SchemaErrors []string // each violation as "field path: message", or why the output is not JSON
+
+	// Set for docci-assert-json-equals-file mismatches
+	JSONFile string // path of the expected JSON file
+	JSONDiff string // the first difference as "field path: message", or why the output is not JSON
+
+	// Set for docci-output-starts-with and docci-output-ends-with mismatches
+	Bound      string // "start" or "end"
+	BoundLines string // the trimmed output's actual first or last lines, as many as Expected has
+
+	// Set for docci-transcript commands whose output differs from the transcript, with Expected and
+	// Actual holding the documented and actual output
+	TranscriptCmd string
+
+	// Set for failed docci-assert-* post-conditions, describing what was expected
+	Assertion string
+
+	// Set when docci-decode-output could not decode the output, which is then not checked further
+	DecodeErr string
+
+	// FullOutput shows all of Actual even when it is long (--verbose)
+	FullOutput bool
+}
+
+func (e *ValidationError) Error() string {
+	if e.Missing {
+		return fmt.Sprintf("no output found for block %d", e.BlockIndex)
+	}
+	if e.Schema != "" {
+		return fmt.Sprintf("block %d: output does not match JSON schema %s:\n  %s", e.BlockIndex, e.Schema, strings.Join(e.SchemaErrors, "\n  "))
+	}
+	if e.DecodeErr != "" {
+		return fmt.Sprintf("block %d: output is not valid base64: %s", e.BlockIndex, e.DecodeErr)
+	}
+	if e.JSONFile != "" {
+		return fmt.Sprintf("block %d: output does not equal the JSON in %s: %s", e.BlockIndex, e.JSONFile, e.JSONDiff)
+	}
+	if e.Bound != "" {
+		position := "first"
+		if e.Bound == "end" {
+			position = "last"
+		}
+		return fmt.Sprintf("block %d: output does not %s with '%s'\nActual %s line(s) of output:\n%s",
+			e.BlockIndex, e.Bound, e.Expected, position, e.BoundLines)
+	}
+	if e.Assertion != "" {
+		return fmt.Sprintf("block %d: assertion failed: %s", e.BlockIndex, e.Assertion)
+	}
+	if e.TranscriptCmd != "" {
+		return fmt.Sprintf("block %d: output of transcript command '%s' does not match the transcript\nExpected:\n%s\nActual:\n%s",
+			e.BlockIndex, e.TranscriptCmd, e.Expected, e.Actual)
+	}
+	if e.LineCountOp != "" {
+		return fmt.Sprintf("block %d: expected %s %d non-empty line(s) in output, found %d\nActual output:\n%s",
+			e.BlockIndex, lineCountWords[e.LineCountOp], e.ExpectedCount, e.ActualCount, e.Actual)
+	}
+	if e.CountMismatch {
+		return fmt.Sprintf("block %d: expected '%s' %d time(s) in output, found %d\nActual output:\n%s",
+			e.BlockIndex, e.Expected, e.ExpectedCount, e.ActualCount, e.Actual)
+	}
+	lines := strings.Split(strings.TrimSuffix(e.Actual, "\n"), "\n")
+	if e.FullOutput || len(lines) <= maxFullOutputLines {
+		return fmt.Sprintf("block %d: output does not contain expected string '%s'\nActual output:\n%s",
+			e.BlockIndex, e.Expected, e.Actual)
+	}
+	return fmt.Sprintf("block %d: output does not contain expected string '%s'\nClosest match in %d lines of output (use --verbose for all of it):\n%s",
+		e.BlockIndex, e.Expected, len(lines), closestLines(lines, e.Expected))
+}
+
+// lineCountWords describes each docci-assert-line-count operator in a validation error
+var lineCountWords = map[string]string{
+	"==": "exactly",
+	"<":  "fewer than",
+	"<=": "at most",
+	">":  "more than",
+	">=": "at least",
+}
+
+// maxFullOutputLines is the longest output a validation error prints in full
+const maxFullOutputLines = 20
+
+// closestContextLines is how many lines are shown on each side of the closest match
+const closestContextLines = 3
+
+// closestLines returns the output line most similar to expected, marked with '>', with a few
+// numbered lines of context. Similarity is the longest run of characters shared with expected,
+// ignoring case, with the earliest line winning ties.
+func closestLines(lines []string, expected string) string {
+	best, bestScore := 0, -1
+	for i, line := range lines {
+		if score := longestCommonSubstring(strings.ToLower(line), strings.ToLower(expected)); score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	start := max(best-closestContextLines, 0)
+	end := min(best+closestContextLines+1, len(lines))
+	width := len(fmt.Sprint(end))
+
+	var b strings.Builder
+	for i := start; i < end; i++ {
+		marker := " "
+		if i == best {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "%s %*d | %s\n", marker, width, i+1, lines[i])
+	}
+	return b.String()
+}
+
+// longestCommonSubstring returns the length in bytes of the longest string found in both a and b
+func longestCommonSubstring(a, b string) int {
+	longest := 0
+	prev := make([]int, len(b)+1)
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				cur[j] = prev[j-1] + 1
+				longest = max(longest, cur[j])
+			}
+		}
+		prev = cur
+	}
+	return longest
+}
+
+// ExecError is returned when the script exits with a non-zero code that was not expected
+type ExecError struct {
+	ExitCode int
+	Block    int    // index of the block that stopped the script, 0 when unknown
+	File     string // source markdown file name of that block
+	Line     int    // line of that block's opening fence
+	Message  string // that block's docci-exit-message, empty when it has none
+	Err      error
+}
+
+func (e *ExecError) Error() string {
+	if e.Block == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("block %d: %s", e.Block, e.Err.Error())
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
@@ -2,14 +2,19 @@ package executor
 
 import (
 	"bufio"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/reecepbcups/docci/logger"
+	"github.com/reecepbcups/docci/types"
 )
 
 type ExecResponse struct {
@@ -32,97 +37,180 @@ func NewExecResponse(exitCode uint, stdout, stderr string, err error) ExecRespon
 // returns exit (status code, error message)
 
 func Exec(commands string) (ExecResponse, error) {
+	return ExecWithOptions(commands, types.DocciOpts{})
+}
+
+// ExecWithOptions runs the commands locally, inside a container when opts.ContainerImage is set,
+// or over ssh when opts.RemoteHost is set. Output is streamed the same way for every target.
+func ExecWithOptions(commands string, opts types.DocciOpts) (ExecResponse, error) {
 	log := logger.GetLogger()
 	log.Debug("Executing commands in bash shell")
 
-	cmd := exec.Command("bash", "-c", commands)
-	cmd.Env = append(os.Environ(), "IS_DOCCI_RUN=true")
+	if opts.KeepTempFiles {
+		path, err := SaveScript(commands)
+		if err != nil {
+			return failedResponse(err)
+		}
+		log.Info("Generated script saved", "path", path)
+	}
 
-	stdout, err := cmd.StdoutPipe()
+	cmd, err := buildCommand(commands, opts)
 	if err != nil {
-		return ExecResponse{}, fmt.Errorf("create stdout pipe: %w", err)
+		return failedResponse(err)
+	}
+	if opts.InputTimeoutSecs > 0 {
+		setProcessGroup(cmd)
 	}
+	watch := newOutputWatch()
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return ExecResponse{}, fmt.Errorf("create stderr pipe: %w", err)
+	var stdoutBuf, stderrBuf strings.Builder // captures output for further validation
+	stdoutWriter, stderrWriter := io.Writer(os.Stdout), io.Writer(os.Stderr)
+	if opts.Stdout != nil {
+		stdoutWriter = opts.Stdout
+	}
+	if opts.Stderr != nil {
+		stderrWriter = opts.Stderr
 	}
+	var mu sync.Mutex // Serializes terminal writes and buffer access so lines from both streams never interleave
+
+	handleStdout := func(line string) {
+		// Don't print DOCCI markers and cleanup messages to stdout
+		shouldPrint := true
+
+		if strings.Contains(line, "DOCCI_BLOCK_START_") || strings.Contains(line, "DOCCI_BLOCK_END_") || strings.Contains(line, "DOCCI_BLOCK_DURATION_") || strings.Contains(line, "DOCCI_BAIL_") || strings.Contains(line, "DOCCI_WARN_") || strings.Contains(line, "DOCCI_TRANSCRIPT_MISMATCH_") || strings.Contains(line, "DOCCI_ASSERTION_FAILED_") {
+			shouldPrint = false
+		}
+		if strings.Contains(line, "Cleaning up background processes") {
+			shouldPrint = false
+		}
+		// Don't show "=== Code Block" headers
+		if strings.Contains(line, "=== Code Block") {
+			shouldPrint = false
+		}
 
-	if err := cmd.Start(); err != nil {
-		return ExecResponse{}, fmt.Errorf("start command: %w", err)
+		watch.seen()
+		mu.Lock()
+		defer mu.Unlock()
+		if shouldPrint {
+			io.WriteString(stdoutWriter, line+"\n")
+		}
+		// Always capture in buffer for validation
+		stdoutBuf.WriteString(line + "\n")
 	}
 
-	var stdoutBuf, stderrBuf strings.Builder // captures output for further validation
-	var mu sync.Mutex // For thread-safe string builder access
-
-	// Create goroutines to read both stdout and stderr concurrently
-	done := make(chan bool, 2)
-
-	// Handle stdout
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line != "" {
-				// Don't print DOCCI markers and cleanup messages to stdout
-				shouldPrint := true
-
-				if strings.Contains(line, "DOCCI_BLOCK_START_") || strings.Contains(line, "DOCCI_BLOCK_END_") {
-					shouldPrint = false
-				}
-				if strings.Contains(line, "Cleaning up background processes") {
-					shouldPrint = false
-				}
-				// Don't show "=== Code Block" headers
-				if strings.Contains(line, "=== Code Block") {
-					shouldPrint = false
-				}
+	handleStderr := func(line string) {
+		// TODO: DevEx:
+		// if error like `bash: -c: line 3: unexpected EOF while looking for matching `"'`
+		// show the actual line number in the file / code block section to help debug.
+		// This case above is when you forget to add a closing quote to an echo line.
+
+		watch.seen()
+		mu.Lock()
+		defer mu.Unlock()
+		// the stderr copies of the block markers are only kept for ParseBlockOutputs
+		if !strings.HasPrefix(line, "### DOCCI_BLOCK_START_") && !strings.HasPrefix(line, "### DOCCI_BLOCK_END_") {
+			io.WriteString(stderrWriter, line+"\n")
+		}
+		stderrBuf.WriteString(line + "\n")
+	}
 
-				if shouldPrint {
-					io.WriteString(os.Stdout, line+"\n")
-				}
-				// Always capture in buffer for validation
-				mu.Lock()
-				stdoutBuf.WriteString(line + "\n")
-				mu.Unlock()
-			}
+	// Create goroutines to read the output streams concurrently
+	var readers []io.Reader
+	var handlers []func(string)
+
+	if opts.MergeOutput {
+		// stdout is written straight into one pipe, and each stderr line is copied into the same pipe
+		// with stderrTag in front as soon as it arrives. Lines are read back in the order they landed
+		// in the pipe, and the tag sends stderr lines to the stderr handler so they still stay out of
+		// the output checks.
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			return failedResponse(fmt.Errorf("create output pipe: %w", err))
 		}
-		done <- true
-	}()
-
-	// Handle stderr
-	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line != "" {
-
-				// TODO: DevEx:
-				// if error like `bash: -c: line 3: unexpected EOF while looking for matching `"'`
-				// show the actual line number in the file / code block section to help debug.
-				// This case above is when you forget to add a closing quote to an echo line.
-
-				io.WriteString(os.Stderr, line+"\n")
-				mu.Lock()
-				stderrBuf.WriteString(line + "\n")
-				mu.Unlock()
+		cmd.Stdout = pw
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			pr.Close()
+			pw.Close()
+			return failedResponse(fmt.Errorf("create stderr pipe: %w", err))
+		}
+		if err := cmd.Start(); err != nil {
+			pr.Close()
+			pw.Close()
+			return failedResponse(fmt.Errorf("start command: %w", err))
+		}
+		defer pr.Close()
+
+		// the child holds its own copy of the write end, so the reader sees EOF once the child
+		// exits and the last stderr line has been copied
+		go func() {
+			defer pw.Close()
+			forwardTagged(stderr, pw)
+		}()
+
+		readers = append(readers, pr)
+		handlers = append(handlers, func(line string) {
+			if rest, ok := strings.CutPrefix(line, stderrTag); ok {
+				handleStderr(rest)
+			} else {
+				handleStdout(line)
 			}
+		})
+	} else {
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return failedResponse(fmt.Errorf("create stdout pipe: %w", err))
+		}
+
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return failedResponse(fmt.Errorf("create stderr pipe: %w", err))
+		}
+
+		if err := cmd.Start(); err != nil {
+			return failedResponse(fmt.Errorf("start command: %w", err))
 		}
-		done <- true
-	}()
 
-	// Wait for both goroutines to finish
-	<-done
-	<-done
+		readers = append(readers, stdout, stderr)
+		handlers = append(handlers, handleStdout, handleStderr)
+	}
+
+	// Warn about, or stop, a script that stops writing output while it waits for input
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	go watch.run(cmd, opts, stopWatch)
+
+	done := make(chan bool, len(readers))
+	for i, r := range readers {
+		go func(r io.Reader, handle func(string)) {
+			scanner := bufio.NewScanner(r)
+			for scanner.Scan() {
+				if line := scanner.Text(); line != "" {
+					handle(line)
+				}
+			}
+			done <- true
+		}(r, handlers[i])
+	}
+
+	// Wait for all readers to finish
+	for range readers {
+		<-done
+	}
 
 	if err := cmd.Wait(); err != nil {
+		if watch.timedOut.Load() {
+			// 124 is the exit code timeout(1) uses for a command it stopped
+			return NewExecResponse(124, stdoutBuf.String(), stderrBuf.String(),
+				fmt.Errorf("no output for %d seconds, stopped by --input-timeout (a command may be waiting for input, like a sudo password prompt)", opts.InputTimeoutSecs)), nil
+		}
 		if exitError, ok := err.(*exec.ExitError); ok {
 			exitCode := exitError.ExitCode()
 			exitErr := exitError.Error()
 			log.Debug("Command exited with code", "exitCode", exitCode, "error", exitErr)
 			return NewExecResponse(uint(exitCode), stdoutBuf.String(), stderrBuf.String(), fmt.Errorf(exitError.Error())), nil
 		} else {
-			return ExecResponse{}, fmt.Errorf("wait command: %w", err)
+			return failedResponse(fmt.Errorf("wait command: %w", err))
 		}
 	}
 
@@ -130,8 +218,169 @@ func Exec(commands string) (ExecResponse, error) {
 	return NewExecResponse(0, stdoutBuf.String(), stderrBuf.String(), nil), nil
 }
 
-// ParseBlockOutputs extracts output for each code block based on markers
-func ParseBlockOutputs(output string) map[int]string {
+// failedResponse is returned when the script could not be started or waited on. The error is set
+// on the response as well, with exit code 1, so callers that only check resp.Error see the failure.
+func failedResponse(err error) (ExecResponse, error) {
+	return NewExecResponse(1, "", "", err), err
+}
+
+// stderrTag marks the stderr lines copied into the stdout pipe with --merge-output. It is the ASCII
+// record separator, which commands practically never print at the start of a line.
+const stderrTag = "\x1e"
+
+// forwardTagged copies each line from r to w with stderrTag in front, one write per line so it is
+// not split by the child's own writes to w
+func forwardTagged(r io.Reader, w io.Writer) {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			io.WriteString(w, stderrTag+strings.TrimSuffix(line, "\n")+"\n")
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// isTraceLine reports whether a line is docci's "Executing CMD" trace, which the script writes to stderr
+func isTraceLine(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "Executing CMD:")
+}
+
+// SaveScript writes the generated script to a new temp file and returns its path,
+// so it can be inspected or rerun with bash after docci exits
+func SaveScript(commands string) (string, error) {
+	f, err := os.CreateTemp("", "docci-script-*.sh")
+	if err != nil {
+		return "", fmt.Errorf("create script file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(commands); err != nil {
+		return "", fmt.Errorf("write script file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// buildCommand returns the command that runs the generated script for the configured target
+func buildCommand(commands string, opts types.DocciOpts) (*exec.Cmd, error) {
+	if opts.ContainerImage != "" && opts.RemoteHost != "" {
+		return nil, fmt.Errorf("cannot run in a container and on a remote host at the same time")
+	}
+	if opts.ForceColor && opts.NoColor {
+		return nil, fmt.Errorf("cannot force color and disable color at the same time")
+	}
+	setColor, unsetColor := colorEnv(opts)
+
+	if opts.PowerShell && (opts.ContainerImage != "" || opts.RemoteHost != "") {
+		return nil, fmt.Errorf("PowerShell scripts only run locally, not in a container or on a remote host")
+	}
+
+	if opts.RemoteHost != "" {
+		if _, err := exec.LookPath("ssh"); err != nil {
+			return nil, fmt.Errorf("ssh is required to run on remote host %s: %w", opts.RemoteHost, err)
+		}
+
+		// Environment variables are not forwarded by ssh, so the marker is exported by the script itself.
+		// The script is read fully before running, same as in a container.
+		var exports strings.Builder
+		for _, kv := range append([]string{"IS_DOCCI_RUN=true"}, setColor...) {
+			exports.WriteString("export " + kv + "\n")
+		}
+		for _, name := range unsetColor {
+			exports.WriteString("unset " + name + "\n")
+		}
+		cmd := exec.Command("ssh", opts.RemoteHost, `bash -c 'eval "$(cat)"'`)
+		cmd.Stdin = strings.NewReader(exports.String() + commands)
+		return cmd, nil
+	}
+
+	if opts.ContainerImage != "" {
+		if _, err := exec.LookPath("docker"); err != nil {
+			return nil, fmt.Errorf("docker is required to run in container %s: %w", opts.ContainerImage, err)
+		}
+
+		// Mount the working directory at the same path so file operations persist on the host
+		wd := opts.WorkingDir
+		if wd == "" {
+			var err error
+			if wd, err = os.Getwd(); err != nil {
+				return nil, fmt.Errorf("get working directory: %w", err)
+			}
+		}
+
+		// The script is piped over stdin and read fully before running,
+		// so commands in the document that read stdin do not consume the script
+		args := []string{"run", "--rm", "-i", "-e", "IS_DOCCI_RUN=true"}
+		for _, kv := range setColor {
+			args = append(args, "-e", kv)
+		}
+		args = append(args, "-v", wd+":"+wd, "-w", wd, opts.ContainerImage, "bash", "-c", `eval "$(cat)"`)
+		cmd := exec.Command("docker", args...)
+		cmd.Stdin = strings.NewReader(commands)
+		return cmd, nil
+	}
+
+	// Check for the shell up front, so a missing one is a clear error rather than a failure to start
+	shell := opts.Shell
+	if shell == "" {
+		shell = "bash"
+		if opts.PowerShell {
+			shell = "pwsh"
+		}
+	}
+	if _, err := exec.LookPath(shell); err != nil {
+		if opts.PowerShell {
+			return nil, fmt.Errorf("%s not found; --powershell requires PowerShell 7+ (use --shell to point at it): %w", shell, err)
+		}
+		return nil, fmt.Errorf("%s not found; docci requires bash (use --shell to point at it): %w", shell, err)
+	}
+
+	cmd := exec.Command(shell, "-c", commands)
+	if opts.PowerShell {
+		cmd = exec.Command(shell, "-NoProfile", "-NonInteractive", "-Command", commands)
+	}
+	cmd.Dir = opts.WorkingDir
+	cmd.Env = append(withoutEnv(os.Environ(), unsetColor), "IS_DOCCI_RUN=true")
+	cmd.Env = append(cmd.Env, setColor...)
+	return cmd, nil
+}
+
+// colorEnv returns the variables --force-color and --no-color set and unset for the script.
+// Most CLIs and color libraries (chalk, supports-color, termcolor, ls, grep) read these instead
+// of only checking for a TTY:
+//   - --force-color sets FORCE_COLOR=1 and CLICOLOR_FORCE=1 and unsets NO_COLOR
+//   - --no-color sets NO_COLOR=1, FORCE_COLOR=0 and CLICOLOR=0 and unsets CLICOLOR_FORCE
+func colorEnv(opts types.DocciOpts) (set []string, unset []string) {
+	switch {
+	case opts.ForceColor:
+		return []string{"FORCE_COLOR=1", "CLICOLOR_FORCE=1"}, []string{"NO_COLOR"}
+	case opts.NoColor:
+		return []string{"NO_COLOR=1", "FORCE_COLOR=0", "CLICOLOR=0"}, []string{"CLICOLOR_FORCE"}
+	}
+	return nil, nil
+}
+
+// withoutEnv returns env without the named variables
+func withoutEnv(env []string, names []string) []string {
+	if len(names) == 0 {
+		return env
+	}
+	var kept []string
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !slices.Contains(names, name) {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
+
+// ParseBlockOutputs extracts output for each code block based on markers. Markers carry the block
+// index, or for blocks in names (see parser.MarkerNames) the block's docci-name, which is mapped
+// back to its index. names may be nil.
+func ParseBlockOutputs(output string, names map[string]int) map[int]string {
 	log := logger.GetLogger()
 	log.Debug("Parsing block outputs from execution result")
 	blockOutputs := make(map[int]string)
@@ -142,12 +391,21 @@ func ParseBlockOutputs(output string) map[int]string {
 	inBlock := false
 
 	for _, line := range lines {
+		// PowerShell on Windows ends lines with \r\n
+		line = strings.TrimSuffix(line, "\r")
+
 		// Check for start marker
 		if strings.HasPrefix(line, "### DOCCI_BLOCK_START_") && strings.HasSuffix(line, " ###") {
-			// Extract block number
+			// Extract block name or number
 			marker := strings.TrimPrefix(line, "### DOCCI_BLOCK_START_")
 			marker = strings.TrimSuffix(marker, " ###")
-			fmt.Sscanf(marker, "%d", &currentBlock)
+			if index, ok := names[marker]; ok {
+				currentBlock = index
+			} else if _, err := fmt.Sscanf(marker, "%d", &currentBlock); err != nil {
+				log.Debug("Skipping output of unknown block marker", "marker", marker)
+				inBlock = false
+				continue
+			}
 			log.Debug("Found start marker for block", "block", currentBlock)
 			inBlock = true
 			currentOutput.Reset()
@@ -164,8 +422,9 @@ func ParseBlockOutputs(output string) map[int]string {
 			continue
 		}
 
-		// Skip code block headers
-		if strings.HasPrefix(line, "### === Code Block") {
+		// Skip code block headers and the markers blocks report failures with
+		if strings.HasPrefix(line, "### === Code Block") || strings.HasPrefix(line, "### DOCCI_WARN_") ||
+			strings.HasPrefix(line, "### DOCCI_TRANSCRIPT_MISMATCH_") || strings.HasPrefix(line, "### DOCCI_ASSERTION_FAILED_") {
 			continue
 		}
 
@@ -182,28 +441,271 @@ func ParseBlockOutputs(output string) map[int]string {
 	return blockOutputs
 }
 
-// ValidateOutputs checks if block outputs contain expected strings
-func ValidateOutputs(blockOutputs map[int]string, validationMap map[int]string) []error {
+// ParseBlockDurations extracts the run time in seconds that timed blocks report after their end
+// marker. Blocks are identified the same way as in ParseBlockOutputs.
+func ParseBlockDurations(output string, names map[string]int) map[int]float64 {
+	durations := make(map[int]float64)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if !strings.HasPrefix(line, "### DOCCI_BLOCK_DURATION_") || !strings.HasSuffix(line, " ###") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(line, "### DOCCI_BLOCK_DURATION_"), " ###"))
+		if len(fields) != 2 {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		if index, ok := names[fields[0]]; ok {
+			durations[index] = seconds
+		} else if index, err := strconv.Atoi(fields[0]); err == nil {
+			durations[index] = seconds
+		}
+	}
+	return durations
+}
+
+// ParseBail returns the index of the block a docci-bail-unless guard stopped the run before
+func ParseBail(output string) (int, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if !strings.HasPrefix(line, "### DOCCI_BAIL_") || !strings.HasSuffix(line, " ###") {
+			continue
+		}
+		if index, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, "### DOCCI_BAIL_"), " ###")); err == nil {
+			return index, true
+		}
+	}
+	return 0, false
+}
+
+// ParseWarnings returns the exit code of each docci-warn-only block that failed, by block index
+func ParseWarnings(output string) map[int]int {
+	warnings := make(map[int]int)
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if !strings.HasPrefix(line, "### DOCCI_WARN_") || !strings.HasSuffix(line, " ###") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(line, "### DOCCI_WARN_"), " ###"))
+		if len(fields) != 2 {
+			continue
+		}
+		index, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		if exitCode, err := strconv.Atoi(fields[1]); err == nil {
+			warnings[index] = exitCode
+		}
+	}
+	return warnings
+}
+
+// ParseTranscriptMismatches returns a validation error for each docci-transcript command whose
+// output differed from the transcript, in the order they ran
+func ParseTranscriptMismatches(output string) []*ValidationError {
+	var errors []*ValidationError
+lines:
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if !strings.HasPrefix(line, "### DOCCI_TRANSCRIPT_MISMATCH_") || !strings.HasSuffix(line, " ###") {
+			continue
+		}
+		index, encoded, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(line, "### DOCCI_TRANSCRIPT_MISMATCH_"), " ###"), " ")
+		blockIndex, err := strconv.Atoi(index)
+		if !ok || err != nil {
+			continue
+		}
+		fields := strings.Split(encoded, ":")
+		if len(fields) != 3 {
+			continue
+		}
+		decoded := make([]string, len(fields))
+		for i, field := range fields {
+			data, err := base64.StdEncoding.DecodeString(field)
+			if err != nil {
+				continue lines
+			}
+			decoded[i] = string(data)
+		}
+		errors = append(errors, &ValidationError{BlockIndex: blockIndex, TranscriptCmd: decoded[0], Expected: decoded[1], Actual: decoded[2]})
+	}
+	return errors
+}
+
+// ParseAssertionFailures returns a validation error for each failed docci-assert-* post-condition,
+// in the order they were checked
+func ParseAssertionFailures(output string) []*ValidationError {
+	var errors []*ValidationError
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if !strings.HasPrefix(line, "### DOCCI_ASSERTION_FAILED_") || !strings.HasSuffix(line, " ###") {
+			continue
+		}
+		index, encoded, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(line, "### DOCCI_ASSERTION_FAILED_"), " ###"), " ")
+		blockIndex, err := strconv.Atoi(index)
+		if !ok || err != nil {
+			continue
+		}
+		if message, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			errors = append(errors, &ValidationError{BlockIndex: blockIndex, Assertion: string(message)})
+		}
+	}
+	return errors
+}
+
+// ParseBlockStderr is ParseBlockOutputs for the script's stderr. docci's "Executing CMD" trace
+// lines are left out, so only what the blocks themselves wrote is returned.
+func ParseBlockStderr(stderr string, names map[string]int) map[int]string {
+	var kept []string
+	for _, line := range strings.Split(stderr, "\n") {
+		if !isTraceLine(line) {
+			kept = append(kept, line)
+		}
+	}
+	return ParseBlockOutputs(strings.Join(kept, "\n"), names)
+}
+
+// SplitBlockOutput is ParseBlockOutputs for showing output rather than validating it. A block's
+// output runs until its end marker or the next block's start marker, so the block the script
+// stopped in keeps what it wrote. docci's markers, headers and trace lines are left out.
+func SplitBlockOutput(output string, names map[string]int) map[int]string {
+	outputs := make(map[int]*strings.Builder)
+	var current *strings.Builder
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.HasPrefix(line, "### DOCCI_BLOCK_START_") && strings.HasSuffix(line, " ###") {
+			marker := strings.TrimSuffix(strings.TrimPrefix(line, "### DOCCI_BLOCK_START_"), " ###")
+			index, ok := names[marker]
+			if !ok {
+				var err error
+				if index, err = strconv.Atoi(marker); err != nil {
+					current = nil
+					continue
+				}
+			}
+			if outputs[index] == nil {
+				outputs[index] = &strings.Builder{}
+			}
+			current = outputs[index]
+			continue
+		}
+		if strings.HasPrefix(line, "### DOCCI_BLOCK_END_") {
+			current = nil
+			continue
+		}
+		if current == nil || line == "" || strings.HasPrefix(line, "### DOCCI_") || strings.HasPrefix(line, "### === Code Block") || isTraceLine(line) {
+			continue
+		}
+		current.WriteString(line + "\n")
+	}
+
+	split := make(map[int]string, len(outputs))
+	for index, b := range outputs {
+		split[index] = b.String()
+	}
+	return split
+}
+
+// ValidateOutputs checks if block outputs contain expected strings, for countMap that they
+// contain a string an exact number of times, and for boundsMap that their trimmed output starts or
+// ends with a string. Errors are returned in block order.
+func ValidateOutputs(blockOutputs map[int]string, validationMap map[int]string, countMap map[int]types.OutputCount, boundsMap map[int]types.OutputBounds) []*ValidationError {
 	log := logger.GetLogger()
 	log.Debug("Validating block outputs against expected strings")
-	var errors []error
+	var errors []*ValidationError
 
-	for blockIndex, expectedContains := range validationMap {
+	seen := make(map[int]bool)
+	var indexes []int
+	for blockIndex := range validationMap {
+		seen[blockIndex] = true
+		indexes = append(indexes, blockIndex)
+	}
+	for blockIndex := range countMap {
+		if !seen[blockIndex] {
+			seen[blockIndex] = true
+			indexes = append(indexes, blockIndex)
+		}
+	}
+	for blockIndex := range boundsMap {
+		if !seen[blockIndex] {
+			indexes = append(indexes, blockIndex)
+		}
+	}
+	sort.Ints(indexes)
+
+	for _, blockIndex := range indexes {
 		output, exists := blockOutputs[blockIndex]
 		if !exists {
 			log.Error("No output found for block", "block", blockIndex)
-			errors = append(errors, fmt.Errorf("no output found for block %d", blockIndex))
+			errors = append(errors, &ValidationError{BlockIndex: blockIndex, Expected: validationMap[blockIndex], Missing: true})
 			continue
 		}
 
-		if !strings.Contains(output, expectedContains) {
-			log.Error("Block validation failed: output does not contain expected", "block", blockIndex, "expected", expectedContains)
-			errors = append(errors, fmt.Errorf("block %d: output does not contain expected string '%s'\nActual output:\n%s",
-				blockIndex, expectedContains, output))
-		} else {
-			log.Debug("Block validation passed: found expected string", "block", blockIndex, "expected", expectedContains)
+		if expectedContains, ok := validationMap[blockIndex]; ok {
+			if !strings.Contains(output, expectedContains) {
+				log.Error("Block validation failed: output does not contain expected", "block", blockIndex, "expected", expectedContains)
+				errors = append(errors, &ValidationError{BlockIndex: blockIndex, Expected: expectedContains, Actual: output})
+			} else {
+				log.Debug("Block validation passed: found expected string", "block", blockIndex, "expected", expectedContains)
+			}
+		}
+
+		if expected, ok := countMap[blockIndex]; ok {
+			actual := strings.Count(output, expected.Text)
+			if actual != expected.Count {
+				log.Error("Block validation failed: output count mismatch", "block", blockIndex, "expected", expected.Text, "count", expected.Count, "actual", actual)
+				errors = append(errors, &ValidationError{
+					BlockIndex:    blockIndex,
+					Expected:      expected.Text,
+					Actual:        output,
+					CountMismatch: true,
+					ExpectedCount: expected.Count,
+					ActualCount:   actual,
+				})
+			} else {
+				log.Debug("Block validation passed: found expected count", "block", blockIndex, "expected", expected.Text, "count", actual)
+			}
+		}
+
+		if bounds, ok := boundsMap[blockIndex]; ok {
+			trimmed := strings.TrimSpace(output)
+			if bounds.Prefix != "" && !strings.HasPrefix(trimmed, bounds.Prefix) {
+				log.Error("Block validation failed: output does not start with expected", "block", blockIndex, "expected", bounds.Prefix)
+				errors = append(errors, &ValidationError{
+					BlockIndex: blockIndex,
+					Expected:   bounds.Prefix,
+					Actual:     output,
+					Bound:      "start",
+					BoundLines: boundaryLines(trimmed, bounds.Prefix, false),
+				})
+			}
+			if bounds.Suffix != "" && !strings.HasSuffix(trimmed, bounds.Suffix) {
+				log.Error("Block validation failed: output does not end with expected", "block", blockIndex, "expected", bounds.Suffix)
+				errors = append(errors, &ValidationError{
+					BlockIndex: blockIndex,
+					Expected:   bounds.Suffix,
+					Actual:     output,
+					Bound:      "end",
+					BoundLines: boundaryLines(trimmed, bounds.Suffix, true),
+				})
+			}
 		}
 	}
 
 	return errors
 }
+
+// boundaryLines returns the first lines of output, or the last when fromEnd is set, one for each
+// line in expected
+func boundaryLines(output string, expected string, fromEnd bool) string {
+	lines := strings.Split(output, "\n")
+	n := min(strings.Count(expected, "\n")+1, len(lines))
+	if fromEnd {
+		return strings.Join(lines[len(lines)-n:], "\n")
+	}
+	return strings.Join(lines[:n], "\n")
+}
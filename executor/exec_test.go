@@ -0,0 +1,391 @@
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reecepbcups/docci/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildCommandLocal(t *testing.T) {
+	cmd, err := buildCommand("echo hi", types.DocciOpts{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"bash", "-c", "echo hi"}, cmd.Args)
+	require.Contains(t, cmd.Env, "IS_DOCCI_RUN=true")
+}
+
+func TestBuildCommandContainer(t *testing.T) {
+	// point PATH at a fake docker so the test does not need docker installed
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(dir+"/docker", []byte("#!/bin/sh\n"), 0755))
+	t.Setenv("PATH", dir)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+
+	cmd, err := buildCommand("echo hi", types.DocciOpts{ContainerImage: "ubuntu:24.04"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"docker", "run", "--rm", "-i", "-e", "IS_DOCCI_RUN=true", "-v", wd + ":" + wd, "-w", wd, "ubuntu:24.04", "bash", "-c", `eval "$(cat)"`}, cmd.Args)
+	require.NotNil(t, cmd.Stdin)
+
+	// docker missing
+	t.Setenv("PATH", t.TempDir())
+	_, err = buildCommand("echo hi", types.DocciOpts{ContainerImage: "ubuntu:24.04"})
+	require.ErrorContains(t, err, "docker is required")
+}
+
+func TestBuildCommandRemote(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(dir+"/ssh", []byte("#!/bin/sh\n"), 0755))
+	t.Setenv("PATH", dir)
+
+	cmd, err := buildCommand("echo hi", types.DocciOpts{RemoteHost: "user@host"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"ssh", "user@host", `bash -c 'eval "$(cat)"'`}, cmd.Args)
+
+	// container and remote are mutually exclusive
+	_, err = buildCommand("echo hi", types.DocciOpts{RemoteHost: "user@host", ContainerImage: "ubuntu"})
+	require.ErrorContains(t, err, "at the same time")
+}
+
+func TestBuildCommandColor(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+	cmd, err := buildCommand("echo hi", types.DocciOpts{ForceColor: true})
+	require.NoError(t, err)
+	require.Contains(t, cmd.Env, "FORCE_COLOR=1")
+	require.Contains(t, cmd.Env, "CLICOLOR_FORCE=1")
+	require.NotContains(t, cmd.Env, "NO_COLOR=1")
+
+	cmd, err = buildCommand("echo hi", types.DocciOpts{NoColor: true})
+	require.NoError(t, err)
+	require.Contains(t, cmd.Env, "NO_COLOR=1")
+	require.Contains(t, cmd.Env, "FORCE_COLOR=0")
+
+	_, err = buildCommand("echo hi", types.DocciOpts{ForceColor: true, NoColor: true})
+	require.ErrorContains(t, err, "cannot force color and disable color")
+
+	// the variables are exported by the script for remote hosts
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(dir+"/ssh", []byte("#!/bin/sh\n"), 0755))
+	t.Setenv("PATH", dir)
+	cmd, err = buildCommand("echo hi", types.DocciOpts{RemoteHost: "user@host", NoColor: true})
+	require.NoError(t, err)
+	script, err := io.ReadAll(cmd.Stdin)
+	require.NoError(t, err)
+	require.Equal(t, "export IS_DOCCI_RUN=true\nexport NO_COLOR=1\nexport FORCE_COLOR=0\nexport CLICOLOR=0\nunset CLICOLOR_FORCE\necho hi", string(script))
+}
+
+func TestSaveScript(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+
+	path, err := SaveScript("echo hi\n")
+	require.NoError(t, err)
+	require.Equal(t, os.Getenv("TMPDIR"), filepath.Dir(path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "echo hi\n", string(data))
+}
+
+func TestExecMergeOutput(t *testing.T) {
+	script := "echo one\necho two >&2\necho '     Executing CMD: echo three' >&2\necho three\n"
+
+	resp, err := ExecWithOptions(script, types.DocciOpts{MergeOutput: true})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+	// the lines share one pipe but each still keeps its stream
+	require.Equal(t, "one\nthree\n", resp.Stdout)
+	require.Equal(t, "two\n     Executing CMD: echo three\n", resp.Stderr)
+
+	resp, err = ExecWithOptions("echo out\nexit 3\n", types.DocciOpts{MergeOutput: true})
+	require.NoError(t, err)
+	require.Equal(t, uint(3), resp.ExitCode)
+	require.Equal(t, "out\n", resp.Stdout)
+}
+
+func TestExecInputTimeout(t *testing.T) {
+	// the sleep stands in for a command waiting on a prompt, and is stopped with the script
+	start := time.Now()
+	resp, err := ExecWithOptions("echo start\nsleep 30\necho never\n", types.DocciOpts{InputTimeoutSecs: 1})
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Equal(t, uint(124), resp.ExitCode)
+	require.ErrorContains(t, resp.Error, "no output for 1 seconds, stopped by --input-timeout")
+	require.Equal(t, "start\n", resp.Stdout)
+
+	// output keeps resetting the timeout
+	resp, err = ExecWithOptions("for i in 1 2 3; do echo $i; sleep 0.6; done\n", types.DocciOpts{InputTimeoutSecs: 1})
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+}
+
+func TestValidateJSONSchemas(t *testing.T) {
+	schema := filepath.Join(t.TempDir(), "schema.json")
+	require.NoError(t, os.WriteFile(schema, []byte(`{
+		"type": "object",
+		"required": ["id", "items"],
+		"properties": {
+			"id": {"type": "integer"},
+			"items": {"type": "array", "items": {"type": "string"}}
+		}
+	}`), 0644))
+
+	outputs := map[int]string{
+		1: `{"id": 12345678901234567890, "items": ["a"]}`,
+		2: `{"id": "7", "items": ["a", 2]}`,
+		3: "not json",
+	}
+	errs := ValidateJSONSchemas(outputs, map[int]string{1: schema, 2: schema, 3: schema, 4: schema})
+	require.Len(t, errs, 3)
+
+	require.Equal(t, 2, errs[0].BlockIndex)
+	require.ElementsMatch(t, []string{"/id: expected integer, but got string", "/items/1: expected string, but got number"}, errs[0].SchemaErrors)
+	require.Contains(t, errs[0].Error(), "block 2: output does not match JSON schema "+schema)
+
+	require.Equal(t, 3, errs[1].BlockIndex)
+	require.Contains(t, errs[1].SchemaErrors[0], "output is not valid JSON")
+	require.True(t, errs[2].Missing)
+
+	_, err := CompileJSONSchema(filepath.Join(t.TempDir(), "missing.json"))
+	require.Error(t, err)
+}
+
+func TestJSONDiff(t *testing.T) {
+	decode := func(s string) any {
+		value, err := decodeJSON(strings.NewReader(s))
+		require.NoError(t, err)
+		return value
+	}
+	tests := []struct {
+		expected string
+		actual   string
+		diff     string
+	}{
+		{`{"a": 1, "b": [1, 2]}`, `{"b": [1, 2.0], "a": 1e0}`, ""},
+		{`{"a": {"b": true}}`, `{"a": {"b": false}}`, "/a/b: expected true, got false"},
+		{`{"a": 1, "c": 2}`, `{"c": 2}`, "/a: missing, expected 1"},
+		{`{"a": 1}`, `{"a": 1, "z": "x"}`, `/z: unexpected field with "x"`},
+		{`[1, 2, 3]`, `[1, 2]`, "/: expected 3 elements, got 2"},
+		{`{"a/b": "1"}`, `{"a/b": 1}`, `/a~1b: expected string "1", got number 1`},
+		{`12345678901234567890`, `12345678901234567891`, "/: expected 12345678901234567890, got 12345678901234567891"},
+		{`null`, `{}`, "/: expected null null, got object {}"},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.diff, jsonDiff("", decode(tt.expected), decode(tt.actual)), tt.expected)
+	}
+}
+
+func TestValidateJSONEquals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "expected.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"ok": true}`), 0644))
+	errs := ValidateJSONEquals(map[int]string{1: `{"ok": true}`, 2: `{"ok": false}`, 3: "ok: true"}, map[int]string{1: path, 2: path, 3: path, 4: path})
+	require.Len(t, errs, 3)
+	require.Equal(t, 2, errs[0].BlockIndex)
+	require.Contains(t, errs[0].Error(), "/ok: expected true, got false")
+	require.Contains(t, errs[1].JSONDiff, "output is not valid JSON")
+	require.True(t, errs[2].Missing)
+}
+
+func TestDecodeOutput(t *testing.T) {
+	// wrapped lines and a trailing newline are ignored
+	decoded, err := DecodeOutput("aGVsbG8g\nd29ybGQ=\n", "base64")
+	require.NoError(t, err)
+	require.Equal(t, "hello world", decoded)
+
+	// URL-safe and unpadded, like JWT segments
+	decoded, err = DecodeOutput("eyJhbGciOiJIUzI1NiJ9", "base64")
+	require.NoError(t, err)
+	require.Equal(t, `{"alg":"HS256"}`, decoded)
+	decoded, err = DecodeOutput("-_8", "base64")
+	require.NoError(t, err)
+	require.Equal(t, "\xfb\xff", decoded)
+
+	_, err = DecodeOutput("not base64!", "base64")
+	require.ErrorContains(t, err, "illegal base64 data")
+	_, err = DecodeOutput("\n", "base64")
+	require.ErrorContains(t, err, "output is empty")
+}
+
+func TestSplitBlockOutput(t *testing.T) {
+	output := "before\n### DOCCI_BLOCK_START_1 ###\none\n### DOCCI_BLOCK_END_1 ###\n### DOCCI_BLOCK_DURATION_1 0.1 ###\n" +
+		"### DOCCI_BLOCK_START_setup ###\n### === Code Block 2 ===\ntwo\n### DOCCI_BLOCK_END_setup ###\n" +
+		"### DOCCI_BLOCK_START_3 ###\npartial\n"
+	split := SplitBlockOutput(output, map[string]int{"setup": 2})
+	// the block without an end marker keeps what it wrote
+	require.Equal(t, map[int]string{1: "one\n", 2: "two\n", 3: "partial\n"}, split)
+}
+
+func TestValidateOutputBounds(t *testing.T) {
+	outputs := map[int]string{1: "\n  Usage: docci [command]\n\nFlags:\n  -h, --help\nDone.\n\n"}
+
+	// surrounding whitespace is trimmed before the comparison
+	require.Empty(t, ValidateOutputs(outputs, nil, nil, map[int]types.OutputBounds{1: {Prefix: "Usage: docci", Suffix: "--help\nDone."}}))
+
+	errs := ValidateOutputs(outputs, nil, nil, map[int]types.OutputBounds{1: {Prefix: "Flags:", Suffix: "Finished"}})
+	require.Len(t, errs, 2)
+	require.Equal(t, "start", errs[0].Bound)
+	require.Equal(t, "Usage: docci [command]", errs[0].BoundLines)
+	require.Contains(t, errs[0].Error(), "block 1: output does not start with 'Flags:'\nActual first line(s) of output:\nUsage: docci [command]")
+	require.Equal(t, "end", errs[1].Bound)
+	require.Equal(t, "Done.", errs[1].BoundLines)
+
+	// as many boundary lines are shown as the expectation has
+	errs = ValidateOutputs(outputs, nil, nil, map[int]types.OutputBounds{1: {Suffix: "--verbose\nDone."}})
+	require.Len(t, errs, 1)
+	require.Equal(t, "  -h, --help\nDone.", errs[0].BoundLines)
+
+	errs = ValidateOutputs(map[int]string{}, nil, nil, map[int]types.OutputBounds{2: {Prefix: "x"}})
+	require.Len(t, errs, 1)
+	require.True(t, errs[0].Missing)
+}
+
+func TestValidateLineCounts(t *testing.T) {
+	require.Equal(t, 0, CountLines(""))
+	require.Equal(t, 3, CountLines("a.txt\n\nb.txt\n   \nc.txt\n"))
+
+	outputs := map[int]string{1: "a.txt\nb.txt\nc.txt\n", 2: "only\n"}
+	require.Empty(t, ValidateLineCounts(outputs, map[int]types.LineCount{1: {Op: "==", Count: 3}, 2: {Op: "<=", Count: 1}}))
+
+	errs := ValidateLineCounts(outputs, map[int]types.LineCount{2: {Op: ">=", Count: 2}, 1: {Op: "<", Count: 3}, 3: {Op: "==", Count: 1}})
+	require.Len(t, errs, 3)
+	require.Equal(t, 1, errs[0].BlockIndex)
+	require.Contains(t, errs[0].Error(), "block 1: expected fewer than 3 non-empty line(s) in output, found 3")
+	require.Equal(t, 2, errs[1].BlockIndex)
+	require.Contains(t, errs[1].Error(), "block 2: expected at least 2 non-empty line(s) in output, found 1")
+	require.True(t, errs[2].Missing)
+}
+
+func TestValidationErrorClosestMatch(t *testing.T) {
+	var output strings.Builder
+	for i := 1; i <= 30; i++ {
+		fmt.Fprintf(&output, "log line %d\n", i)
+	}
+	output.WriteString("Server listening on port 8081\n")
+	for i := 32; i <= 40; i++ {
+		fmt.Fprintf(&output, "log line %d\n", i)
+	}
+
+	verr := &ValidationError{BlockIndex: 1, Expected: "listening on port 8080", Actual: output.String()}
+	msg := verr.Error()
+	require.Contains(t, msg, "Closest match in 40 lines of output (use --verbose for all of it):")
+	require.Contains(t, msg, "> 31 | Server listening on port 8081\n")
+	require.Contains(t, msg, "  28 | log line 28\n")
+	require.Contains(t, msg, "  34 | log line 34\n")
+	require.NotContains(t, msg, "log line 27\n")
+
+	// short output and --verbose print everything
+	verr.FullOutput = true
+	require.Contains(t, verr.Error(), "Actual output:\n"+output.String())
+	short := &ValidationError{BlockIndex: 1, Expected: "x", Actual: "a\nb\n"}
+	require.Contains(t, short.Error(), "Actual output:\na\nb\n")
+}
+
+func TestStripANSI(t *testing.T) {
+	for input, want := range map[string]string{
+		"plain text":            "plain text",
+		"\x1b[1;32mPASS\x1b[0m": "PASS",
+		"\x1b[2K\x1b[1Gdone":    "done",
+		"\x1b]8;;https://x.dev\x07link\x1b]8;;\x07": "link",
+		"\x1b]0;title\x1b\\text":                    "text",
+		"\x1b(Bcharset":                             "charset",
+	} {
+		require.Equal(t, want, StripANSI(input), "%q", input)
+	}
+}
+
+func TestSortLines(t *testing.T) {
+	for input, want := range map[string]string{
+		"":                        "",
+		"\n":                      "\n",
+		"only":                    "only",
+		"cherry\napple\nbanana\n": "apple\nbanana\ncherry\n",
+		"b\na":                    "a\nb",
+	} {
+		require.Equal(t, want, SortLines(input), "%q", input)
+	}
+
+	// shuffled output matches the sorted expectation once its lines are sorted
+	shuffled := map[int]string{1: "c.txt\na.txt\nb.txt\n"}
+	expected := map[int]string{1: "a.txt\nb.txt\nc.txt"}
+	require.Len(t, ValidateOutputs(shuffled, expected, nil, nil), 1)
+	shuffled[1] = SortLines(shuffled[1])
+	require.Empty(t, ValidateOutputs(shuffled, expected, nil, nil))
+}
+
+func TestTrimLines(t *testing.T) {
+	output := "downloading\n10%\n100%\nsummary: ok\n"
+	require.Equal(t, "100%\nsummary: ok\n", TrimLines(output, 2, true))
+	require.Equal(t, "downloading\n", TrimLines(output, 1, false))
+	require.Equal(t, output, TrimLines(output, 10, true))
+	require.Equal(t, "a\nb", TrimLines("a\nb\nc", 2, false))
+	require.Equal(t, "", TrimLines("", 3, true))
+}
+
+func TestBuildCommandPowerShell(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	_, err := buildCommand("Write-Output hi", types.DocciOpts{PowerShell: true})
+	require.ErrorContains(t, err, "pwsh not found; --powershell requires PowerShell 7+")
+
+	_, err = buildCommand("Write-Output hi", types.DocciOpts{PowerShell: true, ContainerImage: "alpine"})
+	require.ErrorContains(t, err, "PowerShell scripts only run locally")
+
+	// a bash stand-in shows the script is passed with -Command
+	shell := filepath.Join(t.TempDir(), "pwsh")
+	require.NoError(t, os.WriteFile(shell, []byte("#!/bin/sh\necho \"$@\"\n"), 0755))
+	cmd, err := buildCommand("Write-Output hi", types.DocciOpts{PowerShell: true, Shell: shell})
+	require.NoError(t, err)
+	require.Equal(t, []string{shell, "-NoProfile", "-NonInteractive", "-Command", "Write-Output hi"}, cmd.Args)
+}
+
+func TestParseBlockOutputsCRLF(t *testing.T) {
+	// PowerShell on Windows writes \r\n line endings
+	output := "### DOCCI_BLOCK_START_1 ###\r\nhello\r\n### DOCCI_BLOCK_END_1 ###\r\n"
+	require.Equal(t, map[int]string{1: "hello"}, ParseBlockOutputs(output, nil))
+}
+
+func TestParseBlockStderr(t *testing.T) {
+	stderr := "### DOCCI_BLOCK_START_1 ###\nExecuting CMD: echo oops >&2\noops\n### DOCCI_BLOCK_END_1 ###\n"
+	require.Equal(t, map[int]string{1: "oops"}, ParseBlockStderr(stderr, nil))
+}
+
+func TestBuildCommandShell(t *testing.T) {
+	// bash missing from PATH is reported before anything starts
+	t.Setenv("PATH", t.TempDir())
+	_, err := buildCommand("echo hi", types.DocciOpts{})
+	require.ErrorContains(t, err, "bash not found; docci requires bash")
+
+	resp, err := Exec("echo hi")
+	require.ErrorContains(t, err, "bash not found")
+	require.Empty(t, resp.Stdout)
+
+	// --shell points at a bash outside PATH
+	bash := "/bin/bash"
+	if _, err := os.Stat(bash); err != nil {
+		t.Skip("no /bin/bash")
+	}
+	cmd, err := buildCommand("echo hi", types.DocciOpts{Shell: bash})
+	require.NoError(t, err)
+	require.Equal(t, []string{bash, "-c", "echo hi"}, cmd.Args)
+
+	_, err = buildCommand("echo hi", types.DocciOpts{Shell: "/does/not/exist/bash"})
+	require.ErrorContains(t, err, "/does/not/exist/bash not found")
+}
+
+func TestExecStartFailure(t *testing.T) {
+	// an executable file that is not a valid program passes the lookup but fails to start
+	shell := filepath.Join(t.TempDir(), "bash")
+	require.NoError(t, os.WriteFile(shell, []byte{0x00, 0x01, 0x02}, 0755))
+
+	for _, opts := range []types.DocciOpts{{Shell: shell}, {Shell: shell, MergeOutput: true}} {
+		resp, err := ExecWithOptions("echo hi", opts)
+		require.ErrorContains(t, err, "start command")
+		require.Equal(t, err, resp.Error)
+		require.Equal(t, uint(1), resp.ExitCode)
+	}
+}
@@ -0,0 +1,179 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// LoadExpectedJSON reads a docci-assert-json-equals-file file, so one that is not JSON is reported
+// before anything runs
+func LoadExpectedJSON(path string) (any, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read expected JSON %s: %w", path, err)
+	}
+	defer file.Close()
+	value, err := decodeJSON(file)
+	if err != nil {
+		return nil, fmt.Errorf("expected JSON %s: %w", path, err)
+	}
+	return value, nil
+}
+
+// ValidateJSONEquals parses each block's output as JSON and compares it with the JSON file in
+// files, keyed by block index. Object keys may be in any order; the first difference is reported
+// with the path of the field it is in.
+func ValidateJSONEquals(blockOutputs map[int]string, files map[int]string) []*ValidationError {
+	var indexes []int
+	for blockIndex := range files {
+		indexes = append(indexes, blockIndex)
+	}
+	sort.Ints(indexes)
+
+	var errors []*ValidationError
+	for _, blockIndex := range indexes {
+		path := files[blockIndex]
+		output, exists := blockOutputs[blockIndex]
+		if !exists {
+			errors = append(errors, &ValidationError{BlockIndex: blockIndex, Missing: true})
+			continue
+		}
+		if diff := jsonEqualsProblem(output, path); diff != "" {
+			errors = append(errors, &ValidationError{BlockIndex: blockIndex, Actual: output, JSONFile: path, JSONDiff: diff})
+		}
+	}
+	return errors
+}
+
+// jsonEqualsProblem returns the first difference between output and the JSON in the file at path,
+// "" when they are equal
+func jsonEqualsProblem(output string, path string) string {
+	expected, err := LoadExpectedJSON(path)
+	if err != nil {
+		return err.Error()
+	}
+	actual, err := decodeJSON(strings.NewReader(output))
+	if err != nil {
+		return fmt.Sprintf("output %v", err)
+	}
+	return jsonDiff("", expected, actual)
+}
+
+// decodeJSON reads exactly one JSON value. Numbers stay json.Number so they compare exactly.
+func decodeJSON(r io.Reader) (any, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("is not valid JSON: %w", err)
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("has more than one JSON value")
+	}
+	return value, nil
+}
+
+// jsonDiff returns the first place actual differs from expected as "path: message", or "" when
+// they are equal. Objects are walked in sorted key order so the result does not depend on either
+// side's key order. Numbers are equal when their values are, so 1.0 equals 1.
+func jsonDiff(path string, expected, actual any) string {
+	location := path
+	if location == "" {
+		location = "/"
+	}
+	if jsonType(expected) != jsonType(actual) {
+		return fmt.Sprintf("%s: expected %s %s, got %s %s", location, jsonType(expected), jsonText(expected), jsonType(actual), jsonText(actual))
+	}
+
+	switch want := expected.(type) {
+	case map[string]any:
+		got := actual.(map[string]any)
+		keys := make([]string, 0, len(want)+len(got))
+		for key := range want {
+			keys = append(keys, key)
+		}
+		for key := range got {
+			if _, ok := want[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			keyPath := path + "/" + escapeJSONPointer(key)
+			wantValue, inWant := want[key]
+			gotValue, inGot := got[key]
+			switch {
+			case !inGot:
+				return fmt.Sprintf("%s: missing, expected %s", keyPath, jsonText(wantValue))
+			case !inWant:
+				return fmt.Sprintf("%s: unexpected field with %s", keyPath, jsonText(gotValue))
+			}
+			if diff := jsonDiff(keyPath, wantValue, gotValue); diff != "" {
+				return diff
+			}
+		}
+	case []any:
+		got := actual.([]any)
+		for i := 0; i < min(len(want), len(got)); i++ {
+			if diff := jsonDiff(path+"/"+strconv.Itoa(i), want[i], got[i]); diff != "" {
+				return diff
+			}
+		}
+		if len(want) != len(got) {
+			return fmt.Sprintf("%s: expected %d elements, got %d", location, len(want), len(got))
+		}
+	case json.Number:
+		wantRat, wantOK := new(big.Rat).SetString(want.String())
+		gotRat, gotOK := new(big.Rat).SetString(actual.(json.Number).String())
+		if !wantOK || !gotOK || wantRat.Cmp(gotRat) != 0 {
+			return fmt.Sprintf("%s: expected %s, got %s", location, want, actual)
+		}
+	default:
+		if expected != actual {
+			return fmt.Sprintf("%s: expected %s, got %s", location, jsonText(expected), jsonText(actual))
+		}
+	}
+	return ""
+}
+
+// jsonType names the JSON type of a decoded value
+func jsonType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// jsonText formats a decoded value as compact JSON for messages, cut short when long
+func jsonText(value any) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	const maxLen = 60
+	if len(data) > maxLen {
+		return string(data[:maxLen]) + "..."
+	}
+	return string(data)
+}
+
+// escapeJSONPointer escapes an object key for a JSON Pointer path like "/items/0/name"
+func escapeJSONPointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
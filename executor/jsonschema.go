@@ -0,0 +1,86 @@
+package executor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// CompileJSONSchema loads a docci-output-json-schema file, so a broken schema is reported before
+// anything runs
+func CompileJSONSchema(path string) (*jsonschema.Schema, error) {
+	schema, err := jsonschema.Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("load JSON schema %s: %w", path, err)
+	}
+	return schema, nil
+}
+
+// ValidateJSONSchemas parses each block's output as JSON and checks it against the schema file in
+// schemas, keyed by block index. Every violation is listed with the path of the field it is about.
+func ValidateJSONSchemas(blockOutputs map[int]string, schemas map[int]string) []*ValidationError {
+	var indexes []int
+	for blockIndex := range schemas {
+		indexes = append(indexes, blockIndex)
+	}
+	sort.Ints(indexes)
+
+	var errors []*ValidationError
+	for _, blockIndex := range indexes {
+		path := schemas[blockIndex]
+		output, exists := blockOutputs[blockIndex]
+		if !exists {
+			errors = append(errors, &ValidationError{BlockIndex: blockIndex, Missing: true})
+			continue
+		}
+		if problems := jsonSchemaProblems(output, path); len(problems) > 0 {
+			errors = append(errors, &ValidationError{BlockIndex: blockIndex, Actual: output, Schema: path, SchemaErrors: problems})
+		}
+	}
+	return errors
+}
+
+// jsonSchemaProblems returns what is wrong with output according to the schema at path, nothing
+// when it conforms
+func jsonSchemaProblems(output string, path string) []string {
+	schema, err := CompileJSONSchema(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	// numbers stay exact, so large integers are not checked as floats
+	value, err := decodeJSON(strings.NewReader(output))
+	if err != nil {
+		return []string{fmt.Sprintf("output %v", err)}
+	}
+
+	err = schema.Validate(value)
+	if err == nil {
+		return nil
+	}
+	verr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return []string{err.Error()}
+	}
+	var problems []string
+	collectSchemaProblems(verr, &problems)
+	return problems
+}
+
+// collectSchemaProblems adds the leaves of a validation error tree, which are the actual
+// violations. The errors above them only say which part of the schema failed.
+func collectSchemaProblems(verr *jsonschema.ValidationError, problems *[]string) {
+	if len(verr.Causes) == 0 {
+		location := verr.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		*problems = append(*problems, location+": "+verr.Message)
+		return
+	}
+	for _, cause := range verr.Causes {
+		collectSchemaProblems(cause, problems)
+	}
+}
@@ -0,0 +1,68 @@
+package executor
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/reecepbcups/docci/logger"
+	"github.com/reecepbcups/docci/types"
+)
+
+// CountLines returns how many lines of output have something other than whitespace on them
+func CountLines(output string) int {
+	count := 0
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) != "" {
+			count++
+		}
+	}
+	return count
+}
+
+// ValidateLineCounts counts the non-empty lines of each block's output and compares the count with
+// the block's docci-assert-line-count expectation in counts, keyed by block index
+func ValidateLineCounts(blockOutputs map[int]string, counts map[int]types.LineCount) []*ValidationError {
+	var indexes []int
+	for blockIndex := range counts {
+		indexes = append(indexes, blockIndex)
+	}
+	sort.Ints(indexes)
+
+	var errors []*ValidationError
+	for _, blockIndex := range indexes {
+		expected := counts[blockIndex]
+		output, exists := blockOutputs[blockIndex]
+		if !exists {
+			errors = append(errors, &ValidationError{BlockIndex: blockIndex, Missing: true})
+			continue
+		}
+		actual := CountLines(output)
+		if !compareCount(actual, expected.Op, expected.Count) {
+			logger.GetLogger().Error("Block validation failed: line count mismatch", "block", blockIndex, "op", expected.Op, "expected", expected.Count, "actual", actual)
+			errors = append(errors, &ValidationError{
+				BlockIndex:    blockIndex,
+				Actual:        output,
+				LineCountOp:   expected.Op,
+				ExpectedCount: expected.Count,
+				ActualCount:   actual,
+			})
+		}
+	}
+	return errors
+}
+
+// compareCount reports whether actual op expected holds
+func compareCount(actual int, op string, expected int) bool {
+	switch op {
+	case "<":
+		return actual < expected
+	case "<=":
+		return actual <= expected
+	case ">":
+		return actual > expected
+	case ">=":
+		return actual >= expected
+	default:
+		return actual == expected
+	}
+}
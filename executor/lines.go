@@ -0,0 +1,34 @@
+package executor
+
+import (
+	"sort"
+	"strings"
+)
+
+// SortLines sorts the lines of s so output printed in any order can be matched against a fixed
+// expectation. A trailing newline is kept at the end.
+func SortLines(s string) string {
+	trimmed := strings.TrimSuffix(s, "\n")
+	if trimmed == "" {
+		return s
+	}
+	lines := strings.Split(trimmed, "\n")
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + s[len(trimmed):]
+}
+
+// TrimLines keeps the first n lines of s, or the last n when fromEnd is set, so validation can
+// ignore progress output around a summary. A trailing newline is kept at the end.
+func TrimLines(s string, n int, fromEnd bool) string {
+	trimmed := strings.TrimSuffix(s, "\n")
+	lines := strings.Split(trimmed, "\n")
+	if trimmed == "" || len(lines) <= n {
+		return s
+	}
+	if fromEnd {
+		lines = lines[len(lines)-n:]
+	} else {
+		lines = lines[:n]
+	}
+	return strings.Join(lines, "\n") + s[len(trimmed):]
+}
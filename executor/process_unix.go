@@ -0,0 +1,31 @@
+//go:build !windows
+
+package executor
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the script in its own process group, so everything it started can be
+// stopped together
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// interruptProcessGroup passes a Ctrl-C on to the script's process group, which no longer gets
+// it from the terminal once it has its own group
+func interruptProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+}
+
+// terminateProcessGroup asks the script and everything it started to stop, which still runs the
+// script's cleanup trap
+func terminateProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+// killProcessGroup stops the script and everything it started right away
+func killProcessGroup(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package executor
+
+import "os/exec"
+
+// setProcessGroup is a no-op on Windows, where the script is stopped on its own
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// interruptProcessGroup is a no-op on Windows, where the script shares the console and gets
+// the Ctrl-C itself
+func interruptProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcessGroup stops the script
+func terminateProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// killProcessGroup stops the script
+func killProcessGroup(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,103 @@
+package executor
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync/atomic"
+	"time"
+
+	"github.com/reecepbcups/docci/logger"
+	"github.com/reecepbcups/docci/types"
+)
+
+const (
+	// hangWarningAfter is how long the script can go without output before docci warns that it
+	// may be waiting for input
+	hangWarningAfter = 30 * time.Second
+	// outputCheckInterval is how often the time since the last output is checked
+	outputCheckInterval = 500 * time.Millisecond
+	// killGracePeriod is how long a script stopped by --input-timeout gets to run its cleanup
+	// trap before it is killed
+	killGracePeriod = 5 * time.Second
+)
+
+// outputWatch tracks when the script last wrote a line, to catch commands that hang waiting for
+// input docci never gives them, like a sudo password prompt
+type outputWatch struct {
+	last     atomic.Int64 // unix nanoseconds of the last line
+	timedOut atomic.Bool  // the script was stopped by --input-timeout
+}
+
+func newOutputWatch() *outputWatch {
+	w := &outputWatch{}
+	w.seen()
+	return w
+}
+
+// seen records that the script wrote a line
+func (w *outputWatch) seen() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+// run checks the script until stop is closed. When stdin is not a terminal, a script that goes
+// quiet for hangWarningAfter gets a warning, once per quiet spell. With opts.InputTimeoutSecs the
+// script is stopped once it has been quiet that long.
+func (w *outputWatch) run(cmd *exec.Cmd, opts types.DocciOpts, stop <-chan struct{}) {
+	log := logger.GetLogger()
+	ticker := time.NewTicker(outputCheckInterval)
+	defer ticker.Stop()
+
+	// the script has its own process group with --input-timeout, so Ctrl-C is passed on by hand
+	var interrupts chan os.Signal
+	if opts.InputTimeoutSecs > 0 {
+		interrupts = make(chan os.Signal, 1)
+		signal.Notify(interrupts, os.Interrupt)
+		defer signal.Stop(interrupts)
+	}
+
+	warn := !StdinIsTerminal()
+	timeout := time.Duration(opts.InputTimeoutSecs) * time.Second
+	var warnedAt int64
+	var killAt time.Time
+	for {
+		select {
+		case <-stop:
+			return
+		case <-interrupts:
+			interruptProcessGroup(cmd)
+		case now := <-ticker.C:
+			last := w.last.Load()
+			quiet := now.Sub(time.Unix(0, last))
+
+			if w.timedOut.Load() {
+				if now.After(killAt) {
+					killProcessGroup(cmd)
+				}
+				continue
+			}
+			if timeout > 0 && quiet >= timeout {
+				log.Error("No output, stopping the run (--input-timeout). A command may be waiting for input, like a sudo password prompt", "seconds", opts.InputTimeoutSecs)
+				w.timedOut.Store(true)
+				killAt = now.Add(killGracePeriod)
+				terminateProcessGroup(cmd)
+				continue
+			}
+			if warn && quiet >= hangWarningAfter && warnedAt != last {
+				warnedAt = last
+				log.Warn("No output for a while, possible hang: waiting on input? Use --input-timeout to stop the run instead of waiting", "seconds", int(quiet.Seconds()))
+			}
+		}
+	}
+}
+
+// StdinIsTerminal reports whether docci's stdin is a terminal someone could answer a prompt on
+func StdinIsTerminal() bool {
+	stat, err := os.Stdin.Stat()
+	if err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// /dev/null is also a character device (e.g. CI or `go test`)
+	devNull, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(stat, devNull)
+}
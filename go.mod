@@ -3,6 +3,7 @@ module github.com/reecepbcups/docci
 go 1.23.7
 
 require (
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
 	github.com/spf13/cobra v1.9.1
 	github.com/stretchr/testify v1.10.0
 	golang.org/x/mod v0.26.0
@@ -0,0 +1,33 @@
+// Package hooks lets programs embedding docci observe a run as its results are processed.
+package hooks
+
+// BlockInfo describes the code block an event is about
+type BlockInfo struct {
+	Index      int    // global block index, matching the DOCCI_BLOCK markers
+	Language   string // language from the fence (bash, sh, shell)
+	FileName   string // source markdown file name, empty for single-file runs
+	LineNumber int    // line of the opening fence
+	Content    string // the block's commands
+	Background bool   // block ran with docci-background, so its output is in the background logs
+}
+
+// Hooks receives events for each block of a run. Since docci executes every block as a
+// single script, events fire in block order while the script's output is processed,
+// after execution has finished.
+type Hooks interface {
+	// OnBlockStart is called before the block's result is reported
+	OnBlockStart(block BlockInfo)
+	// OnBlockEnd is called with the block's captured output and the error that failed it, if any
+	OnBlockEnd(block BlockInfo, output string, err error)
+	// OnValidationFailure is called for each output check the block failed, like docci-output-contains
+	// or docci-assert-line-count. expected is the text the check looked for, empty for checks
+	// without one such as docci-output-json-schema; the error passed to OnBlockEnd has the details.
+	OnValidationFailure(block BlockInfo, expected string, actual string)
+}
+
+// NoopHooks implements Hooks with empty methods. Embed it to only implement the events you need.
+type NoopHooks struct{}
+
+func (NoopHooks) OnBlockStart(BlockInfo)                        {}
+func (NoopHooks) OnBlockEnd(BlockInfo, string, error)           {}
+func (NoopHooks) OnValidationFailure(BlockInfo, string, string) {}
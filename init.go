@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/reecepbcups/docci/parser"
+)
+
+const (
+	initMarkdownFile = "doc.md"
+	initConfigFile   = "docci.json"
+)
+
+// initMarkdownTemplate is the sample document written by `docci init`.
+// {{TAG_LIST}} is replaced with every supported tag so the sample stays in sync.
+const initMarkdownTemplate = "# My Docci Document\n" +
+	"\n" +
+	"Every `bash`, `sh` or `shell` code block in this file runs in order with `docci run doc.md`.\n" +
+	"Tags after the language control how a block runs.\n" +
+	"\n" +
+	"## Validate output\n" +
+	"\n" +
+	"`docci-output-contains` fails the run if the block's output does not contain the text.\n" +
+	"\n" +
+	"```bash docci-output-contains=\"Hello from docci\"\n" +
+	"echo \"Hello from docci\"\n" +
+	"```\n" +
+	"\n" +
+	"## Run a service in the background\n" +
+	"\n" +
+	"`docci-background` starts the block without waiting for it. Its logs are shown at the end of the run.\n" +
+	"\n" +
+	"```bash docci-background\n" +
+	"for i in 1 2 3; do\n" +
+	"  echo \"background tick $i\"\n" +
+	"  sleep 1\n" +
+	"done\n" +
+	"```\n" +
+	"\n" +
+	"## Retry flaky commands\n" +
+	"\n" +
+	"`docci-retry` re-runs a failing block up to N more times.\n" +
+	"\n" +
+	"```bash docci-retry=2\n" +
+	"echo \"this succeeds on the first attempt\"\n" +
+	"```\n" +
+	"\n" +
+	"## Expect a failure\n" +
+	"\n" +
+	"`docci-assert-failure` documents a command that is supposed to fail.\n" +
+	"\n" +
+	"```bash docci-assert-failure\n" +
+	"ls /this/path/does/not/exist\n" +
+	"```\n" +
+	"\n" +
+	"## Skip a block\n" +
+	"\n" +
+	"`docci-ignore` shows a command to readers without running it.\n" +
+	"\n" +
+	"```bash docci-ignore\n" +
+	"npm install -g some-cli-you-already-have\n" +
+	"```\n" +
+	"\n" +
+	"## All available tags\n" +
+	"\n" +
+	"{{TAG_LIST}}"
+
+// sampleMarkdown returns the sample document with the current tag list filled in
+func sampleMarkdown() string {
+	var tagList strings.Builder
+	for _, tag := range parser.GetAllTagsInfo() {
+		tagList.WriteString(fmt.Sprintf("- `%s`: %s\n", tag.Name, tag.Description))
+	}
+	return strings.ReplaceAll(initMarkdownTemplate, "{{TAG_LIST}}", tagList.String())
+}
+
+// writeInitFiles scaffolds a sample document (and optionally a config file) in dir.
+// Existing files are only overwritten when force is set. Returns the paths written.
+func writeInitFiles(dir string, force bool, withConfig bool) ([]string, error) {
+	files := map[string][]byte{
+		initMarkdownFile: []byte(sampleMarkdown()),
+	}
+	order := []string{initMarkdownFile}
+
+	if withConfig {
+		config, err := json.MarshalIndent(DocciConfig{Files: []string{initMarkdownFile}}, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("marshal config: %w", err)
+		}
+		files[initConfigFile] = append(config, '\n')
+		order = append(order, initConfigFile)
+	}
+
+	// Check everything first so nothing is written when one file already exists
+	if !force {
+		for _, name := range order {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return nil, fmt.Errorf("%s already exists, use --force to overwrite", path)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create directory %s: %w", dir, err)
+	}
+
+	var written []string
+	for _, name := range order {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, files[name], 0644); err != nil {
+			return written, fmt.Errorf("write %s: %w", path, err)
+		}
+		written = append(written, path)
+	}
+	return written, nil
+}
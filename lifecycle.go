@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/reecepbcups/docci/logger"
+	"github.com/reecepbcups/docci/types"
+)
+
+// runWithLifecycle wraps a run in what opts asks for around it: the log level is applied for the
+// run, and the pre-commands run before it; the on-failure and cleanup commands run after it with
+// the result in their environment. The process's own directory is never changed. With a working
+// directory, filePaths are made absolute and opts.WorkingDir is passed on to run as an absolute
+// path, for the script and the commands to run in.
+func runWithLifecycle(filePaths []string, opts types.DocciOpts, run func(filePaths []string, opts types.DocciOpts) DocciResult) DocciResult {
+	// the caller's logger is put back once the run is over
+	if opts.LogLevel != "" {
+		previous := logger.GetLogger()
+		logger.SetLogLevel(opts.LogLevel)
+		defer logger.SetLogger(previous)
+	}
+	log := logger.GetLogger()
+
+	if opts.WorkingDir != "" {
+		// file paths stay relative to the caller's directory, not the one the commands run in
+		absPaths := make([]string, 0, len(filePaths))
+		for _, filePath := range filePaths {
+			absPath, err := filepath.Abs(filePath)
+			if err != nil {
+				return lifecycleError(fmt.Errorf("resolve absolute path for %s: %w", filePath, err))
+			}
+			absPaths = append(absPaths, absPath)
+		}
+		filePaths = absPaths
+
+		dir, err := runDir(opts.WorkingDir)
+		if err != nil {
+			return lifecycleError(err)
+		}
+		opts.WorkingDir = dir
+		log.Info("running in working directory", "dir", dir)
+	}
+
+	// Context about the run, exported to pre/cleanup/on-failure commands
+	env, err := runEnv(filePaths, opts.WorkingDir)
+	if err != nil {
+		return lifecycleError(err)
+	}
+	shell := hookShell(opts)
+
+	if len(opts.PreCommands) > 0 {
+		log.Debug("running pre-commands")
+		runPreCommands(opts.PreCommands, env, shell, opts.WorkingDir)
+	}
+
+	result := run(filePaths, opts)
+
+	// Run failure hooks before cleanup so they can still inspect the environment
+	if !result.Success && len(opts.OnFailureCommands) > 0 {
+		log.Debug("running on-failure commands")
+		runOnFailureCommands(opts.OnFailureCommands, append(env, failureEnv(result)...), shell, opts.WorkingDir)
+	}
+
+	// Run cleanup commands if provided, leaving state behind on success when asked to
+	if len(opts.CleanupCommands) > 0 {
+		if opts.SkipCleanupOnSuccess && result.Success {
+			log.Info("Skipping cleanup commands after a successful run (--skip-cleanup-on-success)")
+		} else {
+			log.Debug("running cleanup commands")
+			runCleanupCommands(opts.CleanupCommands, append(env, resultEnv(result)...), shell, opts.WorkingDir)
+		}
+	}
+	return result
+}
+
+// runDir returns the absolute path of the directory a run's commands run in, and errors if it is
+// not an existing directory
+func runDir(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("resolve run directory %s: %w", dir, err)
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", fmt.Errorf("run directory not found: %s", dir)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("run directory is not a directory: %s", dir)
+	}
+	return abs, nil
+}
+
+// lifecycleError is the result of a run that could not be set up, which like a parse error is
+// caught before anything runs
+func lifecycleError(err error) DocciResult {
+	logger.GetLogger().Error("Failed to set up the run", "error", err.Error())
+	return DocciResult{
+		Success:  false,
+		ExitCode: ExitCodeParseError,
+		Stderr:   fmt.Sprintf("Error setting up the run: %s", err.Error()),
+	}
+}
+
+// runEnv describes the run as DOCCI_* environment variables for pre/cleanup commands. dir is the
+// working directory the commands run in, the process's own when empty.
+func runEnv(filePaths []string, dir string) ([]string, error) {
+	if dir == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get working directory: %w", err)
+		}
+		dir = wd
+	}
+	return []string{
+		"DOCCI_FILES=" + strings.Join(filePaths, ","),
+		"DOCCI_WORKING_DIR=" + dir,
+	}, nil
+}
+
+// resultEnv describes the outcome of a run for cleanup commands
+func resultEnv(result DocciResult) []string {
+	return append([]string{
+		"DOCCI_SUCCESS=" + strconv.FormatBool(result.Success),
+		"DOCCI_EXIT_CODE=" + strconv.Itoa(result.ExitCode),
+	}, outputEnv(result)...)
+}
+
+// outputEnv returns the docci-output-to-env variables of a run, sorted by name
+func outputEnv(result DocciResult) []string {
+	names := make([]string, 0, len(result.OutputEnv))
+	for name := range result.OutputEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	env := make([]string, 0, len(names))
+	for _, name := range names {
+		env = append(env, name+"="+result.OutputEnv[name])
+	}
+	return env
+}
+
+// hookShell is the shell pre, cleanup and on-failure commands run in: opts.Shell, pwsh for
+// PowerShell runs, or bash from PATH
+func hookShell(opts types.DocciOpts) string {
+	if opts.Shell != "" {
+		return opts.Shell
+	}
+	if opts.PowerShell {
+		return "pwsh"
+	}
+	return "bash"
+}
+
+func runPreCommands(commands []string, env []string, shell string, dir string) error {
+	log := logger.GetLogger()
+	log.Info("Running pre-commands")
+	for _, command := range commands {
+		log.Info("Running", "command", command)
+
+		// Create command
+		cmd := exec.Command(shell, "-c", command)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Dir = dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		// Run the command
+		if err := cmd.Run(); err != nil {
+			log.Warn("Pre-command failed (ignoring)", "command", command, "err", err)
+			// Continue with other pre-commands even if one fails
+		}
+	}
+	log.Info("Pre-commands completed")
+	return nil
+}
+
+func runCleanupCommands(commands []string, env []string, shell string, dir string) {
+	log := logger.GetLogger()
+	log.Debug("Running cleanup commands")
+	for _, command := range commands {
+		log.Info("Running", "command", command)
+
+		// Create command
+		cmd := exec.Command(shell, "-c", command)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Dir = dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		// Run the command
+		if err := cmd.Run(); err != nil {
+			log.Error("Error running cleanup command", "command", command, "err", err)
+			// Continue with other cleanup commands even if one fails
+		}
+	}
+	log.Info("Cleanup complete")
+}
+
+// runOnFailureCommands runs the --on-failure commands in dir with details of the failure in env
+func runOnFailureCommands(commands []string, env []string, shell string, dir string) {
+	log := logger.GetLogger()
+	env = append(os.Environ(), env...)
+	for _, command := range commands {
+		log.Info("Running on-failure", "command", command)
+
+		cmd := exec.Command(shell, "-c", command)
+		cmd.Env = env
+		cmd.Dir = dir
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			log.Error("Error running on-failure command", "command", command, "err", err)
+			// Continue with other commands even if one fails
+		}
+	}
+}
+
+// failureEnv describes a failed run as DOCCI_* environment variables for --on-failure commands.
+// The block variables are empty when the failure is not tied to a block (e.g. a parse error).
+func failureEnv(result DocciResult) []string {
+	var block, file, line string
+	switch {
+	case result.ExecError != nil && result.ExecError.Block > 0:
+		block = strconv.Itoa(result.ExecError.Block)
+		file = result.ExecError.File
+		if result.ExecError.Line > 0 {
+			line = strconv.Itoa(result.ExecError.Line)
+		}
+	case len(result.ValidationErrors) > 0:
+		verr := result.ValidationErrors[0]
+		block = strconv.Itoa(verr.BlockIndex)
+		file = verr.File
+		if verr.Line > 0 {
+			line = strconv.Itoa(verr.Line)
+		}
+	}
+	return append([]string{
+		"DOCCI_EXIT_CODE=" + strconv.Itoa(result.ExitCode),
+		"DOCCI_FAILED_BLOCK=" + block,
+		"DOCCI_FAILED_FILE=" + file,
+		"DOCCI_FAILED_LINE=" + line,
+	}, outputEnv(result)...)
+}
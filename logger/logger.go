@@ -6,8 +6,20 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"sync"
 )
 
+// current is the logger GetLogger returns. It is swapped by SetLogLevel and SetLogger while blocks
+// may be logging from other goroutines, so it is only accessed under mu.
+var (
+	mu      sync.RWMutex
+	current *slog.Logger
+)
+
+// Logger is the shared logger as last set by SetLogLevel or SetLogger.
+//
+// Deprecated: reading it is not safe while blocks are logging and assigning it has no effect. Use
+// GetLogger and SetLogger instead.
 var Logger *slog.Logger
 
 // ANSI color codes
@@ -22,6 +34,7 @@ const (
 type ColorHandler struct {
 	out   io.Writer
 	level slog.Leveler
+	mu    *sync.Mutex // serializes writes so concurrent records do not interleave
 }
 
 func (h *ColorHandler) Enabled(_ context.Context, level slog.Level) bool {
@@ -57,6 +70,8 @@ func (h *ColorHandler) Handle(_ context.Context, r slog.Record) error {
 		return true
 	})
 
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	fmt.Fprintf(h.out, "%s%s%s(%s) %s%s\n",
 		levelColor, levelStr, colorReset, timeStr, r.Message, attrs)
 	return nil
@@ -71,15 +86,17 @@ func (h *ColorHandler) WithGroup(name string) slog.Handler {
 }
 
 func newColorHandler(out io.Writer, level slog.Leveler) *ColorHandler {
-	return &ColorHandler{out: out, level: level}
+	return &ColorHandler{out: out, level: level, mu: &sync.Mutex{}}
 }
 
 func init() {
-	Logger = slog.New(newColorHandler(os.Stderr, slog.LevelInfo))
+	current = slog.New(newColorHandler(os.Stderr, slog.LevelInfo))
+	Logger = current
 }
 
-// SetLogLevel sets the logging level based on a string
-func SetLogLevel(level string) {
+// New returns a logger writing colored records at the given level ("debug", "info", "warn",
+// "error" or "off") to out, without touching the shared logger
+func New(level string, out io.Writer) *slog.Logger {
 	var lvl slog.Level
 	switch level {
 	case "debug":
@@ -91,20 +108,34 @@ func SetLogLevel(level string) {
 	case "error", "fatal", "panic":
 		lvl = slog.LevelError
 	case "off", "none":
-		Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
-		return
+		return slog.New(slog.NewTextHandler(io.Discard, nil))
 	default:
 		lvl = slog.LevelInfo
 	}
-	Logger = slog.New(newColorHandler(os.Stderr, lvl))
+	return slog.New(newColorHandler(out, lvl))
+}
+
+// SetLogLevel sets the logging level based on a string
+func SetLogLevel(level string) {
+	SetLogger(New(level, os.Stderr))
+}
+
+// SetLogger replaces the shared logger, e.g. so a program embedding docci can route its logs
+func SetLogger(l *slog.Logger) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = l
+	Logger = l
 }
 
 // GetLogger returns the configured logger instance
 func GetLogger() *slog.Logger {
-	return Logger
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
 }
 
 // IsDebugEnabled returns true if debug level logging is enabled
 func IsDebugEnabled() bool {
-	return Logger.Enabled(context.Background(), slog.LevelDebug)
+	return GetLogger().Enabled(context.Background(), slog.LevelDebug)
 }
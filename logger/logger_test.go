@@ -0,0 +1,49 @@
+package logger
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	var out strings.Builder
+	l := New("warn", &out)
+	l.Info("hidden")
+	l.Warn("shown", "key", "value")
+	require.NotContains(t, out.String(), "hidden")
+	require.Contains(t, out.String(), "shown key=value")
+}
+
+// Run with -race: the shared logger is swapped while other goroutines log through it
+func TestConcurrentSetLogLevel(t *testing.T) {
+	defer SetLogLevel("info")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			SetLogLevel("off")
+		}()
+		go func() {
+			defer wg.Done()
+			GetLogger().Debug("concurrent")
+			_ = IsDebugEnabled()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDeprecatedLoggerFollowsSetLogger(t *testing.T) {
+	defer SetLogLevel("info")
+	require.Same(t, GetLogger(), Logger)
+
+	var out strings.Builder
+	SetLogger(New("info", &out))
+	require.Same(t, GetLogger(), Logger)
+	Logger.Info("through the old variable")
+	require.Contains(t, out.String(), "through the old variable")
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/reecepbcups/docci/logger"
@@ -17,14 +21,54 @@ import (
 var (
 	version            = "dev"
 	logLevel           string
+	noDeprecationWarns bool
 	preCommands        []string
 	cleanupCommands    []string
+	onFailureCommands  []string
 	hideBackgroundLogs bool
 	workingDir         string
 	keepRunning        bool
 	debugMode          bool
+	assumeYes          bool
+	verbose            bool
+	containerImage     string
+	remoteHost         string
+	printScriptOnFail  bool
+	keepTempFiles      bool
+	mergeOutput        bool
+	artifactDir        string
+	fixTypography      bool
+	stripANSI          bool
+	forceColor         bool
+	noColor            bool
+	sandbox            bool
+	baseURL            string
+	shell              string
+	powerShell         bool
+	maxRetriesGlobal   int
+	retryAll           int
+	outputFormat       string
+	stepMode           bool
+	perBlock           bool
+	inputTimeout       int
+	allowClear         bool
+	summaryOnly        bool
+	initForce          bool
+	tagsUsedJSON       bool
+	renderOutput       string
+	injectBlock        int
+	injectTag          string
+	initConfig         bool
+
+	skipCleanupOnSuccess bool
 )
 
+// parseError is a run error found before any block runs, such as a bad flag or a missing file.
+// docci exits with ExitCodeParseError for it, like for a document it cannot parse.
+type parseError struct{ error }
+
+func (e parseError) Unwrap() error { return e.error }
+
 // DocciConfig represents the JSON configuration file format
 type DocciConfig struct {
 	Files []string `json:"files"`
@@ -37,6 +81,9 @@ var rootCmd = &cobra.Command{
 in markdown files and validates their outputs.
 
 It helps ensure your documentation examples are always accurate and working.`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		parser.SetDeprecationWarnings(!noDeprecationWarns)
+	},
 }
 
 var runCmd = &cobra.Command{
@@ -77,7 +124,7 @@ File paths in the JSON config are resolved relative to the config file's locatio
 		for i, filePath := range filePaths {
 			absPath, err := filepath.Abs(filePath)
 			if err != nil {
-				return fmt.Errorf("failed to resolve absolute path for %s: %w", filePath, err)
+				return parseError{fmt.Errorf("failed to resolve absolute path for %s: %w", filePath, err)}
 			}
 			filePaths[i] = absPath
 		}
@@ -85,19 +132,46 @@ File paths in the JSON config are resolved relative to the config file's locatio
 		// Check if all files exist
 		for _, filePath := range filePaths {
 			if _, err := os.Stat(filePath); os.IsNotExist(err) {
-				return fmt.Errorf("file not found: %s", filePath)
+				return parseError{fmt.Errorf("file not found: %s", filePath)}
 			}
 		}
 
-		// Validate and change working directory if workingDir is specified
-		if workingDir != "" {
-			if _, err := os.Stat(workingDir); os.IsNotExist(err) {
-				return fmt.Errorf("run directory not found: %s", workingDir)
-			}
-			if err := os.Chdir(workingDir); err != nil {
-				return fmt.Errorf("failed to change to run directory %s: %w", workingDir, err)
+		if forceColor && noColor {
+			return parseError{fmt.Errorf("--force-color and --no-color cannot be used together")}
+		}
+		if baseURL != "" {
+			if u, err := url.Parse(baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return parseError{fmt.Errorf("--base-url must be an http(s) URL, got: %s", baseURL)}
 			}
-			log.Info("changed working directory", "dir", workingDir)
+		}
+		// the sandbox is removed when the script exits, which would pull it out from under kept processes
+		if sandbox && keepRunning {
+			return parseError{fmt.Errorf("--sandbox and --keep-running cannot be used together")}
+		}
+
+		// the PowerShell script only has output markers, the rest of these are written in bash
+		if powerShell && (sandbox || keepRunning || containerImage != "" || remoteHost != "") {
+			return parseError{fmt.Errorf("--powershell cannot be used with --sandbox, --keep-running, --container or --remote")}
+		}
+
+		// each block is its own bash script run locally, which these options work against
+		if (perBlock || stepMode) && (sandbox || keepRunning || powerShell || containerImage != "" || remoteHost != "") {
+			return parseError{fmt.Errorf("--per-block and --step cannot be used with --sandbox, --keep-running, --powershell, --container or --remote")}
+		}
+
+		format, err := resolveOutputFormat(outputFormat)
+		if err != nil {
+			return parseError{err}
+		}
+
+		if maxRetriesGlobal < 0 {
+			return parseError{fmt.Errorf("--max-retries-global must not be negative, got: %d", maxRetriesGlobal)}
+		}
+		if retryAll < 0 {
+			return parseError{fmt.Errorf("--retry-all must not be negative, got: %d", retryAll)}
+		}
+		if inputTimeout < 0 {
+			return parseError{fmt.Errorf("--input-timeout must not be negative, got: %d", inputTimeout)}
 		}
 
 		if len(filePaths) == 1 {
@@ -106,18 +180,45 @@ File paths in the JSON config are resolved relative to the config file's locatio
 			log.Info("running docci", "count", len(filePaths), "files", strings.Join(filePaths, ", "))
 		}
 
-		// Run pre-commands if provided
-		if len(preCommands) > 0 {
-			log.Debug("running pre-commands")
-			runPreCommands(preCommands)
-		}
-
 		// Run the docci command with merged files or single file
-
 		opts := types.DocciOpts{
 			HideBackgroundLogs: hideBackgroundLogs,
 			KeepRunning:        keepRunning,
 			DebugMode:          debugMode,
+			AssumeYes:          assumeYes,
+			Verbose:            verbose,
+			ContainerImage:     containerImage,
+			RemoteHost:         remoteHost,
+			PrintScriptOnFail:  printScriptOnFail,
+			KeepTempFiles:      keepTempFiles,
+			MergeOutput:        mergeOutput,
+			ArtifactDir:        artifactDir,
+			FixTypography:      fixTypography,
+			MaxRetriesGlobal:   maxRetriesGlobal,
+			RetryAll:           retryAll,
+			StripANSI:          stripANSI,
+			ForceColor:         forceColor,
+			NoColor:            noColor,
+			Sandbox:            sandbox,
+			BaseURL:            baseURL,
+			Shell:              shell,
+			PowerShell:         powerShell,
+			PerBlock:           perBlock,
+			Step:               stepMode,
+			InputTimeoutSecs:   inputTimeout,
+			AllowClear:         allowClear,
+
+			LogLevel:             logLevel,
+			WorkingDir:           workingDir,
+			PreCommands:          preCommands,
+			CleanupCommands:      cleanupCommands,
+			OnFailureCommands:    onFailureCommands,
+			SkipCleanupOnSuccess: skipCleanupOnSuccess,
+		}
+		// The blocks' output is kept in the result and only shown for the files that failed
+		if summaryOnly {
+			opts.Stdout = io.Discard
+			opts.Stderr = io.Discard
 		}
 
 		var result DocciResult
@@ -138,9 +239,9 @@ File paths in the JSON config are resolved relative to the config file's locatio
 			hasValidations := false
 			if len(filePaths) == 1 {
 				markdown, _ := os.ReadFile(filePaths[0])
-				blocks, _ := parser.ParseCodeBlocks(string(markdown))
+				blocks, _, _ := parser.ParseCodeBlocksWithOptions(string(markdown), filePaths[0], "", opts)
 				for _, block := range blocks {
-					if block.OutputContains != "" {
+					if block.OutputContains != "" || block.OutputCount != nil {
 						hasValidations = true
 						break
 					}
@@ -149,9 +250,9 @@ File paths in the JSON config are resolved relative to the config file's locatio
 				// For multiple files, check if any had validations
 				for _, filePath := range filePaths {
 					markdown, _ := os.ReadFile(filePath)
-					blocks, _ := parser.ParseCodeBlocks(string(markdown))
+					blocks, _, _ := parser.ParseCodeBlocksWithOptions(string(markdown), filePath, "", opts)
 					for _, block := range blocks {
-						if block.OutputContains != "" {
+						if block.OutputContains != "" || block.OutputCount != nil {
 							hasValidations = true
 							break
 						}
@@ -166,10 +267,31 @@ File paths in the JSON config are resolved relative to the config file's locatio
 			}
 		}
 
-		// Run cleanup commands if provided
-		if len(cleanupCommands) > 0 {
-			log.Debug("running cleanup commands")
-			runCleanupCommands(cleanupCommands)
+		// Say which blocks never ran because of docci-ignore, OS or install checks
+		if summary := skipSummary(result); summary != "" {
+			log.Info(summary)
+			for _, block := range result.Skipped {
+				attrs := []any{"line", block.LineNumber, "reason", block.SkipReason}
+				if block.FileName != "" {
+					attrs = append([]any{"file", block.FileName}, attrs...)
+				}
+				if verbose {
+					log.Info("Skipped block", attrs...)
+				} else {
+					log.Debug("Skipped block", attrs...)
+				}
+			}
+		}
+
+		if summaryOnly {
+			printRunSummary(os.Stdout, result)
+		}
+
+		// Point GitHub Actions at the failing blocks so they show up on the pull request
+		if format == outputGitHub {
+			for _, annotation := range githubAnnotations(result, filePaths) {
+				fmt.Println(annotation)
+			}
 		}
 
 		// Exit with error if command failed
@@ -253,7 +375,7 @@ var validateCmd = &cobra.Command{
 		}
 
 		// Parse code blocks
-		blocks, err := parser.ParseCodeBlocks(string(markdown))
+		blocks, _, err := parser.ParseCodeBlocksWithIncludes(string(markdown), filePath, "")
 		if err != nil {
 			return fmt.Errorf("error parsing code blocks: %w", err)
 		}
@@ -263,7 +385,7 @@ var validateCmd = &cobra.Command{
 		// Show block details at debug level
 		for i, block := range blocks {
 			log.Debug("Block details", "block", i+1, "language", block.Language, "background", block.Background)
-			if block.OutputContains != "" {
+			if block.OutputContains != "" || block.OutputCount != nil {
 				log.Debug("Expected output", "block", i+1, "output", block.OutputContains)
 			}
 		}
@@ -272,13 +394,223 @@ var validateCmd = &cobra.Command{
 	},
 }
 
+var checkCmd = &cobra.Command{
+	Use:   "check <markdown-file>",
+	Short: "Statically check a markdown file and report all issues",
+	Long: `Lint a markdown file without executing it. Unlike validate, check reports every issue at once:
+unknown tags, invalid tag combinations, malformed file paths and endpoint URLs, unusually high retry
+counts and background-kill references that do not resolve. Useful as a pre-commit hook.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// Initialize logging based on flags
+		if logLevel != "" {
+			logger.SetLogLevel(logLevel)
+		}
+
+		filePath := args[0]
+		log := logger.GetLogger()
+
+		markdown, err := os.ReadFile(filePath)
+		if err != nil {
+			return fmt.Errorf("error reading file: %w", err)
+		}
+
+		issues, err := parser.LintMarkdownWithIncludes(string(markdown), filePath)
+		if err != nil {
+			return err
+		}
+		if len(issues) == 0 {
+			log.Info("No issues found", "file", filePath)
+			return nil
+		}
+
+		for _, issue := range issues {
+			fmt.Printf("%s:%s\n", filePath, issue.String())
+		}
+		return fmt.Errorf("found %d issue(s) in %s", len(issues), filePath)
+	},
+}
+
+var tagsUsedCmd = &cobra.Command{
+	Use:   "tags-used <markdown-files|config.json>...",
+	Short: "Count how often each tag is used across markdown files",
+	Long: `Parse markdown files without executing them and report how many times each docci tag is used,
+including which aliases were written. Useful for planning deprecations and seeing which features
+a doc set depends on. Use --json for machine-readable output.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if logLevel != "" {
+			logger.SetLogLevel(logLevel)
+		}
+
+		var filePaths []string
+		for _, arg := range args {
+			filePaths = append(filePaths, parseFileList(arg)...)
+		}
+
+		counts := make(map[string]int)
+		for _, filePath := range filePaths {
+			markdown, err := os.ReadFile(filePath)
+			if err != nil {
+				return fmt.Errorf("error reading file: %w", err)
+			}
+			if err := parser.CountTagUsageWithIncludes(string(markdown), filePath, counts); err != nil {
+				return fmt.Errorf("%s: %w", filePath, err)
+			}
+		}
+		usage := parser.SummarizeTagUsage(counts)
+
+		if tagsUsedJSON {
+			out, err := json.MarshalIndent(map[string]any{"files": len(filePaths), "tags": usage}, "", "  ")
+			if err != nil {
+				return fmt.Errorf("encode tag usage: %w", err)
+			}
+			fmt.Println(string(out))
+			return nil
+		}
+
+		fmt.Printf("Tag usage across %d file(s):\n", len(filePaths))
+		if len(usage) == 0 {
+			fmt.Println("  no docci tags found")
+			return nil
+		}
+		width := 0
+		for _, u := range usage {
+			width = max(width, len(u.Tag))
+		}
+		for _, u := range usage {
+			fmt.Printf("  %-*s %d\n", width, u.Tag, u.Count)
+			aliases := make([]string, 0, len(u.Aliases))
+			for alias := range u.Aliases {
+				aliases = append(aliases, alias)
+			}
+			sort.Strings(aliases)
+			for _, alias := range aliases {
+				fmt.Printf("    as %s: %d\n", alias, u.Aliases[alias])
+			}
+		}
+		return nil
+	},
+}
+
+var renderCmd = &cobra.Command{
+	Use:   "render <markdown-file>",
+	Short: "Print a markdown file with the docci tags removed from its code fences",
+	Long: `Remove every docci tag from the code fences of a markdown file so it can be published,
+e.g. "` + "```bash docci-retry=2" + `" becomes "` + "```bash" + `". Everything else is kept as is.
+The result is printed to stdout, or written to --output.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		markdown, err := os.ReadFile(args[0])
+		if err != nil {
+			return fmt.Errorf("error reading file: %w", err)
+		}
+		rendered := parser.RenderMarkdown(string(markdown))
+
+		if renderOutput == "" {
+			fmt.Print(rendered)
+			return nil
+		}
+		if err := os.WriteFile(renderOutput, []byte(rendered), 0644); err != nil {
+			return fmt.Errorf("write rendered markdown: %w", err)
+		}
+		return nil
+	},
+}
+
+var injectCmd = &cobra.Command{
+	Use:   "inject <markdown-file>",
+	Short: "Add or update a tag on a code block's fence line",
+	Long: `Add a tag to the fence line of a code block, picked by its block number in the run
+(the N in "block N" of docci's output). A tag with the same name or alias already on the
+fence is replaced; the language and other tags are kept. The file is only rewritten when
+the result still parses.`,
+	Example: "  docci inject README.md --block 3 --tag docci-retry=3",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filePath := args[0]
+		markdown, err := os.ReadFile(filePath)
+		if err != nil {
+			return fmt.Errorf("error reading file: %w", err)
+		}
+		updated, err := parser.InjectTagWithIncludes(string(markdown), filePath, injectBlock, injectTag)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filePath, err)
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", filePath, err)
+		}
+		if err := os.WriteFile(filePath, []byte(updated), info.Mode().Perm()); err != nil {
+			return fmt.Errorf("write %s: %w", filePath, err)
+		}
+		fmt.Printf("Set %s on block %d of %s\n", injectTag, injectBlock, filePath)
+		return nil
+	},
+}
+
+var initCmd = &cobra.Command{
+	Use:   "init [directory]",
+	Short: "Scaffold an example docci markdown file",
+	Long: `Write a sample doc.md that demonstrates common docci tags, along with a list of every
+supported tag. Use --config to also write a docci.json config that can be passed to 'docci run'.
+Existing files are never overwritten unless --force is set.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if logLevel != "" {
+			logger.SetLogLevel(logLevel)
+		}
+
+		dir := "."
+		if len(args) == 1 {
+			dir = args[0]
+		}
+
+		written, err := writeInitFiles(dir, initForce, initConfig)
+		if err != nil {
+			return err
+		}
+
+		log := logger.GetLogger()
+		for _, path := range written {
+			log.Info("Created", "file", path)
+		}
+		log.Info("Try it out", "command", "docci run "+written[0])
+		return nil
+	},
+}
+
 var tagsCmd = &cobra.Command{
-	Use:   "tags",
+	Use:   "tags [tag]",
 	Short: "Display all available tags and their aliases",
-	Long:  `Show a comprehensive list of all docci tags, their aliases, descriptions, and usage examples.`,
-	Run: func(cmd *cobra.Command, args []string) {
+	Long: `Show a comprehensive list of all docci tags, their aliases, descriptions, and usage examples.
+Pass a tag name or alias to only show that tag.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
 		tags := parser.GetAllTagsInfo()
 
+		// Show a single tag when one is requested
+		if len(args) == 1 {
+			name, err := parser.TagAlias(args[0])
+			if err != nil {
+				return err
+			}
+			for _, tag := range tags {
+				if tag.Name == name {
+					fmt.Printf("Tag: %s\n", tag.Name)
+					if len(tag.Aliases) > 0 {
+						fmt.Printf("Aliases: %s\n", strings.Join(tag.Aliases, ", "))
+					}
+					if len(tag.DeprecatedAliases) > 0 {
+						fmt.Printf("Deprecated aliases: %s\n", strings.Join(tag.DeprecatedAliases, ", "))
+					}
+					fmt.Printf("Description: %s\n", tag.Description)
+					fmt.Printf("Example: %s\n", tag.Example)
+				}
+			}
+			return nil
+		}
+
 		fmt.Println("Available Docci Tags")
 		fmt.Println("====================")
 		fmt.Println()
@@ -288,6 +620,9 @@ var tagsCmd = &cobra.Command{
 			if len(tag.Aliases) > 0 {
 				fmt.Printf("Aliases: %s\n", strings.Join(tag.Aliases, ", "))
 			}
+			if len(tag.DeprecatedAliases) > 0 {
+				fmt.Printf("Deprecated aliases: %s\n", strings.Join(tag.DeprecatedAliases, ", "))
+			}
 			fmt.Printf("Description: %s\n", tag.Description)
 			fmt.Printf("Example: %s\n", tag.Example)
 			fmt.Println()
@@ -297,70 +632,122 @@ var tagsCmd = &cobra.Command{
 		fmt.Println("- Cannot use 'docci-output-contains' with 'docci-background'")
 		fmt.Println("- Cannot use 'docci-assert-failure' with 'docci-background'")
 		fmt.Println("- Cannot use 'docci-assert-failure' with 'docci-output-contains'")
+		fmt.Println("- Cannot use 'docci-output-contains-count' with background, assert-failure or after-all tags")
 		fmt.Println("- Cannot use 'docci-wait-for-endpoint' with 'docci-background'")
 		fmt.Println("- Cannot use 'docci-retry' with 'docci-background'")
+		fmt.Println("- Cannot use 'docci-retry-timeout' with 'docci-background'")
+		fmt.Println("- 'docci-retry-while-output' requires 'docci-retry' or 'docci-retry-timeout', and cannot be used with concurrent-group, after-all, assert-failure or file tags")
+		fmt.Println("- 'docci-background-expect-log' requires 'docci-background'")
+		fmt.Println("- 'docci-measure-memory' requires 'docci-background'")
+		fmt.Println("- 'docci-background-max-time' requires 'docci-background'")
+		fmt.Println("- Cannot use 'docci-assert-file-exists' with 'docci-background'")
+		fmt.Println("- Cannot use 'docci-assert-file-contains' with 'docci-background'")
+		fmt.Println("- Cannot use 'docci-stdin-file' with 'docci-file'")
+		fmt.Println("- Cannot use 'docci-isolate' with 'docci-background'")
+		fmt.Println("- Cannot use 'docci-expect-duration' with background, concurrent-group, assert-failure, after-all or file tags")
+		fmt.Println("- Cannot use 'docci-skip-if-empty-dir' with background, concurrent-group or after-all tags")
+		fmt.Println("- Cannot use 'docci-bail-unless' with concurrent-group or after-all tags")
+		fmt.Println("- 'docci-bail-message' and 'docci-bail-code' require 'docci-bail-unless'")
+		fmt.Println("- Cannot use 'docci-assert-faster-than' with background, concurrent-group, after-all, assert-failure or file tags")
+		fmt.Println("- Cannot use 'docci-transcript' with background, concurrent-group, assert-failure, after-all, delay-per-cmd or file tags")
+		fmt.Println("- Cannot use 'docci-name' or 'docci-skip-on-failure-of' with background, concurrent-group or after-all tags")
+		fmt.Println("- Cannot use 'docci-matrix' with background, concurrent-group, assert-failure, after-all, output-contains-count or file tags")
+		fmt.Println("- Cannot use 'docci-run-as' with transcript or file tags")
+		fmt.Println("- Cannot use 'docci-no-network' with run-as, transcript or file tags")
+		fmt.Println("- Cannot use 'docci-capture-exit-code' with background, concurrent-group, after-all, assert-failure, name or file tags")
+		fmt.Println("- Cannot use 'docci-assert-no-change' with background, concurrent-group, after-all, assert-failure, matrix, transcript, expect-duration or file tags")
+		fmt.Println("- Cannot use 'docci-output-to-env' with background or after-all tags")
+		fmt.Println("- Cannot use 'docci-output-sort' with background, after-all, matrix or transcript tags")
+		fmt.Println("- Cannot use 'docci-trim-output' with background, after-all, matrix or transcript tags")
+		fmt.Println("- Cannot use 'docci-output-json-schema' with background, after-all, matrix, transcript or output-sort tags")
+		fmt.Println("- Cannot use 'docci-assert-json-equals-file' with background, after-all, matrix, transcript or output-sort tags")
+		fmt.Println("- Cannot use 'docci-decode-output' with background, after-all, matrix or transcript tags")
+		fmt.Println("- Cannot use 'docci-stdin-from-previous' on the first block, or with stdin-file, background, concurrent-group, after-all or file tags")
+		fmt.Println("- Cannot use 'docci-exit-message' with background, assert-failure or capture-exit-code tags")
+		fmt.Println("- Cannot use 'docci-precondition' with background, concurrent-group or after-all tags")
+		fmt.Println("- Cannot use 'docci-repeat-until-file' with retry, background, concurrent-group, after-all, matrix, assert-failure or file tags")
+		fmt.Println("- Cannot use 'docci-output-starts-with' or 'docci-output-ends-with' with background, assert-failure, after-all or matrix tags")
+		fmt.Println("- Cannot use 'docci-assert-line-count' with background, assert-failure, after-all or matrix tags")
+		fmt.Println("- Cannot use 'docci-warn-only' with background, concurrent-group, after-all, assert-failure, capture-exit-code, exit-message, vars-from-output, name or file tags")
+		fmt.Println("- Cannot use 'docci-vars-from-output' with background, concurrent-group, after-all, matrix, assert-failure, capture-exit-code or file tags")
+		fmt.Println("- Cannot use 'docci-tmpdir' with background, concurrent-group or after-all tags")
+		fmt.Println("- Cannot use 'docci-clear-screen' with background, concurrent-group or after-all tags")
+		fmt.Println("- Cannot use 'docci-fixture' with background, concurrent-group or after-all tags")
+		fmt.Println("- 'docci-required' requires 'docci-os', 'docci-if-installed', 'docci-if-not-installed' or 'docci-precondition'")
+		fmt.Println("- Cannot use 'docci-poll-until' with background, concurrent-group or after-all tags")
+		fmt.Println("- Cannot use 'docci-after-all' with background, output, assert-failure, retry or file tags")
+		fmt.Println("- Cannot use 'docci-concurrent-group' with background, assert-failure, retry, wait, delay, before/after-all or file tags")
+		return nil
 	},
 }
 
 func init() {
 	// Add persistent flags
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "", "set log level (debug, info, warn, error, fatal, panic, off)")
+	rootCmd.PersistentFlags().BoolVar(&noDeprecationWarns, "no-deprecation-warnings", false, "do not warn when a deprecated tag alias is used")
 
 	// Add commands
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(checkCmd)
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(latestCmd)
 	rootCmd.AddCommand(tagsCmd)
+	rootCmd.AddCommand(tagsUsedCmd)
+	rootCmd.AddCommand(renderCmd)
+	rootCmd.AddCommand(injectCmd)
+	rootCmd.AddCommand(initCmd)
+	rootCmd.AddCommand(completionCmd)
+	registerCompletions()
+
+	// Add flags to init command
+	initCmd.Flags().BoolVar(&initForce, "force", false, "overwrite existing files")
+	tagsUsedCmd.Flags().BoolVar(&tagsUsedJSON, "json", false, "print the counts as JSON")
+	injectCmd.Flags().IntVar(&injectBlock, "block", 0, "number of the block to tag, as counted in the run (1-based)")
+	injectCmd.Flags().StringVar(&injectTag, "tag", "", "tag to set, e.g. docci-retry=3")
+	injectCmd.MarkFlagRequired("block")
+	injectCmd.MarkFlagRequired("tag")
+	renderCmd.Flags().StringVarP(&renderOutput, "output", "o", "", "write the rendered markdown to this file instead of stdout")
+	initCmd.Flags().BoolVar(&initConfig, "config", false, "also write a docci.json config file")
 
 	// Add flags to run command
 	runCmd.Flags().StringSliceVar(&preCommands, "pre-commands", []string{}, "commands to run before execution starts (useful for environment setup)")
 	runCmd.Flags().StringSliceVar(&cleanupCommands, "cleanup-commands", []string{}, "commands to run after execution completes")
+	runCmd.Flags().BoolVar(&skipCleanupOnSuccess, "skip-cleanup-on-success", false, "only run cleanup commands when the run fails, leaving state behind for inspection on success")
+	runCmd.Flags().StringSliceVar(&onFailureCommands, "on-failure", []string{}, "commands to run only when the run fails (DOCCI_FAILED_BLOCK and DOCCI_EXIT_CODE are set)")
 	runCmd.Flags().BoolVar(&hideBackgroundLogs, "hide-background-logs", false, "hide background process logs from output")
-	runCmd.Flags().StringVar(&workingDir, "working-dir", "", "change working directory before running commands")
+	runCmd.Flags().StringVar(&workingDir, "working-dir", "", "directory to run the blocks and pre/cleanup/on-failure commands in, without changing docci's own")
 	runCmd.Flags().BoolVar(&keepRunning, "keep-running", false, "keep containers running after execution with infinite sleep")
 	runCmd.Flags().BoolVar(&debugMode, "debug", false, "print generated script to stdout without executing")
-}
-
-func runPreCommands(commands []string) error {
-	log := logger.GetLogger()
-	log.Info("Running pre-commands")
-	for _, command := range commands {
-		log.Info("Running", "command", command)
-
-		// Create command
-		cmd := exec.Command("bash", "-c", command)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		// Run the command
-		if err := cmd.Run(); err != nil {
-			log.Warn("Pre-command failed (ignoring)", "command", command, "err", err)
-			// Continue with other pre-commands even if one fails
-		}
-	}
-	log.Info("Pre-commands completed")
-	return nil
-}
-
-func runCleanupCommands(commands []string) {
-	log := logger.GetLogger()
-	log.Debug("Running cleanup commands")
-	for _, command := range commands {
-		log.Info("Running", "command", command)
-
-		// Create command
-		cmd := exec.Command("bash", "-c", command)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		// Run the command
-		if err := cmd.Run(); err != nil {
-			log.Error("Error running cleanup command", "command", command, "err", err)
-			// Continue with other cleanup commands even if one fails
-		}
-	}
-	log.Info("Cleanup complete")
+	runCmd.Flags().StringVar(&containerImage, "container", "", "run the blocks inside this docker image, mounting the working directory")
+	runCmd.Flags().StringVar(&remoteHost, "remote", "", "run the blocks on a remote machine over ssh (user@host)")
+	runCmd.Flags().BoolVar(&printScriptOnFail, "print-script-on-failure", false, "print the generated script with line numbers to stderr when the run fails")
+	runCmd.Flags().BoolVar(&mergeOutput, "merge-output", false, "read stdout and stderr through one stream so lines from the two stay in the order they were written")
+	runCmd.Flags().StringVar(&artifactDir, "artifact-dir", "", "copy docci-artifact files into this directory after the run, even if it failed")
+	runCmd.Flags().BoolVar(&fixTypography, "fix-typography", false, "convert curly quotes and dashes in every block back to ASCII before running (like docci-fix-typography)")
+	runCmd.Flags().BoolVar(&stripANSI, "strip-ansi", false, "remove ANSI color codes from every block's output before validating it (like docci-strip-ansi)")
+	runCmd.Flags().BoolVar(&forceColor, "force-color", false, "set FORCE_COLOR=1 and CLICOLOR_FORCE=1 (and unset NO_COLOR) so commands print colors even though their output is piped")
+	runCmd.Flags().BoolVar(&noColor, "no-color", false, "set NO_COLOR=1, FORCE_COLOR=0 and CLICOLOR=0 (and unset CLICOLOR_FORCE) so commands print plain text")
+	runCmd.Flags().StringVar(&baseURL, "base-url", "", "substitute this URL for ${BASE_URL} in block content, docci-wait-for-endpoint and docci-poll-until")
+	runCmd.Flags().StringVar(&shell, "shell", "", "path to the bash binary that runs the blocks and pre/cleanup commands (default: bash from PATH, or pwsh with --powershell)")
+	runCmd.Flags().BoolVar(&powerShell, "powershell", false, "run powershell/pwsh code blocks with pwsh instead of bash blocks (pre/cleanup commands run with pwsh too)")
+	runCmd.Flags().BoolVar(&sandbox, "sandbox", false, "run every block in a fresh temp directory that is removed afterwards, so docs cannot write into the repo")
+	runCmd.Flags().IntVar(&maxRetriesGlobal, "max-retries-global", 0, "fail once this many docci-retry attempts have been used across all blocks (0 for no limit)")
+	runCmd.Flags().IntVar(&retryAll, "retry-all", 0, "retry every block up to N times as if it had docci-retry=N, unless it has its own retry tags (0 to disable)")
+	runCmd.Flags().BoolVar(&summaryOnly, "summary-only", false, "hide the blocks' output while they run and print a pass/fail line per file at the end, with the full output of the files that failed")
+	runCmd.Flags().BoolVar(&allowClear, "allow-clear", false, "let docci-clear-screen blocks clear the terminal, e.g. when recording a demo (ignored otherwise so CI logs stay intact)")
+	runCmd.Flags().IntVar(&inputTimeout, "input-timeout", 0, "stop the run when it writes no output for this many seconds, e.g. a command waiting on a sudo password prompt (0 to wait forever)")
+	runCmd.Flags().BoolVar(&keepTempFiles, "keep-temp-files", false, "keep /tmp/docci_bg_* files and save the generated script to a temp file for debugging")
+	runCmd.Flags().StringVar(&outputFormat, "output", "", "how failures are reported at the end of the run: text, or github for GitHub Actions annotations on the failing lines (default: github when GITHUB_ACTIONS=true, otherwise text)")
+	runCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "print a section per block with its commands, output and result")
+	runCmd.Flags().BoolVar(&perBlock, "per-block", false, "run every block as its own script instead of one merged script; only exported variables and the working directory carry over between blocks")
+	runCmd.Flags().BoolVar(&stepMode, "step", false, "pause before each block to show it and ask whether to run it (enter), skip it (s) or quit (q); blocks run one at a time like --per-block")
+	runCmd.Flags().BoolVarP(&assumeYes, "yes", "y", false, "automatically confirm docci-confirm blocks (required in non-interactive mode)")
+
+	// a bad flag value is reported like the run's other option errors
+	runCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return parseError{err}
+	})
 }
 
 // parseFileList parses comma separated file paths or JSON config file
@@ -436,6 +823,10 @@ func parseFileList(input string) []string {
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, "\nRuntime errors that occurred:", err)
+		var parseErr parseError
+		if errors.As(err, &parseErr) {
+			os.Exit(ExitCodeParseError)
+		}
 		os.Exit(1)
 	}
 }
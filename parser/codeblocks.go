@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"github.com/reecepbcups/docci/logger"
 	"github.com/reecepbcups/docci/types"
@@ -19,6 +22,8 @@ type CodeBlock struct {
 	Language        string
 	Content         string
 	OutputContains  string
+	OutputCount     *types.OutputCount // docci-output-contains-count: Text that must appear an exact number of times
+	LineCount       *types.LineCount   // docci-assert-line-count: How many non-empty lines the output must have
 	Background      bool
 	BackgroundKill  int // 1-based index of background process to kill
 	AssertFailure   bool
@@ -31,9 +36,85 @@ type CodeBlock struct {
 	DelayPerCmdSecs float64
 	IfFileNotExists string
 	IfNotInstalled  string
+	IfInstalled     string
 	LineNumber      int
 	FileName        string // Added for debugging multiple files
+	IncludeDir      string // directory of the docci-include fragment the block came from, empty for the file itself
+	Skipped         bool   // set on blocks from ParseCodeBlocksWithSkipped that do not run
+	SkipReason      string // the tag that skipped the block, e.g. "docci-os=linux" or "docci-ignore"
 	ReplaceText     string
+	Confirm         bool // docci-confirm: Require confirmation before the block runs
+	BeforeAll       bool // docci-before-all: Run before all other blocks
+	AfterAll        bool // docci-after-all: Run after all other blocks, even on failure
+	ConcurrentGroup string
+	WorkingDir      string   // docci-cwd: Directory the block runs in, scoped to a subshell
+	StdinFile       string   // docci-stdin-file: File piped into the block's stdin
+	Isolate         bool     // docci-isolate: Run the block in a subshell so its environment does not leak
+	ForceExec       bool     // docci-exec: Run the block as shell even though its language is not in ValidLangs
+	StripPrompts    []string // docci-prompt-strip: Prompts removed from command lines before running
+	Transcript      bool     // docci-transcript: Check each command's output against the transcript
+	RetryDelaySecs  float64  // docci-retry-delay: Seconds between retries, overrides DOCCI_RETRY_DELAY when RetryDelaySet
+	RetryDelaySet   bool
+	Name            string   // docci-name: Name other blocks reference with docci-skip-on-failure-of
+	SkipOnFailureOf string   // docci-skip-on-failure-of: Skip unless the named block succeeded
+	MatrixVar       string   // docci-matrix: Variable exported for each run of the block
+	MatrixValues    []string // docci-matrix: Values the block runs with
+	RunAs           string   // docci-run-as: User the block runs as, through sudo
+	FixTypography   bool     // docci-fix-typography: Convert smart quotes and dashes back to ASCII before running
+	PollUntilCmd    string   // docci-poll-until: Command rerun before the block until its output contains PollUntilNeedle
+	PollUntilNeedle string
+	PollTimeoutSecs int
+	CaptureExitCode string // docci-capture-exit-code: Variable the block's exit code is stored in, failures do not stop the run
+	AssertNoChange  string // docci-assert-no-change: Path whose contents must not change when the block runs again
+	NoNetwork       bool   // docci-no-network: Run the block without network access through unshare -n
+	Tmpdir          bool   // docci-tmpdir: Export a scratch directory as $DOCCI_TMP, removed after the block
+	OutputToEnv     string // docci-output-to-env: Variable the trimmed output is set in for cleanup commands
+	RetryTimeout    int    // docci-retry-timeout: Seconds the block keeps retrying for, RetryCount still caps the attempts
+	OutputSort      bool   // docci-output-sort: Sort the output lines before validating them
+	TrimOutputFrom  string // docci-trim-output: "head" or "tail", the end of the output validated
+	TrimOutputLines int    // docci-trim-output: Number of output lines validated
+	FasterThan      string // docci-assert-faster-than: docci-name of the block this block must run faster than
+	SkipIfEmptyDir  string // docci-skip-if-empty-dir: Skip the block when this directory is empty or missing
+	JSONSchema      string // docci-output-json-schema: JSON Schema file the output is validated against, absolute once resolved
+	RetryWhile      string // docci-retry-while-output: Regex the output must stop matching for the block to succeed
+	ClearScreen     bool   // docci-clear-screen: Clear the terminal before the block, only with --allow-clear
+	JSONEqualsFile  string // docci-assert-json-equals-file: JSON file the output must equal, absolute once resolved
+	DecodeOutput    string // docci-decode-output: Encoding the output is decoded from before validation, "base64"
+	StdinPrevious   bool   // docci-stdin-from-previous: Read the previous block's output on stdin
+	ExitMessage     string // docci-exit-message: Message printed to stderr when the block fails the run
+	Precondition    string // docci-precondition: Command that must succeed for the block to run, or the run fails with Required
+	RepeatUntilFile string // docci-repeat-until-file: Run the block again until this file exists
+	RepeatTimeout   int    // docci-repeat-until-file: Seconds the block is repeated for before the run fails
+	OutputPrefix    string // docci-output-starts-with: Text the trimmed output must start with
+	OutputSuffix    string // docci-output-ends-with: Text the trimmed output must end with
+	WarnOnly        bool   // docci-warn-only: A failure is logged as a warning and does not stop the run
+	StripANSI       bool   // docci-strip-ansi: Validate output with ANSI escape sequences removed
+	Required        bool   // docci-required: Fail the parse instead of skipping the block when its OS or install check is not met
+
+	BailUnless  string // docci-bail-unless: Stop the run before this block unless this command succeeds
+	BailMessage string // docci-bail-message: Message printed when the run stops
+	BailCode    int    // docci-bail-code: Exit code the run stops with
+
+	ExpectDurationOp   string  // docci-expect-duration: Comparison operator for the block's run time
+	ExpectDurationSecs float64 // docci-expect-duration: Seconds the run time is compared against
+
+	BackgroundExpectLog            string // docci-background-expect-log: text the background log must contain
+	BackgroundExpectLogTimeoutSecs int
+	BackgroundMaxTimeSecs          int  // docci-background-max-time: Stop the background process after this many seconds
+	MeasureMemory                  bool // docci-measure-memory: Track peak RSS of a background block
+
+	// Scheduling fields
+	AllowParallelWith []string // docci-allow-parallel-with: Names of blocks this block is declared safe to run alongside
+
+	Artifacts []string // docci-artifact: Paths or globs collected into --artifact-dir after the run
+
+	Fixtures []Fixture // docci-fixture: Files copied into place before the block runs
+
+	VarsFromOutput []OutputVar // docci-vars-from-output: Variables exported from the block's output for later blocks
+
+	// Post-condition fields
+	AssertFileExists   []string       // docci-assert-file-exists: Files that must exist after the block runs
+	AssertFileContains []FileContains // docci-assert-file-contains: Text files must contain after the block runs
 
 	// File operation fields
 	File        string // docci-file: The file name to operate on
@@ -42,6 +123,8 @@ type CodeBlock struct {
 	LineReplace string // docci-line-replace: Replace content at line N or N-M
 
 	content strings.Builder // Used during parsing to build content
+
+	includeLine int // line of the outermost docci-include that inlined the block, 0 for the file's own blocks
 }
 
 // given a markdown file, parse out all the code blocks within it.
@@ -49,6 +132,9 @@ type CodeBlock struct {
 
 var ValidLangs = []string{"bash", "shell", "sh"}
 
+// dataLangs are fence languages that hold data rather than commands, so docci-exec on them is likely a mistake
+var dataLangs = []string{"json", "yaml", "yml", "toml", "xml", "html", "csv", "diff"}
+
 // newCodeBlock creates a new CodeBlock with default values
 func newCodeBlock(index int, language string) *CodeBlock {
 	return &CodeBlock{
@@ -60,6 +146,10 @@ func newCodeBlock(index int, language string) *CodeBlock {
 // applyTags applies parsed tags to the CodeBlock
 func (c *CodeBlock) applyTags(tags MetaTag, lineNumber int, fileName string) {
 	c.OutputContains = tags.OutputContains
+	if tags.OutputSort {
+		// the expected lines are written on the fence line, so they are separated with \n
+		c.OutputContains = strings.ReplaceAll(tags.OutputContains, `\n`, "\n")
+	}
 	c.Background = tags.Background
 	c.BackgroundKill = tags.BackgroundKill
 	c.AssertFailure = tags.AssertFailure
@@ -72,7 +162,72 @@ func (c *CodeBlock) applyTags(tags MetaTag, lineNumber int, fileName string) {
 	c.DelayPerCmdSecs = tags.DelayPerCmdSecs
 	c.IfFileNotExists = tags.IfFileNotExists
 	c.IfNotInstalled = tags.IfNotInstalled
+	c.IfInstalled = tags.IfInstalled
 	c.ReplaceText = tags.ReplaceText
+	c.Confirm = tags.Confirm
+	c.BeforeAll = tags.BeforeAll
+	c.AfterAll = tags.AfterAll
+	c.ConcurrentGroup = tags.ConcurrentGroup
+	c.WorkingDir = tags.WorkingDir
+	c.StdinFile = tags.StdinFile
+	c.OutputCount = tags.OutputCount
+	c.LineCount = tags.LineCount
+	c.Isolate = tags.Isolate
+	c.ForceExec = tags.ForceExec
+	c.StripPrompts = tags.StripPrompts
+	c.Transcript = tags.Transcript
+	c.Name = tags.Name
+	c.SkipOnFailureOf = tags.SkipOnFailureOf
+	c.MatrixVar = tags.MatrixVar
+	c.MatrixValues = tags.MatrixValues
+	c.RunAs = tags.RunAs
+	c.FixTypography = tags.FixTypography
+	c.PollUntilCmd = tags.PollUntilCmd
+	c.PollUntilNeedle = tags.PollUntilNeedle
+	c.PollTimeoutSecs = tags.PollTimeoutSecs
+	c.CaptureExitCode = tags.CaptureExitCode
+	c.AssertNoChange = tags.AssertNoChange
+	c.NoNetwork = tags.NoNetwork
+	c.Tmpdir = tags.Tmpdir
+	c.OutputToEnv = tags.OutputToEnv
+	c.RetryTimeout = tags.RetryTimeout
+	c.OutputSort = tags.OutputSort
+	c.TrimOutputFrom = tags.TrimOutputFrom
+	c.TrimOutputLines = tags.TrimOutputLines
+	c.FasterThan = tags.FasterThan
+	c.SkipIfEmptyDir = tags.SkipIfEmptyDir
+	c.JSONSchema = tags.JSONSchema
+	c.RetryWhile = tags.RetryWhile
+	c.ClearScreen = tags.ClearScreen
+	c.JSONEqualsFile = tags.JSONEqualsFile
+	c.DecodeOutput = tags.DecodeOutput
+	c.StdinPrevious = tags.StdinPrevious
+	c.ExitMessage = tags.ExitMessage
+	c.Precondition = tags.Precondition
+	c.RepeatUntilFile = tags.RepeatUntilFile
+	c.RepeatTimeout = tags.RepeatTimeout
+	c.OutputPrefix = tags.OutputPrefix
+	c.OutputSuffix = tags.OutputSuffix
+	c.WarnOnly = tags.WarnOnly
+	c.BailUnless = tags.BailUnless
+	c.BailMessage = tags.BailMessage
+	c.BailCode = tags.BailCode
+	c.StripANSI = tags.StripANSI
+	c.Required = tags.Required
+	c.AllowParallelWith = tags.AllowParallelWith
+	c.Artifacts = tags.Artifacts
+	c.Fixtures = tags.Fixtures
+	c.VarsFromOutput = tags.VarsFromOutput
+	c.RetryDelaySecs = tags.RetryDelaySecs
+	c.RetryDelaySet = tags.RetryDelaySet
+	c.ExpectDurationOp = tags.ExpectDurationOp
+	c.ExpectDurationSecs = tags.ExpectDurationSecs
+	c.BackgroundExpectLog = tags.BackgroundExpectLog
+	c.BackgroundExpectLogTimeoutSecs = tags.BackgroundExpectLogTimeoutSecs
+	c.BackgroundMaxTimeSecs = tags.BackgroundMaxTimeSecs
+	c.MeasureMemory = tags.MeasureMemory
+	c.AssertFileExists = tags.AssertFileExists
+	c.AssertFileContains = tags.AssertFileContains
 	c.File = tags.File
 	c.ResetFile = tags.ResetFile
 	c.LineInsert = tags.LineInsert
@@ -87,16 +242,81 @@ func (c *CodeBlock) finalize() {
 	c.Content = c.content.String()
 }
 
-// GetRetryDelay returns the retry delay in seconds from environment variable or default
-func GetRetryDelay() int {
+// GetRetryDelay returns the retry delay in seconds from environment variable or default.
+// Fractional values like 0.5 are allowed.
+func GetRetryDelay() float64 {
 	if delayStr := os.Getenv("DOCCI_RETRY_DELAY"); delayStr != "" {
-		if delay, err := strconv.Atoi(delayStr); err == nil && delay >= 0 {
+		if delay, err := strconv.ParseFloat(delayStr, 64); err == nil && delay >= 0 {
 			return delay
 		}
 	}
 	return 2 // Default 2 seconds
 }
 
+// warnNonExecutable logs a warning when a docci-exec block looks like data or a console transcript
+// rather than commands, since running it will most likely fail
+func warnNonExecutable(block CodeBlock) {
+	log := logger.GetLogger()
+	if contains(dataLangs, block.Language) {
+		log.Warn("docci-exec block is fenced as a data format and may not be runnable", "block", block.Index, "line", block.LineNumber, "language", block.Language)
+		return
+	}
+	if block.StripPrompts != nil || block.Transcript {
+		return
+	}
+	for _, line := range strings.Split(block.Content, "\n") {
+		if strings.HasPrefix(line, "$ ") {
+			log.Warn("docci-exec block contains shell prompts ($), remove them or add docci-prompt-strip so the commands can run", "block", block.Index, "line", block.LineNumber)
+			return
+		}
+	}
+}
+
+// regionDirective reports whether line is a <!-- docci-disable --> or <!-- docci-enable --> comment.
+// disabled is the state the directive switches to.
+func regionDirective(line string) (disabled bool, ok bool) {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "<!--") || !strings.HasSuffix(trimmed, "-->") {
+		return false, false
+	}
+	switch strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(trimmed, "<!--"), "-->")) {
+	case "docci-disable":
+		return true, true
+	case "docci-enable":
+		return false, true
+	}
+	return false, false
+}
+
+// fenceLanguage returns the language of a ``` fence line. Besides "```bash docci-..." it understands
+// attribute-style info strings such as "```{.bash}", "```{bash}" and "```bash {.numberLines}".
+func fenceLanguage(line string) string {
+	info := strings.TrimSpace(strings.TrimPrefix(line, "```"))
+	if attrs, ok := strings.CutPrefix(info, "{"); ok {
+		fields := strings.FieldsFunc(attrs, func(r rune) bool {
+			return unicode.IsSpace(r) || r == '}' || r == ','
+		})
+		// the first class names the language, e.g. {#id .bash .numberLines}
+		for _, field := range fields {
+			if lang, ok := strings.CutPrefix(field, "."); ok {
+				return lang
+			}
+		}
+		// {bash} and {bash echo=FALSE} name the language without a dot
+		if len(fields) > 0 && !strings.ContainsAny(fields[0], "#=") {
+			return fields[0]
+		}
+		return ""
+	}
+
+	fields := strings.Fields(info)
+	if len(fields) == 0 {
+		return ""
+	}
+	lang, _, _ := strings.Cut(fields[0], "{")
+	return lang
+}
+
 // ParseCodeBlocksWithMetadata returns structured code blocks with metadata
 func ParseCodeBlocks(markdown string) ([]CodeBlock, error) {
 	return ParseCodeBlocksWithFileName(markdown, "")
@@ -104,23 +324,237 @@ func ParseCodeBlocks(markdown string) ([]CodeBlock, error) {
 
 // ParseCodeBlocksWithFileName returns structured code blocks with metadata and filename
 func ParseCodeBlocksWithFileName(markdown string, fileName string) ([]CodeBlock, error) {
+	blocks, _, err := ParseCodeBlocksWithSkipped(markdown, fileName)
+	return blocks, err
+}
+
+// skipReason returns the docci-os or install check tag that leaves a block out of the run on this
+// machine, or "" when it runs
+func skipReason(osList, ifNotInstalled, ifInstalled string) string {
+	switch {
+	case !ShouldRunOnCurrentOS(osList):
+		return TagOS + "=" + osList
+	case !ShouldRunBasedOnCommandInstallation(ifNotInstalled):
+		return TagIfNotInstalled + "=" + ifNotInstalled
+	case !ShouldRunIfInstalled(ifInstalled):
+		return TagIfInstalled + "=" + ifInstalled
+	}
+	return ""
+}
+
+// ParseCodeBlocksWithSkipped is ParseCodeBlocksWithFileName that also returns the runnable blocks
+// left out of the run (docci-ignore, docci-disable regions, docci-os and install checks), with
+// Skipped and SkipReason set. Skipped blocks have no Index.
+func ParseCodeBlocksWithSkipped(markdown string, fileName string) ([]CodeBlock, []CodeBlock, error) {
+	return parseCodeBlocks(markdown, fileName, nil, false)
+}
+
+// blockScan is the parse state a file shares with the docci-include fragments inlined into it
+type blockScan struct {
+	blockNames    map[string]int // docci-name -> line number
+	parallelDecls []parallelDecl
+
+	// powerShell scans for PowerShellLangs blocks instead of ValidLangs, for --powershell
+	powerShell bool
+
+	// lint records each problem in issues and keeps scanning, instead of stopping at the first one
+	lint   bool
+	issues []LintIssue
+}
+
+// fail stops the scan with err, or records it as an issue on line when linting so the scan goes on
+func (s *blockScan) fail(line int, err error) error {
+	if !s.lint {
+		return err
+	}
+	s.issues = append(s.issues, LintIssue{Line: line, Message: strings.TrimPrefix(err.Error(), fmt.Sprintf("line %d: ", line))})
+	return nil
+}
+
+// failBlock is fail for a problem found on a scanned block. Blocks inlined by docci-include are
+// reported on the directive's line, since their own line numbers are in the fragment.
+func (s *blockScan) failBlock(block CodeBlock, err error) error {
+	if !s.lint || block.includeLine == 0 {
+		return s.fail(block.LineNumber, err)
+	}
+	return s.fail(block.includeLine, fmt.Errorf("docci-include %s: %w", block.FileName, err))
+}
+
+// parseCodeBlocks parses markdown and checks the references between its blocks. inc is the file
+// the markdown was read from, nil when it is not known and docci-include cannot be followed.
+// powerShell parses PowerShell blocks instead of bash ones.
+func parseCodeBlocks(markdown string, fileName string, inc *includeContext, powerShell bool) ([]CodeBlock, []CodeBlock, error) {
+	scan := &blockScan{blockNames: make(map[string]int), powerShell: powerShell}
+	codeBlocks, skipped, err := scan.scan(markdown, fileName, inc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := scan.check(codeBlocks); err != nil {
+		return nil, nil, err
+	}
+	return codeBlocks, skipped, nil
+}
+
+// check validates the references between the scanned blocks
+func (s *blockScan) check(codeBlocks []CodeBlock) error {
+	// docci-allow-parallel-with may name blocks further down, so it is checked once every name is known
+	for _, issue := range parallelDeclIssues(s.parallelDecls, s.blockNames) {
+		if err := s.fail(issue.Line, fmt.Errorf("line %d: %s", issue.Line, issue.Message)); err != nil {
+			return err
+		}
+	}
+
+	// Validate background-kill references
+	backgroundIndexes := make(map[int]bool)
+	for _, block := range codeBlocks {
+		if block.Background {
+			backgroundIndexes[block.Index] = true
+		}
+	}
+
+	// Check all background-kill references
+	for _, block := range codeBlocks {
+		if block.BackgroundKill > 0 {
+			if !backgroundIndexes[block.BackgroundKill] {
+				// Find all available background indexes for error message
+				var availableIndexes []int
+				for idx := range backgroundIndexes {
+					availableIndexes = append(availableIndexes, idx)
+				}
+				sort.Ints(availableIndexes)
+
+				var err error
+				if len(availableIndexes) == 0 {
+					err = fmt.Errorf("block %d (line %d): docci-background-kill=%d references a non-existent background process. No background processes are defined in this file",
+						block.Index, block.LineNumber, block.BackgroundKill)
+				} else {
+					err = fmt.Errorf("block %d (line %d): docci-background-kill=%d references a non-existent background process. Available background process indexes: %v",
+						block.Index, block.LineNumber, block.BackgroundKill, availableIndexes)
+				}
+				if err := s.failBlock(block, err); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// docci-stdin-from-previous reads the kept output of the block before it, which must run once,
+	// in order, and succeed to have any
+	for i, block := range codeBlocks {
+		if !block.StdinPrevious {
+			continue
+		}
+		if i == 0 {
+			if err := s.failBlock(block, fmt.Errorf("block %d (line %d): docci-stdin-from-previous cannot be used on the first block", block.Index, block.LineNumber)); err != nil {
+				return err
+			}
+			continue
+		}
+		previous := codeBlocks[i-1]
+		if previous.Background || previous.ConcurrentGroup != "" || previous.AfterAll || previous.MatrixVar != "" ||
+			previous.AssertFailure || previous.CaptureExitCode != "" || previous.WarnOnly || previous.File != "" {
+			err := fmt.Errorf("block %d (line %d): docci-stdin-from-previous cannot read the output of block %d, a background, concurrent-group, after-all, matrix, assert-failure, capture-exit-code, warn-only or file block",
+				block.Index, block.LineNumber, previous.Index)
+			if err := s.failBlock(block, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Blocks in a concurrent group share one wait barrier, so they must be consecutive
+	closedGroups := make(map[string]bool)
+	for i, block := range codeBlocks {
+		if block.ConcurrentGroup == "" {
+			continue
+		}
+		if closedGroups[block.ConcurrentGroup] {
+			err := fmt.Errorf("block %d (line %d): docci-concurrent-group=%s blocks must be consecutive",
+				block.Index, block.LineNumber, block.ConcurrentGroup)
+			if err := s.failBlock(block, err); err != nil {
+				return err
+			}
+		}
+		if i+1 == len(codeBlocks) || codeBlocks[i+1].ConcurrentGroup != block.ConcurrentGroup {
+			closedGroups[block.ConcurrentGroup] = true
+		}
+	}
+
+	return nil
+}
+
+// scan collects the blocks of markdown, inlining the blocks of each docci-include fragment where
+// its directive is. Blocks are numbered in the order they appear once fragments are inlined.
+func (s *blockScan) scan(markdown string, fileName string, inc *includeContext) ([]CodeBlock, []CodeBlock, error) {
 	var codeBlocks []CodeBlock
+	var skipped []CodeBlock
+	skip := func(lang string, lineNumber int, reason string) {
+		skipped = append(skipped, CodeBlock{Language: lang, LineNumber: lineNumber, FileName: fileName, Skipped: true, SkipReason: reason})
+	}
 	var currentBlock *CodeBlock
 	lines := splitIntoLines(markdown)
 	startParsing := false
+	disabled := false
 	for idx, line := range lines {
 		lineNumber := idx + 1 // 1-based index for line numbers
 
+		// <!-- docci-disable --> / <!-- docci-enable --> toggle a region of skipped blocks
+		if !startParsing {
+			if state, ok := regionDirective(line); ok {
+				disabled = state
+				logger.GetLogger().Debug("Region directive found", "line_number", lineNumber, "disabled", disabled)
+				continue
+			}
+			if target, ok := includeDirective(line); ok {
+				if disabled || inc == nil {
+					logger.GetLogger().Debug("Not following docci-include", "line_number", lineNumber, "path", target, "disabled", disabled)
+					continue
+				}
+				issues := len(s.issues)
+				blocks, skippedBlocks, err := s.include(target, inc)
+				if err != nil {
+					if err := s.fail(lineNumber, fmt.Errorf("line %d: %w", lineNumber, err)); err != nil {
+						return nil, nil, err
+					}
+					continue
+				}
+				// issues found in the fragment are reported on the directive, with the fragment's line in the message
+				for i := issues; i < len(s.issues); i++ {
+					s.issues[i] = LintIssue{Line: lineNumber, Message: fmt.Sprintf("docci-include %s: line %d: %s", target, s.issues[i].Line, s.issues[i].Message)}
+				}
+				// the fragment numbered its blocks from 1, docci-background-kill included
+				offset := len(codeBlocks)
+				for i := range blocks {
+					blocks[i].Index += offset
+					if blocks[i].BackgroundKill > 0 {
+						blocks[i].BackgroundKill += offset
+					}
+					blocks[i].includeLine = lineNumber
+				}
+				codeBlocks = append(codeBlocks, blocks...)
+				skipped = append(skipped, skippedBlocks...)
+				continue
+			}
+		}
+
 		// stop the parsing when the codeblock ends
 		if startParsing {
 			if strings.Trim(line, " ") == "```" {
 				if currentBlock != nil && currentBlock.content.Len() > 0 {
 					// Only add the block if it should run on current OS and command conditions are met
-					if ShouldRunOnCurrentOS(currentBlock.OS) && ShouldRunBasedOnCommandInstallation(currentBlock.IfNotInstalled) {
+					if reason := skipReason(currentBlock.OS, currentBlock.IfNotInstalled, currentBlock.IfInstalled); reason == "" {
 						currentBlock.finalize()
+						if currentBlock.ForceExec {
+							warnNonExecutable(*currentBlock)
+						}
 						codeBlocks = append(codeBlocks, *currentBlock)
+					} else if currentBlock.Required {
+						err := fmt.Errorf("line %d: block is docci-required but would be skipped by %s (current OS: %s)", currentBlock.LineNumber, reason, GetCurrentOS())
+						if err := s.fail(currentBlock.LineNumber, err); err != nil {
+							return nil, nil, err
+						}
 					} else {
-						logger.GetLogger().Debug("Skipping code block due to OS restriction", "required_os", currentBlock.OS, "current_os", GetCurrentOS())
+						logger.GetLogger().Debug("Skipping code block due to OS or command restriction", "line_number", currentBlock.LineNumber, "reason", reason, "current_os", GetCurrentOS())
+						skip(currentBlock.Language, currentBlock.LineNumber, reason)
 					}
 					currentBlock = nil
 				}
@@ -139,31 +573,85 @@ func ParseCodeBlocksWithFileName(markdown string, fileName string) ([]CodeBlock,
 		// we only start parsing if the line contains ```bash, ```shell, or ```sh
 		// TODO: only run this if startParsing is false?
 		if strings.HasPrefix(line, "```") {
+			// Blocks in a disabled region are skipped like docci-ignore, without checking their tags
+			// Extract just the language part (before any tags)
+			lang := fenceLanguage(line)
+
+			if disabled {
+				logger.GetLogger().Debug("Ignoring code block in docci-disable region", "line_number", lineNumber)
+				if contains(runnableLangs(s.powerShell), lang) {
+					skip(lang, lineNumber, "docci-disable")
+				}
+				continue
+			}
+
 			// Parse tags first to check for ignore
 			tags, err := ParseTags(line)
 			if err != nil {
-				return nil, fmt.Errorf("line %d: parse tags: %w", lineNumber, err)
+				if !s.lint {
+					return nil, nil, fmt.Errorf("line %d: parse tags: %w", lineNumber, err)
+				}
+				s.fail(lineNumber, err)
+				continue
 			}
 
 			if tags.Ignore {
 				logger.GetLogger().Debug("Ignoring code block due to docci-ignore tag")
+				if contains(runnableLangs(s.powerShell), lang) || tags.ForceExec || tags.Transcript || tags.File != "" {
+					skip(lang, lineNumber, TagIgnore)
+				}
 				continue
 			}
 
-			// Extract just the language part (before any tags)
-			lang := strings.TrimPrefix(line, "```")
-			lang = strings.TrimSpace(lang)
-			// Split by space to get just the language part
-			langParts := strings.Fields(lang)
-			if len(langParts) > 0 {
-				lang = langParts[0]
-			}
-
-			// Allow block if it's a valid language OR if it has file operation tags
-			if contains(ValidLangs, lang) || tags.File != "" {
+			// Allow block if it's a valid language, is forced with docci-exec or docci-transcript, OR if it has file operation tags
+			if contains(runnableLangs(s.powerShell), lang) || tags.ForceExec || tags.Transcript || tags.File != "" {
+				if s.powerShell {
+					if err := checkPowerShellTags(line); err != nil {
+						if err := s.fail(lineNumber, fmt.Errorf("line %d: %w", lineNumber, err)); err != nil {
+							return nil, nil, err
+						}
+					}
+				}
 				// Validate tag combinations using the centralized validation
 				if err := tags.Validate(lineNumber); err != nil {
-					return nil, err
+					if err := s.fail(lineNumber, err); err != nil {
+						return nil, nil, err
+					}
+				}
+				if s.lint {
+					s.issues = append(s.issues, lintTagValues(tags, lineNumber)...)
+				}
+
+				// Names are recorded even for blocks later skipped by OS or install checks,
+				// so their dependents are skipped instead of rejected
+				if tags.SkipOnFailureOf != "" {
+					if _, ok := s.blockNames[tags.SkipOnFailureOf]; !ok {
+						err := fmt.Errorf("line %d: docci-skip-on-failure-of=%s does not match a docci-name on an earlier block", lineNumber, tags.SkipOnFailureOf)
+						if err := s.fail(lineNumber, err); err != nil {
+							return nil, nil, err
+						}
+					}
+				}
+				if tags.FasterThan != "" {
+					if _, ok := s.blockNames[tags.FasterThan]; !ok {
+						err := fmt.Errorf("line %d: docci-assert-faster-than=%s does not match a docci-name on an earlier block", lineNumber, tags.FasterThan)
+						if err := s.fail(lineNumber, err); err != nil {
+							return nil, nil, err
+						}
+					}
+				}
+				if tags.Name != "" {
+					if prev, ok := s.blockNames[tags.Name]; ok {
+						err := fmt.Errorf("line %d: docci-name=%s is already used by the block on line %d", lineNumber, tags.Name, prev)
+						if err := s.fail(lineNumber, err); err != nil {
+							return nil, nil, err
+						}
+					} else {
+						s.blockNames[tags.Name] = lineNumber
+					}
+				}
+				if len(tags.AllowParallelWith) > 0 {
+					s.parallelDecls = append(s.parallelDecls, parallelDecl{line: lineNumber, name: tags.Name, with: tags.AllowParallelWith})
 				}
 
 				startParsing = true
@@ -175,37 +663,7 @@ func ParseCodeBlocksWithFileName(markdown string, fileName string) ([]CodeBlock,
 		}
 	}
 
-	// Validate background-kill references
-	backgroundIndexes := make(map[int]bool)
-	for _, block := range codeBlocks {
-		if block.Background {
-			backgroundIndexes[block.Index] = true
-		}
-	}
-
-	// Check all background-kill references
-	for _, block := range codeBlocks {
-		if block.BackgroundKill > 0 {
-			if !backgroundIndexes[block.BackgroundKill] {
-				// Find all available background indexes for error message
-				var availableIndexes []int
-				for idx := range backgroundIndexes {
-					availableIndexes = append(availableIndexes, idx)
-				}
-				sort.Ints(availableIndexes)
-
-				if len(availableIndexes) == 0 {
-					return nil, fmt.Errorf("block %d (line %d): docci-background-kill=%d references a non-existent background process. No background processes are defined in this file",
-						block.Index, block.LineNumber, block.BackgroundKill)
-				} else {
-					return nil, fmt.Errorf("block %d (line %d): docci-background-kill=%d references a non-existent background process. Available background process indexes: %v",
-						block.Index, block.LineNumber, block.BackgroundKill, availableIndexes)
-				}
-			}
-		}
-	}
-
-	return codeBlocks, nil
+	return codeBlocks, skipped, nil
 }
 
 // WaitForEndpoint polls an HTTP endpoint until it's ready or timeout is reached
@@ -240,6 +698,240 @@ func WaitForEndpoint(url string, timeoutSecs int) error {
 	}
 }
 
+// ResolveStdinFiles makes docci-stdin-file paths absolute, relative to the markdown file's directory,
+// and errors if a file is missing so the problem is caught before anything runs.
+func ResolveStdinFiles(blocks []CodeBlock, markdownDir string) error {
+	for i := range blocks {
+		if blocks[i].StdinFile == "" {
+			continue
+		}
+		path := blocks[i].StdinFile
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(blockDir(blocks[i], markdownDir), path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("block %d (line %d): docci-stdin-file %s not found", blocks[i].Index, blocks[i].LineNumber, path)
+		}
+		blocks[i].StdinFile = path
+	}
+	return nil
+}
+
+// ResolveFixtures makes docci-fixture sources absolute, relative to the markdown file's directory,
+// and errors if a source is missing so the problem is caught before anything runs.
+func ResolveFixtures(blocks []CodeBlock, markdownDir string) error {
+	for i := range blocks {
+		for j, fixture := range blocks[i].Fixtures {
+			path := fixture.Source
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(blockDir(blocks[i], markdownDir), path)
+			}
+			// the script may cd into a docci-cwd or the sandbox before copying
+			path, err := filepath.Abs(path)
+			if err != nil {
+				return fmt.Errorf("block %d (line %d): resolve docci-fixture source %s: %w", blocks[i].Index, blocks[i].LineNumber, fixture.Source, err)
+			}
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("block %d (line %d): docci-fixture source %s not found", blocks[i].Index, blocks[i].LineNumber, path)
+			}
+			blocks[i].Fixtures[j].Source = path
+		}
+	}
+	return nil
+}
+
+// ResolveJSONSchemas makes docci-output-json-schema paths absolute, relative to the markdown file's
+// directory, and errors if a schema is missing so the problem is caught before anything runs.
+func ResolveJSONSchemas(blocks []CodeBlock, markdownDir string) error {
+	for i := range blocks {
+		if blocks[i].JSONSchema == "" {
+			continue
+		}
+		path, err := resolveBlockFile(blocks[i], markdownDir, TagOutputJSONSchema, blocks[i].JSONSchema)
+		if err != nil {
+			return err
+		}
+		blocks[i].JSONSchema = path
+	}
+	return nil
+}
+
+// ResolveJSONEqualsFiles makes docci-assert-json-equals-file paths absolute like ResolveJSONSchemas
+func ResolveJSONEqualsFiles(blocks []CodeBlock, markdownDir string) error {
+	for i := range blocks {
+		if blocks[i].JSONEqualsFile == "" {
+			continue
+		}
+		path, err := resolveBlockFile(blocks[i], markdownDir, TagAssertJSONEquals, blocks[i].JSONEqualsFile)
+		if err != nil {
+			return err
+		}
+		blocks[i].JSONEqualsFile = path
+	}
+	return nil
+}
+
+// resolveBlockFile returns the absolute path of a file a block's tag names, relative to the
+// directory the block came from, and errors if the file is missing
+func resolveBlockFile(block CodeBlock, markdownDir string, tag string, file string) (string, error) {
+	path := file
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(blockDir(block, markdownDir), path)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("block %d (line %d): resolve %s %s: %w", block.Index, block.LineNumber, tag, file, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("block %d (line %d): %s %s not found", block.Index, block.LineNumber, tag, path)
+	}
+	return path, nil
+}
+
+// BaseURLPlaceholder is replaced with --base-url in block content and endpoint tags
+const BaseURLPlaceholder = "${BASE_URL}"
+
+// ApplyBaseURL substitutes baseURL for BaseURLPlaceholder in each block's content, docci-wait-for-endpoint
+// and docci-poll-until command, so one document can run against local and staging endpoints. It errors
+// when a block uses the placeholder and no base URL was given.
+func ApplyBaseURL(blocks []CodeBlock, baseURL string) error {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	for i := range blocks {
+		fields := []*string{&blocks[i].Content, &blocks[i].WaitForEndpoint, &blocks[i].PollUntilCmd}
+		for _, field := range fields {
+			if !strings.Contains(*field, BaseURLPlaceholder) {
+				continue
+			}
+			if baseURL == "" {
+				return fmt.Errorf("block %d (line %d): uses %s but no --base-url was provided", blocks[i].Index, blocks[i].LineNumber, BaseURLPlaceholder)
+			}
+			*field = strings.ReplaceAll(*field, BaseURLPlaceholder, baseURL)
+		}
+	}
+	return nil
+}
+
+// runnableContent returns the block's commands, with prompts and output lines removed for docci-prompt-strip
+// and docci-transcript
+func runnableContent(block CodeBlock) string {
+	if block.StripPrompts == nil && !block.Transcript {
+		return block.Content
+	}
+	return stripPrompts(block.Content, blockPrompts(block))
+}
+
+// blockPrompts returns the prompts that start a command line, docci-prompt-strip's or the defaults
+func blockPrompts(block CodeBlock) []string {
+	if block.StripPrompts != nil {
+		return block.StripPrompts
+	}
+	if block.Transcript {
+		return transcriptPrompts
+	}
+	return defaultPrompts
+}
+
+// writePostConditions appends the docci-assert-* checks for a block
+func writePostConditions(script *strings.Builder, block CodeBlock) {
+	if block.ExpectDurationOp != "" {
+		script.WriteString(replaceTemplateVars(expectDurationTemplate, map[string]string{
+			"INDEX":    strconv.Itoa(block.Index),
+			"OPERATOR": block.ExpectDurationOp,
+			"SECONDS":  strconv.FormatFloat(block.ExpectDurationSecs, 'g', -1, 64),
+		}))
+	}
+	for _, path := range block.AssertFileExists {
+		script.WriteString(replaceTemplateVars(assertFileExistsTemplate, map[string]string{
+			"INDEX": strconv.Itoa(block.Index),
+			"FILE":  path,
+		}))
+	}
+	for _, fc := range block.AssertFileContains {
+		script.WriteString(replaceTemplateVars(assertFileContainsTemplate, map[string]string{
+			"INDEX":    strconv.Itoa(block.Index),
+			"FILE":     fc.Path,
+			"EXPECTED": shellQuote(fc.Expected),
+		}))
+	}
+}
+
+// writeVarsFromOutput appends the exports of a block's docci-vars-from-output variables, read from
+// the output its run kept
+func writeVarsFromOutput(script *strings.Builder, block CodeBlock) {
+	if len(block.VarsFromOutput) == 0 {
+		return
+	}
+	for _, outputVar := range block.VarsFromOutput {
+		// the pattern was checked when the tag was parsed
+		group := "0"
+		if re := regexp.MustCompilePOSIX(outputVar.Pattern); re.NumSubexp() > 0 {
+			group = "1"
+		}
+		script.WriteString(replaceTemplateVars(varFromOutputTemplate, map[string]string{
+			"INDEX":   strconv.Itoa(block.Index),
+			"VAR":     outputVar.Name,
+			"PATTERN": shellQuote(outputVar.Pattern),
+			"GROUP":   group,
+		}))
+	}
+}
+
+// pipedOutputBlocks returns the indexes of blocks whose output the block after them reads with
+// docci-stdin-from-previous
+func pipedOutputBlocks(blocks []CodeBlock) map[int]bool {
+	piped := make(map[int]bool)
+	for i, block := range blocks {
+		if block.StdinPrevious && i > 0 {
+			piped[blocks[i-1].Index] = true
+		}
+	}
+	return piped
+}
+
+// dependencyNames returns the docci-name of every block a docci-skip-on-failure-of block depends on
+func dependencyNames(blocks []CodeBlock) map[string]bool {
+	names := make(map[string]bool)
+	for _, block := range blocks {
+		if block.SkipOnFailureOf != "" {
+			names[block.SkipOnFailureOf] = true
+		}
+	}
+	return names
+}
+
+// dependencySubshell reports whether a block others depend on runs in a subshell. Tags that wrap
+// the block's commands in a subshell of their own stop the script when it fails, which the extra
+// subshell turns into a failure the dependents are skipped for. Those blocks' state does not carry
+// over to later blocks either way.
+func dependencySubshell(block CodeBlock, pipedBlocks map[int]bool) bool {
+	return block.WorkingDir != "" || block.Isolate || keepOutput(block, pipedBlocks) ||
+		block.RetryCount > 0 || block.RetryTimeout > 0 || block.MatrixVar != "" || block.RepeatUntilFile != "" ||
+		block.AssertNoChange != "" || block.AssertFailure || block.CaptureExitCode != ""
+}
+
+// keepOutput reports whether a block's output is kept in a file while it runs, for
+// docci-vars-from-output or the docci-stdin-from-previous block after it
+func keepOutput(block CodeBlock, pipedBlocks map[int]bool) bool {
+	return len(block.VarsFromOutput) > 0 || pipedBlocks[block.Index]
+}
+
+// orderLifecycleBlocks returns the blocks to run in order with docci-before-all blocks first,
+// along with the docci-after-all blocks. Both keep their document order when stacked.
+func orderLifecycleBlocks(blocks []CodeBlock) ([]CodeBlock, []CodeBlock) {
+	var beforeAll, regular, afterAll []CodeBlock
+	for _, block := range blocks {
+		switch {
+		case block.BeforeAll:
+			beforeAll = append(beforeAll, block)
+		case block.AfterAll:
+			afterAll = append(afterAll, block)
+		default:
+			regular = append(regular, block)
+		}
+	}
+	return append(beforeAll, regular...), afterAll
+}
+
 // BuildExecutableScript creates a single script with validation markers
 func BuildExecutableScript(blocks []CodeBlock) (string, map[int]string, map[int]bool) {
 	return BuildExecutableScriptWithOptions(blocks, types.DocciOpts{
@@ -248,6 +940,78 @@ func BuildExecutableScript(blocks []CodeBlock) (string, map[int]string, map[int]
 	})
 }
 
+// MarkerNames maps each docci-name used by exactly one block to that block's index. Those blocks use
+// their name instead of their index in the output markers, so the markers stay the same when blocks
+// are added or removed above them. Names repeated across merged files fall back to the index.
+func MarkerNames(blocks []CodeBlock) map[string]int {
+	names := make(map[string]int)
+	seen := make(map[string]int)
+	for _, block := range blocks {
+		if block.Name == "" {
+			continue
+		}
+		seen[block.Name]++
+		names[block.Name] = block.Index
+	}
+	for name, count := range seen {
+		if count > 1 {
+			delete(names, name)
+		}
+	}
+	return names
+}
+
+// FasterThanBaseline returns the block a docci-assert-faster-than block is compared against, the
+// block in the same file with that docci-name
+func FasterThanBaseline(blocks []CodeBlock, block CodeBlock) (CodeBlock, bool) {
+	for _, candidate := range blocks {
+		if candidate.Name == block.FasterThan && candidate.FileName == block.FileName && candidate.Index != block.Index {
+			return candidate, true
+		}
+	}
+	return CodeBlock{}, false
+}
+
+// applyRetryAll gives every block that can be retried and has no docci-retry or docci-retry-timeout
+// of its own a docci-retry of count, for --retry-all
+func applyRetryAll(blocks []CodeBlock, count int) []CodeBlock {
+	if count <= 0 {
+		return blocks
+	}
+	retried := make([]CodeBlock, len(blocks))
+	for i, block := range blocks {
+		if block.RetryCount == 0 && block.RetryTimeout == 0 && !block.Background && !block.AfterAll &&
+			block.ConcurrentGroup == "" && !block.AssertFailure && block.File == "" {
+			block.RetryCount = count
+		}
+		retried[i] = block
+	}
+	return retried
+}
+
+// timedBlocks returns the indexes of the blocks whose duration is reported for docci-assert-faster-than
+func timedBlocks(blocks []CodeBlock) map[int]bool {
+	timed := make(map[int]bool)
+	for _, block := range blocks {
+		if block.FasterThan == "" {
+			continue
+		}
+		timed[block.Index] = true
+		if baseline, ok := FasterThanBaseline(blocks, block); ok {
+			timed[baseline.Index] = true
+		}
+	}
+	return timed
+}
+
+// markerID returns the ID a block's output markers use, its docci-name when it is in markerNames
+func markerID(block CodeBlock, markerNames map[string]int) string {
+	if index, ok := markerNames[block.Name]; ok && index == block.Index {
+		return block.Name
+	}
+	return strconv.Itoa(block.Index)
+}
+
 // BuildExecutableScriptWithOptions creates a single script with validation markers and options
 func BuildExecutableScriptWithOptions(blocks []CodeBlock, opts types.DocciOpts) (string, map[int]string, map[int]bool) {
 	log := logger.GetLogger()
@@ -259,17 +1023,132 @@ func BuildExecutableScriptWithOptions(blocks []CodeBlock, opts types.DocciOpts)
 
 	// Always generate markers for parsing, visibility controlled in executor
 
+	// Move into a fresh sandbox directory before anything else runs
+	if opts.Sandbox {
+		script.WriteString(sandboxStartTemplate)
+	}
+
 	// Add trap at the beginning to clean up background processes
 	// Only set the trap if keepRunning is false
 	if !opts.KeepRunning {
 		script.WriteString(replaceTemplateVars(scriptCleanupTemplate, map[string]string{
-			"DEBUG_CLEANUP": formatDebugCleanup(debugEnabled),
+			"DEBUG_CLEANUP":   formatDebugCleanup(debugEnabled),
+			"SANDBOX_CLEANUP": formatSandboxCleanup(opts.Sandbox, opts.KeepTempFiles) + formatTmpdirCleanup(blocks),
 		}))
 	}
 
+	// Start the shared retry count from zero for --max-retries-global
+	if opts.MaxRetriesGlobal > 0 {
+		script.WriteString("rm -f /tmp/docci_retries_$$\n\n")
+	}
+
+	// Undo smart quotes and dashes from docs edited outside a code editor
+	blocks = normalizeBlocksTypography(blocks, opts.FixTypography)
+	blocks = applyRetryAll(blocks, opts.RetryAll)
+
+	// Move before-all blocks to the front and pull after-all blocks out into the exit trap
+	blocks, afterAllBlocks := orderLifecycleBlocks(blocks)
+	if len(afterAllBlocks) > 0 {
+		var afterAllEntries strings.Builder
+		for _, block := range afterAllBlocks {
+			afterAllEntries.WriteString(replaceTemplateVars(afterAllEntryTemplate, map[string]string{
+				"INDEX":     strconv.Itoa(block.Index),
+				"FILE_INFO": formatFileInfo(block.FileName),
+				"CONTENT":   formatNoNetwork(formatRunAs(runnableContent(block), block), block),
+			}))
+		}
+		cleanupCall := ""
+		if !opts.KeepRunning {
+			cleanupCall = "  cleanup_background_processes\n"
+		}
+		script.WriteString(replaceTemplateVars(afterAllTemplate, map[string]string{
+			"AFTER_ALL_ENTRIES": afterAllEntries.String(),
+			"CLEANUP_CALL":      cleanupCall,
+		}))
+	}
+
+	markerNames := MarkerNames(blocks)
+	timed := timedBlocks(blocks)
+	pipedBlocks := pipedOutputBlocks(blocks)
+	dependencies := dependencyNames(blocks)
 	var backgroundIndexes []int
+	var groupIndexes []int  // block indexes of the concurrent group being built
+	var memoryIndexes []int // background blocks with docci-measure-memory
+
+	for i, block := range blocks {
+		// Concurrent group members are launched together and joined after the last member
+		if block.ConcurrentGroup != "" {
+			if i == 0 || blocks[i-1].ConcurrentGroup != block.ConcurrentGroup {
+				script.WriteString(replaceTemplateVars(concurrentGroupStartTemplate, map[string]string{
+					"GROUP": block.ConcurrentGroup,
+				}))
+				groupIndexes = nil
+			}
+
+			blockContent := runnableContent(block)
+			if block.ReplaceText != "" {
+				parts := strings.SplitN(block.ReplaceText, ";", 2)
+				if len(parts) == 2 {
+					blockContent = strings.ReplaceAll(blockContent, parts[0], parts[1])
+				}
+			}
+
+			// The guard and post-conditions are checked inside the member's subshell, the guard relative
+			// to the script's directory like in the regular block path
+			var memberContent strings.Builder
+			if block.IfFileNotExists != "" {
+				memberContent.WriteString(replaceTemplateVars(fileExistenceGuardStartTemplate, map[string]string{
+					"FILE":  block.IfFileNotExists,
+					"INDEX": strconv.Itoa(block.Index),
+				}))
+			}
+			memberContent.WriteString(formatWorkingDirPrefix(block.WorkingDir))
+			memberContent.WriteString(formatStdinFile(formatNoNetwork(formatRunAs(blockContent, block), block), block.StdinFile))
+			writePostConditions(&memberContent, block)
+			if block.IfFileNotExists != "" {
+				memberContent.WriteString("fi\n")
+			}
+			script.WriteString(replaceTemplateVars(concurrentBlockTemplate, map[string]string{
+				"GROUP":     block.ConcurrentGroup,
+				"INDEX":     strconv.Itoa(block.Index),
+				"FILE_INFO": formatFileInfo(block.FileName),
+				"CONTENT":   memberContent.String(),
+			}))
+			groupIndexes = append(groupIndexes, block.Index)
+
+			if block.OutputContains != "" {
+				validationMap[block.Index] = block.OutputContains
+			}
+
+			if i+1 == len(blocks) || blocks[i+1].ConcurrentGroup != block.ConcurrentGroup {
+				var outputEntries strings.Builder
+				for _, idx := range groupIndexes {
+					outputEntries.WriteString(replaceTemplateVars(concurrentOutputEntryTemplate, map[string]string{
+						"INDEX": strconv.Itoa(idx),
+					}))
+				}
+				script.WriteString(replaceTemplateVars(concurrentGroupWaitTemplate, map[string]string{
+					"GROUP":          block.ConcurrentGroup,
+					"OUTPUT_ENTRIES": outputEntries.String(),
+				}))
+			}
+			continue
+		}
+
+		// Stop the whole run here unless the guard command succeeds
+		if block.BailUnless != "" {
+			message := block.BailMessage
+			if message == "" {
+				message = "docci-bail-unless guard failed: " + block.BailUnless
+			}
+			script.WriteString(replaceTemplateVars(bailGuardTemplate, map[string]string{
+				"INDEX":   strconv.Itoa(block.Index),
+				"COMMAND": shellQuote(block.BailUnless),
+				"MESSAGE": shellQuote(fmt.Sprintf("Stopping before block %d: %s", block.Index, message)),
+				"CODE":    strconv.Itoa(block.BailCode),
+			}))
+		}
 
-	for _, block := range blocks {
 		// Handle background kill first if specified
 		if block.BackgroundKill > 0 {
 			script.WriteString(replaceTemplateVars(backgroundKillTemplate, map[string]string{
@@ -283,14 +1162,61 @@ func BuildExecutableScriptWithOptions(blocks []CodeBlock, opts types.DocciOpts)
 			script.WriteString(replaceTemplateVars(backgroundBlockTemplate, map[string]string{
 				"INDEX":     strconv.Itoa(block.Index),
 				"FILE_INFO": formatFileInfo(block.FileName),
-				"CONTENT":   block.Content,
+				"CONTENT":   formatWorkingDirPrefix(block.WorkingDir) + formatStdinFile(formatNoNetwork(formatRunAs(runnableContent(block), block), block), block.StdinFile),
+				"MAX_TIME":  formatBackgroundMaxTime(block),
+			}))
+
+			// Sample the memory of the background process tree until it exits
+			if block.MeasureMemory {
+				script.WriteString(replaceTemplateVars(measureMemoryTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+				}))
+				memoryIndexes = append(memoryIndexes, block.Index)
+			}
+
+			// Fail early if the process died on startup
+			script.WriteString(replaceTemplateVars(backgroundStartupCheckTemplate, map[string]string{
+				"INDEX": strconv.Itoa(block.Index),
 			}))
+
+			// Block until the background log shows the expected readiness text
+			if block.BackgroundExpectLog != "" {
+				script.WriteString(replaceTemplateVars(backgroundExpectLogTemplate, map[string]string{
+					"INDEX":    strconv.Itoa(block.Index),
+					"EXPECTED": shellQuote(block.BackgroundExpectLog),
+					"TIMEOUT":  strconv.Itoa(block.BackgroundExpectLogTimeoutSecs),
+				}))
+			}
 			backgroundPIDs = append(backgroundPIDs, fmt.Sprintf("$DOCCI_BG_PID_%d", block.Index))
 			backgroundIndexes = append(backgroundIndexes, block.Index)
 		} else {
+			// Clear the terminal for demo recordings, left out of CI logs unless --allow-clear is set
+			if block.ClearScreen && opts.AllowClear {
+				script.WriteString(clearScreenTemplate)
+			}
+
+			if opts.Verbose {
+				script.WriteString(replaceTemplateVars(verboseBlockHeaderTemplate, map[string]string{
+					"INDEX":     strconv.Itoa(block.Index),
+					"LANGUAGE":  block.Language,
+					"FILE_INFO": formatFileInfo(block.FileName),
+					"COMMANDS":  formatVerboseCommands(runnableContent(block)),
+				}))
+			}
+
+			// Give the block a fresh scratch directory
+			if block.Tmpdir {
+				script.WriteString(replaceTemplateVars(tmpdirStartTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+				}))
+			}
+
 			// Regular blocks with markers (always generated for parsing)
 			script.WriteString(replaceTemplateVars(blockStartMarkerTemplate, map[string]string{
-				"INDEX": strconv.Itoa(block.Index),
+				"ID": markerID(block, markerNames),
+			}))
+			script.WriteString(replaceTemplateVars(blockStderrStartMarkerTemplate, map[string]string{
+				"ID": markerID(block, markerNames),
 			}))
 
 			// Add the block header comment only in debug mode
@@ -318,6 +1244,24 @@ func BuildExecutableScriptWithOptions(blocks []CodeBlock, opts types.DocciOpts)
 				}))
 			}
 
+			// Poll a command until its output shows the expected text
+			if block.PollUntilCmd != "" {
+				script.WriteString(replaceTemplateVars(pollUntilTemplate, map[string]string{
+					"INDEX":   strconv.Itoa(block.Index),
+					"COMMAND": shellQuote(block.PollUntilCmd),
+					"NEEDLE":  shellQuote(block.PollUntilNeedle),
+					"TIMEOUT": strconv.Itoa(block.PollTimeoutSecs),
+				}))
+			}
+
+			// Skip the block unless the block it depends on succeeded
+			if block.SkipOnFailureOf != "" {
+				script.WriteString(replaceTemplateVars(dependencyGuardStartTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+					"NAME":  block.SkipOnFailureOf,
+				}))
+			}
+
 			// Add file existence check as guard clause if needed
 			if block.IfFileNotExists != "" {
 				script.WriteString(replaceTemplateVars(fileExistenceGuardStartTemplate, map[string]string{
@@ -325,9 +1269,71 @@ func BuildExecutableScriptWithOptions(blocks []CodeBlock, opts types.DocciOpts)
 					"INDEX": strconv.Itoa(block.Index),
 				}))
 			}
+			if block.SkipIfEmptyDir != "" {
+				script.WriteString(replaceTemplateVars(emptyDirGuardStartTemplate, map[string]string{
+					"DIR":   block.SkipIfEmptyDir,
+					"INDEX": strconv.Itoa(block.Index),
+				}))
+			}
+			if block.Precondition != "" {
+				guard := preconditionGuardStartTemplate
+				if block.Required {
+					guard = requiredPreconditionGuardStartTemplate
+				}
+				script.WriteString(replaceTemplateVars(guard, map[string]string{
+					"COMMAND": shellQuote(block.Precondition),
+					"INDEX":   strconv.Itoa(block.Index),
+				}))
+			}
+
+			// Run the block in a subshell whose failure is stored instead of stopping the script
+			if block.CaptureExitCode != "" {
+				script.WriteString(replaceTemplateVars(captureExitCodeStartTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+					"VAR":   block.CaptureExitCode,
+				}))
+			}
+
+			// Run the block in a subshell whose failure is only reported
+			if block.WarnOnly {
+				script.WriteString(replaceTemplateVars(warnOnlyStartTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+				}))
+			} else if dependencies[block.Name] {
+				script.WriteString(replaceTemplateVars(dependencyStartTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+				}))
+				if dependencySubshell(block, pipedBlocks) {
+					script.WriteString("(\n")
+				}
+			}
+
+			// Scope the block to its own directory, relative to the global working directory
+			if block.WorkingDir != "" {
+				script.WriteString(replaceTemplateVars(workingDirStartTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+					"DIR":   block.WorkingDir,
+				}))
+			} else if block.Isolate {
+				script.WriteString(replaceTemplateVars(isolateStartTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+				}))
+			}
+
+			// Copy fixtures into place, relative to the block's directory
+			for _, fixture := range block.Fixtures {
+				script.WriteString(replaceTemplateVars(fixtureTemplate, map[string]string{
+					"INDEX":  strconv.Itoa(block.Index),
+					"SOURCE": fixture.Source,
+					"DEST":   fixture.Dest,
+				}))
+			}
 
 			// Apply text replacement if needed
-			blockContent := block.Content
+			blockContent := runnableContent(block)
+			if block.Transcript {
+				blockContent = formatTranscript(block.Content, blockPrompts(block), block.Index)
+			}
 			if block.ReplaceText != "" {
 				parts := strings.SplitN(block.ReplaceText, ";", 2)
 				if len(parts) == 2 {
@@ -338,6 +1344,18 @@ func BuildExecutableScriptWithOptions(blocks []CodeBlock, opts types.DocciOpts)
 				}
 			}
 
+			// Hand the commands to the docci-run-as user or a network namespace, then feed the stdin file
+			// or the previous block's output into them
+			blockContent = formatStdinFile(formatNoNetwork(formatRunAs(blockContent, block), block), block.StdinFile)
+			blockContent = formatStdinFromPrevious(blockContent, block.StdinPrevious)
+
+			// Start timing right before the block's commands
+			if block.ExpectDurationOp != "" || timed[block.Index] {
+				script.WriteString(replaceTemplateVars(durationStartTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+				}))
+			}
+
 			// Check if this is a file operation block
 			if block.File != "" {
 				// Handle file operations
@@ -386,35 +1404,134 @@ func BuildExecutableScriptWithOptions(blocks []CodeBlock, opts types.DocciOpts)
 				}
 			} else {
 				// Regular code execution (not a file operation)
-				// Prepare the code content with per-command delay and command display
+				// Prepare the code content with per-command delay and command display. A block others
+				// depend on runs in the main shell without set -e, see dependencyStartTemplate.
+				mainShellDependency := dependencies[block.Name] && !block.WarnOnly && !dependencySubshell(block, pipedBlocks)
 				delaySeconds := block.DelayPerCmdSecs
 				codeContent := replaceTemplateVars(codeExecutionTemplate, map[string]string{
 					"DELAY":      strconv.FormatFloat(delaySeconds, 'g', -1, 64),
-					"BASH_FLAGS": formatBashFlags(block.AssertFailure),
+					"BASH_FLAGS": formatBashFlags(block.AssertFailure || mainShellDependency),
 					"CONTENT":    blockContent,
 				})
 
+				// Run the code once per matrix value
+				if block.MatrixVar != "" {
+					script.WriteString(formatMatrixStart(block))
+				}
+				if keepOutput(block, pipedBlocks) {
+					script.WriteString(replaceTemplateVars(keepOutputStartTemplate, map[string]string{
+						"INDEX": strconv.Itoa(block.Index),
+					}))
+				}
+
 				// Add the actual code with retry logic if needed
-				if block.RetryCount > 0 {
+				if block.RetryCount > 0 || block.RetryTimeout > 0 {
 					retryDelay := GetRetryDelay()
-					script.WriteString(replaceTemplateVars(retryWrapperStartTemplate, map[string]string{
-						"INDEX":       strconv.Itoa(block.Index),
-						"MAX_RETRIES": strconv.Itoa(block.RetryCount),
-						"RETRY_DELAY": strconv.Itoa(retryDelay),
-					}))
+					if block.RetryDelaySet {
+						retryDelay = block.RetryDelaySecs
+					}
+					script.WriteString(formatRetryStart(block, retryDelay, opts.MaxRetriesGlobal))
 					script.WriteString(codeContent)
-					script.WriteString(replaceTemplateVars(retryWrapperEndTemplate, map[string]string{
+					script.WriteString(formatRetryEnd(block))
+				} else if block.RepeatUntilFile != "" {
+					vars := map[string]string{
+						"INDEX":   strconv.Itoa(block.Index),
+						"FILE":    shellQuote(block.RepeatUntilFile),
+						"TIMEOUT": strconv.Itoa(block.RepeatTimeout),
+					}
+					script.WriteString(replaceTemplateVars(repeatUntilFileStartTemplate, vars))
+					script.WriteString(codeContent)
+					script.WriteString(replaceTemplateVars(repeatUntilFileEndTemplate, vars))
+				} else {
+					script.WriteString(codeContent)
+				}
+
+				if keepOutput(block, pipedBlocks) {
+					script.WriteString(replaceTemplateVars(keepOutputEndTemplate, map[string]string{
 						"INDEX": strconv.Itoa(block.Index),
 					}))
-				} else {
+				}
+				if block.MatrixVar != "" {
+					script.WriteString(formatMatrixEnd(block, block.StripANSI || opts.StripANSI))
+				}
+
+				// Run the block again and compare the path's checksum from before and after
+				if block.AssertNoChange != "" {
+					vars := map[string]string{
+						"INDEX": strconv.Itoa(block.Index),
+						"PATH":  block.AssertNoChange,
+					}
+					script.WriteString(replaceTemplateVars(assertNoChangeStartTemplate, vars))
 					script.WriteString(codeContent)
+					script.WriteString(replaceTemplateVars(assertNoChangeEndTemplate, vars))
+				}
+			}
+
+			// Check post-conditions once the block's code has run
+			writePostConditions(&script, block)
+
+			// Leave the block's subshell, propagating a failure unless one is expected
+			if block.WorkingDir != "" || block.Isolate {
+				if block.AssertFailure {
+					script.WriteString(")\n")
+				} else {
+					script.WriteString(subshellEndTemplate)
 				}
 			}
 
-			// Close the guard clause if needed
+			if block.CaptureExitCode != "" {
+				script.WriteString(replaceTemplateVars(captureExitCodeEndTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+					"VAR":   block.CaptureExitCode,
+				}))
+			}
+			if block.WarnOnly {
+				script.WriteString(replaceTemplateVars(warnOnlyEndTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+				}))
+			} else if dependencies[block.Name] {
+				if dependencySubshell(block, pipedBlocks) {
+					script.WriteString(")\n")
+				}
+				script.WriteString(replaceTemplateVars(dependencyEndTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+					"NAME":  block.Name,
+				}))
+			}
+
+			// Export the docci-vars-from-output variables and hand the output to a docci-stdin-from-previous
+			// block, outside any subshell so later blocks see them
+			writeVarsFromOutput(&script, block)
+			if pipedBlocks[block.Index] {
+				script.WriteString(replaceTemplateVars(previousOutputTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+				}))
+			}
+			if keepOutput(block, pipedBlocks) {
+				script.WriteString("rm -f /tmp/docci_output_$$_" + strconv.Itoa(block.Index) + ".out\n")
+			}
+
+			// Record that a named block succeeded, outside any subshell so later blocks see it. Blocks
+			// others depend on recorded it in dependencyEndTemplate.
+			if block.Name != "" && !dependencies[block.Name] {
+				script.WriteString(replaceTemplateVars(blockSucceededTemplate, map[string]string{
+					"NAME": block.Name,
+				}))
+			}
+
+			// Close the guard clauses if needed
+			if block.Precondition != "" {
+				script.WriteString("fi\n")
+			}
+			if block.SkipIfEmptyDir != "" {
+				script.WriteString("fi\n")
+			}
 			if block.IfFileNotExists != "" {
 				script.WriteString("fi\n")
 			}
+			if block.SkipOnFailureOf != "" {
+				script.WriteString("fi\n")
+			}
 
 			// Add delay after block if specified
 			if block.DelayAfterSecs > 0 {
@@ -425,9 +1542,28 @@ func BuildExecutableScriptWithOptions(blocks []CodeBlock, opts types.DocciOpts)
 			}
 
 			// Add a marker after the block
+			script.WriteString(replaceTemplateVars(blockStderrEndMarkerTemplate, map[string]string{
+				"ID": markerID(block, markerNames),
+			}))
 			script.WriteString(replaceTemplateVars(blockEndMarkerTemplate, map[string]string{
-				"INDEX": strconv.Itoa(block.Index),
+				"ID": markerID(block, markerNames),
 			}))
+			if timed[block.Index] {
+				script.WriteString(replaceTemplateVars(blockDurationTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+					"ID":    markerID(block, markerNames),
+				}))
+			}
+
+			if block.Tmpdir {
+				script.WriteString(tmpdirEndTemplate)
+			}
+
+			if opts.Verbose {
+				script.WriteString(replaceTemplateVars(verboseBlockFooterTemplate, map[string]string{
+					"INDEX": strconv.Itoa(block.Index),
+				}))
+			}
 
 			// Store validation requirement if present
 			if block.OutputContains != "" {
@@ -445,13 +1581,14 @@ func BuildExecutableScriptWithOptions(blocks []CodeBlock, opts types.DocciOpts)
 		var logEntries strings.Builder
 		for _, bgIndex := range backgroundIndexes {
 			logEntries.WriteString(replaceTemplateVars(backgroundLogEntryTemplate, map[string]string{
-				"INDEX": strconv.Itoa(bgIndex),
+				"INDEX":       strconv.Itoa(bgIndex),
+				"REMOVE_FILE": formatRemoveTempFile(fmt.Sprintf("/tmp/docci_bg_%d.out", bgIndex), opts.KeepTempFiles),
 			}))
 		}
 		script.WriteString(replaceTemplateVars(backgroundLogsDisplayTemplate, map[string]string{
 			"LOG_ENTRIES": logEntries.String(),
 		}))
-	} else if len(backgroundIndexes) > 0 && opts.HideBackgroundLogs {
+	} else if len(backgroundIndexes) > 0 && opts.HideBackgroundLogs && !opts.KeepTempFiles {
 		// Still clean up the background output files even if we're not displaying them
 		var cleanupCommands strings.Builder
 		for _, bgIndex := range backgroundIndexes {
@@ -462,6 +1599,24 @@ func BuildExecutableScriptWithOptions(blocks []CodeBlock, opts types.DocciOpts)
 		}))
 	}
 
+	// Report peak memory of measured background blocks, even when their logs are hidden
+	if len(memoryIndexes) > 0 {
+		var memoryEntries strings.Builder
+		for _, idx := range memoryIndexes {
+			memoryEntries.WriteString(replaceTemplateVars(memoryReportEntryTemplate, map[string]string{
+				"INDEX":       strconv.Itoa(idx),
+				"REMOVE_FILE": formatRemoveTempFile(fmt.Sprintf("/tmp/docci_bg_%d.mem", idx), opts.KeepTempFiles),
+			}))
+		}
+		script.WriteString(replaceTemplateVars(memoryReportTemplate, map[string]string{
+			"MEMORY_ENTRIES": memoryEntries.String(),
+		}))
+	}
+
+	if opts.MaxRetriesGlobal > 0 {
+		script.WriteString("rm -f /tmp/docci_retries_$$\n")
+	}
+
 	// Add infinite sleep if keepRunning is true (as a final block)
 	if opts.KeepRunning {
 		script.WriteString(replaceTemplateVars(keepRunningTemplate, map[string]string{
@@ -2,11 +2,15 @@ package parser
 
 import (
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/reecepbcups/docci/executor"
+	"github.com/reecepbcups/docci/types"
 	"github.com/stretchr/testify/require"
 )
 
@@ -67,10 +71,10 @@ func TestCodeBlockExecute(t *testing.T) {
 	}
 
 	// Parse block outputs from the stdout
-	blockOutputs := executor.ParseBlockOutputs(resp.Stdout)
+	blockOutputs := executor.ParseBlockOutputs(resp.Stdout, nil)
 
 	if len(validationMap) > 0 {
-		validationErrors := executor.ValidateOutputs(blockOutputs, validationMap)
+		validationErrors := executor.ValidateOutputs(blockOutputs, validationMap, nil, nil)
 		if len(validationErrors) > 0 {
 			for _, err := range validationErrors {
 				t.Errorf("❌ Validation error: %s", err.Error())
@@ -295,3 +299,854 @@ func TestCommandSubstitutionNoDebugContamination(t *testing.T) {
 	require.NotContains(t, resp.Stdout, "Executing CMD:")
 	require.NotContains(t, resp.Stdout, "date +%Y-%m-%d")
 }
+
+func TestBeforeAfterAllOrdering(t *testing.T) {
+	markdown := "```bash docci-after-all\necho \"teardown\"\n```\n" +
+		"```bash\necho \"main\"\n```\n" +
+		"```bash docci-before-all\necho \"setup\"\n```\n"
+
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	require.Len(t, blocks, 3)
+	require.True(t, blocks[0].AfterAll)
+	require.True(t, blocks[2].BeforeAll)
+
+	script, _, _ := BuildExecutableScript(blocks)
+	require.Contains(t, script, "trap docci_after_all EXIT")
+
+	// setup runs before main, teardown is only defined inside the exit trap
+	require.Less(t, strings.Index(script, "echo \"setup\""), strings.Index(script, "echo \"main\""))
+	require.Less(t, strings.Index(script, "docci_after_all() {"), strings.Index(script, "echo \"setup\""))
+	require.NotContains(t, script, "DOCCI_BLOCK_START_1 ")
+
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+	require.Less(t, strings.Index(resp.Stdout, "setup"), strings.Index(resp.Stdout, "main"))
+	require.Less(t, strings.Index(resp.Stdout, "main"), strings.Index(resp.Stdout, "teardown"))
+}
+
+func TestConcurrentGroup(t *testing.T) {
+	markdown := "```bash docci-concurrent-group=startup\nsleep 1\necho \"a done\"\n```\n" +
+		"```bash docci-concurrent-group=startup docci-output-contains=\"b done\"\nsleep 1\necho \"b done\"\n```\n" +
+		"```bash\necho \"after\"\n```\n"
+
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	require.Len(t, blocks, 3)
+	require.Equal(t, "startup", blocks[0].ConcurrentGroup)
+
+	script, validationMap, _ := BuildExecutableScript(blocks)
+	require.Equal(t, "b done", validationMap[2])
+	require.Equal(t, 1, strings.Count(script, "# Wait for concurrent group startup"))
+
+	start := time.Now()
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+	require.Less(t, time.Since(start), 1900*time.Millisecond, "group members should run in parallel")
+
+	outputs := executor.ParseBlockOutputs(resp.Stdout, nil)
+	require.Equal(t, "a done", outputs[1])
+	require.Equal(t, "b done", outputs[2])
+	require.Less(t, strings.Index(resp.Stdout, "b done"), strings.Index(resp.Stdout, "after"))
+
+	// a failing member fails the whole group
+	blocks, err = ParseCodeBlocks("```bash docci-concurrent-group=g\nexit 2\n```\n```bash docci-concurrent-group=g\necho ok\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScript(blocks)
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.Contains(t, resp.Stderr, "Concurrent block 1 in group g failed")
+
+	// a member's docci-if-file-not-exists guard is checked in its subshell
+	existing := filepath.Join(t.TempDir(), "exists.txt")
+	require.NoError(t, os.WriteFile(existing, []byte("x"), 0644))
+	blocks, err = ParseCodeBlocks("```bash docci-concurrent-group=g docci-if-file-not-exists=\"" + existing + "\"\necho guarded\n```\n```bash docci-concurrent-group=g\necho ok\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScript(blocks)
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+	outputs = executor.ParseBlockOutputs(resp.Stdout, nil)
+	require.NotContains(t, outputs[1], "guarded")
+	require.Contains(t, outputs[1], "Skipping block 1")
+	require.Equal(t, "ok", outputs[2])
+
+	// a member's file assertions are checked in its subshell and reported as validation failures
+	blocks, err = ParseCodeBlocks("```bash docci-concurrent-group=g\necho 1\n```\n```bash docci-concurrent-group=g docci-assert-file-exists=\"/tmp/docci_cg_never_created\"\necho 2\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScript(blocks)
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+	failures := executor.ParseAssertionFailures(resp.Stdout)
+	require.Len(t, failures, 1)
+	require.Equal(t, "block 2: assertion failed: expected file /tmp/docci_cg_never_created to exist", failures[0].Error())
+
+	contains := filepath.Join(t.TempDir(), "contains.txt")
+	blocks, err = ParseCodeBlocks("```bash docci-concurrent-group=g docci-assert-file-contains=\"" + contains + "|ready\"\necho starting > " + contains + "\n```\n```bash docci-concurrent-group=g\necho 2\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScript(blocks)
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+	failures = executor.ParseAssertionFailures(resp.Stdout)
+	require.Len(t, failures, 1)
+	require.Equal(t, "block 1: assertion failed: expected file "+contains+" to contain 'ready'", failures[0].Error())
+
+	// group members must be consecutive
+	_, err = ParseCodeBlocks("```bash docci-concurrent-group=g\necho 1\n```\n```bash\necho 2\n```\n```bash docci-concurrent-group=g\necho 3\n```\n")
+	require.ErrorContains(t, err, "must be consecutive")
+
+	// ordering dependent tags are rejected
+	_, err = ParseCodeBlocks("```bash docci-concurrent-group=g docci-background\necho 1\n```\n")
+	require.ErrorContains(t, err, "docci-concurrent-group cannot be combined")
+}
+
+func TestVerboseSectionsDoNotAffectValidation(t *testing.T) {
+	// the command text contains the expected string, but the output does not
+	blocks, err := ParseCodeBlocks("```bash docci-output-contains=\"needle\"\n# needle\necho \"hay\"\n```\n")
+	require.NoError(t, err)
+
+	script, validationMap, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{Verbose: true})
+	require.Contains(t, script, "│ $ # needle")
+
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+	require.Contains(t, resp.Stdout, "┌── Block 1 (bash)")
+	require.Contains(t, resp.Stdout, "└── Block 1 completed")
+
+	outputs := executor.ParseBlockOutputs(resp.Stdout, nil)
+	require.Equal(t, "hay", outputs[1])
+	validationErrors := executor.ValidateOutputs(outputs, validationMap, nil, nil)
+	require.Len(t, validationErrors, 1)
+	require.Equal(t, 1, validationErrors[0].BlockIndex)
+	require.Equal(t, "needle", validationErrors[0].Expected)
+	require.Equal(t, "hay", validationErrors[0].Actual)
+}
+
+func TestAssertFileContainsScript(t *testing.T) {
+	blocks, err := ParseCodeBlocks("```bash docci-assert-file-contains=\"/tmp/docci_fc_test.txt|it's here\"\necho \"it's not\" > /tmp/docci_fc_test.txt\n```\n")
+	require.NoError(t, err)
+
+	script, _, _ := BuildExecutableScript(blocks)
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	// a failed assertion is a validation failure, so the script itself succeeds
+	require.NoError(t, resp.Error)
+	require.Contains(t, resp.Stderr, "expected file /tmp/docci_fc_test.txt to contain 'it's here'")
+	failures := executor.ParseAssertionFailures(resp.Stdout)
+	require.Len(t, failures, 1)
+	require.Equal(t, "block 1: assertion failed: expected file /tmp/docci_fc_test.txt to contain 'it's here'", failures[0].Error())
+	os.Remove("/tmp/docci_fc_test.txt")
+}
+
+func TestIsolatedBlockDoesNotLeak(t *testing.T) {
+	markdown := "```bash docci-isolate\nexport DOCCI_ISOLATED=leaked\nPLAIN_VAR=leaked\ncd /\n```\n" +
+		"```bash docci-output-contains=\"isolated=,plain=\"\necho \"isolated=${DOCCI_ISOLATED:-},plain=${PLAIN_VAR:-}\"\n```\n" +
+		"```bash\npwd\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+
+	script, validationMap, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	require.Contains(t, script, "# Run block 1 in a subshell")
+
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+
+	outputs := executor.ParseBlockOutputs(resp.Stdout, nil)
+	require.Empty(t, executor.ValidateOutputs(outputs, validationMap, nil, nil))
+	require.NotEqual(t, "/", outputs[3])
+
+	// a failure inside the isolated block still stops the run
+	blocks, err = ParseCodeBlocks("```bash docci-isolate\nfalse\n```\n```bash\necho after\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.NotContains(t, resp.Stdout, "after\n")
+}
+
+func TestExpectDurationScript(t *testing.T) {
+	blocks, err := ParseCodeBlocks("```bash docci-expect-duration=\"<5\"\necho fast\n```\n```bash docci-expect-duration=\">0.5\"\nsleep 1.1\n```\n")
+	require.NoError(t, err)
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+
+	blocks, err = ParseCodeBlocks("```bash docci-expect-duration=\"<0.1\"\nsleep 1\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+	require.Contains(t, resp.Stderr, "block 1 expected duration < 0.1s, took 1")
+	failures := executor.ParseAssertionFailures(resp.Stdout)
+	require.Len(t, failures, 1)
+	require.Contains(t, failures[0].Assertion, "expected duration < 0.1s, took 1")
+}
+
+func TestDisabledRegion(t *testing.T) {
+	markdown := "```bash\necho 1\n```\n" +
+		"<!-- docci-disable -->\n" +
+		"```bash\necho 2\n```\n" +
+		"```bash docci-not-a-real-tag\necho 3\n```\n" +
+		"  <!--docci-enable-->\n" +
+		"```bash\necho 4\n```\n" +
+		"```bash\n<!-- docci-disable -->\necho 5\n```\n" +
+		"```bash\necho 6\n```\n"
+
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	require.Len(t, blocks, 4)
+	require.Equal(t, "echo 1\n", blocks[0].Content)
+	require.Equal(t, "echo 4\n", blocks[1].Content)
+	// directives inside a code block are content, not directives
+	require.Equal(t, "<!-- docci-disable -->\necho 5\n", blocks[2].Content)
+	require.Equal(t, "echo 6\n", blocks[3].Content)
+
+	// a region without docci-enable runs to the end of the file
+	blocks, err = ParseCodeBlocks("```bash\necho 1\n```\n<!-- docci-disable -->\n```bash\necho 2\n```\n")
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+}
+
+func TestForceExecBlocks(t *testing.T) {
+	markdown := "```console\necho skipped\n```\n" +
+		"```console docci-exec\necho forced\n```\n" +
+		"```text docci-exec docci-output-contains=\"plain\"\necho plain\n```\n"
+
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	require.Equal(t, "console", blocks[0].Language)
+	require.True(t, blocks[0].ForceExec)
+	require.Equal(t, "echo forced\n", blocks[0].Content)
+	require.Equal(t, "plain", blocks[1].OutputContains)
+
+	// data and prompt blocks still parse, with a warning logged
+	blocks, err = ParseCodeBlocks("```json docci-exec\n{\"a\": 1}\n```\n```console docci-exec\n$ echo hi\n```\n")
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+}
+
+func TestRetryDelayOverride(t *testing.T) {
+	t.Setenv("DOCCI_RETRY_DELAY", "4")
+	blocks, err := ParseCodeBlocks("```bash docci-retry=2 docci-retry-delay=0.5\necho 1\n```\n```bash docci-retry=2\necho 2\n```\n")
+	require.NoError(t, err)
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	require.Contains(t, script, "sleep 0.5\n")
+	require.Contains(t, script, "sleep 4\n")
+}
+
+func TestFractionalRetryDelay(t *testing.T) {
+	blocks, err := ParseCodeBlocks("```bash docci-retry=1\necho 1\n```\n")
+	require.NoError(t, err)
+
+	t.Setenv("DOCCI_RETRY_DELAY", "0.25")
+	require.Equal(t, 0.25, GetRetryDelay())
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	require.Contains(t, script, "sleep 0.25\n")
+
+	// integers and invalid values keep working
+	t.Setenv("DOCCI_RETRY_DELAY", "3")
+	require.Equal(t, 3.0, GetRetryDelay())
+	t.Setenv("DOCCI_RETRY_DELAY", "-1")
+	require.Equal(t, 2.0, GetRetryDelay())
+}
+
+func TestSkipOnFailureOf(t *testing.T) {
+	// references must point at an earlier, unique name
+	_, err := ParseCodeBlocks("```bash docci-skip-on-failure-of=build\necho deploy\n```\n```bash docci-name=build\necho build\n```\n")
+	require.ErrorContains(t, err, "does not match a docci-name on an earlier block")
+	_, err = ParseCodeBlocks("```bash docci-name=build\necho 1\n```\n```bash docci-name=build\necho 2\n```\n")
+	require.ErrorContains(t, err, "already used by the block on line 1")
+
+	// a dependency skipped by its file guard skips the dependent; a dependency that ran lets it run
+	markdown := "```bash docci-name=build docci-if-file-not-exists=\"/etc/passwd\"\necho build\n```\n" +
+		"```bash docci-skip-on-failure-of=build\necho deploy\n```\n" +
+		"```bash docci-name=setup docci-isolate\necho setup\n```\n" +
+		"```bash docci-skip-on-failure-of=setup\necho after-setup\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+
+	outputs := executor.ParseBlockOutputs(resp.Stdout, MarkerNames(blocks))
+	require.Equal(t, "Skipping block 2: block 'build' did not succeed", outputs[2])
+	require.Equal(t, "after-setup", outputs[4])
+
+	// a dependency that fails skips its dependents and the run goes on; one that succeeds runs in
+	// the main shell, so its variables, functions, options and directory carry over
+	markdown = "```bash docci-name=flaky\n(exit 4)\necho trying\n```\n" +
+		"```bash docci-skip-on-failure-of=flaky\necho never\n```\n" +
+		"```bash docci-name=env\nexport DEP_VAR=kept\nreadonly DEP_PLAIN=plain\ngreet() { echo hi; }\nset -o pipefail\ncd /tmp\n```\n" +
+		"```bash docci-skip-on-failure-of=env\necho \"$DEP_VAR $DEP_PLAIN $(greet) $PWD $(set -o | grep -c 'pipefail.*on')\"\n```\n" +
+		"```bash docci-name=wrapped docci-cwd=/tmp\nfalse\necho not reached\n```\n" +
+		"```bash docci-skip-on-failure-of=wrapped\necho never\n```\n"
+	blocks, err = ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+	require.Contains(t, resp.Stderr, "Block 1 failed with status 4, skipping the blocks that depend on 'flaky'")
+	require.Equal(t, map[int]int{1: 4, 5: 1}, executor.ParseWarnings(resp.Stdout))
+
+	// the block runs on after a failing command, and the first failure is the one reported
+	outputs = executor.ParseBlockOutputs(resp.Stdout, MarkerNames(blocks))
+	require.Equal(t, "trying", outputs[1])
+	require.Equal(t, "Skipping block 2: block 'flaky' did not succeed", outputs[2])
+	require.Equal(t, "kept plain hi /tmp 1", outputs[4])
+	require.NotContains(t, outputs[5], "not reached")
+	require.Equal(t, "Skipping block 6: block 'wrapped' did not succeed", outputs[6])
+}
+
+func TestAssertFasterThanDurations(t *testing.T) {
+	_, err := ParseCodeBlocks("```bash docci-assert-faster-than=baseline\ntrue\n```\n```bash docci-name=baseline\nsleep 1\n```\n")
+	require.ErrorContains(t, err, "docci-assert-faster-than=baseline does not match a docci-name on an earlier block")
+
+	markdown := "```bash docci-name=baseline\nsleep 0.2\n```\n" +
+		"```bash\necho untimed\n```\n" +
+		"```bash docci-assert-faster-than=baseline\necho fast\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	baseline, ok := FasterThanBaseline(blocks, blocks[2])
+	require.True(t, ok)
+	require.Equal(t, 1, baseline.Index)
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+
+	// only the compared blocks report a duration, and it stays out of the block output
+	durations := executor.ParseBlockDurations(resp.Stdout, MarkerNames(blocks))
+	require.Len(t, durations, 2)
+	require.GreaterOrEqual(t, durations[1], 0.2)
+	require.Less(t, durations[3], durations[1])
+	require.Equal(t, "fast", executor.ParseBlockOutputs(resp.Stdout, MarkerNames(blocks))[3])
+}
+
+func TestSkipIfEmptyDir(t *testing.T) {
+	empty := t.TempDir()
+	full := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(full, ".hidden"), []byte("x"), 0644))
+
+	markdown := "```bash docci-skip-if-empty-dir=\"" + empty + "\"\necho empty-ran\n```\n" +
+		"```bash docci-skip-if-empty-dir=\"" + filepath.Join(empty, "missing") + "\"\necho missing-ran\n```\n" +
+		"```bash docci-if-dir-not-empty=\"" + full + "\"\necho full-ran\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	require.Equal(t, empty, blocks[0].SkipIfEmptyDir)
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+
+	outputs := executor.ParseBlockOutputs(resp.Stdout, nil)
+	require.Equal(t, "Skipping block 1: directory "+empty+" is empty or does not exist", outputs[1])
+	require.Contains(t, outputs[2], "Skipping block 2")
+	require.Equal(t, "full-ran", outputs[3])
+}
+
+func TestBackgroundMaxTime(t *testing.T) {
+	markdown := "```bash docci-background docci-background-max-time=1\nsleep 30\n```\n" +
+		"```bash\nsleep 2\nkill -0 $DOCCI_BG_PID_1 2>/dev/null && echo running || echo stopped\ncat /tmp/docci_bg_1.out\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	require.Equal(t, 1, blocks[0].BackgroundMaxTimeSecs)
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{HideBackgroundLogs: true})
+	start := time.Now()
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+	require.Less(t, time.Since(start), 20*time.Second)
+
+	outputs := executor.ParseBlockOutputs(resp.Stdout, nil)
+	require.Contains(t, outputs[2], "stopped")
+	require.Contains(t, outputs[2], "Stopping background process 1 after its max time of 1s")
+
+	// without the tag no timer is started
+	blocks, err = ParseCodeBlocks("```bash docci-background\nsleep 1\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScript(blocks)
+	require.NotContains(t, script, "max time")
+}
+
+func TestMatrixRuns(t *testing.T) {
+	markdown := "```bash docci-matrix=\"N=1,2\" docci-output-contains=\"run\"\necho \"run $N\"\n```\n" +
+		"```bash\necho \"${N:-unset}\"\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+
+	outputs := executor.ParseBlockOutputs(resp.Stdout, nil)
+	require.Contains(t, outputs[1], "run 1\n")
+	require.Contains(t, outputs[1], "run 2\n")
+	require.Contains(t, outputs[1], "=== Block 1 passed for N=1,2 ===")
+	// the variable only exists inside the matrix runs
+	require.Equal(t, "unset", outputs[2])
+
+	// output-contains is checked against every run, not just the combined output
+	blocks, err = ParseCodeBlocks("```bash docci-matrix=\"N=1,2\" docci-output-contains=\"run 1\"\necho \"run $N\"\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.Contains(t, resp.Stderr, "Block 1 output for N=2 does not contain: run 1")
+}
+
+func TestKeepTempFiles(t *testing.T) {
+	blocks, err := ParseCodeBlocks("```bash docci-background docci-measure-memory\nsleep 1\n```\n```bash docci-background-kill=1\necho done\n```\n")
+	require.NoError(t, err)
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	require.Contains(t, script, "rm -f /tmp/docci_bg_1.out")
+	require.Contains(t, script, "rm -f /tmp/docci_bg_1.mem")
+
+	for _, opts := range []types.DocciOpts{{KeepTempFiles: true}, {KeepTempFiles: true, HideBackgroundLogs: true}} {
+		script, _, _ = BuildExecutableScriptWithOptions(blocks, opts)
+		require.NotContains(t, script, "rm -f /tmp/docci_bg_")
+	}
+}
+
+func TestRunAsBlocks(t *testing.T) {
+	// a stand-in sudo that drops "-n -u USER" and runs the command as the current user
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sudo"), []byte("#!/bin/sh\nshift 3\nexec \"$@\"\n"), 0755))
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+
+	blocks, err := ParseCodeBlocks("```bash docci-run-as=root\necho 'it'\"'\"'s quoted' \"$0\"\n```\n")
+	require.NoError(t, err)
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	require.Contains(t, script, "sudo -n -u 'root' bash -eT -c ")
+
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+	require.Equal(t, "it's quoted bash", executor.ParseBlockOutputs(resp.Stdout, nil)[1])
+
+	// unknown users fail before sudo runs
+	blocks, err = ParseCodeBlocks("```bash docci-run-as=docci_no_such_user\necho hi\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.Contains(t, resp.Stderr, "docci-run-as user docci_no_such_user does not exist")
+}
+
+func TestAllowParallelWithBlocks(t *testing.T) {
+	// declarations may point at blocks further down and are stored on the block
+	blocks, err := ParseCodeBlocks("```bash docci-name=lint docci-allow-parallel-with=unit\necho 1\n```\n```bash docci-name=unit\necho 2\n```\n")
+	require.NoError(t, err)
+	require.Equal(t, []string{"unit"}, blocks[0].AllowParallelWith)
+
+	_, err = ParseCodeBlocks("```bash docci-allow-parallel-with=unit\necho 1\n```\n")
+	require.ErrorContains(t, err, "line 1: docci-allow-parallel-with=unit does not match a docci-name in this file")
+}
+
+func TestBackgroundStartupCheck(t *testing.T) {
+	// a background block that finishes cleanly right away is not a startup failure
+	blocks, err := ParseCodeBlocks("```bash docci-background\necho done\n```\n```bash\necho after\n```\n")
+	require.NoError(t, err)
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{HideBackgroundLogs: true})
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+	require.Equal(t, "after", executor.ParseBlockOutputs(resp.Stdout, nil)[2])
+
+	blocks, err = ParseCodeBlocks("```bash docci-background\necho starting\nexit 3\n```\n```bash\necho after\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{HideBackgroundLogs: true})
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.Equal(t, uint(3), resp.ExitCode)
+	require.Contains(t, resp.Stderr, "Background block 1 exited right after starting with status 3")
+	require.Contains(t, resp.Stderr, "starting")
+	require.NotContains(t, resp.Stdout, "after")
+}
+
+func TestMaxRetriesGlobal(t *testing.T) {
+	t.Setenv("DOCCI_RETRY_DELAY", "0")
+	t.Setenv("DOCCI_TEST_COUNTER", filepath.Join(t.TempDir(), "attempts"))
+	// the first block passes on its third attempt, using up both retries,
+	// so the second block fails without retrying
+	markdown := "```bash docci-retry=3 docci-isolate\nn=$(cat \"$DOCCI_TEST_COUNTER\" 2>/dev/null || echo 0)\necho $((n + 1)) > \"$DOCCI_TEST_COUNTER\"\n[ \"$n\" -ge 2 ]\necho passed\n```\n" +
+		"```bash docci-retry=5\nfalse\necho unreachable\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{MaxRetriesGlobal: 2})
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.Contains(t, resp.Stdout, "Retry attempt 2/3 for block 1")
+	require.Contains(t, resp.Stdout, "passed")
+	require.Contains(t, resp.Stderr, "Global retry limit of 2 reached, not retrying block 2")
+	require.NotContains(t, resp.Stdout, "for block 2")
+	require.NotContains(t, resp.Stdout, "unreachable")
+
+	// without a cap the check is not generated
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	require.NotContains(t, script, "docci_retries")
+}
+
+func TestIfInstalledBlocks(t *testing.T) {
+	markdown := "```bash docci-if-installed=ls\necho 1\n```\n" +
+		"```bash docci-if-installed=nonexistent-fake-command\necho 2\n```\n" +
+		"```bash docci-if-installed=ls docci-if-not-installed=ls\necho 3\n```\n"
+
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	require.Equal(t, "echo 1\n", blocks[0].Content)
+	require.Equal(t, "ls", blocks[0].IfInstalled)
+
+	_, err = ParseTags("```bash docci-if-installed")
+	require.ErrorContains(t, err, "docci-if-installed requires a command name")
+}
+
+func TestAttributeInfoStrings(t *testing.T) {
+	for line, lang := range map[string]string{
+		"```bash":                      "bash",
+		"```bash docci-os=linux":       "bash",
+		"```{.bash}":                   "bash",
+		"```{bash}":                    "bash",
+		"```{#setup .sh .numberLines}": "sh",
+		"```bash {.numberLines}":       "bash",
+		"```bash{#id}":                 "bash",
+		"```{#id}":                     "",
+		"```":                          "",
+	} {
+		require.Equal(t, lang, fenceLanguage(line), line)
+	}
+
+	markdown := "```{.bash}\necho 1\n```\n" +
+		"```bash {.numberLines} docci-output-contains=\"2\"\necho 2\n```\n" +
+		"```{.bash docci-retry=2}\necho 3\n```\n" +
+		"```{.python}\nprint(4)\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	require.Len(t, blocks, 3)
+	require.Equal(t, "echo 1\n", blocks[0].Content)
+	require.Equal(t, "2", blocks[1].OutputContains)
+	require.Equal(t, 2, blocks[2].RetryCount)
+}
+
+func TestNamedMarkers(t *testing.T) {
+	markdown := "```bash\necho one\n```\n" +
+		"```bash docci-name=build\necho two\n```\n" +
+		"```bash\necho three\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"build": 2}, MarkerNames(blocks))
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	require.Contains(t, script, "### DOCCI_BLOCK_START_build ###")
+	require.Contains(t, script, "### DOCCI_BLOCK_END_build ###")
+	require.Contains(t, script, "### DOCCI_BLOCK_START_3 ###")
+
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	outputs := executor.ParseBlockOutputs(resp.Stdout, MarkerNames(blocks))
+	require.Equal(t, map[int]string{1: "one", 2: "two", 3: "three"}, outputs)
+
+	// names repeated across merged files keep numeric markers
+	require.Empty(t, MarkerNames([]CodeBlock{{Index: 1, Name: "setup"}, {Index: 2, Name: "setup"}}))
+
+	_, err = ParseTags("```bash docci-name=42")
+	require.ErrorContains(t, err, "not mistaken for a block number")
+}
+
+func TestParseCodeBlocksWithSkipped(t *testing.T) {
+	markdown := "```bash\necho run\n```\n" +
+		"```bash docci-ignore\necho ignored\n```\n" +
+		"```bash docci-if-installed=nonexistent-fake-command\necho missing\n```\n" +
+		"```json\n{}\n```\n" +
+		"<!-- docci-disable -->\n" +
+		"```bash\necho disabled\n```\n" +
+		"<!-- docci-enable -->\n"
+	blocks, skipped, err := ParseCodeBlocksWithSkipped(markdown, "doc.md")
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	require.Len(t, skipped, 3)
+
+	var reasons []string
+	for _, block := range skipped {
+		require.True(t, block.Skipped)
+		require.Equal(t, "doc.md", block.FileName)
+		reasons = append(reasons, block.SkipReason)
+	}
+	require.Equal(t, []string{"docci-ignore", "docci-if-installed=nonexistent-fake-command", "docci-disable"}, reasons)
+	require.Equal(t, 7, skipped[1].LineNumber)
+}
+
+func TestRequiredBlocks(t *testing.T) {
+	blocks, err := ParseCodeBlocks("```bash docci-if-installed=ls docci-required\necho 1\n```\n")
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	require.True(t, blocks[0].Required)
+
+	_, err = ParseCodeBlocks("```bash\necho 1\n```\n```bash docci-if-not-installed=ls docci-required\necho 2\n```\n")
+	require.ErrorContains(t, err, "line 4: block is docci-required but would be skipped by docci-if-not-installed=ls")
+
+	_, err = ParseCodeBlocks("```bash docci-required\necho 1\n```\n")
+	require.ErrorContains(t, err, "docci-required needs docci-os, docci-if-installed, docci-if-not-installed or docci-precondition")
+
+	issues := LintMarkdown("```bash docci-if-installed=nonexistent-fake-command docci-required\necho 1\n```\n")
+	require.Len(t, issues, 1)
+	require.Equal(t, 1, issues[0].Line)
+	require.Contains(t, issues[0].Message, "docci-required")
+}
+
+func TestSandbox(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	// the second block fails, the sandbox is still removed
+	blocks, err := ParseCodeBlocks("```bash\ntouch written.txt\necho \"in $PWD\"\n```\n```bash\nls written.txt\nfalse\n```\n")
+	require.NoError(t, err)
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{Sandbox: true})
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.Contains(t, resp.Stdout, "in "+filepath.Join(tmp, "docci_sandbox."))
+	require.Contains(t, resp.Stdout, "written.txt")
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	// --keep-temp-files leaves the sandbox behind for inspection
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{Sandbox: true, KeepTempFiles: true})
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.Contains(t, resp.Stderr, "Sandbox directory kept at")
+	matches, err := filepath.Glob(filepath.Join(tmp, "docci_sandbox.*", "written.txt"))
+	require.NoError(t, err)
+	require.Len(t, matches, 1)
+
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	require.NotContains(t, script, "DOCCI_SANDBOX")
+}
+
+func TestApplyBaseURL(t *testing.T) {
+	markdown := "```bash docci-wait-for-endpoint=\"${BASE_URL}/health|5\" docci-poll-until=\"curl -s ${BASE_URL}/ready|ok|5\"\ncurl ${BASE_URL}/api\n```\n" +
+		"```bash\necho \"$HOME\"\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	require.Equal(t, "${BASE_URL}/health", blocks[0].WaitForEndpoint)
+
+	// the placeholder without a base URL is an error
+	require.ErrorContains(t, ApplyBaseURL(blocks, ""), "block 1 (line 1): uses ${BASE_URL} but no --base-url was provided")
+
+	require.NoError(t, ApplyBaseURL(blocks, "https://staging.example.com/"))
+	require.Equal(t, "https://staging.example.com/health", blocks[0].WaitForEndpoint)
+	require.Equal(t, "curl -s https://staging.example.com/ready", blocks[0].PollUntilCmd)
+	require.Equal(t, "curl https://staging.example.com/api\n", blocks[0].Content)
+	require.Equal(t, "echo \"$HOME\"\n", blocks[1].Content)
+
+	// blocks without the placeholder do not need a base URL
+	require.NoError(t, ApplyBaseURL(blocks[1:], ""))
+}
+
+func TestNoNetworkBlocks(t *testing.T) {
+	if runtime.GOOS != "linux" || exec.Command("unshare", "-r", "-n", "true").Run() != nil {
+		t.Skip("network namespaces are not available")
+	}
+
+	// only the loopback interface exists inside the namespace
+	blocks, err := ParseCodeBlocks("```bash docci-no-network\nexport X=1\ngrep -c : /proc/net/dev\n```\n```bash\necho \"X=${X:-unset}\"\n```\n")
+	require.NoError(t, err)
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+	outputs := executor.ParseBlockOutputs(resp.Stdout, nil)
+	require.Equal(t, "1", outputs[1])
+	require.Equal(t, "X=unset", outputs[2])
+
+	// a failing command still fails the block
+	blocks, err = ParseCodeBlocks("```bash docci-no-network\nfalse\necho unreachable\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.NotContains(t, resp.Stdout, "unreachable")
+}
+
+func TestTmpdirBlocks(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	// the scratch directory is removed by the exit trap when the block fails
+	blocks, err := ParseCodeBlocks("```bash docci-tmpdir\ntouch \"$DOCCI_TMP/file\"\necho \"in $DOCCI_TMP\"\nfalse\n```\n")
+	require.NoError(t, err)
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.Contains(t, resp.Stdout, "in "+filepath.Join(tmp, "docci_tmp_1."))
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	pt, err := ParseTags("```bash docci-tmpdir docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-tmpdir cannot be combined")
+}
+
+func TestRetryTimeoutBlocks(t *testing.T) {
+	t.Setenv("DOCCI_RETRY_DELAY", "0")
+
+	// without docci-retry the block keeps retrying until it passes
+	counter := filepath.Join(t.TempDir(), "attempts")
+	markdown := "```bash docci-retry-timeout=30 docci-isolate\nn=$(cat \"" + counter + "\" 2>/dev/null || echo 0)\necho $((n + 1)) > \"" + counter + "\"\n[ \"$n\" -ge 4 ]\necho passed\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	script, _, _ := BuildExecutableScript(blocks)
+	require.Contains(t, script, "# Retry logic for block 1 (timeout: 30s)")
+	require.NotContains(t, script, "max_retries")
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+	require.Contains(t, resp.Stdout, "Retry attempt 4 for block 1")
+	require.Contains(t, resp.Stdout, "passed")
+
+	// the timeout stops a block that never passes
+	blocks, err = ParseCodeBlocks("```bash docci-retry-timeout=1 docci-retry-delay=0.2\nfalse\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScript(blocks)
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.Contains(t, resp.Stdout, "Block 1 still failing after 1 seconds of retries")
+
+	// with both, whichever limit is reached first stops the block
+	blocks, err = ParseCodeBlocks("```bash docci-retry=2 docci-retry-timeout=60\nfalse\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScript(blocks)
+	require.Contains(t, script, "# Retry logic for block 1 (max attempts: 2, timeout: 60s)")
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.Contains(t, resp.Stdout, "Retry attempt 2/2 for block 1")
+	require.Contains(t, resp.Stdout, "Block 1 failed after 2 retry attempts")
+	require.NotContains(t, resp.Stdout, "seconds of retries")
+}
+
+func TestStdinFromPreviousBlocks(t *testing.T) {
+	// the previous block's output is still printed, and the next block reads it
+	markdown := "```bash\nprintf 'b\\na\\n'\n```\n```bash docci-stdin-from-previous docci-isolate\nsort | tr '\\n' ,\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	script, _, _ := BuildExecutableScript(blocks)
+	require.Contains(t, script, "# Pass the output of block 1 to the next block's stdin")
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+	require.Contains(t, resp.Stdout, "b\na\n")
+	require.Contains(t, resp.Stdout, "a,b,")
+
+	_, err = ParseCodeBlocks("```bash docci-stdin-from-previous\ncat\n```\n")
+	require.ErrorContains(t, err, "cannot be used on the first block")
+
+	_, err = ParseCodeBlocks("```bash docci-background\nsleep 1\n```\n```bash docci-stdin-from-previous\ncat\n```\n")
+	require.ErrorContains(t, err, "cannot read the output of block 1")
+}
+
+func TestRetryAllBlocks(t *testing.T) {
+	markdown := "```bash\necho one\n```\n" +
+		"```bash docci-retry=5\necho two\n```\n" +
+		"```bash docci-background\nsleep 1\n```\n" +
+		"```bash docci-assert-failure\nfalse\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{RetryAll: 3})
+	require.Contains(t, script, "# Retry logic for block 1 (max attempts: 3)")
+	// a block's own docci-retry wins over the flag
+	require.Contains(t, script, "# Retry logic for block 2 (max attempts: 5)")
+	require.NotContains(t, script, "# Retry logic for block 3")
+	require.NotContains(t, script, "# Retry logic for block 4")
+	// the parsed blocks are left as they were
+	require.Zero(t, blocks[0].RetryCount)
+
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	require.NotContains(t, script, "# Retry logic for block 1")
+}
+
+func TestPreconditionBlocks(t *testing.T) {
+	dir := t.TempDir()
+	markdown := "```bash docci-precondition=\"test -d '" + dir + "'\"\necho dir exists\n```\n" +
+		"```bash docci-precondition=\"test -d '" + dir + "/missing'\"\necho never\n```\n" +
+		"```bash\necho after\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	script, _, _ := BuildExecutableScript(blocks)
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+	require.Contains(t, resp.Stdout, "dir exists")
+	require.Contains(t, resp.Stdout, "Skipping block 2: precondition failed: test -d")
+	require.NotContains(t, resp.Stdout, "never")
+	require.Contains(t, resp.Stdout, "after")
+
+	// with docci-required the failed check stops the run
+	blocks, err = ParseCodeBlocks("```bash docci-precondition=false docci-required\necho never\n```\n```bash\necho after\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScript(blocks)
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.Contains(t, resp.Stderr, "Block 1: precondition failed: false")
+	require.NotContains(t, resp.Stdout, "after")
+}
+
+func TestRepeatUntilFileBlocks(t *testing.T) {
+	dir := t.TempDir()
+	counter := filepath.Join(dir, "runs")
+	flag := filepath.Join(dir, "done.flag")
+
+	// the third run writes the file, which ends the loop
+	markdown := "```bash docci-repeat-until-file=\"" + flag + "|30\"\nn=$(( $(cat \"" + counter + "\" 2>/dev/null || echo 0) + 1 ))\necho $n > \"" + counter + "\"\n" +
+		"echo \"run $n\"\nif [ $n -ge 3 ]; then touch \"" + flag + "\"; fi\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	script, _, _ := BuildExecutableScript(blocks)
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error)
+	require.Contains(t, resp.Stdout, "run 3")
+	require.NotContains(t, resp.Stdout, "run 4")
+	require.Contains(t, resp.Stdout, "running block 1 again")
+
+	// the timeout fails the run when the file never appears
+	blocks, err = ParseCodeBlocks("```bash docci-repeat-until-file=\"" + filepath.Join(dir, "never") + "|1\"\necho waiting\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScript(blocks)
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.Contains(t, resp.Stderr, "still does not exist after 1 seconds")
+}
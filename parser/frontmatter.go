@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FrontMatter holds metadata from a leading YAML front matter section
+type FrontMatter struct {
+	Title string
+	Order int // docci-order: files with a lower value run first when merging, defaults to 0
+	// docci-allow-parallel-with: other markdown files this file is declared safe to run alongside.
+	// Recorded only, files still run one after another.
+	AllowParallelWith []string
+}
+
+// ParseFrontMatter extracts metadata from the lines between leading `---` markers.
+// Only simple top-level `key: value` pairs are read; files without front matter return an empty FrontMatter.
+// An error is returned when a known field has an invalid value.
+func ParseFrontMatter(markdown string) (FrontMatter, error) {
+	var fm FrontMatter
+
+	lines := splitIntoLines(markdown)
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "---" {
+		return fm, nil
+	}
+
+	var fields = make(map[string]string)
+	closed := false
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "---" || trimmed == "..." {
+			closed = true
+			break
+		}
+
+		// nested values and list items are not supported
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		fields[strings.TrimSpace(key)] = unquoteFrontMatterValue(strings.TrimSpace(value))
+	}
+
+	// an unterminated block is not front matter, just a horizontal rule
+	if !closed {
+		return fm, nil
+	}
+
+	fm.Title = fields["title"]
+	if order, ok := fields["docci-order"]; ok {
+		value, err := strconv.Atoi(order)
+		if err != nil {
+			return FrontMatter{}, fmt.Errorf("docci-order must be an integer, got %q", order)
+		}
+		fm.Order = value
+	}
+	if files, ok := fields["docci-allow-parallel-with"]; ok {
+		for _, file := range strings.Split(files, ",") {
+			if file = strings.TrimSpace(file); file != "" {
+				fm.AllowParallelWith = append(fm.AllowParallelWith, file)
+			}
+		}
+	}
+	return fm, nil
+}
+
+// unquoteFrontMatterValue removes matching single or double quotes around a value
+func unquoteFrontMatterValue(value string) string {
+	if len(value) >= 2 {
+		if (strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"")) ||
+			(strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'")) {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
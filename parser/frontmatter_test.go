@@ -0,0 +1,41 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFrontMatter(t *testing.T) {
+	fm, err := ParseFrontMatter("---\ntitle: \"Getting Started\"\nauthor: someone\n---\n# Heading\n")
+	require.NoError(t, err)
+	require.Equal(t, "Getting Started", fm.Title)
+	require.Zero(t, fm.Order)
+
+	fm, err = ParseFrontMatter("---\ntags:\n  title: nested\ntitle: 'Top Level'\n---\n")
+	require.NoError(t, err)
+	require.Equal(t, "Top Level", fm.Title)
+
+	// no front matter
+	fm, err = ParseFrontMatter("# Heading\n---\ntitle: nope\n---\n")
+	require.NoError(t, err)
+	require.Empty(t, fm.Title)
+
+	// unterminated front matter is ignored
+	fm, err = ParseFrontMatter("---\ntitle: open\n")
+	require.NoError(t, err)
+	require.Empty(t, fm.Title)
+
+	// docci-order
+	fm, err = ParseFrontMatter("---\ndocci-order: -2\n---\n")
+	require.NoError(t, err)
+	require.Equal(t, -2, fm.Order)
+
+	_, err = ParseFrontMatter("---\ndocci-order: first\n---\n")
+	require.ErrorContains(t, err, "docci-order must be an integer")
+
+	// docci-allow-parallel-with
+	fm, err = ParseFrontMatter("---\ndocci-allow-parallel-with: \"b.md, c.md\"\n---\n")
+	require.NoError(t, err)
+	require.Equal(t, []string{"b.md", "c.md"}, fm.AllowParallelWith)
+}
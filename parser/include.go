@@ -0,0 +1,108 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/reecepbcups/docci/types"
+)
+
+// includeContext is the file a parse reads docci-include paths relative to
+type includeContext struct {
+	path  string   // absolute path of the file being parsed
+	stack []string // absolute paths of the files that included it, outermost first
+}
+
+// ParseCodeBlocksWithIncludes is ParseCodeBlocksWithSkipped for the markdown read from filePath.
+// Each <!-- docci-include: path --> comment is replaced by the blocks of the fragment it names,
+// resolved relative to the including file, and blocks are numbered in the order they appear once
+// every fragment is inlined. Fragment blocks have FileName set to the fragment's base name.
+func ParseCodeBlocksWithIncludes(markdown string, filePath string, fileName string) ([]CodeBlock, []CodeBlock, error) {
+	return ParseCodeBlocksWithOptions(markdown, filePath, fileName, types.DocciOpts{})
+}
+
+// ParseCodeBlocksWithOptions is ParseCodeBlocksWithIncludes for a run with opts. With
+// opts.PowerShell only PowerShellLangs blocks are parsed, and tags they cannot run are rejected.
+func ParseCodeBlocksWithOptions(markdown string, filePath string, fileName string, opts types.DocciOpts) ([]CodeBlock, []CodeBlock, error) {
+	path, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolve %s: %w", filePath, err)
+	}
+	return parseCodeBlocks(markdown, fileName, &includeContext{path: path}, opts.PowerShell)
+}
+
+// includeDirective returns the path of a <!-- docci-include: path --> comment
+func includeDirective(line string) (string, bool) {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "<!--") || !strings.HasSuffix(trimmed, "-->") {
+		return "", false
+	}
+	inner := strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(trimmed, "<!--"), "-->"))
+	path, ok := strings.CutPrefix(inner, "docci-include:")
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSpace(path), true
+}
+
+// include parses the fragment a docci-include directive in inc names. The fragment shares docci-name
+// lookups with the files including it, so its blocks can depend on blocks that came before it.
+func (s *blockScan) include(target string, inc *includeContext) ([]CodeBlock, []CodeBlock, error) {
+	markdown, fragment, err := readInclude(target, inc)
+	if err != nil {
+		return nil, nil, err
+	}
+	blocks, skipped, err := s.scan(markdown, filepath.Base(fragment.path), fragment)
+	if err != nil {
+		return nil, nil, fmt.Errorf("docci-include %s: %w", target, err)
+	}
+
+	// blocks from fragments the fragment included already know their own directory
+	for i := range blocks {
+		if blocks[i].IncludeDir == "" {
+			blocks[i].IncludeDir = filepath.Dir(fragment.path)
+		}
+	}
+	return blocks, skipped, nil
+}
+
+// readInclude reads the fragment a docci-include directive in inc names, resolved relative to the
+// including file, and returns it with the context to parse it in. Including a file that is already
+// being included is an error.
+func readInclude(target string, inc *includeContext) (string, *includeContext, error) {
+	if target == "" {
+		return "", nil, fmt.Errorf("docci-include needs a file path")
+	}
+	path := target
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(inc.path), path)
+	}
+	path = filepath.Clean(path)
+
+	stack := append(slices.Clone(inc.stack), inc.path)
+	if slices.Contains(stack, path) {
+		chain := make([]string, 0, len(stack)+1)
+		for _, file := range append(stack[slices.Index(stack, path):], path) {
+			chain = append(chain, filepath.Base(file))
+		}
+		return "", nil, fmt.Errorf("docci-include cycle: %s", strings.Join(chain, " -> "))
+	}
+
+	markdown, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("docci-include %s: %w", target, err)
+	}
+	return string(markdown), &includeContext{path: path, stack: stack}, nil
+}
+
+// blockDir is the directory a block's relative docci-stdin-file, docci-fixture,
+// docci-output-json-schema and docci-assert-json-equals-file paths resolve against
+func blockDir(block CodeBlock, markdownDir string) string {
+	if block.IncludeDir != "" {
+		return block.IncludeDir
+	}
+	return markdownDir
+}
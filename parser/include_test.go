@@ -0,0 +1,79 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCodeBlocksWithIncludes(t *testing.T) {
+	dir := t.TempDir()
+	shared := filepath.Join(dir, "shared")
+	require.NoError(t, os.MkdirAll(filepath.Join(shared, "inputs"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(shared, "inputs", "answers.txt"), []byte("y\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(shared, "setup.md"), []byte("# Setup\n\n"+
+		"```bash docci-background\nsleep 10\n```\n"+
+		"```bash docci-background-kill=1 docci-stdin-file=\"inputs/answers.txt\"\nread answer\n```\n"+
+		"<!-- docci-include: env.md -->\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(shared, "env.md"), []byte("```bash docci-name=env\nexport A=1\n```\n"), 0644))
+
+	path := filepath.Join(dir, "guide.md")
+	markdown := "```bash\necho first\n```\n" +
+		"<!-- docci-include: shared/setup.md -->\n" +
+		"```bash docci-skip-on-failure-of=env\necho last\n```\n"
+	blocks, _, err := ParseCodeBlocksWithIncludes(markdown, path, "")
+	require.NoError(t, err)
+	require.Len(t, blocks, 5)
+
+	// fragment blocks are numbered where they were included, keeping their own line numbers
+	for i, block := range blocks {
+		require.Equal(t, i+1, block.Index)
+	}
+	require.Equal(t, "", blocks[0].FileName)
+	require.Equal(t, "setup.md", blocks[1].FileName)
+	require.Equal(t, 3, blocks[1].LineNumber)
+	require.Equal(t, 2, blocks[2].BackgroundKill)
+	require.Equal(t, "env.md", blocks[3].FileName)
+	require.Equal(t, 5, blocks[4].LineNumber)
+
+	// relative paths in a fragment resolve against the fragment's directory
+	require.NoError(t, ResolveStdinFiles(blocks, dir))
+	require.Equal(t, filepath.Join(shared, "inputs", "answers.txt"), blocks[2].StdinFile)
+
+	// without the file's path the directive is left alone
+	blocks, err = ParseCodeBlocks("```bash\necho first\n```\n<!-- docci-include: shared/setup.md -->\n")
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+
+	// includes inside a docci-disable region are not followed
+	blocks, _, err = ParseCodeBlocksWithIncludes("<!-- docci-disable -->\n<!-- docci-include: missing.md -->\n<!-- docci-enable -->\n", path, "")
+	require.NoError(t, err)
+	require.Empty(t, blocks)
+}
+
+func TestParseCodeBlocksWithIncludesErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "guide.md")
+
+	_, _, err := ParseCodeBlocksWithIncludes("text\n<!-- docci-include: missing.md -->\n", path, "")
+	require.ErrorContains(t, err, "line 2: docci-include missing.md")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.md"), []byte("<!-- docci-include: b.md -->\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.md"), []byte("```bash\necho b\n```\n<!-- docci-include: ./a.md -->\n"), 0644))
+	_, _, err = ParseCodeBlocksWithIncludes("<!-- docci-include: a.md -->\n", path, "")
+	require.ErrorContains(t, err, "docci-include cycle: a.md -> b.md -> a.md")
+
+	// a file including itself is a cycle too
+	_, _, err = ParseCodeBlocksWithIncludes("<!-- docci-include: guide.md -->\n", path, "")
+	require.ErrorContains(t, err, "docci-include cycle: guide.md -> guide.md")
+
+	// names are shared, so a fragment cannot reuse one from the including file
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "named.md"), []byte("```bash docci-name=build\nmake\n```\n"), 0644))
+	_, _, err = ParseCodeBlocksWithIncludes("```bash docci-name=build\nmake\n```\n<!-- docci-include: named.md -->\n", path, "")
+	require.ErrorContains(t, err, "docci-name=build is already used")
+
+	_, _, err = ParseCodeBlocksWithIncludes("<!-- docci-include: -->\n", path, "")
+	require.ErrorContains(t, err, "docci-include needs a file path")
+}
@@ -0,0 +1,88 @@
+package parser
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// InjectTag adds tag to the fence line of the block with the given index (as numbered in the run)
+// and returns the updated markdown. A tag with the same name or alias already on the fence is
+// replaced, other tags and the language are kept. The result must still parse.
+func InjectTag(markdown string, blockIndex int, tag string) (string, error) {
+	return injectTag(markdown, nil, blockIndex, tag)
+}
+
+// InjectTagWithIncludes is InjectTag for the markdown read from filePath, with blocks numbered as
+// in a run once docci-include fragments are inlined. A block from a fragment is an error, since
+// its fence is in the fragment's file.
+func InjectTagWithIncludes(markdown string, filePath string, blockIndex int, tag string) (string, error) {
+	path, err := filepath.Abs(filePath)
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", filePath, err)
+	}
+	return injectTag(markdown, &includeContext{path: path}, blockIndex, tag)
+}
+
+// injectTag sets tag on a block of markdown, following docci-include directives when inc is set
+func injectTag(markdown string, inc *includeContext, blockIndex int, tag string) (string, error) {
+	if match := tagRe.FindString(tag); match == "" || match != tag {
+		return "", fmt.Errorf("invalid tag %q, expected a single docci-* tag like docci-retry=3", tag)
+	}
+	name, _, _ := strings.Cut(tag, "=")
+	canonical, err := TagAlias(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := ParseTags("```bash " + tag); err != nil {
+		return "", fmt.Errorf("invalid tag %q: %w", tag, err)
+	}
+
+	blocks, _, err := parseCodeBlocks(markdown, "", inc, false)
+	if err != nil {
+		return "", err
+	}
+	if blockIndex < 1 || blockIndex > len(blocks) {
+		return "", fmt.Errorf("block %d not found, the file has %d runnable block(s)", blockIndex, len(blocks))
+	}
+	if block := blocks[blockIndex-1]; block.includeLine != 0 {
+		return "", fmt.Errorf("block %d is in %s, included on line %d; tag it in that file instead", blockIndex, block.FileName, block.includeLine)
+	}
+	lineNumber := blocks[blockIndex-1].LineNumber
+
+	lines := strings.SplitAfter(markdown, "\n")
+	body := strings.TrimRight(lines[lineNumber-1], "\r\n")
+	ending := lines[lineNumber-1][len(body):]
+
+	// drop the tag if it is already there, under any of its names
+	body = renderTagRe.ReplaceAllStringFunc(body, func(match string) string {
+		existing, _, _ := strings.Cut(strings.TrimSpace(match), "=")
+		if existingCanonical, err := TagAlias(existing); err == nil && existingCanonical == canonical {
+			return ""
+		}
+		return match
+	})
+
+	// tags in an attribute list stay inside its braces
+	body = strings.TrimRight(body, " \t")
+	if attributeListRe.MatchString(body) {
+		body = strings.TrimSuffix(body, "}") + " " + tag + "}"
+	} else {
+		body += " " + tag
+	}
+
+	tags, err := ParseTags(body)
+	if err != nil {
+		return "", fmt.Errorf("line %d: %w", lineNumber, err)
+	}
+	if err := tags.Validate(lineNumber); err != nil {
+		return "", err
+	}
+
+	lines[lineNumber-1] = body + ending
+	updated := strings.Join(lines, "")
+	if _, _, err := parseCodeBlocks(updated, "", inc, false); err != nil {
+		return "", err
+	}
+	return updated, nil
+}
@@ -0,0 +1,63 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInjectTag(t *testing.T) {
+	markdown := "# Doc\r\n" +
+		"```bash\necho one\n```\n" +
+		"```json\n{}\n```\n" +
+		"```bash docci-retry=2 docci-output-contains=\"two\"\necho two\n```\n" +
+		"```{.bash .numberLines}\necho three\n```\n"
+
+	// a new tag is appended, keeping the line ending of the rest of the file
+	updated, err := InjectTag(markdown, 1, "docci-isolate")
+	require.NoError(t, err)
+	require.Contains(t, updated, "# Doc\r\n```bash docci-isolate\necho one\n")
+
+	// an existing tag is replaced, even when written as an alias
+	updated, err = InjectTag(markdown, 2, "docci-retry=5")
+	require.NoError(t, err)
+	require.Contains(t, updated, "```bash docci-output-contains=\"two\" docci-retry=5\necho two\n")
+	updated, err = InjectTag(markdown, 2, `docci-contains="second"`)
+	require.NoError(t, err)
+	require.Contains(t, updated, "```bash docci-retry=2 docci-contains=\"second\"\necho two\n")
+
+	// attribute lists keep their braces
+	updated, err = InjectTag(markdown, 3, "docci-retry=1")
+	require.NoError(t, err)
+	require.Contains(t, updated, "```{.bash .numberLines docci-retry=1}\necho three\n")
+
+	_, err = InjectTag(markdown, 4, "docci-isolate")
+	require.ErrorContains(t, err, "block 4 not found, the file has 3 runnable block(s)")
+	_, err = InjectTag(markdown, 1, "docci-retry=abc")
+	require.ErrorContains(t, err, "invalid retry count")
+	_, err = InjectTag(markdown, 1, "docci-isolate docci-retry=2")
+	require.ErrorContains(t, err, "expected a single docci-* tag")
+	_, err = InjectTag(markdown, 1, "docci-nope")
+	require.Error(t, err)
+
+	// combinations that do not validate leave the file alone
+	_, err = InjectTag(markdown, 2, "docci-background")
+	require.ErrorContains(t, err, "line 8: Cannot use both")
+}
+
+func TestInjectTagWithIncludes(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "setup.md"), []byte("```bash\necho setup\n```\n"), 0644))
+	path := filepath.Join(dir, "guide.md")
+	markdown := "<!-- docci-include: setup.md -->\n```bash\necho guide\n```\n"
+
+	// blocks are numbered as in the run, so the file's own block comes after the fragment's
+	updated, err := InjectTagWithIncludes(markdown, path, 2, "docci-retry=2")
+	require.NoError(t, err)
+	require.Equal(t, "<!-- docci-include: setup.md -->\n```bash docci-retry=2\necho guide\n```\n", updated)
+
+	_, err = InjectTagWithIncludes(markdown, path, 1, "docci-retry=2")
+	require.ErrorContains(t, err, "block 1 is in setup.md, included on line 1; tag it in that file instead")
+}
@@ -0,0 +1,101 @@
+package parser
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxSaneRetryCount is the highest docci-retry value the linter accepts without flagging it
+const maxSaneRetryCount = 100
+
+// LintIssue is a single problem found while statically checking a markdown file
+type LintIssue struct {
+	Line    int
+	Message string
+}
+
+func (i LintIssue) String() string {
+	return fmt.Sprintf("line %d: %s", i.Line, i.Message)
+}
+
+// LintMarkdown statically checks a markdown file and reports every issue found,
+// rather than stopping at the first one like ParseCodeBlocks does.
+func LintMarkdown(markdown string) []LintIssue {
+	return lintMarkdown(markdown, nil)
+}
+
+// LintMarkdownWithIncludes is LintMarkdown for the markdown read from filePath, so docci-include
+// fragments are checked too. Issues in a fragment are reported on the line of its directive.
+func LintMarkdownWithIncludes(markdown string, filePath string) ([]LintIssue, error) {
+	path, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", filePath, err)
+	}
+	return lintMarkdown(markdown, &includeContext{path: path}), nil
+}
+
+// lintMarkdown runs the same scan and checks as parseCodeBlocks, collecting every problem as an issue
+func lintMarkdown(markdown string, inc *includeContext) []LintIssue {
+	scan := &blockScan{blockNames: make(map[string]int), lint: true}
+	if _, err := ParseFrontMatter(markdown); err != nil {
+		scan.issues = append(scan.issues, LintIssue{Line: 1, Message: "front matter: " + err.Error()})
+	}
+
+	// scan and check only return errors when they are not linting
+	codeBlocks, _, _ := scan.scan(markdown, "", inc)
+	scan.check(codeBlocks)
+
+	sort.SliceStable(scan.issues, func(i, j int) bool { return scan.issues[i].Line < scan.issues[j].Line })
+	return scan.issues
+}
+
+// parallelDecl is a block's docci-allow-parallel-with declaration
+type parallelDecl struct {
+	line int
+	name string   // the declaring block's docci-name, if any
+	with []string // names of the blocks it may run alongside
+}
+
+// parallelDeclIssues reports docci-allow-parallel-with names that do not match a docci-name in the file
+func parallelDeclIssues(decls []parallelDecl, blockNames map[string]int) []LintIssue {
+	var issues []LintIssue
+	for _, decl := range decls {
+		for _, name := range decl.with {
+			if name == decl.name {
+				issues = append(issues, LintIssue{Line: decl.line, Message: fmt.Sprintf("docci-allow-parallel-with=%s names the block itself", name)})
+			} else if _, ok := blockNames[name]; !ok {
+				issues = append(issues, LintIssue{Line: decl.line, Message: fmt.Sprintf("docci-allow-parallel-with=%s does not match a docci-name in this file", name)})
+			}
+		}
+	}
+	return issues
+}
+
+// lintTagValues checks tag values that parse fine but would misbehave at runtime
+func lintTagValues(tags MetaTag, lineNumber int) []LintIssue {
+	var issues []LintIssue
+
+	if tags.IfFileNotExists != "" {
+		if strings.ContainsAny(tags.IfFileNotExists, "\"`") || strings.IndexFunc(tags.IfFileNotExists, unicode.IsControl) != -1 {
+			issues = append(issues, LintIssue{Line: lineNumber, Message: fmt.Sprintf("docci-if-file-not-exists path contains invalid characters: %q", tags.IfFileNotExists)})
+		}
+	}
+
+	if tags.WaitForEndpoint != "" {
+		// the --base-url placeholder is only known at run time, so check the rest of the URL
+		u, err := url.Parse(strings.Replace(tags.WaitForEndpoint, BaseURLPlaceholder, "http://localhost", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			issues = append(issues, LintIssue{Line: lineNumber, Message: fmt.Sprintf("docci-wait-for-endpoint is not a valid http(s) URL: %s", tags.WaitForEndpoint)})
+		}
+	}
+
+	if tags.RetryCount > maxSaneRetryCount {
+		issues = append(issues, LintIssue{Line: lineNumber, Message: fmt.Sprintf("docci-retry=%d is unusually high (max %d)", tags.RetryCount, maxSaneRetryCount)})
+	}
+
+	return issues
+}
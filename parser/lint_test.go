@@ -0,0 +1,103 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLintMarkdownReportsAllIssues(t *testing.T) {
+	markdown := "```bash docci-bad-tag\necho 1\n```\n" +
+		"```bash docci-wait-for-endpoint=\"localhost:8080|5\"\necho 2\n```\n" +
+		"```bash docci-retry=500\necho 3\n```\n" +
+		"```bash docci-output-contains=\"x\" docci-background\necho 4\n```\n" +
+		"```bash docci-background-kill=7\necho 5\n```\n"
+
+	issues := LintMarkdown(markdown)
+	require.Len(t, issues, 5)
+	require.Contains(t, issues[0].String(), "line 1: unknown tag")
+	require.Contains(t, issues[1].Message, "not a valid http(s) URL")
+	require.Contains(t, issues[2].Message, "docci-retry=500 is unusually high")
+	require.Contains(t, issues[3].Message, "Cannot use both docci-output-contains and docci-background")
+	require.Contains(t, issues[4].Message, "docci-background-kill=7 references a non-existent background process")
+}
+
+func TestLintMarkdownCleanFile(t *testing.T) {
+	markdown, err := os.ReadFile("../examples/base.md")
+	require.NoError(t, err)
+	require.Empty(t, LintMarkdown(string(markdown)))
+}
+
+func TestLintMarkdownSkipsDisabledRegion(t *testing.T) {
+	markdown := "<!-- docci-disable -->\n```bash docci-bad-tag\necho 1\n```\n<!-- docci-enable -->\n" +
+		"```bash docci-other-bad-tag\necho 2\n```\n"
+
+	issues := LintMarkdown(markdown)
+	require.Len(t, issues, 1)
+	require.Equal(t, 6, issues[0].Line)
+}
+
+func TestLintMarkdownBlockNames(t *testing.T) {
+	markdown := "```bash docci-skip-on-failure-of=build\necho 1\n```\n" +
+		"```bash docci-name=build\necho 2\n```\n" +
+		"```bash docci-name=build\necho 3\n```\n"
+
+	issues := LintMarkdown(markdown)
+	require.Len(t, issues, 2)
+	require.Contains(t, issues[0].Message, "does not match a docci-name on an earlier block")
+	require.Contains(t, issues[1].Message, "already used by the block on line 4")
+}
+
+func TestLintMarkdownAllowParallelWith(t *testing.T) {
+	markdown := "```bash docci-name=lint docci-allow-parallel-with=\"unit,lint\"\necho 1\n```\n" +
+		"```bash docci-name=unit docci-allow-parallel-with=e2e\necho 2\n```\n"
+
+	issues := LintMarkdown(markdown)
+	require.Len(t, issues, 2)
+	require.Contains(t, issues[0].Message, "docci-allow-parallel-with=lint names the block itself")
+	require.Equal(t, 4, issues[1].Line)
+	require.Contains(t, issues[1].Message, "docci-allow-parallel-with=e2e does not match a docci-name in this file")
+}
+
+func TestLintMarkdownBaseURLPlaceholder(t *testing.T) {
+	markdown := "```bash docci-wait-for-endpoint=\"${BASE_URL}/health|5\"\necho 1\n```\n" +
+		"```bash docci-wait-for-endpoint=\"${BASE_URL}|5\"\necho 2\n```\n"
+	require.Empty(t, LintMarkdown(markdown))
+}
+
+func TestLintMarkdownWithIncludes(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "setup.md"), []byte("```bash docci-name=setup\necho 1\n```\n"+
+		"```bash docci-retry=500\necho 2\n```\n"), 0644))
+
+	markdown := "---\ndocci-order: first\n---\n" +
+		"<!-- docci-include: setup.md -->\n" +
+		"```bash docci-skip-on-failure-of=setup docci-stdin-from-previous\necho 3\n```\n" +
+		"<!-- docci-include: missing.md -->\n"
+	issues, err := LintMarkdownWithIncludes(markdown, filepath.Join(dir, "guide.md"))
+	require.NoError(t, err)
+	require.Len(t, issues, 3)
+	require.Equal(t, 1, issues[0].Line)
+	require.Contains(t, issues[0].Message, "front matter: docci-order must be an integer")
+	// the fragment's issue is reported on its directive, and its names are known to the blocks after it
+	require.Equal(t, 4, issues[1].Line)
+	require.Contains(t, issues[1].Message, "docci-include setup.md: line 4: docci-retry=500 is unusually high")
+	require.Equal(t, 8, issues[2].Line)
+	require.Contains(t, issues[2].Message, "docci-include missing.md")
+}
+
+func TestLintMarkdownBlockOrderChecks(t *testing.T) {
+	markdown := "```bash docci-stdin-from-previous\ncat\n```\n" +
+		"```bash docci-concurrent-group=a\necho 1\n```\n" +
+		"```bash\necho 2\n```\n" +
+		"```bash docci-concurrent-group=a\necho 3\n```\n"
+
+	issues := LintMarkdown(markdown)
+	require.Len(t, issues, 2)
+	require.Equal(t, 1, issues[0].Line)
+	require.Contains(t, issues[0].Message, "docci-stdin-from-previous cannot be used on the first block")
+	require.Equal(t, 10, issues[1].Line)
+	require.Contains(t, issues[1].Message, "docci-concurrent-group=a blocks must be consecutive")
+}
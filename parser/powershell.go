@@ -0,0 +1,70 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/reecepbcups/docci/types"
+)
+
+// PowerShellLangs are the fence languages that run with --powershell, in place of ValidLangs
+var PowerShellLangs = []string{"powershell", "pwsh", "ps1"}
+
+// powerShellTags are the tags PowerShell blocks support. The rest generate bash, so they are
+// rejected instead of silently doing nothing.
+var powerShellTags = []string{
+	TagIgnore, TagOutputContains, TagOutputCount, TagOS, TagRequired, TagIfInstalled, TagIfNotInstalled,
+	TagStripANSI, TagOutputSort, TagTrimOutput, TagOutputJSONSchema, TagAssertJSONEquals, TagDecodeOutput,
+	TagOutputStartsWith, TagOutputEndsWith, TagAssertLineCount,
+}
+
+// runnableLangs returns the fence languages that run with or without --powershell. In PowerShell
+// mode only PowerShellLangs blocks run and bash blocks are left alone like any other language.
+func runnableLangs(powerShell bool) []string {
+	if powerShell {
+		return PowerShellLangs
+	}
+	return ValidLangs
+}
+
+// checkPowerShellTags rejects tags on a fence line that PowerShell blocks do not support
+func checkPowerShellTags(line string) error {
+	for _, tag := range tagRe.FindAllString(stripAttributeBrace(line), -1) {
+		name, _, _ := strings.Cut(tag, "=")
+		canonical, err := TagAlias(strings.TrimSpace(name))
+		if err != nil {
+			return err
+		}
+		if !contains(powerShellTags, canonical) {
+			return fmt.Errorf("%s is not supported in PowerShell blocks (supported: %s)", canonical, strings.Join(powerShellTags, ", "))
+		}
+	}
+	return nil
+}
+
+// BuildPowerShellScript is BuildExecutableScriptWithOptions for --powershell. Blocks run in order
+// in one PowerShell session, each between the same output markers the bash script writes, and the
+// run stops at the first block that throws or whose last native command fails.
+func BuildPowerShellScript(blocks []CodeBlock, opts types.DocciOpts) (string, map[int]string, map[int]bool) {
+	var script strings.Builder
+	validationMap := make(map[int]string)
+
+	script.WriteString(powerShellHeaderTemplate)
+	for _, block := range normalizeBlocksTypography(blocks, opts.FixTypography) {
+		script.WriteString(replaceTemplateVars(powerShellBlockTemplate, map[string]string{
+			"INDEX":     strconv.Itoa(block.Index),
+			"FILE_INFO": formatFileInfo(block.FileName),
+		}))
+		// written as is, so the block's own text never goes through template substitution
+		script.WriteString(strings.TrimSuffix(block.Content, "\n") + "\n")
+		script.WriteString(replaceTemplateVars(powerShellBlockEndTemplate, map[string]string{
+			"INDEX": strconv.Itoa(block.Index),
+		}))
+
+		if block.OutputContains != "" {
+			validationMap[block.Index] = block.OutputContains
+		}
+	}
+	return script.String(), validationMap, make(map[int]bool)
+}
@@ -0,0 +1,79 @@
+package parser
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/reecepbcups/docci/executor"
+	"github.com/reecepbcups/docci/types"
+	"github.com/stretchr/testify/require"
+)
+
+const powerShellMarkdown = "```bash\necho from-bash\n```\n" +
+	"```powershell docci-output-contains=\"hello\"\n$name = 'hello'\nWrite-Output $name\n```\n" +
+	"```pwsh\nWrite-Output \"$name again\"\n```\n"
+
+func TestPowerShellMode(t *testing.T) {
+	// bash docs are unaffected unless PowerShell is switched on
+	blocks, err := ParseCodeBlocks(powerShellMarkdown)
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	require.Equal(t, "bash", blocks[0].Language)
+
+	// the mode is per parse, so the bash parse above is not affected by this one
+	pwsh := types.DocciOpts{PowerShell: true}
+	blocks, _, err = ParseCodeBlocksWithOptions(powerShellMarkdown, "README.md", "", pwsh)
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	require.Equal(t, "powershell", blocks[0].Language)
+	require.Equal(t, 1, blocks[0].Index)
+
+	script, validationMap, _ := BuildPowerShellScript(blocks, types.DocciOpts{})
+	require.Contains(t, script, "Write-Output '### DOCCI_BLOCK_START_1 ###'\n")
+	require.Contains(t, script, "$name = 'hello'\nWrite-Output $name\n}")
+	require.Contains(t, script, "Write-Output '### DOCCI_BLOCK_END_2 ###'\n")
+	require.NotContains(t, script, "from-bash")
+	require.Equal(t, map[int]string{1: "hello"}, validationMap)
+
+	// tags that generate bash are rejected rather than ignored
+	_, _, err = ParseCodeBlocksWithOptions("```powershell docci-retry=2\nWrite-Output hi\n```\n", "README.md", "", pwsh)
+	require.ErrorContains(t, err, "line 1: docci-retry is not supported in PowerShell blocks")
+	_, _, err = ParseCodeBlocksWithOptions("```bash docci-exec\necho hi\n```\n", "README.md", "", pwsh)
+	require.ErrorContains(t, err, "docci-exec is not supported in PowerShell blocks")
+	_, _, err = ParseCodeBlocksWithOptions("```ps1 docci-output-count=\"a:1\" docci-trim-output=tail:1\nWrite-Output a\n```\n", "README.md", "", pwsh)
+	require.NoError(t, err)
+
+	blocks, err = ParseCodeBlocks(powerShellMarkdown)
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	require.Equal(t, "bash", blocks[0].Language)
+
+	require.Empty(t, LintMarkdown("```pwsh docci-output-contains=\"x\"\nWrite-Output x\n```\n"))
+}
+
+func TestPowerShellScriptRuns(t *testing.T) {
+	if _, err := exec.LookPath("pwsh"); err != nil {
+		t.Skip("pwsh is not installed")
+	}
+	pwsh := types.DocciOpts{PowerShell: true}
+	blocks, _, err := ParseCodeBlocksWithOptions(powerShellMarkdown, "README.md", "", pwsh)
+	require.NoError(t, err)
+	script, _, _ := BuildPowerShellScript(blocks, types.DocciOpts{})
+	resp, err := executor.ExecWithOptions(script, pwsh)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+
+	outputs := executor.ParseBlockOutputs(resp.Stdout, nil)
+	require.Equal(t, "hello", outputs[1])
+	require.Equal(t, "hello again", outputs[2])
+
+	// a throwing block stops the run
+	blocks, _, err = ParseCodeBlocksWithOptions("```pwsh\nthrow 'broken'\n```\n```pwsh\nWrite-Output unreachable\n```\n", "README.md", "", pwsh)
+	require.NoError(t, err)
+	script, _, _ = BuildPowerShellScript(blocks, types.DocciOpts{})
+	resp, err = executor.ExecWithOptions(script, pwsh)
+	require.NoError(t, err)
+	require.Error(t, resp.Error)
+	require.Contains(t, resp.Stderr, "Block 1 failed: broken")
+	require.NotContains(t, resp.Stdout, "unreachable")
+}
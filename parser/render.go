@@ -0,0 +1,56 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+)
+
+// renderTagRe matches a tag on a fence line together with the whitespace before it
+var renderTagRe = regexp.MustCompile(`[ \t]*` + tagRe.String())
+
+// attributeOpenRe matches the whitespace left after an attribute list's "{" when its first entry was a tag
+var attributeOpenRe = regexp.MustCompile(`\{[ \t]+`)
+
+// RenderMarkdown returns markdown with the docci tags removed from every code fence, so a tested
+// document can be published as is. Everything other than the fence info strings is kept verbatim.
+func RenderMarkdown(markdown string) string {
+	var out strings.Builder
+	inBlock := false
+
+	for _, line := range strings.SplitAfter(markdown, "\n") {
+		body := strings.TrimRight(line, "\r\n")
+		ending := line[len(body):]
+
+		if inBlock {
+			if strings.Trim(body, " ") == "```" {
+				inBlock = false
+			}
+			out.WriteString(line)
+			continue
+		}
+		if !strings.HasPrefix(body, "```") {
+			out.WriteString(line)
+			continue
+		}
+
+		inBlock = true
+		out.WriteString(renderFence(body) + ending)
+	}
+	return out.String()
+}
+
+// renderFence removes the recognized docci tags from a fence line. Text that only looks like a
+// tag is kept, since it is not something docci reads.
+func renderFence(line string) string {
+	rendered := renderTagRe.ReplaceAllStringFunc(line, func(match string) string {
+		name, _, _ := strings.Cut(strings.TrimSpace(match), "=")
+		if _, err := TagAlias(name); err != nil {
+			return match
+		}
+		return ""
+	})
+	if rendered == line {
+		return line
+	}
+	return attributeOpenRe.ReplaceAllString(strings.TrimRightFunc(rendered, func(r rune) bool { return r == ' ' || r == '\t' }), "{")
+}
@@ -0,0 +1,34 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	markdown := "# Title\r\n\r\nSome `docci-retry=2` prose stays.\n\n" +
+		"```bash docci-output-contains=\"hello world\" docci-retry=2\n" +
+		"echo 'hello world' # docci-ignore in a comment stays\n" +
+		"```\n" +
+		"```{.bash docci-bg .numberLines}\nsleep 1\n```\n" +
+		"```{docci-retry=1 .bash}\ntrue\n```\n" +
+		"```json docci-ignore\n{}\n```\n" +
+		"```bash title=\"setup.sh\" docci-not-a-tag\necho\n```\n" +
+		"<!-- docci-disable -->\n```bash docci-os=linux\nls\n```\n<!-- docci-enable -->\n"
+
+	want := "# Title\r\n\r\nSome `docci-retry=2` prose stays.\n\n" +
+		"```bash\n" +
+		"echo 'hello world' # docci-ignore in a comment stays\n" +
+		"```\n" +
+		"```{.bash .numberLines}\nsleep 1\n```\n" +
+		"```{.bash}\ntrue\n```\n" +
+		"```json\n{}\n```\n" +
+		"```bash title=\"setup.sh\" docci-not-a-tag\necho\n```\n" +
+		"<!-- docci-disable -->\n```bash\nls\n```\n<!-- docci-enable -->\n"
+	require.Equal(t, want, RenderMarkdown(markdown))
+
+	// rendering is idempotent and leaves tag-free files untouched
+	require.Equal(t, want, RenderMarkdown(want))
+	require.Equal(t, "no fences", RenderMarkdown("no fences"))
+}
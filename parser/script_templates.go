@@ -6,9 +6,36 @@ const (
 	scriptCleanupTemplate = `# Cleanup function for background processes
 cleanup_background_processes() {
 {{DEBUG_CLEANUP}} jobs -p | xargs -r kill 2>/dev/null
-}
+{{SANDBOX_CLEANUP}}}
 trap cleanup_background_processes EXIT
 
+`
+
+	// --sandbox runs every block in a fresh temp directory. It is created before the cleanup trap,
+	// which removes it once background processes have been stopped.
+	sandboxStartTemplate = `# Run every block in a fresh sandbox directory
+DOCCI_SANDBOX=$(mktemp -d "${TMPDIR:-/tmp}/docci_sandbox.XXXXXX") || { echo "Failed to create the sandbox directory" >&2; exit 1; }
+export DOCCI_SANDBOX
+cd "$DOCCI_SANDBOX"
+
+`
+
+	// After-all handler, replaces the cleanup trap so teardown runs even when a block fails
+	afterAllTemplate = `# After-all blocks (run on exit, even if a block failed)
+docci_after_all() {
+  docci_exit_code=$?
+  trap - DEBUG
+  set +e
+{{AFTER_ALL_ENTRIES}}{{CLEANUP_CALL}}  exit $docci_exit_code
+}
+trap docci_after_all EXIT
+
+`
+
+	// Single after-all block entry template
+	afterAllEntryTemplate = `  # After-all block {{INDEX}}{{FILE_INFO}}
+  (
+{{CONTENT}}  )
 `
 
 	// Background kill template
@@ -31,11 +58,151 @@ fi
 {{CONTENT}}) > /tmp/docci_bg_{{INDEX}}.out 2>&1 &
 DOCCI_BG_PID_{{INDEX}}=$!
 echo 'Started background process {{INDEX}} with PID '$DOCCI_BG_PID_{{INDEX}}
+{{MAX_TIME}}
+`
+
+	// docci-background-max-time: a detached timer that stops the background process. Its output
+	// goes to the block's log so the timer never holds the script's stdout open.
+	backgroundMaxTimeTemplate = `(
+  sleep {{SECONDS}}
+  if kill -0 $DOCCI_BG_PID_{{INDEX}} 2>/dev/null; then
+    echo 'Stopping background process {{INDEX}} after its max time of {{SECONDS}}s'
+    kill -TERM -$DOCCI_BG_PID_{{INDEX}} 2>/dev/null || kill $DOCCI_BG_PID_{{INDEX}} 2>/dev/null
+  fi
+) >> /tmp/docci_bg_{{INDEX}}.out 2>&1 &
+`
+
+	// Background startup check: a process that already exited with an error (e.g. command not found)
+	// fails the run with its output, instead of surfacing later as a timeout or a missing process
+	backgroundStartupCheckTemplate = `# Check background block {{INDEX}} survived startup
+sleep 0.5
+if ! kill -0 "$DOCCI_BG_PID_{{INDEX}}" 2>/dev/null; then
+  docci_bg_status=0
+  wait "$DOCCI_BG_PID_{{INDEX}}" || docci_bg_status=$?
+  if [ $docci_bg_status -ne 0 ]; then
+    echo "Background block {{INDEX}} exited right after starting with status $docci_bg_status" >&2
+    echo '--- Background Block {{INDEX}} Output ---' >&2
+    cat /tmp/docci_bg_{{INDEX}}.out >&2
+    exit $docci_bg_status
+  fi
+fi
+
+`
+
+	// Concurrent group start template
+	concurrentGroupStartTemplate = `# Concurrent group {{GROUP}}
+DOCCI_CG_PIDS=""
+`
+
+	// Concurrent group member template, output is captured and replayed after the barrier
+	concurrentBlockTemplate = `# Concurrent group {{GROUP}}: block {{INDEX}}{{FILE_INFO}}
+(
+set -e
+{{CONTENT}}) > /tmp/docci_cg_$$_{{INDEX}}.out 2>&1 &
+DOCCI_CG_PIDS="$DOCCI_CG_PIDS $!:{{INDEX}}"
+echo 'Started concurrent block {{INDEX}} in group {{GROUP}}'
+
+`
+
+	// Concurrent group wait barrier template
+	concurrentGroupWaitTemplate = `# Wait for concurrent group {{GROUP}}
+docci_cg_failed=0
+for docci_cg_entry in $DOCCI_CG_PIDS; do
+  if ! wait "${docci_cg_entry%%:*}"; then
+    echo "Concurrent block ${docci_cg_entry##*:} in group {{GROUP}} failed" >&2
+    docci_cg_failed=1
+  fi
+done
+unset DOCCI_CG_PIDS
+{{OUTPUT_ENTRIES}}if [ $docci_cg_failed -ne 0 ]; then
+  exit 1
+fi
 
 `
 
-	// Regular block start marker
-	blockStartMarkerTemplate = `echo '### DOCCI_BLOCK_START_{{INDEX}} ###'
+	// Replays a concurrent block's output between its markers so it can be validated
+	concurrentOutputEntryTemplate = `echo '### DOCCI_BLOCK_START_{{INDEX}} ###'
+cat /tmp/docci_cg_$$_{{INDEX}}.out
+rm -f /tmp/docci_cg_$$_{{INDEX}}.out
+echo '### DOCCI_BLOCK_END_{{INDEX}} ###'
+`
+
+	// Memory sampler for a background block. Sums RSS over the whole process tree with ps,
+	// falling back to /proc/<pid>/status for the top process when ps is not installed.
+	measureMemoryTemplate = `# Measure peak memory of background block {{INDEX}}
+(
+  docci_mem_pid=$DOCCI_BG_PID_{{INDEX}}
+  docci_peak_kb=0
+  while kill -0 "$docci_mem_pid" 2>/dev/null; do
+    if command -v ps > /dev/null 2>&1; then
+      docci_rss_kb=$(ps -A -o pid=,ppid=,rss= 2>/dev/null | awk -v root="$docci_mem_pid" '
+        { ppid[$1] = $2; rss[$1] = $3 }
+        END {
+          total = 0
+          for (p in rss) {
+            q = p
+            while (q != "" && q != 0) {
+              if (q == root) { total += rss[p]; break }
+              q = ppid[q]
+            }
+          }
+          print total
+        }')
+    else
+      docci_rss_kb=$(awk '/^VmRSS:/ { print $2 }' /proc/$docci_mem_pid/status 2>/dev/null)
+    fi
+    if [ -n "$docci_rss_kb" ] && [ "$docci_rss_kb" -gt "$docci_peak_kb" ]; then
+      docci_peak_kb=$docci_rss_kb
+      echo "$docci_peak_kb" > /tmp/docci_bg_{{INDEX}}.mem
+    fi
+    sleep 0.2
+  done
+) &
+
+`
+
+	// Background expect log template, polls the background output file for readiness text
+	backgroundExpectLogTemplate = `# Waiting for background block {{INDEX}} log (timeout: {{TIMEOUT}} seconds)
+docci_expected_log={{EXPECTED}}
+echo "Waiting for background block {{INDEX}} to log: $docci_expected_log"
+docci_log_start=$(date +%s)
+until grep -qF -- "$docci_expected_log" /tmp/docci_bg_{{INDEX}}.out 2>/dev/null; do
+  if [ $(( $(date +%s) - docci_log_start )) -ge {{TIMEOUT}} ]; then
+    echo "Timeout waiting for background block {{INDEX}} to log '$docci_expected_log' after {{TIMEOUT}} seconds"
+    echo '--- Background Block {{INDEX}} Output ---'
+    cat /tmp/docci_bg_{{INDEX}}.out 2>/dev/null
+    exit 1
+  fi
+  sleep 0.5
+done
+echo "Background block {{INDEX}} logged expected text"
+
+`
+
+	// Verbose block header, printed outside the markers so it never affects validation
+	verboseBlockHeaderTemplate = `echo '┌── Block {{INDEX}} ({{LANGUAGE}}){{FILE_INFO}}'
+cat << 'DOCCI_EOF'
+{{COMMANDS}}DOCCI_EOF
+echo '├── output'
+`
+
+	// Verbose block footer, only reached when the block did not fail
+	verboseBlockFooterTemplate = `echo '└── Block {{INDEX}} completed'
+`
+
+	// docci-clear-screen with --allow-clear. The escape sequence ends with a newline so it is printed
+	// on its own line instead of in front of the block's start marker
+	clearScreenTemplate = `printf '\033[H\033[2J\n'
+`
+
+	// Regular block start marker, ID is the block index or its docci-name (see MarkerNames)
+	blockStartMarkerTemplate = `echo '### DOCCI_BLOCK_START_{{ID}} ###'
+`
+
+	// The same markers on stderr, so each block's stderr can be told apart too
+	blockStderrStartMarkerTemplate = `echo '### DOCCI_BLOCK_START_{{ID}} ###' >&2
+`
+	blockStderrEndMarkerTemplate = `echo '### DOCCI_BLOCK_END_{{ID}} ###' >&2
 `
 
 	// Block header (debug mode only)
@@ -73,6 +240,62 @@ while true; do
     sleep 1
 done
 
+`
+
+	// Poll until template, reruns a command until its output contains the expected text
+	pollUntilTemplate = `# Poll before block {{INDEX}} until the command output contains the expected text (timeout: {{TIMEOUT}} seconds)
+docci_poll_cmd={{COMMAND}}
+docci_poll_needle={{NEEDLE}}
+echo "Waiting for '$docci_poll_cmd' to output '$docci_poll_needle'..."
+docci_poll_start=$(date +%s)
+while true; do
+  docci_poll_output=$(eval "$docci_poll_cmd" 2>&1) || true
+  if printf '%s\n' "$docci_poll_output" | grep -qF -- "$docci_poll_needle"; then
+    echo "Command output contains '$docci_poll_needle'"
+    break
+  fi
+  if [ $(( $(date +%s) - docci_poll_start )) -ge {{TIMEOUT}} ]; then
+    echo "Timeout waiting for '$docci_poll_cmd' to output '$docci_poll_needle' after {{TIMEOUT}} seconds" >&2
+    echo "Last output:" >&2
+    printf '%s\n' "$docci_poll_output" >&2
+    exit 1
+  fi
+  sleep 1
+done
+
+`
+
+	// Dependency guard template for docci-skip-on-failure-of
+	dependencyGuardStartTemplate = `# Guard clause: skip block {{INDEX}} unless block '{{NAME}}' succeeded
+if [ "${DOCCI_BLOCK_OK_{{NAME}}:-}" != "1" ]; then
+  echo "Skipping block {{INDEX}}: block '{{NAME}}' did not succeed"
+fi
+if [ "${DOCCI_BLOCK_OK_{{NAME}}:-}" = "1" ]; then
+`
+
+	// Marks a docci-name block as succeeded for docci-skip-on-failure-of guards
+	blockSucceededTemplate = `DOCCI_BLOCK_OK_{{NAME}}=1
+`
+
+	// A docci-name block that docci-skip-on-failure-of blocks depend on runs in the main shell with
+	// set -e turned off, so its variables, functions and shell options carry over like any other
+	// block's. An ERR trap keeps the status of its first failing command. A failure skips the
+	// dependents instead of stopping the run, and is reported with the docci-warn-only marker.
+	dependencyStartTemplate = `# Run block {{INDEX}} so a failure skips the blocks that depend on it
+docci_dep_rc=0
+docci_dep_trap=$(trap -p ERR)
+trap 'docci_dep_err=$?; [ $docci_dep_rc -ne 0 ] || docci_dep_rc=$docci_dep_err' ERR
+set +e
+`
+
+	dependencyEndTemplate = `set -e
+eval "${docci_dep_trap:-trap - ERR}"
+if [ $docci_dep_rc -eq 0 ]; then
+  DOCCI_BLOCK_OK_{{NAME}}=1
+else
+  echo "Block {{INDEX}} failed with status $docci_dep_rc, skipping the blocks that depend on '{{NAME}}'" >&2
+  echo "### DOCCI_WARN_{{INDEX}} $docci_dep_rc ###"
+fi
 `
 
 	// File existence guard template
@@ -83,6 +306,161 @@ else
   echo "File {{FILE}} does not exist, executing block {{INDEX}}"
 fi
 if [ ! -f "{{FILE}}" ]; then
+`
+
+	// docci-bail-unless ends the run before the block when the guard command fails. The marker tells
+	// docci which block the run stopped at, so the blocks after it are not reported as missing.
+	bailGuardTemplate = `# Stop the run before block {{INDEX}} unless the guard command succeeds
+if ! eval {{COMMAND}}; then
+  echo "### DOCCI_BAIL_{{INDEX}} ###"
+  echo {{MESSAGE}}
+  exit {{CODE}}
+fi
+
+`
+
+	// Guard clause: skip the block when the directory has no entries, closed with "fi"
+	emptyDirGuardStartTemplate = `# Guard clause: skip if {{DIR}} is empty or missing
+if [ -z "$(ls -A "{{DIR}}" 2>/dev/null)" ]; then
+  echo "Skipping block {{INDEX}}: directory {{DIR}} is empty or does not exist"
+else
+`
+
+	// Guard clause: skip the block unless its docci-precondition command succeeds, closed with "fi"
+	preconditionGuardStartTemplate = `# Guard clause: run block {{INDEX}} only if its precondition succeeds
+if ! eval {{COMMAND}}; then
+  echo "Skipping block {{INDEX}}: precondition failed:" {{COMMAND}}
+else
+`
+
+	// With docci-required a failed docci-precondition stops the run instead, closed with "fi"
+	requiredPreconditionGuardStartTemplate = `# Guard clause: block {{INDEX}} requires its precondition to succeed
+if ! eval {{COMMAND}}; then
+  echo "Block {{INDEX}}: precondition failed:" {{COMMAND}} >&2
+  exit 1
+else
+`
+
+	// Per-block working directory, closed with ")" once the block and its post-conditions ran
+	workingDirStartTemplate = `# Run block {{INDEX}} in {{DIR}} (scoped to a subshell)
+(
+cd "{{DIR}}" || { echo "Block {{INDEX}}: directory {{DIR}} does not exist" >&2; exit 1; }
+`
+
+	isolateStartTemplate = `# Run block {{INDEX}} in a subshell so its environment does not leak
+(
+`
+
+	// Closes a docci-cwd or docci-isolate subshell. The status is checked on its own line because
+	// "( ... ) || exit" would disable set -e for every command inside the subshell.
+	subshellEndTemplate = `)
+docci_subshell_exit=$?
+if [ $docci_subshell_exit -ne 0 ]; then exit $docci_subshell_exit; fi
+`
+
+	// docci-tmpdir scratch directory. It is created and removed outside the block's subshells so the
+	// cleanup trap can still remove it when the block fails.
+	tmpdirStartTemplate = `# Scratch directory for block {{INDEX}}
+DOCCI_TMP=$(mktemp -d "${TMPDIR:-/tmp}/docci_tmp_{{INDEX}}.XXXXXX") || { echo "Block {{INDEX}}: failed to create the docci-tmpdir directory" >&2; exit 1; }
+export DOCCI_TMP
+`
+
+	tmpdirEndTemplate = `rm -rf "$DOCCI_TMP"
+unset DOCCI_TMP
+`
+
+	// Copies a docci-fixture into place, creating the destination's parent directories
+	fixtureTemplate = `# Stage fixture {{SOURCE}} at {{DEST}} for block {{INDEX}}
+mkdir -p "$(dirname "{{DEST}}")"
+cp -R "{{SOURCE}}" "{{DEST}}"
+`
+
+	// docci-capture-exit-code runs the block in a subshell with set -e turned off around it, so a failing
+	// command ends the block but not the script. The status is exported for later blocks.
+	captureExitCodeStartTemplate = `# Capture the exit code of block {{INDEX}} in {{VAR}}
+set +e
+(
+`
+
+	captureExitCodeEndTemplate = `)
+{{VAR}}=$?
+set -e
+export {{VAR}}
+if [ ${{VAR}} -ne 0 ]; then
+  echo "Block {{INDEX}} exited with status ${{VAR}}, saved in {{VAR}}" >&2
+fi
+`
+
+	// docci-warn-only runs the block in a subshell like docci-capture-exit-code. A failure is reported
+	// with a marker docci logs as a warning, and the run goes on.
+	warnOnlyStartTemplate = `# Only warn when block {{INDEX}} fails
+set +e
+(
+`
+
+	warnOnlyEndTemplate = `)
+docci_warn_rc=$?
+set -e
+if [ $docci_warn_rc -ne 0 ]; then
+  echo "### DOCCI_WARN_{{INDEX}} $docci_warn_rc ###"
+fi
+`
+
+	// docci-vars-from-output and docci-stdin-from-previous run the block in a subshell whose output
+	// is shown and kept, so it can be read once the block is done
+	keepOutputStartTemplate = `# Keep the output of block {{INDEX}}
+set +e
+(
+`
+
+	keepOutputEndTemplate = `) | tee /tmp/docci_output_$$_{{INDEX}}.out
+docci_keep_rc=${PIPESTATUS[0]}
+set -e
+if [ $docci_keep_rc -ne 0 ]; then exit $docci_keep_rc; fi
+`
+
+	// Hands a block's kept output to the docci-stdin-from-previous block after it
+	previousOutputTemplate = `# Pass the output of block {{INDEX}} to the next block's stdin
+docci_previous_output=$(cat /tmp/docci_output_$$_{{INDEX}}.out)
+`
+
+	// Exports one docci-vars-from-output variable from the first output line its pattern matches
+	varFromOutputTemplate = `# Set {{VAR}} from the output of block {{INDEX}}
+docci_vars_re={{PATTERN}}
+docci_vars_found=0
+while IFS= read -r docci_vars_line || [ -n "$docci_vars_line" ]; do
+  if [[ $docci_vars_line =~ $docci_vars_re ]]; then
+    export {{VAR}}="${BASH_REMATCH[{{GROUP}}]}"
+    docci_vars_found=1
+    break
+  fi
+done < /tmp/docci_output_$$_{{INDEX}}.out
+if [ $docci_vars_found -eq 0 ]; then
+  echo "Block {{INDEX}}: no output line matches "{{PATTERN}}" for docci-vars-from-output {{VAR}}" >&2
+  rm -f /tmp/docci_output_$$_{{INDEX}}.out
+  exit 1
+fi
+`
+
+	// Runs one docci-transcript command, keeping its output for the check that follows
+	transcriptStepTemplate = `printf '\n     Executing CMD: %s\n' {{COMMAND_QUOTED}} >&2
+{
+{{COMMAND}}
+} > /tmp/docci_transcript_$$_{{INDEX}}.out 2>&1 && docci_transcript_rc=0 || docci_transcript_rc=$?
+cat /tmp/docci_transcript_$$_{{INDEX}}.out
+if [ $docci_transcript_rc -ne 0 ]; then exit $docci_transcript_rc; fi
+`
+
+	// Compares a docci-transcript command's output with the transcript. A mismatch is a validation
+	// failure like docci-output-contains, so the run goes on. The marker hands the command, expected
+	// and actual output to docci base64 encoded, as they may span several lines.
+	transcriptCheckTemplate = `docci_transcript_expected={{EXPECTED}}
+docci_transcript_actual=$(sed 's/[[:space:]]*$//' /tmp/docci_transcript_$$_{{INDEX}}.out)
+if [ "$docci_transcript_actual" != "$docci_transcript_expected" ]; then
+  echo "Transcript mismatch in block {{INDEX}} for command: "{{COMMAND_QUOTED}} >&2
+  printf 'Expected:\n%s\nActual:\n%s\n' "$docci_transcript_expected" "$docci_transcript_actual" >&2
+  echo "### DOCCI_TRANSCRIPT_MISMATCH_{{INDEX}} {{COMMAND_BASE64}}:{{EXPECTED_BASE64}}:$(printf '%s' "$docci_transcript_actual" | base64 | tr -d '\n') ###"
+fi
 `
 
 	// Code execution with per-command delay template
@@ -95,31 +473,219 @@ trap - DEBUG # reset trap
 `
 
 	// Retry wrapper start template
-	retryWrapperStartTemplate = `# Retry logic for block {{INDEX}} (max attempts: {{MAX_RETRIES}})
+	retryWrapperStartTemplate = `# Retry logic for block {{INDEX}} ({{LIMITS}})
 retry_count=0
-max_retries={{MAX_RETRIES}}
-while [ $retry_count -le $max_retries ]; do
+{{LIMIT_VARS}}while true; do
   if [ $retry_count -gt 0 ]; then
-    echo "Retry attempt $retry_count/$max_retries for block {{INDEX}}"
+{{GLOBAL_RETRY_CHECK}}    echo "Retry attempt {{ATTEMPT}} for block {{INDEX}}"
     sleep {{RETRY_DELAY}}
   fi
 
-  # Execute the block content
-  if (
+  # Execute the block content. The subshell is not run as an if condition,
+  # which would turn off set -e inside it and hide failing commands.
+  set +e
+  (
 `
 
 	// Retry wrapper end template
-	retryWrapperEndTemplate = `  ); then
+	retryWrapperEndTemplate = `  )
+  exit_code=$?
+  set -e
+  if [ $exit_code -eq 0 ]; then
     break
-  else
-    exit_code=$?
-    retry_count=$((retry_count + 1))
-    if [ $retry_count -gt $max_retries ]; then
-      echo "Block {{INDEX}} failed after $max_retries retry attempts"
-      exit $exit_code
+  fi
+  retry_count=$((retry_count + 1))
+{{LIMIT_CHECKS}}done
+`
+
+	// docci-retry-while-output end of the retry loop, a run that succeeds but still prints the
+	// pattern is retried like a failed one
+	retryWhileOutputEndTemplate = `  ) | tee /tmp/docci_retry_$$_{{INDEX}}.out
+  exit_code=${PIPESTATUS[0]}
+  set -e
+  if [ $exit_code -eq 0 ]; then
+    if ! grep -qE -- {{PATTERN}} /tmp/docci_retry_$$_{{INDEX}}.out; then
+      break
     fi
+    echo "Block {{INDEX}} output still matches "{{PATTERN}}
+    exit_code=1
   fi
+  retry_count=$((retry_count + 1))
+{{LIMIT_CHECKS}}done
+rm -f /tmp/docci_retry_$$_{{INDEX}}.out
+`
+
+	// docci-repeat-until-file runs the block again until the file exists, for jobs that signal they
+	// are done by writing one. A failing run still stops the script.
+	repeatUntilFileStartTemplate = `# Repeat block {{INDEX}} until {{FILE}} exists (timeout: {{TIMEOUT}} seconds)
+docci_repeat_start=$(date +%s)
+while true; do
+`
+
+	repeatUntilFileEndTemplate = `  if [ -f {{FILE}} ]; then
+    break
+  fi
+  if [ $(( $(date +%s) - docci_repeat_start )) -ge {{TIMEOUT}} ]; then
+    echo "Block {{INDEX}}: "{{FILE}}" still does not exist after {{TIMEOUT}} seconds" >&2
+    exit 1
+  fi
+  echo "Waiting for "{{FILE}}", running block {{INDEX}} again"
+  sleep 1
 done
+`
+
+	// docci-retry limit, stops once every retry attempt has been used
+	retryCountCheckTemplate = `  if [ $retry_count -gt $max_retries ]; then
+    echo "Block {{INDEX}} failed after $max_retries retry attempts"
+    exit $exit_code
+  fi
+`
+
+	// docci-retry-timeout limit, stops once the block has been retrying for the timeout
+	retryTimeoutCheckTemplate = `  if [ $(( $(date +%s) - retry_start )) -ge {{TIMEOUT}} ]; then
+    echo "Block {{INDEX}} still failing after {{TIMEOUT}} seconds of retries ($retry_count attempts)"
+    exit $exit_code
+  fi
+`
+
+	// docci-run-as wrapper, checks sudo and the user first so a missing one fails with a clear message.
+	// sudo -n fails instead of prompting for a password in non-interactive runs.
+	runAsTemplate = `if ! command -v sudo > /dev/null 2>&1; then
+  echo "Block {{INDEX}}: docci-run-as requires sudo, which is not installed" >&2
+  exit 1
+fi
+if ! id -u {{USER}} > /dev/null 2>&1; then
+  echo "Block {{INDEX}}: docci-run-as user "{{USER}}" does not exist" >&2
+  exit 1
+fi
+sudo -n -u {{USER}} bash {{BASH_FLAGS}} -c {{CONTENT}}
+`
+
+	// docci-no-network wrapper, runs the commands in a new network namespace that only has a down
+	// loopback interface. Non-root users need unprivileged user namespaces (unshare -r).
+	noNetworkTemplate = `if [ "$(uname -s)" != "Linux" ]; then
+  echo "Block {{INDEX}}: docci-no-network is only supported on Linux, add docci-os=linux to skip the block elsewhere" >&2
+  exit 1
+fi
+if ! command -v unshare > /dev/null 2>&1; then
+  echo "Block {{INDEX}}: docci-no-network requires unshare (util-linux), which is not installed" >&2
+  exit 1
+fi
+docci_unshare="unshare -n"
+if [ "$(id -u)" -ne 0 ]; then docci_unshare="unshare -r -n"; fi
+$docci_unshare bash {{BASH_FLAGS}} -c {{CONTENT}}
+`
+
+	// Global retry cap check, counts retries in a file so blocks running in subshells share the count
+	globalRetryCheckTemplate = `    docci_retries_used=$(( $(cat /tmp/docci_retries_$$ 2>/dev/null || echo 0) + 1 ))
+    echo $docci_retries_used > /tmp/docci_retries_$$
+    if [ $docci_retries_used -gt {{MAX_RETRIES_GLOBAL}} ]; then
+      echo "Global retry limit of {{MAX_RETRIES_GLOBAL}} reached, not retrying block {{INDEX}}" >&2
+      exit $exit_code
+    fi
+`
+
+	// Matrix start template: runs the block once per value, teeing each run's output so it can be checked on its own
+	matrixStartTemplate = `# Matrix for block {{INDEX}}: one run per {{VAR}} value
+for docci_matrix_value in {{VALUES}}; do
+echo "=== Block {{INDEX}} matrix run: {{VAR}}=$docci_matrix_value ==="
+set +e
+(
+export {{VAR}}="$docci_matrix_value"
+`
+
+	// Matrix run end template: a failing run stops the block and names the value it failed with
+	matrixRunEndTemplate = `) | tee /tmp/docci_matrix_$$_{{INDEX}}.out
+docci_matrix_rc=${PIPESTATUS[0]}
+set -e
+if [ $docci_matrix_rc -ne 0 ]; then
+  echo "Block {{INDEX}} failed for {{VAR}}=$docci_matrix_value" >&2
+  rm -f /tmp/docci_matrix_$$_{{INDEX}}.out
+  exit $docci_matrix_rc
+fi
+`
+
+	// Matrix output check template: docci-output-contains must hold for every run, not just the combined output
+	matrixOutputCheckTemplate = `if ! {{READ_OUTPUT}} /tmp/docci_matrix_$$_{{INDEX}}.out | grep -qF -- {{EXPECTED}}; then
+  echo "Block {{INDEX}} output for {{VAR}}=$docci_matrix_value does not contain: "{{EXPECTED}} >&2
+  rm -f /tmp/docci_matrix_$$_{{INDEX}}.out
+  exit 1
+fi
+`
+
+	// Matrix end template
+	matrixEndTemplate = `done
+rm -f /tmp/docci_matrix_$$_{{INDEX}}.out
+echo "=== Block {{INDEX}} passed for {{VAR}}="{{VALUE_LIST}}" ==="
+`
+
+	// Reports the failed docci-assert-* post-condition described by $docci_assertion. Like a
+	// docci-output-contains mismatch it is a validation failure, so the run goes on. The marker hands
+	// the message to docci base64 encoded.
+	assertionFailedSnippet = `  echo "Assertion failed: block {{INDEX}} $docci_assertion" >&2
+  echo "### DOCCI_ASSERTION_FAILED_{{INDEX}} $(printf '%s' "$docci_assertion" | base64 | tr -d '\n') ###"
+`
+
+	// Post-condition: file must exist after the block
+	assertFileExistsTemplate = `# Assert file {{FILE}} exists after block {{INDEX}}
+if [ ! -f "{{FILE}}" ]; then
+  docci_assertion="expected file {{FILE}} to exist"
+` + assertionFailedSnippet + `fi
+`
+
+	// Records when a docci-expect-duration block starts. EPOCHREALTIME (bash 5+) gives sub-second
+	// precision, older shells fall back to whole seconds.
+	durationStartTemplate = `docci_duration_start_{{INDEX}}=${EPOCHREALTIME:-$(date +%s)}
+`
+
+	// Reports the block's run time after its end marker, for docci-assert-faster-than
+	blockDurationTemplate = `docci_duration_end=${EPOCHREALTIME:-$(date +%s)}
+echo "### DOCCI_BLOCK_DURATION_{{ID}} $(awk -v s="${docci_duration_start_{{INDEX}}/,/.}" -v e="${docci_duration_end/,/.}" 'BEGIN { printf "%.3f", e - s }') ###"
+`
+
+	// Post-condition: the block's run time must satisfy the comparison
+	expectDurationTemplate = `# Assert block {{INDEX}} took {{OPERATOR}} {{SECONDS}} seconds
+docci_duration_end=${EPOCHREALTIME:-$(date +%s)}
+docci_duration=$(awk -v s="${docci_duration_start_{{INDEX}}/,/.}" -v e="${docci_duration_end/,/.}" 'BEGIN { printf "%.3f", e - s }')
+if ! awk -v d="$docci_duration" 'BEGIN { exit !(d {{OPERATOR}} {{SECONDS}}) }'; then
+  docci_assertion="expected duration {{OPERATOR}} {{SECONDS}}s, took ${docci_duration}s"
+` + assertionFailedSnippet + `fi
+`
+
+	// Post-condition: file must contain text after the block
+	assertFileContainsTemplate = `# Assert file {{FILE}} contains expected text after block {{INDEX}}
+docci_expected_text={{EXPECTED}}
+if [ ! -f "{{FILE}}" ]; then
+  docci_assertion="expected file {{FILE}} to exist"
+` + assertionFailedSnippet + `elif ! grep -qF -- "$docci_expected_text" "{{FILE}}"; then
+  docci_assertion="expected file {{FILE}} to contain '$docci_expected_text'"
+` + assertionFailedSnippet + `fi
+`
+
+	// Post-condition: running the block a second time must leave the path unchanged. A directory
+	// is hashed as the sorted list of its files' checksums. The second run's output goes to stderr
+	// so output validation only sees the first run.
+	assertNoChangeStartTemplate = `# Assert block {{INDEX}} leaves {{PATH}} unchanged when run again
+docci_sha256() { if command -v sha256sum > /dev/null 2>&1; then sha256sum "$@"; else shasum -a 256 "$@"; fi; }
+docci_hash_path() {
+  if [ -d "$1" ]; then
+    (cd "$1" && find . -type f -print0 | LC_ALL=C sort -z | while IFS= read -r -d '' f; do docci_sha256 "$f"; done) | docci_sha256
+  elif [ -e "$1" ]; then
+    docci_sha256 < "$1"
+  else
+    echo missing
+  fi
+}
+docci_no_change_before=$(docci_hash_path "{{PATH}}")
+echo "Running block {{INDEX}} again to check it leaves {{PATH}} unchanged" >&2
+{
+`
+
+	assertNoChangeEndTemplate = `} >&2
+docci_no_change_after=$(docci_hash_path "{{PATH}}")
+if [ "$docci_no_change_before" != "$docci_no_change_after" ]; then
+  docci_assertion="changed {{PATH}} when run again"
+` + assertionFailedSnippet + `fi
 `
 
 	// Delay after template
@@ -128,7 +694,7 @@ sleep {{DELAY}}
 `
 
 	// Block end marker (there is purposely 2 newlines for readability in output debug)
-	blockEndMarkerTemplate = `echo '### DOCCI_BLOCK_END_{{INDEX}} ###'
+	blockEndMarkerTemplate = `echo '### DOCCI_BLOCK_END_{{ID}} ###'
 
 `
 
@@ -142,10 +708,23 @@ echo -e '\n=== Background Process Logs ==='
 	backgroundLogEntryTemplate = `if [ -f /tmp/docci_bg_{{INDEX}}.out ]; then
   echo -e '\n--- Background Block {{INDEX}} Output ---'
   cat /tmp/docci_bg_{{INDEX}}.out
-  rm -f /tmp/docci_bg_{{INDEX}}.out
-else
+{{REMOVE_FILE}}else
   echo 'No output file found for background block {{INDEX}}'
 fi
+`
+
+	// Peak memory report template
+	memoryReportTemplate = `
+# Report peak memory of measured background processes
+echo -e '\n=== Background Process Memory ==='
+{{MEMORY_ENTRIES}}`
+
+	// Single peak memory report entry template
+	memoryReportEntryTemplate = `if [ -f /tmp/docci_bg_{{INDEX}}.mem ]; then
+  echo "Background block {{INDEX}} peak memory: $(cat /tmp/docci_bg_{{INDEX}}.mem) KB"
+{{REMOVE_FILE}}else
+  echo 'No memory samples recorded for background block {{INDEX}}'
+fi
 `
 
 	// Background logs cleanup template (hidden)
@@ -241,3 +820,36 @@ else
 fi
 `
 )
+
+// PowerShell templates for --powershell. They only write the output markers and stop the run on
+// the first failing block; bash-only features have no PowerShell equivalent here.
+const (
+	// Stops on errors from cmdlets, and from native commands on PowerShell 7.3+
+	powerShellHeaderTemplate = `# Generated by docci for PowerShell
+$ErrorActionPreference = 'Stop'
+$PSNativeCommandUseErrorActionPreference = $true
+
+`
+
+	// Opens a block. The content is dot-sourced so variables it sets are visible to later blocks.
+	powerShellBlockTemplate = `# Code block {{INDEX}}{{FILE_INFO}}
+Write-Output '### DOCCI_BLOCK_START_{{INDEX}} ###'
+$global:LASTEXITCODE = 0
+try {
+. {
+`
+
+	// Closes a block, exiting when it threw or its last native command failed
+	powerShellBlockEndTemplate = `}
+} catch {
+  [Console]::Error.WriteLine("Block {{INDEX}} failed: $_")
+  exit 1
+}
+if ($LASTEXITCODE -ne 0) {
+  [Console]::Error.WriteLine("Block {{INDEX}} failed with exit code $LASTEXITCODE")
+  exit $LASTEXITCODE
+}
+Write-Output '### DOCCI_BLOCK_END_{{INDEX}} ###'
+
+`
+)
@@ -3,12 +3,18 @@ package parser
 import (
 	"fmt"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"unicode"
 
 	"github.com/reecepbcups/docci/logger"
+	"github.com/reecepbcups/docci/types"
 )
 
 type MetaTag struct {
@@ -16,6 +22,8 @@ type MetaTag struct {
 	Ignore   bool
 
 	OutputContains  string
+	OutputCount     *types.OutputCount // docci-output-contains-count: text that must appear an exact number of times
+	LineCount       *types.LineCount   // docci-assert-line-count: how many non-empty lines the output must have
 	Background      bool
 	BackgroundKill  int // 1-based index of background process to kill
 	AssertFailure   bool
@@ -28,7 +36,80 @@ type MetaTag struct {
 	DelayPerCmdSecs float64
 	IfFileNotExists string
 	IfNotInstalled  string
+	IfInstalled     string
 	ReplaceText     string
+	Confirm         bool
+	BeforeAll       bool
+	AfterAll        bool
+	ConcurrentGroup string
+	WorkingDir      string
+	StdinFile       string
+	Isolate         bool
+	ForceExec       bool
+	StripPrompts    []string // prompts removed by docci-prompt-strip, nil when the tag is absent
+	Transcript      bool
+	Name            string  // docci-name: name other blocks can reference
+	SkipOnFailureOf string  // docci-skip-on-failure-of: name of the block that must succeed first
+	RetryDelaySecs  float64 // docci-retry-delay: seconds between retries, only used when RetryDelaySet
+	RetryDelaySet   bool
+	MatrixVar       string   // docci-matrix: variable exported for each run of the block
+	MatrixValues    []string // docci-matrix: values the block runs with, in order
+	RunAs           string   // docci-run-as: user the block runs as, through sudo
+	FixTypography   bool     // docci-fix-typography: convert smart quotes and dashes back to ASCII
+	PollUntilCmd    string   // docci-poll-until: command rerun until its output contains PollUntilNeedle
+	PollUntilNeedle string
+	PollTimeoutSecs int
+	CaptureExitCode string // docci-capture-exit-code: variable the block's exit code is stored in
+	StripANSI       bool   // docci-strip-ansi: validate output with ANSI escape sequences removed
+	Required        bool   // docci-required: fail instead of skipping when docci-os or an install check excludes the block
+	AssertNoChange  string // docci-assert-no-change: path that must be unchanged when the block runs a second time
+	NoNetwork       bool   // docci-no-network: run the block in its own network namespace with no network access
+	Tmpdir          bool   // docci-tmpdir: export an empty scratch directory as $DOCCI_TMP for the block
+	OutputToEnv     string // docci-output-to-env: variable the trimmed output is passed to cleanup commands in
+	RetryTimeout    int    // docci-retry-timeout: seconds the block keeps retrying for, capped by RetryCount when set
+	OutputSort      bool   // docci-output-sort: validate output with its lines sorted
+	TrimOutputFrom  string // docci-trim-output: "head" or "tail", the end of the output that is kept
+	TrimOutputLines int    // docci-trim-output: number of lines kept for validation
+	FasterThan      string // docci-assert-faster-than: name of an earlier block this block must run faster than
+	SkipIfEmptyDir  string // docci-skip-if-empty-dir: directory that must have entries for the block to run
+	JSONSchema      string // docci-output-json-schema: JSON Schema file the block's output must conform to
+	RetryWhile      string // docci-retry-while-output: regex that keeps the block retrying while its output matches
+	ClearScreen     bool   // docci-clear-screen: clear the terminal before the block when run with --allow-clear
+	JSONEqualsFile  string // docci-assert-json-equals-file: JSON file the block's output must equal, ignoring key order and whitespace
+	DecodeOutput    string // docci-decode-output: encoding the output is decoded from before it is validated, "base64"
+	StdinPrevious   bool   // docci-stdin-from-previous: read the previous block's output on stdin
+	ExitMessage     string // docci-exit-message: message printed when the block fails the run
+	Precondition    string // docci-precondition: command that must succeed for the block to run
+	RepeatUntilFile string // docci-repeat-until-file: file whose appearance stops the block from being run again
+	RepeatTimeout   int    // docci-repeat-until-file: seconds the block is repeated for before the run fails
+	OutputPrefix    string // docci-output-starts-with: text the trimmed output must start with
+	OutputSuffix    string // docci-output-ends-with: text the trimmed output must end with
+	WarnOnly        bool   // docci-warn-only: log the block's failure as a warning and go on with the run
+
+	BailUnless  string // docci-bail-unless: command that must succeed for the run to go on past this block
+	BailMessage string // docci-bail-message: message printed when the run stops at the guard
+	BailCode    int    // docci-bail-code: exit code the run stops with, 0 by default
+
+	ExpectDurationOp   string  // comparison operator: <, <=, > or >=
+	ExpectDurationSecs float64 // seconds the block's duration is compared against
+
+	BackgroundExpectLog            string
+	BackgroundExpectLogTimeoutSecs int
+	BackgroundMaxTimeSecs          int // docci-background-max-time: seconds before the background process is stopped
+	MeasureMemory                  bool
+
+	// Recorded for a future parallel scheduler, blocks still run in order
+	AllowParallelWith []string // docci-allow-parallel-with: docci-names of blocks this block may run alongside
+
+	Artifacts []string // docci-artifact: paths or globs copied to --artifact-dir after the run
+
+	Fixtures []Fixture // docci-fixture: files copied into place before the block runs
+
+	VarsFromOutput []OutputVar // docci-vars-from-output: variables exported from lines of the block's output
+
+	// Post-condition tags
+	AssertFileExists   []string
+	AssertFileContains []FileContains
 
 	// File operation tags
 	File        string // docci-file: The file name to operate on
@@ -51,19 +132,98 @@ const (
 	TagDelayPerCmd     = "docci-delay-per-cmd"
 	TagIfFileNotExists = "docci-if-file-not-exists"
 	TagIfNotInstalled  = "docci-if-not-installed"
+	TagIfInstalled     = "docci-if-installed"
 	TagReplaceText     = "docci-replace-text"
 	TagFile            = "docci-file"
 	TagResetFile       = "docci-reset-file"
 	TagLineInsert      = "docci-line-insert"
 	TagLineReplace     = "docci-line-replace"
+	TagConfirm         = "docci-confirm"
+	TagBeforeAll       = "docci-before-all"
+	TagAfterAll        = "docci-after-all"
+	TagConcurrentGroup = "docci-concurrent-group"
+
+	TagBackgroundExpectLog = "docci-background-expect-log"
+	TagMeasureMemory       = "docci-measure-memory"
+	TagAssertFileExists    = "docci-assert-file-exists"
+	TagAssertFileContains  = "docci-assert-file-contains"
+	TagWorkingDir          = "docci-cwd"
+	TagStdinFile           = "docci-stdin-file"
+	TagIsolate             = "docci-isolate"
+	TagExpectDuration      = "docci-expect-duration"
+	TagForceExec           = "docci-exec"
+	TagPromptStrip         = "docci-prompt-strip"
+	TagTranscript          = "docci-transcript"
+	TagRetryDelay          = "docci-retry-delay"
+	TagOutputCount         = "docci-output-contains-count"
+	TagName                = "docci-name"
+	TagSkipOnFailureOf     = "docci-skip-on-failure-of"
+	TagMatrix              = "docci-matrix"
+	TagRunAs               = "docci-run-as"
+	TagPollUntil           = "docci-poll-until"
+	TagAllowParallelWith   = "docci-allow-parallel-with"
+	TagArtifact            = "docci-artifact"
+	TagFixTypography       = "docci-fix-typography"
+	TagCaptureExitCode     = "docci-capture-exit-code"
+	TagStripANSI           = "docci-strip-ansi"
+	TagRequired            = "docci-required"
+	TagAssertNoChange      = "docci-assert-no-change"
+	TagFixture             = "docci-fixture"
+	TagNoNetwork           = "docci-no-network"
+	TagTmpdir              = "docci-tmpdir"
+	TagOutputToEnv         = "docci-output-to-env"
+	TagRetryTimeout        = "docci-retry-timeout"
+	TagOutputSort          = "docci-output-sort"
+	TagTrimOutput          = "docci-trim-output"
+	TagAssertFasterThan    = "docci-assert-faster-than"
+	TagSkipIfEmptyDir      = "docci-skip-if-empty-dir"
+	TagBackgroundMaxTime   = "docci-background-max-time"
+	TagBailUnless          = "docci-bail-unless"
+	TagBailMessage         = "docci-bail-message"
+	TagBailCode            = "docci-bail-code"
+	TagOutputJSONSchema    = "docci-output-json-schema"
+	TagVarsFromOutput      = "docci-vars-from-output"
+	TagRetryWhileOutput    = "docci-retry-while-output"
+	TagClearScreen         = "docci-clear-screen"
+	TagAssertJSONEquals    = "docci-assert-json-equals-file"
+	TagDecodeOutput        = "docci-decode-output"
+	TagStdinFromPrevious   = "docci-stdin-from-previous"
+	TagExitMessage         = "docci-exit-message"
+	TagPrecondition        = "docci-precondition"
+	TagRepeatUntilFile     = "docci-repeat-until-file"
+	TagOutputStartsWith    = "docci-output-starts-with"
+	TagOutputEndsWith      = "docci-output-ends-with"
+	TagAssertLineCount     = "docci-assert-line-count"
+	TagWarnOnly            = "docci-warn-only"
 )
 
+// FileContains is a docci-assert-file-contains post-condition
+type FileContains struct {
+	Path     string
+	Expected string
+}
+
+// Fixture is a docci-fixture file copied from Source, relative to the markdown file, to Dest
+// before the block runs
+type Fixture struct {
+	Source string
+	Dest   string
+}
+
+// OutputVar is a docci-vars-from-output variable, set to the first group Pattern captures on the
+// first output line it matches, or the whole match when Pattern has no group
+type OutputVar struct {
+	Name    string
+	Pattern string
+}
+
 // TagInfo holds information about a tag and its aliases
 type TagInfo struct {
-	Name        string
-	Aliases     []string
-	Description string
-	Example     string
+	Name              string
+	Aliases           []string
+	DeprecatedAliases []string // still accepted, but ParseTags warns and suggests Name instead
+	Description       string
+	Example           string
 }
 
 // tagDefinitions is the single source of truth for all tag information
@@ -75,10 +235,11 @@ var tagDefinitions = []TagInfo{
 		Example:     "```bash docci-ignore",
 	},
 	{
-		Name:        TagOutputContains,
-		Aliases:     []string{"docci-contains", "docci-contains-output"},
-		Description: "Validate that the output contains specific text",
-		Example:     "```bash docci-output-contains=\"Expected output\"",
+		Name:              TagOutputContains,
+		Aliases:           []string{"docci-contains"},
+		DeprecatedAliases: []string{"docci-contains-output"},
+		Description:       "Validate that the output contains specific text",
+		Example:           "```bash docci-output-contains=\"Expected output\"",
 	},
 	{
 		Name:        TagBackground,
@@ -101,7 +262,7 @@ var tagDefinitions = []TagInfo{
 	{
 		Name:        TagOS,
 		Aliases:     []string{"docci-machine"},
-		Description: "Only run on specific operating systems (linux, macos, windows)",
+		Description: "Only run on specific operating systems (linux, macos, windows), comma-separated, '!' to exclude one",
 		Example:     "```bash docci-os=\"linux\"",
 	},
 	{
@@ -146,6 +307,12 @@ var tagDefinitions = []TagInfo{
 		Description: "Only run if the specified command is not installed",
 		Example:     "```bash docci-if-not-installed=\"docker\"",
 	},
+	{
+		Name:        TagIfInstalled,
+		Aliases:     []string{},
+		Description: "Only run if the specified command is installed",
+		Example:     "```bash docci-if-installed=\"docker\"",
+	},
 	{
 		Name:        TagReplaceText,
 		Aliases:     []string{"docci-replace"},
@@ -176,14 +343,491 @@ var tagDefinitions = []TagInfo{
 		Description: "Replace content at line N or lines N-M (1-based)",
 		Example:     "```html docci-file=\"example.html\" docci-line-replace=\"3\" or docci-line-replace=\"7-9\"",
 	},
+	{
+		Name:        TagConfirm,
+		Aliases:     []string{},
+		Description: "Ask for interactive confirmation before running this block (use --yes in CI)",
+		Example:     "```bash docci-confirm",
+	},
+	{
+		Name:        TagBeforeAll,
+		Aliases:     []string{"docci-setup"},
+		Description: "Run this block before all other blocks, regardless of its position",
+		Example:     "```bash docci-before-all",
+	},
+	{
+		Name:        TagAfterAll,
+		Aliases:     []string{"docci-teardown"},
+		Description: "Run this block after all other blocks, even if an earlier block failed",
+		Example:     "```bash docci-after-all",
+	},
+	{
+		Name:        TagConcurrentGroup,
+		Aliases:     []string{"docci-parallel-group"},
+		Description: "Run consecutive blocks sharing a group name in parallel and wait for all of them to finish",
+		Example:     "```bash docci-concurrent-group=\"startup\"",
+	},
+	{
+		Name:        TagBackgroundExpectLog,
+		Aliases:     []string{"docci-bg-expect-log"},
+		Description: "Wait until a background block's log contains text (format: 'text|timeout_seconds')",
+		Example:     "```bash docci-background docci-background-expect-log=\"Listening on 8080|30\"",
+	},
+	{
+		Name:        TagMeasureMemory,
+		Aliases:     []string{"docci-measure-mem"},
+		Description: "Sample a background block's memory usage and report its peak RSS at the end of the run",
+		Example:     "```bash docci-background docci-measure-memory",
+	},
+	{
+		Name:        TagAssertFileExists,
+		Aliases:     []string{"docci-file-exists"},
+		Description: "Fail the block if the file(s) do not exist after it runs (comma-separated or repeated for multiple)",
+		Example:     "```bash docci-assert-file-exists=\"dist/app,dist/app.sha256\"",
+	},
+	{
+		Name:        TagAssertFileContains,
+		Aliases:     []string{"docci-file-contains"},
+		Description: "Fail the block if a file does not contain text after it runs (format: 'path|text')",
+		Example:     "```bash docci-assert-file-contains=\"config.yaml|enabled: true\"",
+	},
+	{
+		Name:        TagWorkingDir,
+		Aliases:     []string{"docci-working-dir", "docci-dir"},
+		Description: "Run this block in another directory (relative to --working-dir) inside a subshell",
+		Example:     "```bash docci-cwd=\"frontend\"",
+	},
+	{
+		Name:        TagStdinFile,
+		Aliases:     []string{"docci-stdin"},
+		Description: "Pipe a file (relative to the markdown file) into the block's stdin",
+		Example:     "```bash docci-stdin-file=\"input.json\"",
+	},
+	{
+		Name:        TagIsolate,
+		Aliases:     []string{"docci-subshell"},
+		Description: "Run this block in a subshell so its variables and cd do not leak into later blocks",
+		Example:     "```bash docci-isolate",
+	},
+	{
+		Name:        TagExpectDuration,
+		Aliases:     []string{"docci-duration"},
+		Description: "Fail the block if its run time does not match a comparison in seconds (<, <=, >, >=)",
+		Example:     "```bash docci-expect-duration=\"<2\"",
+	},
+	{
+		Name:        TagForceExec,
+		Aliases:     []string{"docci-force-exec"},
+		Description: "Run a block fenced with another language (e.g. console or text) as shell",
+		Example:     "```console docci-exec",
+	},
+	{
+		Name:        TagPromptStrip,
+		Aliases:     []string{"docci-strip-prompt"},
+		Description: "Remove leading prompts ('$ ' and '# ' by default) and drop output lines so a pasted terminal session runs",
+		Example:     "```bash docci-prompt-strip or docci-prompt-strip=\"> \"",
+	},
+	{
+		Name:        TagTranscript,
+		Aliases:     []string{"docci-console"},
+		Description: "Run each '$ ' command of a terminal transcript and check its output against the lines that follow it",
+		Example:     "```console docci-transcript",
+	},
+	{
+		Name:        TagRetryDelay,
+		Aliases:     []string{"docci-retry-wait"},
+		Description: "Seconds to wait between docci-retry attempts for this block (overrides DOCCI_RETRY_DELAY)",
+		Example:     "```bash docci-retry=5 docci-retry-delay=10",
+	},
+	{
+		Name:        TagOutputCount,
+		Aliases:     []string{"docci-output-count"},
+		Description: "Ensure the output contains a string exactly N times (format: 'text:N')",
+		Example:     "```bash docci-output-contains-count=\"PASS:3\"",
+	},
+	{
+		Name:        TagName,
+		Aliases:     []string{"docci-id"},
+		Description: "Name this block so later blocks can reference it (letters, numbers and '_')",
+		Example:     "```bash docci-name=build",
+	},
+	{
+		Name:        TagSkipOnFailureOf,
+		Aliases:     []string{"docci-depends-on"},
+		Description: "Skip this block (without failing) unless the named earlier block ran successfully",
+		Example:     "```bash docci-skip-on-failure-of=build",
+	},
+	{
+		Name:        TagMatrix,
+		Aliases:     []string{"docci-foreach"},
+		Description: "Run the block once per value with the variable exported, checking output-contains on each run (format: 'NAME=a,b,c')",
+		Example:     "```bash docci-matrix=\"VERSION=1.20,1.21,1.22\"",
+	},
+	{
+		Name:        TagRunAs,
+		Aliases:     []string{"docci-user"},
+		Description: "Run the block as another user with 'sudo -n -u USER' (needs passwordless sudo)",
+		Example:     "```bash docci-run-as=postgres",
+	},
+	{
+		Name:        TagPollUntil,
+		Aliases:     []string{"docci-wait-for-output"},
+		Description: "Rerun a command before the block until its output contains a string (format: 'command|text|timeout_seconds')",
+		Example:     "```bash docci-poll-until=\"kubectl get pod web|Running|60\"",
+	},
+	{
+		Name:        TagAllowParallelWith,
+		Aliases:     []string{"docci-parallel-with"},
+		Description: "Declare the named blocks (docci-name) this block is safe to run alongside. Recorded only, blocks still run in order",
+		Example:     "```bash docci-allow-parallel-with=\"lint,unit_tests\"",
+	},
+	{
+		Name:        TagArtifact,
+		Aliases:     []string{"docci-artifacts"},
+		Description: "Copy files or globs (comma-separated) into --artifact-dir once the run finishes, even if it failed",
+		Example:     "```bash docci-artifact=\"dist/app.tar.gz,logs/*.log\"",
+	},
+	{
+		Name:        TagFixTypography,
+		Aliases:     []string{"docci-fix-smart-quotes"},
+		Description: "Convert curly quotes, ellipses, non-breaking spaces and dashes merged into flags (–flag) back to ASCII before running",
+		Example:     "```bash docci-fix-typography",
+	},
+	{
+		Name:        TagCaptureExitCode,
+		Aliases:     []string{"docci-save-exit-code"},
+		Description: "Store the block's exit code in a shell variable for later blocks instead of stopping the run when it fails",
+		Example:     "```bash docci-capture-exit-code=BUILD_RC",
+	},
+	{
+		Name:        TagStripANSI,
+		Aliases:     []string{"docci-strip-colors"},
+		Description: "Remove ANSI color codes and other escape sequences from the block's output before it is validated",
+		Example:     "```bash docci-strip-ansi docci-output-contains=\"PASS\"",
+	},
+	{
+		Name:        TagRequired,
+		Aliases:     []string{"docci-must-run"},
+		Description: "Fail instead of skipping the block when its docci-os, install check or docci-precondition is not met",
+		Example:     "```bash docci-if-installed=docker docci-required",
+	},
+	{
+		Name:        TagAssertNoChange,
+		Aliases:     []string{"docci-assert-idempotent"},
+		Description: "Run the block a second time and fail if the file or directory changed, to check it is idempotent",
+		Example:     "```bash docci-assert-no-change=\"config/\"",
+	},
+	{
+		Name:        TagFixture,
+		Aliases:     []string{"docci-stage-file"},
+		Description: "Copy a file or directory from next to the markdown file into place before the block runs (source:dest)",
+		Example:     "```bash docci-fixture=\"testdata/input.json:input.json\"",
+	},
+	{
+		Name:        TagNoNetwork,
+		Aliases:     []string{"docci-network-isolate"},
+		Description: "Run the block with network access disabled through 'unshare -n' to check it is hermetic (Linux only)",
+		Example:     "```bash docci-no-network",
+	},
+	{
+		Name:        TagTmpdir,
+		Aliases:     []string{"docci-scratch-dir"},
+		Description: "Create an empty scratch directory for the block, exported as $DOCCI_TMP and removed after it, even if it fails",
+		Example:     "```bash docci-tmpdir",
+	},
+	{
+		Name:        TagOutputToEnv,
+		Aliases:     []string{"docci-export-output"},
+		Description: "Pass the block's trimmed output to --cleanup-commands and --on-failure commands as an environment variable",
+		Example:     "```bash docci-output-to-env=CONTAINER_ID",
+	},
+	{
+		Name:        TagRetryTimeout,
+		Aliases:     []string{"docci-retry-for"},
+		Description: "Retry the block until it succeeds or N seconds have passed, combine with docci-retry to also cap the attempts",
+		Example:     "```bash docci-retry-timeout=60",
+	},
+	{
+		Name:        TagOutputSort,
+		Aliases:     []string{"docci-sort-output"},
+		Description: "Sort the block's output lines before docci-output-contains checks it, for commands that print lines in any order. '\\n' in docci-output-contains separates expected lines",
+		Example:     "```bash docci-output-sort docci-output-contains=\"a.txt\\nb.txt\"",
+	},
+	{
+		Name:        TagTrimOutput,
+		Aliases:     []string{"docci-output-lines"},
+		Description: "Validate only the first (head:N) or last (tail:N) N lines of the block's output",
+		Example:     "```bash docci-trim-output=\"tail:5\"",
+	},
+	{
+		Name:        TagAssertFasterThan,
+		Aliases:     []string{"docci-faster-than"},
+		Description: "Fail unless this block runs faster than an earlier block with the given docci-name",
+		Example:     "```bash docci-assert-faster-than=baseline",
+	},
+	{
+		Name:        TagSkipIfEmptyDir,
+		Aliases:     []string{"docci-if-dir-not-empty"},
+		Description: "Skip the block if a directory is empty or does not exist",
+		Example:     "```bash docci-skip-if-empty-dir=\"./inbox\"",
+	},
+	{
+		Name:        TagBackgroundMaxTime,
+		Aliases:     []string{"docci-bg-max-time"},
+		Description: "Stop a background block's process after N seconds instead of waiting for a docci-background-kill block",
+		Example:     "```bash docci-background docci-background-max-time=30",
+	},
+	{
+		Name:        TagBailUnless,
+		Aliases:     []string{"docci-stop-unless"},
+		Description: "Stop the whole run before this block, without failing it, unless a guard command succeeds",
+		Example:     "```bash docci-bail-unless=\"command -v docker\"",
+	},
+	{
+		Name:        TagBailMessage,
+		Description: "Message printed when docci-bail-unless stops the run",
+		Example:     "```bash docci-bail-unless=\"command -v docker\" docci-bail-message=\"docker is required for the rest of this guide\"",
+	},
+	{
+		Name:        TagBailCode,
+		Description: "Exit code docci-bail-unless stops the run with (default 0)",
+		Example:     "```bash docci-bail-unless=\"command -v docker\" docci-bail-code=78",
+	},
+	{
+		Name:        TagOutputJSONSchema,
+		Aliases:     []string{"docci-json-schema"},
+		Description: "Parse the block's output as JSON and validate it against a JSON Schema file, relative to the markdown file",
+		Example:     "```bash docci-output-json-schema=\"schemas/response.json\"",
+	},
+	{
+		Name:        TagVarsFromOutput,
+		Aliases:     []string{"docci-capture-vars"},
+		Description: "Export a variable from the block's output for later blocks (NAME=regex, repeat the tag for more). The first group of the first matching line is used",
+		Example:     "```bash docci-vars-from-output=\"TOKEN=token: ([a-z0-9]+)\" docci-vars-from-output=\"USER_ID=id: ([0-9]+)\"",
+	},
+	{
+		Name:        TagRetryWhileOutput,
+		Aliases:     []string{"docci-retry-output-not"},
+		Description: "Retry the block while its output matches a regex, e.g. a pending status, within the docci-retry or docci-retry-timeout limits",
+		Example:     "```bash docci-retry-while-output=\"status: (pending|creating)\" docci-retry-timeout=120",
+	},
+	{
+		Name:        TagClearScreen,
+		Aliases:     []string{"docci-clear"},
+		Description: "Clear the terminal before the block runs, for recording demos. Only takes effect with --allow-clear",
+		Example:     "```bash docci-clear-screen",
+	},
+	{
+		Name:        TagAssertJSONEquals,
+		Aliases:     []string{"docci-assert-json-equals"},
+		Description: "Parse the block's output as JSON and fail unless it equals the JSON in a file, relative to the markdown file. Key order and whitespace are ignored",
+		Example:     "```bash docci-assert-json-equals-file=\"expected/user.json\"",
+	},
+	{
+		Name:        TagDecodeOutput,
+		Aliases:     []string{"docci-output-decode"},
+		Description: "Decode the block's output before it is validated. Only base64 is supported, in the standard or URL-safe alphabet with or without padding",
+		Example:     "```bash docci-decode-output=\"base64\" docci-output-contains=\"hello\"",
+	},
+	{
+		Name:        TagStdinFromPrevious,
+		Aliases:     []string{"docci-pipe-previous"},
+		Description: "Pipe the previous block's output into this block's stdin, like `cmd1 | cmd2` across two blocks. Cannot be used on the first block",
+		Example:     "```bash docci-stdin-from-previous",
+	},
+	{
+		Name:        TagExitMessage,
+		Aliases:     []string{"docci-failure-message"},
+		Description: "Print a message to stderr when the block fails the run, to tell readers how to fix it",
+		Example:     "```bash docci-exit-message=\"Make sure Docker is running.\"",
+	},
+	{
+		Name:        TagPrecondition,
+		Aliases:     []string{"docci-run-if"},
+		Description: "Run the block only if a shell command succeeds, skipping it otherwise. With docci-required a failed check fails the run instead",
+		Example:     "```bash docci-precondition=\"test -d build\"",
+	},
+	{
+		Name:        TagRepeatUntilFile,
+		Aliases:     []string{"docci-until-file"},
+		Description: "Run the block again every second until a file exists, failing once the timeout in seconds has passed",
+		Example:     "```bash docci-repeat-until-file=\"done.flag|60\"",
+	},
+	{
+		Name:        TagOutputStartsWith,
+		Aliases:     []string{"docci-output-prefix"},
+		Description: "Ensure the output, with surrounding whitespace trimmed, starts with a string",
+		Example:     "```bash docci-output-starts-with=\"Usage:\"",
+	},
+	{
+		Name:        TagOutputEndsWith,
+		Aliases:     []string{"docci-output-suffix"},
+		Description: "Ensure the output, with surrounding whitespace trimmed, ends with a string",
+		Example:     "```bash docci-output-ends-with=\"Done.\"",
+	},
+	{
+		Name:        TagAssertLineCount,
+		Aliases:     []string{"docci-line-count"},
+		Description: "Ensure the output has a number of non-empty lines, exactly or compared with <, <=, > or >=",
+		Example:     "```bash docci-assert-line-count=\">=2\"",
+	},
+	{
+		Name:        TagWarnOnly,
+		Aliases:     []string{"docci-warn-on-failure"},
+		Description: "Log a warning with the block index when the block fails, and go on with the run without failing it",
+		Example:     "```bash docci-warn-only",
+	},
 }
 
+// parseDurationExpectation splits a docci-expect-duration value like "<2" or ">=0.5" into its operator and seconds
+func parseDurationExpectation(content string) (string, float64, error) {
+	if content == "" {
+		return "", 0, fmt.Errorf("docci-expect-duration requires a comparison (e.g. \"<2\")")
+	}
+
+	var op string
+	// two character operators are checked first so "<=" is not read as "<"
+	for _, candidate := range []string{"<=", ">=", "<", ">"} {
+		if strings.HasPrefix(content, candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return "", 0, fmt.Errorf("docci-expect-duration must start with <, <=, > or >=, got: %s", content)
+	}
+
+	secs, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(content, op)), 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid seconds in docci-expect-duration: %s", content)
+	}
+	if secs <= 0 {
+		return "", 0, fmt.Errorf("seconds must be positive in docci-expect-duration, got: %g", secs)
+	}
+	return op, secs, nil
+}
+
+// parseLineCount splits a docci-assert-line-count value like "3" or ">=2" into its operator and count
+func parseLineCount(content string) (*types.LineCount, error) {
+	content = strings.TrimSpace(content)
+	if content == "" {
+		return nil, fmt.Errorf("docci-assert-line-count requires a line count (e.g. \"3\" or \">=2\")")
+	}
+
+	op := "=="
+	// two character operators are checked first so "<=" is not read as "<"
+	for _, candidate := range []string{"==", "<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(content, candidate) {
+			op = candidate
+			break
+		}
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(content, op)))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("docci-assert-line-count must be a non-negative line count, optionally after ==, <, <=, > or >=, got: %s", content)
+	}
+	if op == "=" {
+		op = "=="
+	}
+	return &types.LineCount{Op: op, Count: count}, nil
+}
+
+// parseMatrix splits a docci-matrix value like "VERSION=1.20,1.21" into the variable name and its values
+func parseMatrix(content string) (string, []string, error) {
+	name, list, ok := strings.Cut(content, "=")
+	if !ok {
+		return "", nil, fmt.Errorf("docci-matrix requires 'NAME=value1,value2' format, got: %s", content)
+	}
+	name = strings.TrimSpace(name)
+	if !shellVarRe.MatchString(name) {
+		return "", nil, fmt.Errorf("docci-matrix variable must be a valid shell variable name, got: %q", name)
+	}
+
+	var values []string
+	for _, value := range strings.Split(list, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return "", nil, fmt.Errorf("docci-matrix values must not be empty, got: %s", content)
+		}
+		values = append(values, value)
+	}
+	return name, values, nil
+}
+
+// parsePollUntil splits a docci-poll-until value into its command, expected text and timeout.
+// The text and timeout are taken from the right so the command itself may contain pipes.
+func parsePollUntil(content string) (string, string, int, error) {
+	formatErr := fmt.Errorf("docci-poll-until format should be 'command|text|timeout_seconds', got: %s", content)
+
+	idx := strings.LastIndex(content, "|")
+	if idx < 0 {
+		return "", "", 0, formatErr
+	}
+	rest, timeoutStr := content[:idx], strings.TrimSpace(content[idx+1:])
+	idx = strings.LastIndex(rest, "|")
+	if idx < 0 {
+		return "", "", 0, formatErr
+	}
+	command, needle := strings.TrimSpace(rest[:idx]), strings.TrimSpace(rest[idx+1:])
+	if command == "" || needle == "" {
+		return "", "", 0, formatErr
+	}
+
+	timeout, err := strconv.Atoi(timeoutStr)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid timeout value in docci-poll-until: %s", timeoutStr)
+	}
+	if timeout <= 0 {
+		return "", "", 0, fmt.Errorf("timeout must be positive in docci-poll-until, got: %d", timeout)
+	}
+	return command, needle, timeout, nil
+}
+
+// parseOutputVar splits a docci-vars-from-output value like "TOKEN=token: ([a-z0-9]+)" into its
+// variable and pattern. The pattern is matched by bash's =~, so it must be a POSIX extended regex.
+func parseOutputVar(content string) (OutputVar, error) {
+	name, pattern, ok := strings.Cut(content, "=")
+	if !ok || pattern == "" {
+		return OutputVar{}, fmt.Errorf("docci-vars-from-output format should be 'NAME=regex', got: %q", content)
+	}
+	name = strings.TrimSpace(name)
+	if !shellVarRe.MatchString(name) {
+		return OutputVar{}, fmt.Errorf("docci-vars-from-output requires a valid shell variable name, got: %q", name)
+	}
+	if _, err := regexp.CompilePOSIX(pattern); err != nil {
+		return OutputVar{}, fmt.Errorf("docci-vars-from-output pattern for %s is not a POSIX extended regex: %w", name, err)
+	}
+	return OutputVar{Name: name, Pattern: pattern}, nil
+}
+
+// shellVarRe matches the shell variable names docci-matrix, docci-capture-exit-code and docci-vars-from-output set
+var shellVarRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// userNameRe matches the user names docci-run-as accepts
+var userNameRe = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*$`)
+
+// blockNameRe restricts docci-name values to characters that are valid in a shell variable name
+var blockNameRe = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// concurrentGroupNameRe restricts group names to characters that are safe inside the generated script
+var concurrentGroupNameRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
 // tagAliasMap is built from tagDefinitions for fast lookup
 var tagAliasMap map[string]string
 
+// deprecatedAliases holds the aliases ParseTags warns about
+var deprecatedAliases map[string]bool
+
+// deprecationWarningsOff silences the deprecated alias warnings (--no-deprecation-warnings)
+var deprecationWarningsOff atomic.Bool
+
+// warnedAliases records the deprecated aliases already warned about, so each is reported once per run
+var warnedAliases sync.Map
+
 // init builds the tagAliasMap from tagDefinitions
 func init() {
 	tagAliasMap = make(map[string]string)
+	deprecatedAliases = make(map[string]bool)
 	for _, tagInfo := range tagDefinitions {
 		// Map the tag name to itself
 		tagAliasMap[tagInfo.Name] = tagInfo.Name
@@ -191,9 +835,29 @@ func init() {
 		for _, alias := range tagInfo.Aliases {
 			tagAliasMap[alias] = tagInfo.Name
 		}
+		for _, alias := range tagInfo.DeprecatedAliases {
+			tagAliasMap[alias] = tagInfo.Name
+			deprecatedAliases[alias] = true
+		}
 	}
 }
 
+// SetDeprecationWarnings turns the warnings for deprecated tag aliases on or off
+func SetDeprecationWarnings(enabled bool) {
+	deprecationWarningsOff.Store(!enabled)
+}
+
+// warnDeprecatedAlias logs a warning the first time a deprecated alias is used
+func warnDeprecatedAlias(alias, tag string) {
+	if !deprecatedAliases[alias] || deprecationWarningsOff.Load() {
+		return
+	}
+	if _, warned := warnedAliases.LoadOrStore(alias, true); warned {
+		return
+	}
+	logger.GetLogger().Warn("Deprecated tag alias, use the canonical tag instead", "alias", alias, "tag", tag)
+}
+
 // TagAlias returns the real tag name for a given alias.
 func TagAlias(tag string) (string, error) {
 	if canonicalTag, exists := tagAliasMap[tag]; exists {
@@ -203,6 +867,18 @@ func TagAlias(tag string) (string, error) {
 	return "", fmt.Errorf("unknown tag / alias: %s", tag)
 }
 
+// AllTagNames returns every tag name and alias, sorted, leaving out deprecated aliases
+func AllTagNames() []string {
+	names := make([]string, 0, len(tagAliasMap))
+	for name := range tagAliasMap {
+		if !deprecatedAliases[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 // given a line, find any docci- tags that are present and parse them out
 func ParseTags(line string) (MetaTag, error) {
 	// Use regex to find all docci-* tags with optional quoted or unquoted values
@@ -211,15 +887,27 @@ func ParseTags(line string) (MetaTag, error) {
 	// - docci-tagname=value (unquoted value, no spaces)
 	// - docci-tagname="value with spaces" (double quoted value)
 	// - docci-tagname='value with spaces' (single quoted value)
-	pattern := `docci-[a-zA-Z0-9-]+(?:=(?:"[^"]*"|'[^']*'|[^\s]+))?`
-
-	re := regexp.MustCompile(pattern)
-	matches := re.FindAllString(line, -1)
+	matches := tagRe.FindAllString(stripAttributeBrace(line), -1)
 
 	logger.GetLogger().Debug("Potential tags found", "matches", matches)
 	return parseTagsFromPotential(matches)
 }
 
+// tagRe matches a docci tag on a fence line, see ParseTags
+var tagRe = regexp.MustCompile(`docci-[a-zA-Z0-9-]+(?:=(?:"[^"]*"|'[^']*'|[^\s]+))?`)
+
+// attributeListRe matches a fence line that ends in a {...} attribute list, like "```{.bash docci-os=linux}"
+var attributeListRe = regexp.MustCompile("^```(?:.*\\s)?\\{.*\\}\\s*$")
+
+// stripAttributeBrace drops the closing brace of a trailing attribute list, so an unquoted value
+// on the last tag inside it does not keep the brace
+func stripAttributeBrace(line string) string {
+	if !attributeListRe.MatchString(line) {
+		return line
+	}
+	return strings.TrimSuffix(strings.TrimRightFunc(line, unicode.IsSpace), "}")
+}
+
 // parseTagsFromPotential returns an error when there is a bad tag
 func parseTagsFromPotential(potential []string) (MetaTag, error) {
 	// given a list of potential tags, parse them out and return a MetaTags struct
@@ -251,6 +939,7 @@ func parseTagsFromPotential(potential []string) (MetaTag, error) {
 		if err != nil {
 			return MetaTag{}, err
 		}
+		warnDeprecatedAlias(tag, normalizedTag)
 
 		switch normalizedTag {
 		case TagIgnore:
@@ -276,7 +965,12 @@ func parseTagsFromPotential(potential []string) (MetaTag, error) {
 		case TagAssertFailure:
 			mt.AssertFailure = true
 		case TagOS:
-			mt.OS = content
+			osList, err := normalizeOSList(content)
+			if err != nil {
+				return MetaTag{}, err
+			}
+			mt.OS = osList
+			logger.GetLogger().Debug("OS tag found", "os", osList)
 		case TagWaitForEndpoint:
 			if content == "" {
 				return MetaTag{}, fmt.Errorf("docci-wait-for-endpoint requires a value in format 'url|timeout_seconds'")
@@ -313,6 +1007,53 @@ func parseTagsFromPotential(potential []string) (MetaTag, error) {
 			}
 			mt.RetryCount = retryCount
 			logger.GetLogger().Debug("Retry tag found", "count", retryCount)
+		case TagRetryTimeout:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-retry-timeout requires a value (timeout in seconds)")
+			}
+			retryTimeout, err := strconv.Atoi(content)
+			if err != nil {
+				return MetaTag{}, fmt.Errorf("invalid timeout seconds in docci-retry-timeout: %s", content)
+			}
+			if retryTimeout <= 0 {
+				return MetaTag{}, fmt.Errorf("timeout seconds must be positive in docci-retry-timeout, got: %d", retryTimeout)
+			}
+			mt.RetryTimeout = retryTimeout
+			logger.GetLogger().Debug("Retry timeout tag found", "seconds", retryTimeout)
+		case TagRetryWhileOutput:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-retry-while-output requires a regex")
+			}
+			if _, err := regexp.CompilePOSIX(content); err != nil {
+				return MetaTag{}, fmt.Errorf("docci-retry-while-output is not a POSIX extended regex: %w", err)
+			}
+			mt.RetryWhile = content
+			logger.GetLogger().Debug("Retry while output tag found", "pattern", content)
+		case TagOutputCount:
+			idx := strings.LastIndex(content, ":")
+			if idx <= 0 {
+				return MetaTag{}, fmt.Errorf("docci-output-contains-count requires 'text:count' format, got: %s", content)
+			}
+			count, err := strconv.Atoi(content[idx+1:])
+			if err != nil || count < 0 {
+				return MetaTag{}, fmt.Errorf("count must be a non-negative integer in docci-output-contains-count, got: %s", content[idx+1:])
+			}
+			mt.OutputCount = &types.OutputCount{Text: content[:idx], Count: count}
+			logger.GetLogger().Debug("Output contains count tag found", "text", content[:idx], "count", count)
+		case TagRetryDelay:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-retry-delay requires a value (delay in seconds)")
+			}
+			retryDelay, err := strconv.ParseFloat(content, 64)
+			if err != nil {
+				return MetaTag{}, fmt.Errorf("invalid delay seconds in docci-retry-delay: %s", content)
+			}
+			if retryDelay < 0 {
+				return MetaTag{}, fmt.Errorf("delay seconds must not be negative in docci-retry-delay, got: %g", retryDelay)
+			}
+			mt.RetryDelaySecs = retryDelay
+			mt.RetryDelaySet = true
+			logger.GetLogger().Debug("Retry delay tag found", "seconds", retryDelay)
 		case TagDelayBefore:
 			if content == "" {
 				return MetaTag{}, fmt.Errorf("docci-delay-before requires a value (delay in seconds)")
@@ -361,6 +1102,15 @@ func parseTagsFromPotential(potential []string) (MetaTag, error) {
 			}
 			mt.IfFileNotExists = content
 			logger.GetLogger().Debug("If file not exists tag found", "path", content)
+		case TagSkipIfEmptyDir:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-skip-if-empty-dir requires a directory path")
+			}
+			if strings.ContainsAny(content, "\"`$") {
+				return MetaTag{}, fmt.Errorf("docci-skip-if-empty-dir path contains invalid characters: %q", content)
+			}
+			mt.SkipIfEmptyDir = content
+			logger.GetLogger().Debug("Skip if empty dir tag found", "path", content)
 		case TagIfNotInstalled:
 			if content == "" {
 				return MetaTag{}, fmt.Errorf("docci-if-not-installed requires a command name")
@@ -370,6 +1120,15 @@ func parseTagsFromPotential(potential []string) (MetaTag, error) {
 			}
 			mt.IfNotInstalled = content
 			logger.GetLogger().Debug("If not installed tag found", "command", content)
+		case TagIfInstalled:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-if-installed requires a command name")
+			}
+			if strings.Contains(content, " ") {
+				return MetaTag{}, fmt.Errorf("docci-if-installed does not support commands with spaces: %s", content)
+			}
+			mt.IfInstalled = content
+			logger.GetLogger().Debug("If installed tag found", "command", content)
 		case TagReplaceText:
 			if content == "" {
 				return MetaTag{}, fmt.Errorf("docci-replace-text requires a value in format 'old;new'")
@@ -439,6 +1198,386 @@ func parseTagsFromPotential(potential []string) (MetaTag, error) {
 			}
 			mt.LineReplace = content
 			logger.GetLogger().Debug("Line replace tag found", "range", content)
+		case TagConfirm:
+			mt.Confirm = true
+			logger.GetLogger().Debug("Confirm tag found")
+		case TagBeforeAll:
+			mt.BeforeAll = true
+			logger.GetLogger().Debug("Before all tag found")
+		case TagAfterAll:
+			mt.AfterAll = true
+			logger.GetLogger().Debug("After all tag found")
+		case TagBackgroundExpectLog:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-background-expect-log requires a value in format 'text|timeout_seconds'")
+			}
+			// Split on the last | so the expected text may contain one
+			idx := strings.LastIndex(content, "|")
+			if idx == -1 {
+				return MetaTag{}, fmt.Errorf("docci-background-expect-log format should be 'text|timeout_seconds', got: %s", content)
+			}
+			expected := content[:idx]
+			timeoutStr := strings.TrimSpace(content[idx+1:])
+			if expected == "" {
+				return MetaTag{}, fmt.Errorf("docci-background-expect-log expected text must be non-empty, got: %s", content)
+			}
+
+			timeout, err := strconv.Atoi(timeoutStr)
+			if err != nil {
+				return MetaTag{}, fmt.Errorf("invalid timeout value in docci-background-expect-log: %s", timeoutStr)
+			}
+			if timeout <= 0 {
+				return MetaTag{}, fmt.Errorf("timeout must be positive in docci-background-expect-log, got: %d", timeout)
+			}
+
+			mt.BackgroundExpectLog = expected
+			mt.BackgroundExpectLogTimeoutSecs = timeout
+			logger.GetLogger().Debug("Background expect log tag found", "expected", expected, "timeout_seconds", timeout)
+		case TagBackgroundMaxTime:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-background-max-time requires a value (seconds)")
+			}
+			maxTime, err := strconv.Atoi(content)
+			if err != nil {
+				return MetaTag{}, fmt.Errorf("invalid seconds in docci-background-max-time: %s", content)
+			}
+			if maxTime <= 0 {
+				return MetaTag{}, fmt.Errorf("seconds must be positive in docci-background-max-time, got: %d", maxTime)
+			}
+			mt.BackgroundMaxTimeSecs = maxTime
+			logger.GetLogger().Debug("Background max time tag found", "seconds", maxTime)
+		case TagBailUnless:
+			if strings.TrimSpace(content) == "" {
+				return MetaTag{}, fmt.Errorf("docci-bail-unless requires a command")
+			}
+			mt.BailUnless = content
+			logger.GetLogger().Debug("Bail unless tag found", "command", content)
+		case TagBailMessage:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-bail-message requires a message")
+			}
+			mt.BailMessage = content
+			logger.GetLogger().Debug("Bail message tag found", "message", content)
+		case TagBailCode:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-bail-code requires a value (exit code)")
+			}
+			code, err := strconv.Atoi(content)
+			if err != nil || code < 0 || code > 255 {
+				return MetaTag{}, fmt.Errorf("docci-bail-code must be an exit code from 0 to 255, got: %s", content)
+			}
+			mt.BailCode = code
+			logger.GetLogger().Debug("Bail code tag found", "code", code)
+		case TagMeasureMemory:
+			mt.MeasureMemory = true
+			logger.GetLogger().Debug("Measure memory tag found")
+		case TagAssertFileExists:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-assert-file-exists requires a file path")
+			}
+			for _, path := range strings.Split(content, ",") {
+				path = strings.TrimSpace(path)
+				if path == "" {
+					return MetaTag{}, fmt.Errorf("docci-assert-file-exists contains an empty file path: %s", content)
+				}
+				if strings.Contains(path, "\"") {
+					return MetaTag{}, fmt.Errorf("docci-assert-file-exists does not support file paths with quotes: %s", path)
+				}
+				mt.AssertFileExists = append(mt.AssertFileExists, path)
+			}
+			logger.GetLogger().Debug("Assert file exists tag found", "paths", mt.AssertFileExists)
+		case TagAssertFileContains:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-assert-file-contains requires a value in format 'path|text'")
+			}
+			// Split on the first | so the expected text may contain one
+			parts := strings.SplitN(content, "|", 2)
+			if len(parts) != 2 {
+				return MetaTag{}, fmt.Errorf("docci-assert-file-contains format should be 'path|text', got: %s", content)
+			}
+			path := strings.TrimSpace(parts[0])
+			if path == "" || parts[1] == "" {
+				return MetaTag{}, fmt.Errorf("docci-assert-file-contains both path and text must be non-empty, got: %s", content)
+			}
+			if strings.Contains(path, "\"") {
+				return MetaTag{}, fmt.Errorf("docci-assert-file-contains does not support file paths with quotes: %s", path)
+			}
+			mt.AssertFileContains = append(mt.AssertFileContains, FileContains{Path: path, Expected: parts[1]})
+			logger.GetLogger().Debug("Assert file contains tag found", "path", path, "expected", parts[1])
+		case TagFixture:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-fixture requires a value in format 'source:dest'")
+			}
+			source, dest, ok := strings.Cut(content, ":")
+			source, dest = strings.TrimSpace(source), strings.TrimSpace(dest)
+			if !ok || source == "" || dest == "" {
+				return MetaTag{}, fmt.Errorf("docci-fixture format should be 'source:dest', got: %s", content)
+			}
+			if strings.Contains(content, "\"") {
+				return MetaTag{}, fmt.Errorf("docci-fixture does not support paths with quotes: %s", content)
+			}
+			mt.Fixtures = append(mt.Fixtures, Fixture{Source: source, Dest: dest})
+			logger.GetLogger().Debug("Fixture tag found", "source", source, "dest", dest)
+		case TagWorkingDir:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-cwd requires a directory path")
+			}
+			if strings.Contains(content, "\"") {
+				return MetaTag{}, fmt.Errorf("docci-cwd does not support paths with quotes: %s", content)
+			}
+			mt.WorkingDir = content
+			logger.GetLogger().Debug("Working dir tag found", "dir", content)
+		case TagExpectDuration:
+			op, secs, err := parseDurationExpectation(content)
+			if err != nil {
+				return MetaTag{}, err
+			}
+			mt.ExpectDurationOp = op
+			mt.ExpectDurationSecs = secs
+			logger.GetLogger().Debug("Expect duration tag found", "operator", op, "seconds", secs)
+		case TagPromptStrip:
+			if content == "" {
+				mt.StripPrompts = defaultPrompts
+			} else {
+				mt.StripPrompts = strings.Split(content, ",")
+			}
+			logger.GetLogger().Debug("Prompt strip tag found", "prompts", mt.StripPrompts)
+		case TagTranscript:
+			mt.Transcript = true
+			logger.GetLogger().Debug("Transcript tag found")
+		case TagForceExec:
+			mt.ForceExec = true
+			logger.GetLogger().Debug("Force exec tag found")
+		case TagIsolate:
+			mt.Isolate = true
+			logger.GetLogger().Debug("Isolate tag found")
+		case TagStdinFile:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-stdin-file requires a file path")
+			}
+			if strings.Contains(content, "\"") {
+				return MetaTag{}, fmt.Errorf("docci-stdin-file does not support file paths with quotes: %s", content)
+			}
+			mt.StdinFile = content
+			logger.GetLogger().Debug("Stdin file tag found", "path", content)
+		case TagName:
+			if !blockNameRe.MatchString(content) {
+				return MetaTag{}, fmt.Errorf("docci-name may only contain letters, numbers and '_', got: %q", content)
+			}
+			// names appear in the output markers in place of block numbers, so they cannot be a number
+			if strings.Trim(content, "0123456789") == "" {
+				return MetaTag{}, fmt.Errorf("docci-name must contain a letter or '_' so it is not mistaken for a block number, got: %q", content)
+			}
+			mt.Name = content
+			logger.GetLogger().Debug("Name tag found", "name", content)
+		case TagSkipOnFailureOf:
+			if !blockNameRe.MatchString(content) {
+				return MetaTag{}, fmt.Errorf("docci-skip-on-failure-of requires a block name (letters, numbers and '_'), got: %q", content)
+			}
+			mt.SkipOnFailureOf = content
+			logger.GetLogger().Debug("Skip on failure of tag found", "name", content)
+		case TagMatrix:
+			name, values, err := parseMatrix(content)
+			if err != nil {
+				return MetaTag{}, err
+			}
+			mt.MatrixVar = name
+			mt.MatrixValues = values
+			logger.GetLogger().Debug("Matrix tag found", "var", name, "values", values)
+		case TagPollUntil:
+			command, needle, timeout, err := parsePollUntil(content)
+			if err != nil {
+				return MetaTag{}, err
+			}
+			mt.PollUntilCmd = command
+			mt.PollUntilNeedle = needle
+			mt.PollTimeoutSecs = timeout
+			logger.GetLogger().Debug("Poll until tag found", "command", command, "text", needle, "timeout_seconds", timeout)
+		case TagRequired:
+			mt.Required = true
+			logger.GetLogger().Debug("Required tag found")
+		case TagAssertFasterThan:
+			if !blockNameRe.MatchString(content) {
+				return MetaTag{}, fmt.Errorf("docci-assert-faster-than requires a block name (letters, numbers and '_'), got: %q", content)
+			}
+			mt.FasterThan = content
+			logger.GetLogger().Debug("Assert faster than tag found", "name", content)
+		case TagTrimOutput:
+			from, lines, ok := strings.Cut(content, ":")
+			if !ok || (from != "head" && from != "tail") {
+				return MetaTag{}, fmt.Errorf("docci-trim-output requires 'head:N' or 'tail:N' format, got: %q", content)
+			}
+			n, err := strconv.Atoi(lines)
+			if err != nil || n <= 0 {
+				return MetaTag{}, fmt.Errorf("line count must be a positive integer in docci-trim-output, got: %s", lines)
+			}
+			mt.TrimOutputFrom = from
+			mt.TrimOutputLines = n
+			logger.GetLogger().Debug("Trim output tag found", "from", from, "lines", n)
+		case TagOutputJSONSchema:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-output-json-schema requires a schema file path")
+			}
+			mt.JSONSchema = content
+			logger.GetLogger().Debug("Output JSON schema tag found", "path", content)
+		case TagVarsFromOutput:
+			outputVar, err := parseOutputVar(content)
+			if err != nil {
+				return MetaTag{}, err
+			}
+			for _, existing := range mt.VarsFromOutput {
+				if existing.Name == outputVar.Name {
+					return MetaTag{}, fmt.Errorf("docci-vars-from-output sets %s more than once", outputVar.Name)
+				}
+			}
+			mt.VarsFromOutput = append(mt.VarsFromOutput, outputVar)
+			logger.GetLogger().Debug("Vars from output tag found", "variable", outputVar.Name, "pattern", outputVar.Pattern)
+		case TagClearScreen:
+			mt.ClearScreen = true
+			logger.GetLogger().Debug("Clear screen tag found")
+		case TagAssertJSONEquals:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-assert-json-equals-file requires a JSON file path")
+			}
+			mt.JSONEqualsFile = content
+			logger.GetLogger().Debug("Assert JSON equals tag found", "path", content)
+		case TagDecodeOutput:
+			if content != "base64" {
+				return MetaTag{}, fmt.Errorf("docci-decode-output only supports \"base64\", got: %q", content)
+			}
+			mt.DecodeOutput = content
+			logger.GetLogger().Debug("Decode output tag found", "encoding", content)
+		case TagStdinFromPrevious:
+			mt.StdinPrevious = true
+			logger.GetLogger().Debug("Stdin from previous tag found")
+		case TagExitMessage:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-exit-message requires a message")
+			}
+			mt.ExitMessage = content
+			logger.GetLogger().Debug("Exit message tag found", "message", content)
+		case TagPrecondition:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-precondition requires a command")
+			}
+			mt.Precondition = content
+			logger.GetLogger().Debug("Precondition tag found", "command", content)
+		case TagRepeatUntilFile:
+			// Parse format: done.flag|60
+			path, timeoutStr, ok := strings.Cut(content, "|")
+			path, timeoutStr = strings.TrimSpace(path), strings.TrimSpace(timeoutStr)
+			if !ok || path == "" {
+				return MetaTag{}, fmt.Errorf("docci-repeat-until-file format should be 'file|timeout_seconds', got: %q", content)
+			}
+			timeout, err := strconv.Atoi(timeoutStr)
+			if err != nil {
+				return MetaTag{}, fmt.Errorf("invalid timeout value in docci-repeat-until-file: %s", timeoutStr)
+			}
+			if timeout <= 0 {
+				return MetaTag{}, fmt.Errorf("timeout must be positive in docci-repeat-until-file, got: %d", timeout)
+			}
+			mt.RepeatUntilFile = path
+			mt.RepeatTimeout = timeout
+			logger.GetLogger().Debug("Repeat until file tag found", "path", path, "timeout_seconds", timeout)
+		case TagOutputStartsWith:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-output-starts-with requires the text the output starts with")
+			}
+			mt.OutputPrefix = content
+			logger.GetLogger().Debug("Output starts with tag found", "prefix", content)
+		case TagOutputEndsWith:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-output-ends-with requires the text the output ends with")
+			}
+			mt.OutputSuffix = content
+			logger.GetLogger().Debug("Output ends with tag found", "suffix", content)
+		case TagAssertLineCount:
+			lineCount, err := parseLineCount(content)
+			if err != nil {
+				return MetaTag{}, err
+			}
+			mt.LineCount = lineCount
+			logger.GetLogger().Debug("Assert line count tag found", "op", lineCount.Op, "count", lineCount.Count)
+		case TagWarnOnly:
+			mt.WarnOnly = true
+			logger.GetLogger().Debug("Warn only tag found")
+		case TagOutputSort:
+			mt.OutputSort = true
+			logger.GetLogger().Debug("Output sort tag found")
+		case TagStripANSI:
+			mt.StripANSI = true
+			logger.GetLogger().Debug("Strip ANSI tag found")
+		case TagFixTypography:
+			mt.FixTypography = true
+			logger.GetLogger().Debug("Fix typography tag found")
+		case TagArtifact:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-artifact requires a file path or glob")
+			}
+			for _, pattern := range strings.Split(content, ",") {
+				pattern = strings.TrimSpace(pattern)
+				if pattern == "" {
+					return MetaTag{}, fmt.Errorf("docci-artifact paths must not be empty, got: %s", content)
+				}
+				if _, err := filepath.Match(pattern, ""); err != nil {
+					return MetaTag{}, fmt.Errorf("invalid glob in docci-artifact: %s", pattern)
+				}
+				mt.Artifacts = append(mt.Artifacts, pattern)
+			}
+			logger.GetLogger().Debug("Artifact tag found", "paths", mt.Artifacts)
+		case TagAllowParallelWith:
+			var names []string
+			for _, name := range strings.Split(content, ",") {
+				name = strings.TrimSpace(name)
+				if !blockNameRe.MatchString(name) {
+					return MetaTag{}, fmt.Errorf("docci-allow-parallel-with requires comma-separated block names (letters, numbers and '_'), got: %q", content)
+				}
+				names = append(names, name)
+			}
+			mt.AllowParallelWith = names
+			logger.GetLogger().Debug("Allow parallel with tag found", "names", names)
+		case TagAssertNoChange:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-assert-no-change requires a file or directory path")
+			}
+			if strings.Contains(content, "\"") {
+				return MetaTag{}, fmt.Errorf("docci-assert-no-change does not support paths with quotes: %s", content)
+			}
+			mt.AssertNoChange = content
+			logger.GetLogger().Debug("Assert no change tag found", "path", content)
+		case TagCaptureExitCode:
+			if !shellVarRe.MatchString(content) {
+				return MetaTag{}, fmt.Errorf("docci-capture-exit-code requires a valid shell variable name, got: %q", content)
+			}
+			mt.CaptureExitCode = content
+			logger.GetLogger().Debug("Capture exit code tag found", "variable", content)
+		case TagOutputToEnv:
+			if !shellVarRe.MatchString(content) {
+				return MetaTag{}, fmt.Errorf("docci-output-to-env requires a valid shell variable name, got: %q", content)
+			}
+			mt.OutputToEnv = content
+			logger.GetLogger().Debug("Output to env tag found", "variable", content)
+		case TagTmpdir:
+			mt.Tmpdir = true
+			logger.GetLogger().Debug("Tmpdir tag found")
+		case TagNoNetwork:
+			mt.NoNetwork = true
+			logger.GetLogger().Debug("No network tag found")
+		case TagRunAs:
+			if !userNameRe.MatchString(content) {
+				return MetaTag{}, fmt.Errorf("docci-run-as requires a user name (letters, numbers, '_', '.' and '-'), got: %q", content)
+			}
+			mt.RunAs = content
+			logger.GetLogger().Debug("Run as tag found", "user", content)
+		case TagConcurrentGroup:
+			if content == "" {
+				return MetaTag{}, fmt.Errorf("docci-concurrent-group requires a group name")
+			}
+			if !concurrentGroupNameRe.MatchString(content) {
+				return MetaTag{}, fmt.Errorf("docci-concurrent-group name may only contain letters, numbers, '-' and '_', got: %s", content)
+			}
+			mt.ConcurrentGroup = content
+			logger.GetLogger().Debug("Concurrent group tag found", "group", content)
 		default:
 			return MetaTag{}, fmt.Errorf("unknown tag: %s", normalizedTag)
 		}
@@ -464,25 +1603,69 @@ func GetCurrentOS() string {
 
 // ShouldRunOnCurrentOS checks if a code block should run on the current OS
 func ShouldRunOnCurrentOS(blockOS string) bool {
+	return shouldRunOnOS(blockOS, GetCurrentOS())
+}
+
+// shouldRunOnOS checks a comma-separated docci-os list against currentOS. Entries prefixed with
+// '!' exclude an OS. The block runs when it matches one of the listed OSes (or only exclusions
+// were listed) and none of the excluded ones.
+func shouldRunOnOS(blockOS string, currentOS string) bool {
 	if blockOS == "" {
 		return true // No OS restriction
 	}
 
-	currentOS := GetCurrentOS()
+	hasAllowed, allowed := false, false
+	for _, entry := range strings.Split(blockOS, ",") {
+		entry = strings.TrimSpace(entry)
+		if name, negated := strings.CutPrefix(entry, "!"); negated {
+			if canonicalOS(name) == currentOS {
+				return false
+			}
+			continue
+		}
+		hasAllowed = true
+		// Unknown OS names never match, so the block is skipped
+		if canonicalOS(entry) == currentOS {
+			allowed = true
+		}
+	}
+	return !hasAllowed || allowed
+}
+
+// canonicalOS maps the supported OS names and their aliases to the names GetCurrentOS returns.
+// Unknown names are returned lowercased so they never match a supported OS.
+func canonicalOS(name string) string {
 	// Only support the three main OS types
-	switch strings.ToLower(blockOS) {
+	switch name = strings.ToLower(strings.TrimSpace(name)); name {
 	case "mac", "osx", "macos", "darwin":
-		return currentOS == "macos"
+		return "macos"
 	case "win", "windows":
-		return currentOS == "windows"
+		return "windows"
 	case "linux":
-		return currentOS == "linux"
+		return "linux"
 	default:
-		// Unknown OS, skip the block
-		return false
+		return name
 	}
 }
 
+// normalizeOSList validates a docci-os value and rewrites it as a lowercase list of canonical names,
+// e.g. "Mac, ! win" becomes "macos,!windows"
+func normalizeOSList(content string) (string, error) {
+	var entries []string
+	for _, entry := range strings.Split(content, ",") {
+		name, negated := strings.CutPrefix(strings.TrimSpace(entry), "!")
+		name = canonicalOS(name)
+		if name == "" {
+			return "", fmt.Errorf("docci-os entries must not be empty, got: %q", content)
+		}
+		if negated {
+			name = "!" + name
+		}
+		entries = append(entries, name)
+	}
+	return strings.Join(entries, ","), nil
+}
+
 // IsCommandInstalled checks if a command is available in the system PATH
 func IsCommandInstalled(command string) bool {
 	_, err := exec.LookPath(command)
@@ -505,6 +1688,22 @@ func ShouldRunBasedOnCommandInstallation(ifNotInstalledCommand string) bool {
 	return !isInstalled
 }
 
+// ShouldRunIfInstalled checks if a code block should run based on docci-if-installed, which only
+// includes the block when the command is installed
+func ShouldRunIfInstalled(ifInstalledCommand string) bool {
+	if ifInstalledCommand == "" {
+		return true // No command restriction
+	}
+
+	isInstalled := IsCommandInstalled(ifInstalledCommand)
+	if isInstalled {
+		logger.GetLogger().Debug("Including code block: command installed", "command", ifInstalledCommand)
+	} else {
+		logger.GetLogger().Debug("Skipping code block: command not installed", "command", ifInstalledCommand)
+	}
+	return isInstalled
+}
+
 // GetAllTagsInfo returns information about all available tags and their aliases
 func GetAllTagsInfo() []TagInfo {
 	return tagDefinitions
@@ -523,12 +1722,219 @@ func (mt *MetaTag) Validate(lineNumber int) error {
 	if mt.AssertFailure && mt.OutputContains != "" {
 		return fmt.Errorf("line %d: Cannot use both docci-assert-failure and docci-output-contains on the same code block", lineNumber)
 	}
+	if mt.OutputCount != nil && (mt.Background || mt.AssertFailure || mt.AfterAll) {
+		return fmt.Errorf("line %d: docci-output-contains-count cannot be combined with background, assert-failure or after-all tags", lineNumber)
+	}
 	if mt.WaitForEndpoint != "" && mt.Background {
 		return fmt.Errorf("line %d: Cannot use both docci-wait-for-endpoint and docci-background on the same code block", lineNumber)
 	}
+	if mt.PollUntilCmd != "" && (mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll) {
+		return fmt.Errorf("line %d: docci-poll-until cannot be combined with background, concurrent-group or after-all tags", lineNumber)
+	}
 	if mt.RetryCount > 0 && mt.Background {
 		return fmt.Errorf("line %d: Cannot use both docci-retry and docci-background on the same code block", lineNumber)
 	}
+	if mt.RetryTimeout > 0 && mt.Background {
+		return fmt.Errorf("line %d: Cannot use both docci-retry-timeout and docci-background on the same code block", lineNumber)
+	}
+
+	if mt.RetryDelaySet && mt.RetryCount == 0 && mt.RetryTimeout == 0 {
+		return fmt.Errorf("line %d: docci-retry-delay requires docci-retry or docci-retry-timeout on the same code block", lineNumber)
+	}
+	// an output that never changes would retry forever without a limit
+	if mt.RetryWhile != "" && mt.RetryCount == 0 && mt.RetryTimeout == 0 {
+		return fmt.Errorf("line %d: docci-retry-while-output requires docci-retry or docci-retry-timeout on the same code block", lineNumber)
+	}
+	if mt.RetryWhile != "" && (mt.ConcurrentGroup != "" || mt.AfterAll || mt.AssertFailure || mt.File != "") {
+		return fmt.Errorf("line %d: docci-retry-while-output cannot be combined with concurrent-group, after-all, assert-failure or file tags", lineNumber)
+	}
+
+	if mt.BackgroundExpectLog != "" && !mt.Background {
+		return fmt.Errorf("line %d: docci-background-expect-log requires docci-background on the same code block", lineNumber)
+	}
+	if mt.Isolate && mt.Background {
+		return fmt.Errorf("line %d: Cannot use both docci-isolate and docci-background on the same code block (background blocks already run in a subshell)", lineNumber)
+	}
+	if mt.MeasureMemory && !mt.Background {
+		return fmt.Errorf("line %d: docci-measure-memory requires docci-background on the same code block", lineNumber)
+	}
+	if mt.BackgroundMaxTimeSecs > 0 && !mt.Background {
+		return fmt.Errorf("line %d: docci-background-max-time requires docci-background on the same code block", lineNumber)
+	}
+	if len(mt.AssertFileExists) > 0 && mt.Background {
+		return fmt.Errorf("line %d: Cannot use both docci-assert-file-exists and docci-background on the same code block", lineNumber)
+	}
+	if len(mt.AssertFileContains) > 0 && mt.Background {
+		return fmt.Errorf("line %d: Cannot use both docci-assert-file-contains and docci-background on the same code block", lineNumber)
+	}
+	if mt.ExpectDurationOp != "" {
+		if mt.Background || mt.ConcurrentGroup != "" || mt.AssertFailure || mt.AfterAll || mt.File != "" {
+			return fmt.Errorf("line %d: docci-expect-duration cannot be combined with background, concurrent-group, assert-failure, after-all or file tags", lineNumber)
+		}
+	}
+	// named blocks record success in a flag, which background and concurrent blocks cannot do in order
+	if mt.Name != "" || mt.SkipOnFailureOf != "" {
+		if mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll {
+			return fmt.Errorf("line %d: docci-name and docci-skip-on-failure-of cannot be combined with background, concurrent-group or after-all tags", lineNumber)
+		}
+	}
+	// both blocks are timed from the script, so they have to run on their own, in order
+	if mt.FasterThan != "" {
+		if mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll || mt.AssertFailure || mt.File != "" {
+			return fmt.Errorf("line %d: docci-assert-faster-than cannot be combined with background, concurrent-group, after-all, assert-failure or file tags", lineNumber)
+		}
+		if mt.FasterThan == mt.Name {
+			return fmt.Errorf("line %d: docci-assert-faster-than=%s names the block itself", lineNumber, mt.FasterThan)
+		}
+	}
+	// the guard is only written around blocks that run in order in the main script
+	if mt.SkipIfEmptyDir != "" && (mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll) {
+		return fmt.Errorf("line %d: docci-skip-if-empty-dir cannot be combined with background, concurrent-group or after-all tags", lineNumber)
+	}
+	if (mt.BailMessage != "" || mt.BailCode != 0) && mt.BailUnless == "" {
+		return fmt.Errorf("line %d: docci-bail-message and docci-bail-code require docci-bail-unless on the same code block", lineNumber)
+	}
+	// the guard exits the main script, which concurrent members and after-all blocks do not run in
+	if mt.BailUnless != "" && (mt.ConcurrentGroup != "" || mt.AfterAll) {
+		return fmt.Errorf("line %d: docci-bail-unless cannot be combined with concurrent-group or after-all tags", lineNumber)
+	}
+	// an assert-failure block keeps going after a failed command, so its success cannot be recorded
+	if mt.Name != "" && mt.AssertFailure {
+		return fmt.Errorf("line %d: Cannot use both docci-name and docci-assert-failure on the same code block", lineNumber)
+	}
+
+	// transcripts run command by command with their own output checks
+	if mt.Transcript {
+		if mt.Background || mt.ConcurrentGroup != "" || mt.AssertFailure || mt.AfterAll || mt.File != "" || mt.DelayPerCmdSecs > 0 {
+			return fmt.Errorf("line %d: docci-transcript cannot be combined with background, concurrent-group, assert-failure, after-all, delay-per-cmd or file tags", lineNumber)
+		}
+	}
+	// matrix runs are checked one by one in the script, which needs the block to run in order and succeed
+	if mt.MatrixVar != "" {
+		if mt.Background || mt.ConcurrentGroup != "" || mt.AssertFailure || mt.AfterAll || mt.File != "" || mt.OutputCount != nil {
+			return fmt.Errorf("line %d: docci-matrix cannot be combined with background, concurrent-group, assert-failure, after-all, output-contains-count or file tags", lineNumber)
+		}
+	}
+	if mt.Required && mt.OS == "" && mt.IfInstalled == "" && mt.IfNotInstalled == "" && mt.Precondition == "" {
+		return fmt.Errorf("line %d: docci-required needs docci-os, docci-if-installed, docci-if-not-installed or docci-precondition on the same code block", lineNumber)
+	}
+	// the exit code is stored in the script's own shell, and a failure no longer stops the run, so
+	// blocks that run elsewhere, expect a failure or record their success are rejected
+	if mt.CaptureExitCode != "" {
+		if mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll || mt.AssertFailure || mt.Name != "" || mt.File != "" {
+			return fmt.Errorf("line %d: docci-capture-exit-code cannot be combined with background, concurrent-group, after-all, assert-failure, name or file tags", lineNumber)
+		}
+	}
+	// the block runs a second time in the same shell, so it has to be a plain command block that
+	// runs once, in order, and is expected to pass
+	if mt.AssertNoChange != "" {
+		if mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll || mt.AssertFailure || mt.MatrixVar != "" ||
+			mt.Transcript || mt.ExpectDurationOp != "" || mt.File != "" {
+			return fmt.Errorf("line %d: docci-assert-no-change cannot be combined with background, concurrent-group, after-all, assert-failure, matrix, transcript, expect-duration or file tags", lineNumber)
+		}
+	}
+	// fixtures are staged by the regular block path, which background, concurrent and after-all blocks skip
+	if len(mt.Fixtures) > 0 && (mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll) {
+		return fmt.Errorf("line %d: docci-fixture cannot be combined with background, concurrent-group or after-all tags", lineNumber)
+	}
+	if len(mt.AllowParallelWith) > 0 && (mt.Background || mt.BeforeAll || mt.AfterAll) {
+		return fmt.Errorf("line %d: docci-allow-parallel-with cannot be combined with background, before-all or after-all tags", lineNumber)
+	}
+	// transcripts and file operations are not plain commands that can be handed to sudo
+	if mt.RunAs != "" && (mt.Transcript || mt.File != "") {
+		return fmt.Errorf("line %d: docci-run-as cannot be combined with transcript or file tags", lineNumber)
+	}
+	// the output is read from the block's markers, which these blocks do not write
+	if mt.OutputToEnv != "" && (mt.Background || mt.AfterAll) {
+		return fmt.Errorf("line %d: docci-output-to-env cannot be combined with background or after-all tags", lineNumber)
+	}
+	// sorting happens on the output read from the block's markers, while matrix and transcript
+	// blocks check their output in the script
+	if mt.OutputSort && (mt.Background || mt.AfterAll || mt.MatrixVar != "" || mt.Transcript) {
+		return fmt.Errorf("line %d: docci-output-sort cannot be combined with background, after-all, matrix or transcript tags", lineNumber)
+	}
+	if mt.TrimOutputLines > 0 && (mt.Background || mt.AfterAll || mt.MatrixVar != "" || mt.Transcript) {
+		return fmt.Errorf("line %d: docci-trim-output cannot be combined with background, after-all, matrix or transcript tags", lineNumber)
+	}
+	// the output is parsed as a whole JSON document, which sorting its lines would break
+	if mt.JSONSchema != "" && (mt.Background || mt.AfterAll || mt.MatrixVar != "" || mt.Transcript || mt.OutputSort) {
+		return fmt.Errorf("line %d: docci-output-json-schema cannot be combined with background, after-all, matrix, transcript or output-sort tags", lineNumber)
+	}
+	// the output is kept from the regular block path, and a block that fails or runs more than once
+	// has no single output to read the variables from
+	if len(mt.VarsFromOutput) > 0 && (mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll || mt.MatrixVar != "" ||
+		mt.AssertFailure || mt.CaptureExitCode != "" || mt.File != "") {
+		return fmt.Errorf("line %d: docci-vars-from-output cannot be combined with background, concurrent-group, after-all, matrix, assert-failure, capture-exit-code or file tags", lineNumber)
+	}
+	// the screen is cleared by the regular block path, before the block's start marker
+	if mt.ClearScreen && (mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll) {
+		return fmt.Errorf("line %d: docci-clear-screen cannot be combined with background, concurrent-group or after-all tags", lineNumber)
+	}
+	if mt.JSONEqualsFile != "" && (mt.Background || mt.AfterAll || mt.MatrixVar != "" || mt.Transcript || mt.OutputSort) {
+		return fmt.Errorf("line %d: docci-assert-json-equals-file cannot be combined with background, after-all, matrix, transcript or output-sort tags", lineNumber)
+	}
+	if mt.DecodeOutput != "" && (mt.Background || mt.AfterAll || mt.MatrixVar != "" || mt.Transcript) {
+		return fmt.Errorf("line %d: docci-decode-output cannot be combined with background, after-all, matrix or transcript tags", lineNumber)
+	}
+	// the output is fed in by the regular block path, and stdin can only come from one place
+	if mt.StdinPrevious && (mt.StdinFile != "" || mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll || mt.File != "") {
+		return fmt.Errorf("line %d: docci-stdin-from-previous cannot be combined with stdin-file, background, concurrent-group, after-all or file tags", lineNumber)
+	}
+	// these blocks never fail the run, so the message would never be printed
+	if mt.ExitMessage != "" && (mt.Background || mt.AssertFailure || mt.CaptureExitCode != "") {
+		return fmt.Errorf("line %d: docci-exit-message cannot be combined with background, assert-failure or capture-exit-code tags", lineNumber)
+	}
+	// the guard is only written around blocks that run in order in the main script
+	if mt.Precondition != "" && (mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll) {
+		return fmt.Errorf("line %d: docci-precondition cannot be combined with background, concurrent-group or after-all tags", lineNumber)
+	}
+	// the block is repeated by the regular block path, in a loop of its own that retries would nest
+	if mt.RepeatUntilFile != "" && (mt.RetryCount > 0 || mt.RetryTimeout > 0 || mt.Background || mt.ConcurrentGroup != "" ||
+		mt.AfterAll || mt.MatrixVar != "" || mt.AssertFailure || mt.File != "") {
+		return fmt.Errorf("line %d: docci-repeat-until-file cannot be combined with retry, background, concurrent-group, after-all, matrix, assert-failure or file tags", lineNumber)
+	}
+	// a matrix block's output holds every run, so only the first run's start and the last run's end could be checked
+	if (mt.OutputPrefix != "" || mt.OutputSuffix != "") && (mt.Background || mt.AssertFailure || mt.AfterAll || mt.MatrixVar != "") {
+		return fmt.Errorf("line %d: docci-output-starts-with and docci-output-ends-with cannot be combined with background, assert-failure, after-all or matrix tags", lineNumber)
+	}
+	if mt.LineCount != nil && (mt.Background || mt.AssertFailure || mt.AfterAll || mt.MatrixVar != "") {
+		return fmt.Errorf("line %d: docci-assert-line-count cannot be combined with background, assert-failure, after-all or matrix tags", lineNumber)
+	}
+	// a failure is caught in the script's own shell like docci-capture-exit-code, so the same blocks
+	// are rejected, and blocks that expect a failure or explain one have nothing left to do
+	if mt.WarnOnly && (mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll || mt.AssertFailure || mt.CaptureExitCode != "" ||
+		mt.ExitMessage != "" || len(mt.VarsFromOutput) > 0 || mt.Name != "" || mt.File != "") {
+		return fmt.Errorf("line %d: docci-warn-only cannot be combined with background, concurrent-group, after-all, assert-failure, capture-exit-code, exit-message, vars-from-output, name or file tags", lineNumber)
+	}
+	// the scratch directory is removed after the block's end marker, which these blocks do not have
+	if mt.Tmpdir && (mt.Background || mt.ConcurrentGroup != "" || mt.AfterAll) {
+		return fmt.Errorf("line %d: docci-tmpdir cannot be combined with background, concurrent-group or after-all tags", lineNumber)
+	}
+	// the namespace wrapper runs the commands with bash -c, like docci-run-as, and sudo cannot be
+	// nested inside the unprivileged namespace
+	if mt.NoNetwork && (mt.RunAs != "" || mt.Transcript || mt.File != "") {
+		return fmt.Errorf("line %d: docci-no-network cannot be combined with run-as, transcript or file tags", lineNumber)
+	}
+	if mt.StdinFile != "" && mt.File != "" {
+		return fmt.Errorf("line %d: Cannot use docci-stdin-file with file operations", lineNumber)
+	}
+	if mt.BeforeAll && mt.AfterAll {
+		return fmt.Errorf("line %d: Cannot use both docci-before-all and docci-after-all on the same code block", lineNumber)
+	}
+	// after-all blocks run inside the exit trap, so they cannot be validated or backgrounded
+	if mt.AfterAll {
+		if mt.Background || mt.BackgroundKill > 0 || mt.OutputContains != "" || mt.AssertFailure || mt.RetryCount > 0 || mt.RetryTimeout > 0 || mt.File != "" {
+			return fmt.Errorf("line %d: docci-after-all cannot be combined with background, output, assert-failure, retry or file tags", lineNumber)
+		}
+	}
+
+	// concurrent blocks run together, so tags that depend on ordering or exit status are rejected
+	if mt.ConcurrentGroup != "" {
+		if mt.Background || mt.BackgroundKill > 0 || mt.AssertFailure || mt.RetryCount > 0 || mt.RetryTimeout > 0 || mt.WaitForEndpoint != "" ||
+			mt.DelayBeforeSecs > 0 || mt.DelayAfterSecs > 0 || mt.DelayPerCmdSecs > 0 || mt.BeforeAll || mt.AfterAll || mt.File != "" {
+			return fmt.Errorf("line %d: docci-concurrent-group cannot be combined with background, assert-failure, retry, wait, delay, before/after-all or file tags", lineNumber)
+		}
+	}
 
 	// Validate file operations
 	if mt.File != "" {
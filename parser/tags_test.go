@@ -1,8 +1,12 @@
 package parser
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 
+	"github.com/reecepbcups/docci/logger"
+	"github.com/reecepbcups/docci/types"
 	"github.com/stretchr/testify/require"
 	// "github.com/stretchr/testify/require"
 )
@@ -187,3 +191,874 @@ func TestDelayBefore(t *testing.T) {
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "requires a value")
 }
+
+func TestBackgroundExpectLog(t *testing.T) {
+	pt, err := ParseTags("```bash docci-background docci-background-expect-log=\"Listening on 8080|30\"")
+	require.NoError(t, err)
+	require.Equal(t, "Listening on 8080", pt.BackgroundExpectLog)
+	require.Equal(t, 30, pt.BackgroundExpectLogTimeoutSecs)
+	require.NoError(t, pt.Validate(1))
+
+	// Test alias and a | inside the expected text
+	pt, err = ParseTags("```bash docci-bg docci-bg-expect-log=\"a|b|5\"")
+	require.NoError(t, err)
+	require.Equal(t, "a|b", pt.BackgroundExpectLog)
+	require.Equal(t, 5, pt.BackgroundExpectLogTimeoutSecs)
+
+	// Test missing timeout
+	_, err = ParseTags("```bash docci-background-expect-log=\"ready\"")
+	require.ErrorContains(t, err, "format should be")
+
+	// Test invalid timeout
+	_, err = ParseTags("```bash docci-background-expect-log=\"ready|0\"")
+	require.ErrorContains(t, err, "timeout must be positive")
+
+	// Test requires background
+	pt, err = ParseTags("```bash docci-background-expect-log=\"ready|5\"")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "requires docci-background")
+}
+
+func TestMeasureMemory(t *testing.T) {
+	pt, err := ParseTags("```bash docci-background docci-measure-memory")
+	require.NoError(t, err)
+	require.True(t, pt.MeasureMemory)
+	require.NoError(t, pt.Validate(1))
+
+	// Test requires background
+	pt, err = ParseTags("```bash docci-measure-mem")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "requires docci-background")
+}
+
+func TestAssertFileExists(t *testing.T) {
+	pt, err := ParseTags("```bash docci-assert-file-exists=\"dist/app\"")
+	require.NoError(t, err)
+	require.Equal(t, []string{"dist/app"}, pt.AssertFileExists)
+
+	// Test comma-separated and repeated tags
+	pt, err = ParseTags("```bash docci-assert-file-exists=\"dist/app, dist/app.sha256\" docci-file-exists=README.md")
+	require.NoError(t, err)
+	require.Equal(t, []string{"dist/app", "dist/app.sha256", "README.md"}, pt.AssertFileExists)
+
+	// Test empty value
+	_, err = ParseTags("```bash docci-assert-file-exists")
+	require.ErrorContains(t, err, "requires a file path")
+
+	// Test empty entry
+	_, err = ParseTags("```bash docci-assert-file-exists=\"a,,b\"")
+	require.ErrorContains(t, err, "empty file path")
+}
+
+func TestAssertFileContains(t *testing.T) {
+	pt, err := ParseTags("```bash docci-assert-file-contains=\"config.yaml|enabled: true\"")
+	require.NoError(t, err)
+	require.Equal(t, []FileContains{{Path: "config.yaml", Expected: "enabled: true"}}, pt.AssertFileContains)
+
+	// Test alias, repeated tags and a | inside the expected text
+	pt, err = ParseTags("```bash docci-file-contains=\"a.txt|x|y\" docci-assert-file-contains='b.txt|z'")
+	require.NoError(t, err)
+	require.Equal(t, []FileContains{{Path: "a.txt", Expected: "x|y"}, {Path: "b.txt", Expected: "z"}}, pt.AssertFileContains)
+
+	// Test missing separator
+	_, err = ParseTags("```bash docci-assert-file-contains=\"config.yaml\"")
+	require.ErrorContains(t, err, "format should be")
+
+	// Test empty parts
+	_, err = ParseTags("```bash docci-assert-file-contains=\"|text\"")
+	require.ErrorContains(t, err, "must be non-empty")
+}
+
+func TestAllTagNames(t *testing.T) {
+	names := AllTagNames()
+	require.Contains(t, names, TagRetry)
+	require.Contains(t, names, "docci-repeat")
+	require.IsIncreasing(t, names)
+}
+
+func TestWorkingDir(t *testing.T) {
+	pt, err := ParseTags("```bash docci-cwd=\"frontend/app\"")
+	require.NoError(t, err)
+	require.Equal(t, "frontend/app", pt.WorkingDir)
+
+	// Test alias
+	pt, err = ParseTags("```bash docci-dir=backend")
+	require.NoError(t, err)
+	require.Equal(t, "backend", pt.WorkingDir)
+
+	// Test empty value
+	_, err = ParseTags("```bash docci-cwd")
+	require.ErrorContains(t, err, "requires a directory path")
+}
+
+func TestStdinFile(t *testing.T) {
+	pt, err := ParseTags("```bash docci-stdin-file=\"input.json\"")
+	require.NoError(t, err)
+	require.Equal(t, "input.json", pt.StdinFile)
+
+	// Test alias
+	pt, err = ParseTags("```bash docci-stdin=data/input.txt")
+	require.NoError(t, err)
+	require.Equal(t, "data/input.txt", pt.StdinFile)
+
+	// Test empty value
+	_, err = ParseTags("```bash docci-stdin-file")
+	require.ErrorContains(t, err, "requires a file path")
+
+	// Cannot be combined with file operations
+	pt, err = ParseTags("```bash docci-stdin-file=input.json docci-file=out.txt")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "Cannot use docci-stdin-file with file operations")
+}
+
+func TestIsolate(t *testing.T) {
+	pt, err := ParseTags("```bash docci-isolate")
+	require.NoError(t, err)
+	require.True(t, pt.Isolate)
+	require.NoError(t, pt.Validate(1))
+
+	// Test alias
+	pt, err = ParseTags("```bash docci-subshell")
+	require.NoError(t, err)
+	require.True(t, pt.Isolate)
+
+	// Background blocks already run in a subshell
+	pt, err = ParseTags("```bash docci-isolate docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "Cannot use both docci-isolate and docci-background")
+}
+
+func TestExpectDuration(t *testing.T) {
+	tests := []struct {
+		tag  string
+		op   string
+		secs float64
+	}{
+		{"docci-expect-duration=\"<2\"", "<", 2},
+		{"docci-expect-duration=\"<=1.5\"", "<=", 1.5},
+		{"docci-expect-duration=\">0.5\"", ">", 0.5},
+		{"docci-duration=\">= 3\"", ">=", 3},
+	}
+	for _, tc := range tests {
+		pt, err := ParseTags("```bash " + tc.tag)
+		require.NoError(t, err, tc.tag)
+		require.Equal(t, tc.op, pt.ExpectDurationOp, tc.tag)
+		require.Equal(t, tc.secs, pt.ExpectDurationSecs, tc.tag)
+		require.NoError(t, pt.Validate(1))
+	}
+
+	_, err := ParseTags("```bash docci-expect-duration")
+	require.ErrorContains(t, err, "requires a comparison")
+	_, err = ParseTags("```bash docci-expect-duration=\"2\"")
+	require.ErrorContains(t, err, "must start with <, <=, > or >=")
+	_, err = ParseTags("```bash docci-expect-duration=\"<fast\"")
+	require.ErrorContains(t, err, "invalid seconds")
+	_, err = ParseTags("```bash docci-expect-duration=\"<0\"")
+	require.ErrorContains(t, err, "must be positive")
+
+	pt, err := ParseTags("```bash docci-expect-duration=\"<2\" docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-expect-duration cannot be combined")
+}
+
+func TestForceExec(t *testing.T) {
+	pt, err := ParseTags("```console docci-exec")
+	require.NoError(t, err)
+	require.True(t, pt.ForceExec)
+
+	// Test alias
+	pt, err = ParseTags("```text docci-force-exec")
+	require.NoError(t, err)
+	require.True(t, pt.ForceExec)
+}
+
+func TestPromptStrip(t *testing.T) {
+	pt, err := ParseTags("```bash docci-prompt-strip")
+	require.NoError(t, err)
+	require.Equal(t, []string{"$ ", "# "}, pt.StripPrompts)
+
+	pt, err = ParseTags("```bash docci-prompt-strip=\"> ,% \"")
+	require.NoError(t, err)
+	require.Equal(t, []string{"> ", "% "}, pt.StripPrompts)
+
+	pt, err = ParseTags("```bash")
+	require.NoError(t, err)
+	require.Nil(t, pt.StripPrompts)
+}
+
+func TestTranscript(t *testing.T) {
+	pt, err := ParseTags("```console docci-transcript")
+	require.NoError(t, err)
+	require.True(t, pt.Transcript)
+	require.NoError(t, pt.Validate(1))
+
+	pt, err = ParseTags("```console docci-console docci-background")
+	require.NoError(t, err)
+	require.True(t, pt.Transcript)
+	require.ErrorContains(t, pt.Validate(1), "docci-transcript cannot be combined")
+}
+
+func TestRetryDelay(t *testing.T) {
+	pt, err := ParseTags("```bash docci-retry=3 docci-retry-delay=10")
+	require.NoError(t, err)
+	require.True(t, pt.RetryDelaySet)
+	require.Equal(t, 10.0, pt.RetryDelaySecs)
+	require.NoError(t, pt.Validate(1))
+
+	// zero is allowed and distinct from unset
+	pt, err = ParseTags("```bash docci-retry=3 docci-retry-wait=0")
+	require.NoError(t, err)
+	require.True(t, pt.RetryDelaySet)
+	require.Zero(t, pt.RetryDelaySecs)
+
+	_, err = ParseTags("```bash docci-retry=3 docci-retry-delay=-1")
+	require.ErrorContains(t, err, "must not be negative")
+	_, err = ParseTags("```bash docci-retry=3 docci-retry-delay=soon")
+	require.ErrorContains(t, err, "invalid delay seconds")
+
+	pt, err = ParseTags("```bash docci-retry-delay=2")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-retry-delay requires docci-retry")
+}
+
+func TestRetryTimeout(t *testing.T) {
+	pt, err := ParseTags("```bash docci-retry-timeout=60")
+	require.NoError(t, err)
+	require.Equal(t, 60, pt.RetryTimeout)
+	require.Zero(t, pt.RetryCount)
+	require.NoError(t, pt.Validate(1))
+
+	// combines with docci-retry, and docci-retry-delay works with either
+	pt, err = ParseTags("```bash docci-retry=5 docci-retry-for=30 docci-retry-delay=1")
+	require.NoError(t, err)
+	require.Equal(t, 5, pt.RetryCount)
+	require.Equal(t, 30, pt.RetryTimeout)
+	require.NoError(t, pt.Validate(1))
+	pt, err = ParseTags("```bash docci-retry-timeout=30 docci-retry-delay=1")
+	require.NoError(t, err)
+	require.NoError(t, pt.Validate(1))
+
+	for _, value := range []string{"0", "-5"} {
+		_, err = ParseTags("```bash docci-retry-timeout=" + value)
+		require.ErrorContains(t, err, "must be positive")
+	}
+	_, err = ParseTags("```bash docci-retry-timeout=1.5")
+	require.ErrorContains(t, err, "invalid timeout seconds")
+	_, err = ParseTags("```bash docci-retry-timeout")
+	require.ErrorContains(t, err, "requires a value")
+
+	pt, err = ParseTags("```bash docci-retry-timeout=10 docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-retry-timeout and docci-background")
+	pt, err = ParseTags("```bash docci-retry-timeout=10 docci-after-all")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-after-all cannot be combined")
+}
+
+func TestOutputSortTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-sort-output docci-output-contains=\"a.txt\\nb.txt\"")
+	require.NoError(t, err)
+	require.True(t, pt.OutputSort)
+	require.NoError(t, pt.Validate(1))
+
+	// \n separates the expected lines only on sorted blocks
+	blocks, err := ParseCodeBlocks("```bash docci-output-sort docci-output-contains=\"a.txt\\nb.txt\"\nls\n```\n" +
+		"```bash docci-output-contains=\"a\\nb\"\nls\n```\n")
+	require.NoError(t, err)
+	require.Equal(t, "a.txt\nb.txt", blocks[0].OutputContains)
+	require.Equal(t, `a\nb`, blocks[1].OutputContains)
+
+	for _, tag := range []string{"docci-background", "docci-after-all", "docci-matrix=\"N=1,2\"", "docci-transcript"} {
+		pt, err = ParseTags("```bash docci-output-sort " + tag)
+		require.NoError(t, err)
+		require.ErrorContains(t, pt.Validate(1), "docci-output-sort cannot be combined", tag)
+	}
+}
+
+func TestTrimOutputTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-trim-output=\"tail:5\"")
+	require.NoError(t, err)
+	require.Equal(t, "tail", pt.TrimOutputFrom)
+	require.Equal(t, 5, pt.TrimOutputLines)
+	require.NoError(t, pt.Validate(1))
+
+	pt, err = ParseTags("```bash docci-output-lines=head:1")
+	require.NoError(t, err)
+	require.Equal(t, "head", pt.TrimOutputFrom)
+	require.Equal(t, 1, pt.TrimOutputLines)
+
+	for _, value := range []string{"5", "middle:5", "tail:", "tail:0", "head:-2", "tail:x"} {
+		_, err = ParseTags("```bash docci-trim-output=" + value)
+		require.Error(t, err, value)
+	}
+
+	pt, err = ParseTags("```bash docci-trim-output=tail:5 docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-trim-output cannot be combined")
+}
+
+func TestAssertFasterThanTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-assert-faster-than=baseline")
+	require.NoError(t, err)
+	require.Equal(t, "baseline", pt.FasterThan)
+	require.NoError(t, pt.Validate(1))
+
+	pt, err = ParseTags("```bash docci-faster-than=old_way docci-name=new_way")
+	require.NoError(t, err)
+	require.Equal(t, "old_way", pt.FasterThan)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-assert-faster-than=\"two words\"")
+	require.ErrorContains(t, err, "requires a block name")
+
+	pt, err = ParseTags("```bash docci-assert-faster-than=fast docci-name=fast")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "names the block itself")
+
+	for _, tag := range []string{"docci-background", "docci-after-all", "docci-assert-failure", "docci-concurrent-group=g"} {
+		pt, err = ParseTags("```bash docci-assert-faster-than=baseline " + tag)
+		require.NoError(t, err)
+		require.ErrorContains(t, pt.Validate(1), "docci-assert-faster-than cannot be combined", tag)
+	}
+}
+
+func TestSkipIfEmptyDirTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-skip-if-empty-dir=\"./inbox\"")
+	require.NoError(t, err)
+	require.Equal(t, "./inbox", pt.SkipIfEmptyDir)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-skip-if-empty-dir")
+	require.ErrorContains(t, err, "requires a directory path")
+	_, err = ParseTags("```bash docci-skip-if-empty-dir=\"$HOME/inbox\"")
+	require.ErrorContains(t, err, "invalid characters")
+
+	pt, err = ParseTags("```bash docci-skip-if-empty-dir=inbox docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-skip-if-empty-dir cannot be combined")
+}
+
+func TestBackgroundMaxTimeTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-background docci-bg-max-time=30")
+	require.NoError(t, err)
+	require.Equal(t, 30, pt.BackgroundMaxTimeSecs)
+	require.NoError(t, pt.Validate(1))
+
+	for _, value := range []string{"0", "-1", "1.5", ""} {
+		_, err = ParseTags("```bash docci-background docci-background-max-time=" + value)
+		require.Error(t, err, value)
+	}
+
+	pt, err = ParseTags("```bash docci-background-max-time=30")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-background-max-time requires docci-background")
+}
+
+func TestBailUnlessTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-stop-unless=\"command -v docker\" docci-bail-message=\"docker is required\" docci-bail-code=78")
+	require.NoError(t, err)
+	require.Equal(t, "command -v docker", pt.BailUnless)
+	require.Equal(t, "docker is required", pt.BailMessage)
+	require.Equal(t, 78, pt.BailCode)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-bail-unless")
+	require.ErrorContains(t, err, "requires a command")
+	for _, value := range []string{"-1", "256", "x", ""} {
+		_, err = ParseTags("```bash docci-bail-unless=true docci-bail-code=" + value)
+		require.Error(t, err, value)
+	}
+
+	pt, err = ParseTags("```bash docci-bail-code=1")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "require docci-bail-unless")
+	pt, err = ParseTags("```bash docci-bail-unless=true docci-after-all")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-bail-unless cannot be combined")
+}
+
+func TestOutputJSONSchemaTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-json-schema=\"schemas/response.json\"")
+	require.NoError(t, err)
+	require.Equal(t, "schemas/response.json", pt.JSONSchema)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-output-json-schema")
+	require.ErrorContains(t, err, "requires a schema file path")
+
+	pt, err = ParseTags("```bash docci-output-json-schema=s.json docci-output-sort")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-output-json-schema cannot be combined")
+}
+
+func TestVarsFromOutputTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-vars-from-output=\"TOKEN=token: ([a-z0-9]+)\" docci-capture-vars=\"ID=id=[0-9]+\"")
+	require.NoError(t, err)
+	require.Equal(t, []OutputVar{{Name: "TOKEN", Pattern: "token: ([a-z0-9]+)"}, {Name: "ID", Pattern: "id=[0-9]+"}}, pt.VarsFromOutput)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-vars-from-output=TOKEN")
+	require.ErrorContains(t, err, "format should be 'NAME=regex'")
+	_, err = ParseTags("```bash docci-vars-from-output=\"1TOKEN=x\"")
+	require.ErrorContains(t, err, "valid shell variable name")
+	_, err = ParseTags("```bash docci-vars-from-output=\"TOKEN=(x\"")
+	require.ErrorContains(t, err, "not a POSIX extended regex")
+	// Perl classes are not part of the regexes bash matches with
+	_, err = ParseTags("```bash docci-vars-from-output=\"TOKEN=\\d+\"")
+	require.ErrorContains(t, err, "not a POSIX extended regex")
+	_, err = ParseTags("```bash docci-vars-from-output=\"A=x\" docci-vars-from-output=\"A=y\"")
+	require.ErrorContains(t, err, "sets A more than once")
+
+	pt, err = ParseTags("```bash docci-vars-from-output=\"A=x\" docci-matrix=\"V=1,2\"")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-vars-from-output cannot be combined")
+}
+
+func TestRetryWhileOutputTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-retry-output-not=\"status: (pending|creating)\" docci-retry-timeout=60")
+	require.NoError(t, err)
+	require.Equal(t, "status: (pending|creating)", pt.RetryWhile)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-retry-while-output docci-retry=3")
+	require.ErrorContains(t, err, "requires a regex")
+	_, err = ParseTags("```bash docci-retry-while-output=\"(pending\" docci-retry=3")
+	require.ErrorContains(t, err, "not a POSIX extended regex")
+
+	// without a limit the block could retry forever
+	pt, err = ParseTags("```bash docci-retry-while-output=pending")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "requires docci-retry or docci-retry-timeout")
+
+	pt, err = ParseTags("```bash docci-retry-while-output=pending docci-retry=3 docci-assert-failure")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-retry-while-output cannot be combined")
+}
+
+func TestClearScreenTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-clear")
+	require.NoError(t, err)
+	require.True(t, pt.ClearScreen)
+	require.NoError(t, pt.Validate(1))
+
+	pt, err = ParseTags("```bash docci-clear-screen docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-clear-screen cannot be combined")
+}
+
+func TestAssertJSONEqualsTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-assert-json-equals=\"expected/user.json\"")
+	require.NoError(t, err)
+	require.Equal(t, "expected/user.json", pt.JSONEqualsFile)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-assert-json-equals-file")
+	require.ErrorContains(t, err, "requires a JSON file path")
+
+	pt, err = ParseTags("```bash docci-assert-json-equals-file=e.json docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-assert-json-equals-file cannot be combined")
+}
+
+func TestDecodeOutputTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-decode-output=\"base64\" docci-output-contains=hello")
+	require.NoError(t, err)
+	require.Equal(t, "base64", pt.DecodeOutput)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-output-decode=hex")
+	require.ErrorContains(t, err, "only supports \"base64\"")
+
+	pt, err = ParseTags("```bash docci-decode-output=base64 docci-matrix=\"V=1,2\"")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-decode-output cannot be combined")
+}
+
+func TestStdinFromPreviousTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-pipe-previous")
+	require.NoError(t, err)
+	require.True(t, pt.StdinPrevious)
+	require.NoError(t, pt.Validate(1))
+
+	pt, err = ParseTags("```bash docci-stdin-from-previous docci-stdin-file=in.txt")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-stdin-from-previous cannot be combined")
+}
+
+func TestExitMessageTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-exit-message=\"Make sure Docker is running.\"")
+	require.NoError(t, err)
+	require.Equal(t, "Make sure Docker is running.", pt.ExitMessage)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-failure-message")
+	require.ErrorContains(t, err, "requires a message")
+
+	pt, err = ParseTags("```bash docci-exit-message=hint docci-assert-failure")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-exit-message cannot be combined")
+}
+
+func TestPreconditionTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-precondition=\"test -d build\" docci-required")
+	require.NoError(t, err)
+	require.Equal(t, "test -d build", pt.Precondition)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-run-if")
+	require.ErrorContains(t, err, "requires a command")
+
+	pt, err = ParseTags("```bash docci-precondition=true docci-after-all")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-precondition cannot be combined")
+}
+
+func TestRepeatUntilFileTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-repeat-until-file=\"out/done.flag | 60\"")
+	require.NoError(t, err)
+	require.Equal(t, "out/done.flag", pt.RepeatUntilFile)
+	require.Equal(t, 60, pt.RepeatTimeout)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-until-file=done.flag")
+	require.ErrorContains(t, err, "format should be 'file|timeout_seconds'")
+	_, err = ParseTags("```bash docci-repeat-until-file=\"done.flag|soon\"")
+	require.ErrorContains(t, err, "invalid timeout value")
+	_, err = ParseTags("```bash docci-repeat-until-file=\"done.flag|0\"")
+	require.ErrorContains(t, err, "timeout must be positive")
+
+	pt, err = ParseTags("```bash docci-repeat-until-file=\"done.flag|5\" docci-retry=3")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-repeat-until-file cannot be combined")
+}
+
+func TestOutputStartsEndsWithTags(t *testing.T) {
+	pt, err := ParseTags("```bash docci-output-starts-with=\"Usage:\" docci-output-suffix=\"Done.\"")
+	require.NoError(t, err)
+	require.Equal(t, "Usage:", pt.OutputPrefix)
+	require.Equal(t, "Done.", pt.OutputSuffix)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-output-ends-with")
+	require.ErrorContains(t, err, "requires the text the output ends with")
+
+	pt, err = ParseTags("```bash docci-output-prefix=ok docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-output-starts-with and docci-output-ends-with cannot be combined")
+}
+
+func TestAssertLineCountTag(t *testing.T) {
+	for content, want := range map[string]types.LineCount{
+		"3":    {Op: "==", Count: 3},
+		"=0":   {Op: "==", Count: 0},
+		"==1":  {Op: "==", Count: 1},
+		">=2":  {Op: ">=", Count: 2},
+		"< 10": {Op: "<", Count: 10},
+		">0":   {Op: ">", Count: 0},
+	} {
+		pt, err := ParseTags("```bash docci-assert-line-count=\"" + content + "\"")
+		require.NoError(t, err, content)
+		require.Equal(t, &want, pt.LineCount, content)
+	}
+
+	for _, content := range []string{"", "three", "-1", "=>2"} {
+		_, err := ParseTags("```bash docci-line-count=\"" + content + "\"")
+		require.Error(t, err, content)
+	}
+
+	pt, err := ParseTags("```bash docci-assert-line-count=3 docci-assert-failure")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-assert-line-count cannot be combined")
+}
+
+func TestWarnOnlyTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-warn-only")
+	require.NoError(t, err)
+	require.True(t, pt.WarnOnly)
+	require.NoError(t, pt.Validate(1))
+
+	pt, err = ParseTags("```bash docci-warn-on-failure docci-assert-failure")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-warn-only cannot be combined")
+}
+
+func TestOutputContainsCount(t *testing.T) {
+	pt, err := ParseTags("```bash docci-output-contains-count=\"PASS:3\"")
+	require.NoError(t, err)
+	require.Equal(t, &types.OutputCount{Text: "PASS", Count: 3}, pt.OutputCount)
+
+	// the count is split on the last colon so the text can contain colons
+	pt, err = ParseTags("```bash docci-output-count=\"status: ok:0\"")
+	require.NoError(t, err)
+	require.Equal(t, &types.OutputCount{Text: "status: ok", Count: 0}, pt.OutputCount)
+
+	_, err = ParseTags("```bash docci-output-contains-count=\"PASS\"")
+	require.ErrorContains(t, err, "requires 'text:count' format")
+	_, err = ParseTags("```bash docci-output-contains-count=\":3\"")
+	require.ErrorContains(t, err, "requires 'text:count' format")
+	_, err = ParseTags("```bash docci-output-contains-count=\"PASS:-1\"")
+	require.ErrorContains(t, err, "non-negative integer")
+
+	pt, err = ParseTags("```bash docci-output-contains-count=\"PASS:3\" docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-output-contains-count cannot be combined")
+}
+
+func TestNameAndSkipOnFailureOf(t *testing.T) {
+	pt, err := ParseTags("```bash docci-name=build")
+	require.NoError(t, err)
+	require.Equal(t, "build", pt.Name)
+
+	pt, err = ParseTags("```bash docci-depends-on=build_step")
+	require.NoError(t, err)
+	require.Equal(t, "build_step", pt.SkipOnFailureOf)
+
+	_, err = ParseTags("```bash docci-name=my-build")
+	require.ErrorContains(t, err, "docci-name may only contain")
+	_, err = ParseTags("```bash docci-skip-on-failure-of")
+	require.ErrorContains(t, err, "requires a block name")
+
+	pt, err = ParseTags("```bash docci-name=build docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "cannot be combined with background")
+
+	pt, err = ParseTags("```bash docci-name=build docci-assert-failure")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "Cannot use both docci-name and docci-assert-failure")
+}
+
+func TestMatrix(t *testing.T) {
+	pt, err := ParseTags("```bash docci-matrix=\"VERSION=1.20, 1.21,1.22\"")
+	require.NoError(t, err)
+	require.Equal(t, "VERSION", pt.MatrixVar)
+	require.Equal(t, []string{"1.20", "1.21", "1.22"}, pt.MatrixValues)
+	require.NoError(t, pt.Validate(1))
+
+	pt, err = ParseTags("```bash docci-foreach=\"MODE=fast\"")
+	require.NoError(t, err)
+	require.Equal(t, []string{"fast"}, pt.MatrixValues)
+
+	_, err = ParseTags("```bash docci-matrix=\"1.20,1.21\"")
+	require.ErrorContains(t, err, "requires 'NAME=value1,value2' format")
+	_, err = ParseTags("```bash docci-matrix=\"2X=a,b\"")
+	require.ErrorContains(t, err, "valid shell variable name")
+	_, err = ParseTags("```bash docci-matrix=\"X=a,,b\"")
+	require.ErrorContains(t, err, "values must not be empty")
+	_, err = ParseTags("```bash docci-matrix=\"X=\"")
+	require.ErrorContains(t, err, "values must not be empty")
+
+	pt, err = ParseTags("```bash docci-matrix=\"X=a,b\" docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-matrix cannot be combined")
+}
+
+func TestRunAs(t *testing.T) {
+	pt, err := ParseTags("```bash docci-run-as=postgres")
+	require.NoError(t, err)
+	require.Equal(t, "postgres", pt.RunAs)
+
+	pt, err = ParseTags("```bash docci-user=www-data")
+	require.NoError(t, err)
+	require.Equal(t, "www-data", pt.RunAs)
+
+	_, err = ParseTags("```bash docci-run-as")
+	require.ErrorContains(t, err, "docci-run-as requires a user name")
+	_, err = ParseTags("```bash docci-run-as=\"bob;rm\"")
+	require.ErrorContains(t, err, "docci-run-as requires a user name")
+
+	pt, err = ParseTags("```bash docci-run-as=postgres docci-file=a.txt")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-run-as cannot be combined")
+}
+
+func TestPollUntil(t *testing.T) {
+	pt, err := ParseTags("```bash docci-poll-until=\"kubectl get pods | grep web|Running|60\"")
+	require.NoError(t, err)
+	require.Equal(t, "kubectl get pods | grep web", pt.PollUntilCmd)
+	require.Equal(t, "Running", pt.PollUntilNeedle)
+	require.Equal(t, 60, pt.PollTimeoutSecs)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-poll-until=\"kubectl get pods|60\"")
+	require.ErrorContains(t, err, "format should be 'command|text|timeout_seconds'")
+	_, err = ParseTags("```bash docci-poll-until=\"kubectl get pods||60\"")
+	require.ErrorContains(t, err, "format should be 'command|text|timeout_seconds'")
+	_, err = ParseTags("```bash docci-poll-until=\"kubectl get pods|Running|soon\"")
+	require.ErrorContains(t, err, "invalid timeout value")
+	_, err = ParseTags("```bash docci-poll-until=\"kubectl get pods|Running|0\"")
+	require.ErrorContains(t, err, "timeout must be positive")
+
+	pt, err = ParseTags("```bash docci-wait-for-output=\"date|2|5\" docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-poll-until cannot be combined")
+}
+
+func TestAllowParallelWith(t *testing.T) {
+	pt, err := ParseTags("```bash docci-allow-parallel-with=\"lint, unit_tests\"")
+	require.NoError(t, err)
+	require.Equal(t, []string{"lint", "unit_tests"}, pt.AllowParallelWith)
+
+	_, err = ParseTags("```bash docci-parallel-with=\"lint,\"")
+	require.ErrorContains(t, err, "requires comma-separated block names")
+
+	pt, err = ParseTags("```bash docci-allow-parallel-with=lint docci-after-all")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-allow-parallel-with cannot be combined")
+}
+
+func TestArtifact(t *testing.T) {
+	pt, err := ParseTags("```bash docci-artifact=\"dist/app.tar.gz, logs/*.log\"")
+	require.NoError(t, err)
+	require.Equal(t, []string{"dist/app.tar.gz", "logs/*.log"}, pt.Artifacts)
+
+	_, err = ParseTags("```bash docci-artifact")
+	require.ErrorContains(t, err, "docci-artifact requires a file path or glob")
+	_, err = ParseTags("```bash docci-artifacts=\"a,,b\"")
+	require.ErrorContains(t, err, "must not be empty")
+	_, err = ParseTags("```bash docci-artifact=\"logs/[.log\"")
+	require.ErrorContains(t, err, "invalid glob")
+}
+
+func TestOSNegation(t *testing.T) {
+	pt, err := ParseTags("```bash docci-os=\"Mac, ! win\"")
+	require.NoError(t, err)
+	require.Equal(t, "macos,!windows", pt.OS)
+
+	_, err = ParseTags("```bash docci-os=\"!\"")
+	require.ErrorContains(t, err, "docci-os entries must not be empty")
+
+	tests := []struct {
+		blockOS string
+		linux   bool
+		macos   bool
+		windows bool
+	}{
+		{"", true, true, true},
+		{"linux", true, false, false},
+		{"mac,windows", false, true, true},
+		{"!windows", true, true, false},
+		{"!darwin", true, false, true},
+		{"!linux", false, true, true},
+		{"!windows,!macos", true, false, false},
+		{"linux,!linux", false, false, false},
+		{"!bsd", true, true, true},
+		{"bsd", false, false, false},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.linux, shouldRunOnOS(tt.blockOS, "linux"), "%q on linux", tt.blockOS)
+		require.Equal(t, tt.macos, shouldRunOnOS(tt.blockOS, "macos"), "%q on macos", tt.blockOS)
+		require.Equal(t, tt.windows, shouldRunOnOS(tt.blockOS, "windows"), "%q on windows", tt.blockOS)
+	}
+}
+
+func TestCaptureExitCode(t *testing.T) {
+	pt, err := ParseTags("```bash docci-capture-exit-code=BUILD_RC")
+	require.NoError(t, err)
+	require.Equal(t, "BUILD_RC", pt.CaptureExitCode)
+	require.NoError(t, pt.Validate(1))
+
+	pt, err = ParseTags("```bash docci-save-exit-code=rc")
+	require.NoError(t, err)
+	require.Equal(t, "rc", pt.CaptureExitCode)
+
+	_, err = ParseTags("```bash docci-capture-exit-code=1RC")
+	require.ErrorContains(t, err, "valid shell variable name")
+
+	pt, err = ParseTags("```bash docci-capture-exit-code=RC docci-assert-failure")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-capture-exit-code cannot be combined")
+}
+
+func TestAssertNoChange(t *testing.T) {
+	pt, err := ParseTags("```bash docci-assert-no-change=\"config/\"")
+	require.NoError(t, err)
+	require.Equal(t, "config/", pt.AssertNoChange)
+	require.NoError(t, pt.Validate(1))
+
+	pt, err = ParseTags("```bash docci-assert-idempotent=/tmp/out.txt")
+	require.NoError(t, err)
+	require.Equal(t, "/tmp/out.txt", pt.AssertNoChange)
+
+	_, err = ParseTags("```bash docci-assert-no-change=")
+	require.ErrorContains(t, err, "requires a file or directory path")
+
+	pt, err = ParseTags("```bash docci-assert-no-change=out docci-matrix=\"V=a,b\"")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-assert-no-change cannot be combined")
+}
+
+func TestFixtureTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-fixture=\"testdata/input.json:input.json\" docci-stage-file=\"a.txt : dir/b.txt\"")
+	require.NoError(t, err)
+	require.Equal(t, []Fixture{{Source: "testdata/input.json", Dest: "input.json"}, {Source: "a.txt", Dest: "dir/b.txt"}}, pt.Fixtures)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-fixture=input.json")
+	require.ErrorContains(t, err, "format should be 'source:dest'")
+
+	pt, err = ParseTags("```bash docci-fixture=a:b docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-fixture cannot be combined")
+}
+
+func TestNoNetworkTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-no-network")
+	require.NoError(t, err)
+	require.True(t, pt.NoNetwork)
+	require.NoError(t, pt.Validate(1))
+
+	pt, err = ParseTags("```bash docci-network-isolate docci-run-as=postgres")
+	require.NoError(t, err)
+	require.True(t, pt.NoNetwork)
+	require.ErrorContains(t, pt.Validate(1), "docci-no-network cannot be combined")
+}
+
+func TestDeprecatedAliasWarning(t *testing.T) {
+	var buf bytes.Buffer
+	prev := logger.GetLogger()
+	logger.SetLogger(logger.New("warn", &buf))
+	t.Cleanup(func() {
+		logger.SetLogger(prev)
+		SetDeprecationWarnings(true)
+		warnedAliases.Delete("docci-contains-output")
+	})
+
+	// deprecated aliases still work, but warn once with the canonical tag
+	warnedAliases.Delete("docci-contains-output")
+	for i := 0; i < 2; i++ {
+		pt, err := ParseTags("```bash docci-contains-output=\"hi\"")
+		require.NoError(t, err)
+		require.Equal(t, "hi", pt.OutputContains)
+	}
+	require.Equal(t, 1, strings.Count(buf.String(), "Deprecated tag alias"))
+	require.Contains(t, buf.String(), "alias=docci-contains-output")
+	require.Contains(t, buf.String(), "tag=docci-output-contains")
+	require.NotContains(t, AllTagNames(), "docci-contains-output")
+
+	// regular aliases do not warn
+	buf.Reset()
+	_, err := ParseTags("```bash docci-contains=\"hi\"")
+	require.NoError(t, err)
+	require.Empty(t, buf.String())
+
+	// --no-deprecation-warnings silences it
+	SetDeprecationWarnings(false)
+	warnedAliases.Delete("docci-contains-output")
+	_, err = ParseTags("```bash docci-contains-output=\"hi\"")
+	require.NoError(t, err)
+	require.Empty(t, buf.String())
+}
+
+func TestOutputToEnvTag(t *testing.T) {
+	pt, err := ParseTags("```bash docci-output-to-env=CONTAINER_ID")
+	require.NoError(t, err)
+	require.Equal(t, "CONTAINER_ID", pt.OutputToEnv)
+	require.NoError(t, pt.Validate(1))
+
+	_, err = ParseTags("```bash docci-export-output=bad-name")
+	require.ErrorContains(t, err, "valid shell variable name")
+
+	pt, err = ParseTags("```bash docci-output-to-env=ID docci-background")
+	require.NoError(t, err)
+	require.ErrorContains(t, pt.Validate(1), "docci-output-to-env cannot be combined")
+}
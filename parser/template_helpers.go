@@ -3,6 +3,7 @@ package parser
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -58,10 +59,213 @@ func formatDebugCleanup(debugEnabled bool) string {
 	return ""
 }
 
-// formatBashFlags returns appropriate bash flags based on assert failure setting
-func formatBashFlags(assertFailure bool) string {
-	if assertFailure {
-		return "-T" // Don't use -e for assert-failure blocks
+// formatSandboxCleanup returns the cleanup lines that remove the --sandbox directory, or report
+// where it was left when --keep-temp-files is set
+func formatSandboxCleanup(sandbox, keep bool) string {
+	if !sandbox {
+		return ""
+	}
+	if keep {
+		return "  echo \"Sandbox directory kept at $DOCCI_SANDBOX\" >&2\n"
+	}
+	return "  cd / && rm -rf \"$DOCCI_SANDBOX\"\n"
+}
+
+// formatTmpdirCleanup returns the cleanup line that removes the current docci-tmpdir directory when a
+// block fails before removing it itself, or nothing when no block uses the tag
+func formatTmpdirCleanup(blocks []CodeBlock) string {
+	for _, block := range blocks {
+		if block.Tmpdir {
+			return "  if [ -n \"${DOCCI_TMP:-}\" ]; then rm -rf \"$DOCCI_TMP\"; fi\n"
+		}
+	}
+	return ""
+}
+
+// formatRemoveTempFile returns the rm line for a temp file, or nothing when --keep-temp-files is set
+func formatRemoveTempFile(path string, keep bool) string {
+	if keep {
+		return ""
+	}
+	return fmt.Sprintf("  rm -f %s\n", path)
+}
+
+// formatBashFlags returns appropriate bash flags, without -e when a failing command should not
+// stop the block
+func formatBashFlags(keepGoing bool) string {
+	if keepGoing {
+		return "-T" // Don't use -e for assert-failure blocks or blocks others depend on
 	}
 	return "-eT"
 }
+
+// shellQuote wraps a value in single quotes so it is passed to bash literally
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// formatVerboseCommands prefixes each line of a block so it reads like a shell transcript
+func formatVerboseCommands(content string) string {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		b.WriteString("│ $ " + line + "\n")
+	}
+	return b.String()
+}
+
+// formatWorkingDirPrefix returns a cd line for blocks that already run in their own subshell
+func formatWorkingDirPrefix(dir string) string {
+	if dir == "" {
+		return ""
+	}
+	return fmt.Sprintf("cd \"%s\" || exit 1\n", dir)
+}
+
+// formatStdinFile wraps block content in a group that reads stdin from file
+func formatStdinFile(content string, file string) string {
+	if file == "" {
+		return content
+	}
+	return fmt.Sprintf("{\n%s} < \"%s\"\n", content, file)
+}
+
+// formatStdinFromPrevious wraps block content in a group that reads stdin from the previous block's
+// output, kept in docci_previous_output
+func formatStdinFromPrevious(content string, enabled bool) string {
+	if !enabled {
+		return content
+	}
+	return fmt.Sprintf("{\n%s} <<<\"$docci_previous_output\"\n", content)
+}
+
+// formatGlobalRetryCheck returns the --max-retries-global check for a retry attempt, or nothing without a cap
+func formatGlobalRetryCheck(index int, maxRetries int) string {
+	if maxRetries <= 0 {
+		return ""
+	}
+	return replaceTemplateVars(globalRetryCheckTemplate, map[string]string{
+		"INDEX":              strconv.Itoa(index),
+		"MAX_RETRIES_GLOBAL": strconv.Itoa(maxRetries),
+	})
+}
+
+// formatRetryStart returns the opening of a block's retry loop, bounded by docci-retry,
+// docci-retry-timeout or both
+func formatRetryStart(block CodeBlock, retryDelay float64, maxRetriesGlobal int) string {
+	var limits []string
+	var limitVars strings.Builder
+	attempt := "$retry_count"
+	if block.RetryCount > 0 {
+		limits = append(limits, "max attempts: "+strconv.Itoa(block.RetryCount))
+		limitVars.WriteString("max_retries=" + strconv.Itoa(block.RetryCount) + "\n")
+		attempt = "$retry_count/$max_retries"
+	}
+	if block.RetryTimeout > 0 {
+		limits = append(limits, "timeout: "+strconv.Itoa(block.RetryTimeout)+"s")
+		limitVars.WriteString("retry_start=$(date +%s)\n")
+	}
+	return replaceTemplateVars(retryWrapperStartTemplate, map[string]string{
+		"INDEX":              strconv.Itoa(block.Index),
+		"LIMITS":             strings.Join(limits, ", "),
+		"LIMIT_VARS":         limitVars.String(),
+		"ATTEMPT":            attempt,
+		"RETRY_DELAY":        strconv.FormatFloat(retryDelay, 'g', -1, 64),
+		"GLOBAL_RETRY_CHECK": formatGlobalRetryCheck(block.Index, maxRetriesGlobal),
+	})
+}
+
+// formatRetryEnd returns the close of a block's retry loop with a check for each of its limits.
+// With docci-retry-while-output the loop also goes on while the output matches its pattern.
+func formatRetryEnd(block CodeBlock) string {
+	vars := map[string]string{
+		"INDEX":   strconv.Itoa(block.Index),
+		"TIMEOUT": strconv.Itoa(block.RetryTimeout),
+	}
+	var checks strings.Builder
+	if block.RetryCount > 0 {
+		checks.WriteString(replaceTemplateVars(retryCountCheckTemplate, vars))
+	}
+	if block.RetryTimeout > 0 {
+		checks.WriteString(replaceTemplateVars(retryTimeoutCheckTemplate, vars))
+	}
+	if block.RetryWhile != "" {
+		return replaceTemplateVars(retryWhileOutputEndTemplate, map[string]string{
+			"INDEX":        strconv.Itoa(block.Index),
+			"PATTERN":      shellQuote(block.RetryWhile),
+			"LIMIT_CHECKS": checks.String(),
+		})
+	}
+	return replaceTemplateVars(retryWrapperEndTemplate, map[string]string{
+		"LIMIT_CHECKS": checks.String(),
+	})
+}
+
+// formatBackgroundMaxTime returns the timer that stops a background block after docci-background-max-time
+func formatBackgroundMaxTime(block CodeBlock) string {
+	if block.BackgroundMaxTimeSecs <= 0 {
+		return ""
+	}
+	return replaceTemplateVars(backgroundMaxTimeTemplate, map[string]string{
+		"INDEX":   strconv.Itoa(block.Index),
+		"SECONDS": strconv.Itoa(block.BackgroundMaxTimeSecs),
+	})
+}
+
+// formatRunAs wraps block content so it runs as the docci-run-as user
+func formatRunAs(content string, block CodeBlock) string {
+	if block.RunAs == "" {
+		return content
+	}
+	return replaceTemplateVars(runAsTemplate, map[string]string{
+		"INDEX":      strconv.Itoa(block.Index),
+		"USER":       shellQuote(block.RunAs),
+		"BASH_FLAGS": formatBashFlags(block.AssertFailure),
+		"CONTENT":    shellQuote(content),
+	})
+}
+
+// formatNoNetwork wraps the block's commands in the docci-no-network namespace wrapper
+func formatNoNetwork(content string, block CodeBlock) string {
+	if !block.NoNetwork {
+		return content
+	}
+	return replaceTemplateVars(noNetworkTemplate, map[string]string{
+		"INDEX":      strconv.Itoa(block.Index),
+		"BASH_FLAGS": formatBashFlags(block.AssertFailure),
+		"CONTENT":    shellQuote(content),
+	})
+}
+
+// formatMatrixStart opens the docci-matrix loop over the block's values
+func formatMatrixStart(block CodeBlock) string {
+	quoted := make([]string, len(block.MatrixValues))
+	for i, value := range block.MatrixValues {
+		quoted[i] = shellQuote(value)
+	}
+	return replaceTemplateVars(matrixStartTemplate, map[string]string{
+		"INDEX":  strconv.Itoa(block.Index),
+		"VAR":    block.MatrixVar,
+		"VALUES": strings.Join(quoted, " "),
+	})
+}
+
+// formatMatrixEnd closes the docci-matrix loop, checking docci-output-contains against each run's output.
+// With stripANSI the output is checked with ANSI escape sequences removed.
+func formatMatrixEnd(block CodeBlock, stripANSI bool) string {
+	readOutput := "cat"
+	if stripANSI {
+		readOutput = `sed $'s/\x1b\\[[0-?]*[ -/]*[@-~]//g'`
+	}
+	vars := map[string]string{
+		"INDEX":       strconv.Itoa(block.Index),
+		"VAR":         block.MatrixVar,
+		"EXPECTED":    shellQuote(block.OutputContains),
+		"VALUE_LIST":  shellQuote(strings.Join(block.MatrixValues, ",")),
+		"READ_OUTPUT": readOutput,
+	}
+	end := replaceTemplateVars(matrixRunEndTemplate, vars)
+	if block.OutputContains != "" {
+		end += replaceTemplateVars(matrixOutputCheckTemplate, vars)
+	}
+	return end + replaceTemplateVars(matrixEndTemplate, vars)
+}
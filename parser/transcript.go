@@ -0,0 +1,119 @@
+package parser
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultPrompts are the leading prompts docci-prompt-strip removes when no custom prompt is given
+var defaultPrompts = []string{"$ ", "# "}
+
+// transcriptPrompts start command lines in a docci-transcript block. "# " is left out because
+// output often contains comment lines.
+var transcriptPrompts = []string{"$ "}
+
+// transcriptStep is one command from a terminal transcript and the output lines shown after it
+type transcriptStep struct {
+	Command string
+	Output  []string
+}
+
+// parseTranscript splits a terminal transcript into commands and their output.
+// Lines starting with one of the prompts are commands (with the prompt removed), a command ending
+// in a backslash continues on the next line, and every other line is output of the previous command.
+func parseTranscript(content string, prompts []string) []transcriptStep {
+	var steps []transcriptStep
+	continuation := false
+
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		if continuation && len(steps) > 0 {
+			last := &steps[len(steps)-1]
+			last.Command += "\n" + line
+			continuation = strings.HasSuffix(line, "\\")
+			continue
+		}
+
+		if command, ok := cutPrompt(line, prompts); ok {
+			steps = append(steps, transcriptStep{Command: command})
+			continuation = strings.HasSuffix(command, "\\")
+			continue
+		}
+
+		if len(steps) > 0 {
+			last := &steps[len(steps)-1]
+			last.Output = append(last.Output, line)
+		}
+	}
+	return steps
+}
+
+// cutPrompt returns line without its leading prompt, reporting whether one was found
+func cutPrompt(line string, prompts []string) (string, bool) {
+	for _, prompt := range prompts {
+		if command, ok := strings.CutPrefix(line, prompt); ok {
+			return command, true
+		}
+		// a bare prompt with nothing after it, e.g. "$"
+		if line == strings.TrimRight(prompt, " ") {
+			return "", true
+		}
+	}
+	return "", false
+}
+
+// stripPrompts turns a copy-pasted terminal session into runnable commands: prompts are removed and
+// output lines dropped. Content without any prompt is returned unchanged.
+func stripPrompts(content string, prompts []string) string {
+	steps := parseTranscript(content, prompts)
+	if len(steps) == 0 {
+		return content
+	}
+
+	var commands strings.Builder
+	for _, step := range steps {
+		commands.WriteString(step.Command)
+		commands.WriteString("\n")
+	}
+	return commands.String()
+}
+
+// formatTranscript generates the script for a docci-transcript block: each command runs in order
+// and its output is compared with the lines that followed it in the transcript. Commands shown
+// without output are run but not checked.
+func formatTranscript(content string, prompts []string, index int) string {
+	var script strings.Builder
+	// commands are announced by the transcript itself, so the per-command trace is turned off
+	script.WriteString("trap - DEBUG\n")
+
+	for _, step := range parseTranscript(content, prompts) {
+		vars := map[string]string{
+			"INDEX":          strconv.Itoa(index),
+			"COMMAND":        step.Command,
+			"COMMAND_QUOTED": shellQuote(step.Command),
+		}
+		script.WriteString(replaceTemplateVars(transcriptStepTemplate, vars))
+
+		expected := normalizeTranscriptOutput(step.Output)
+		if expected == "" {
+			continue
+		}
+		vars["EXPECTED"] = shellQuote(expected)
+		vars["COMMAND_BASE64"] = base64.StdEncoding.EncodeToString([]byte(step.Command))
+		vars["EXPECTED_BASE64"] = base64.StdEncoding.EncodeToString([]byte(expected))
+		script.WriteString(replaceTemplateVars(transcriptCheckTemplate, vars))
+	}
+	script.WriteString(fmt.Sprintf("rm -f /tmp/docci_transcript_$$_%d.out\n", index))
+	return script.String()
+}
+
+// normalizeTranscriptOutput joins expected output lines the same way the script reads actual output:
+// trailing whitespace on each line and trailing blank lines are ignored
+func normalizeTranscriptOutput(lines []string) string {
+	trimmed := make([]string, len(lines))
+	for i, line := range lines {
+		trimmed[i] = strings.TrimRight(line, " \t\r")
+	}
+	return strings.TrimRight(strings.Join(trimmed, "\n"), "\n")
+}
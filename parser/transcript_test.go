@@ -0,0 +1,72 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/reecepbcups/docci/executor"
+	"github.com/reecepbcups/docci/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripPrompts(t *testing.T) {
+	transcript := "$ echo hello\nhello\n$ ls \\\n  -la /tmp\ntotal 0\n# whoami\nroot\n$\n"
+	require.Equal(t, "echo hello\nls \\\n  -la /tmp\nwhoami\n\n", stripPrompts(transcript, defaultPrompts))
+
+	// custom prompt
+	require.Equal(t, "echo hi\n", stripPrompts("> echo hi\nhi\n", []string{"> "}))
+
+	// content without prompts is left alone
+	require.Equal(t, "echo plain\n", stripPrompts("echo plain\n", defaultPrompts))
+}
+
+func TestParseTranscript(t *testing.T) {
+	steps := parseTranscript("intro text\n$ echo a\na\n$ printf 'b\\nc\\n'\nb\nc\n$ true\n", defaultPrompts)
+	require.Equal(t, []transcriptStep{
+		{Command: "echo a", Output: []string{"a"}},
+		{Command: "printf 'b\\nc\\n'", Output: []string{"b", "c"}},
+		{Command: "true"},
+	}, steps)
+}
+
+func TestTranscriptScript(t *testing.T) {
+	markdown := "```console docci-transcript\n" +
+		"$ export NAME=docci\n" +
+		"$ echo \"hello $NAME\"\n" +
+		"hello docci   \n" +
+		"$ printf 'a\\nb\\n'\n" +
+		"a\n" +
+		"b\n" +
+		"\n" +
+		"$ echo unchecked\n" +
+		"```\n" +
+		"```bash docci-output-contains=\"still docci\"\necho \"still $NAME\"\n```\n"
+	blocks, err := ParseCodeBlocks(markdown)
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	require.True(t, blocks[0].Transcript)
+
+	script, validationMap, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err := executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+	outputs := executor.ParseBlockOutputs(resp.Stdout, nil)
+	require.Equal(t, "hello docci\na\nb\nunchecked", outputs[1])
+	require.Empty(t, executor.ValidateOutputs(outputs, validationMap, nil, nil))
+
+	// a command whose output differs from the transcript is reported, and the block goes on
+	blocks, err = ParseCodeBlocks("```console docci-transcript\n$ echo actual\nexpected\n$ printf 'two\\nlines\\n'\ntwo\n$ echo still run\n```\n")
+	require.NoError(t, err)
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	resp, err = executor.Exec(script)
+	require.NoError(t, err)
+	require.NoError(t, resp.Error, resp.Stderr)
+	require.Contains(t, resp.Stderr, "Transcript mismatch in block 1 for command: echo actual")
+	require.Contains(t, resp.Stderr, "Expected:\nexpected\nActual:\nactual")
+	require.Contains(t, resp.Stdout, "still run")
+	require.NotContains(t, executor.ParseBlockOutputs(resp.Stdout, nil)[1], "DOCCI_TRANSCRIPT_MISMATCH")
+
+	mismatches := executor.ParseTranscriptMismatches(resp.Stdout)
+	require.Len(t, mismatches, 2)
+	require.Equal(t, executor.ValidationError{BlockIndex: 1, TranscriptCmd: "echo actual", Expected: "expected", Actual: "actual"}, *mismatches[0])
+	require.Equal(t, "two\nlines", mismatches[1].Actual)
+}
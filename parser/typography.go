@@ -0,0 +1,51 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/reecepbcups/docci/logger"
+)
+
+// typographyReplacer turns the characters word processors substitute for straight quotes,
+// ellipses and spaces back into their ASCII form
+var typographyReplacer = strings.NewReplacer(
+	"\u2018", "'", // left single quote
+	"\u2019", "'", // right single quote
+	"\u201A", "'", // low single quote
+	"\u201B", "'", // reversed single quote
+	"\u201C", `"`, // left double quote
+	"\u201D", `"`, // right double quote
+	"\u201E", `"`, // low double quote
+	"\u201F", `"`, // reversed double quote
+	"\u2026", "...", // ellipsis
+	"\u00A0", " ", // non-breaking space
+)
+
+// flagDashRe matches an en or em dash that starts a word, which in a command is a "--" flag
+// that an editor merged into one character (e.g. "–verbose"). Dashes used as punctuation
+// between words are left alone.
+var flagDashRe = regexp.MustCompile(`(^|[\s=])[\x{2013}\x{2014}]([A-Za-z])`)
+
+// normalizeTypography converts typographic quotes, dashes and spaces in code back to ASCII
+func normalizeTypography(content string) string {
+	content = typographyReplacer.Replace(content)
+	return flagDashRe.ReplaceAllString(content, "${1}--${2}")
+}
+
+// normalizeBlocksTypography returns the blocks with typography normalized for every block that
+// has docci-fix-typography, or for all blocks when all is set. The input slice is not modified.
+func normalizeBlocksTypography(blocks []CodeBlock, all bool) []CodeBlock {
+	normalized := make([]CodeBlock, len(blocks))
+	for i, block := range blocks {
+		if all || block.FixTypography {
+			content := normalizeTypography(block.Content)
+			if content != block.Content {
+				logger.GetLogger().Info("Replaced typographic quotes or dashes with ASCII", "block", block.Index)
+				block.Content = content
+			}
+		}
+		normalized[i] = block
+	}
+	return normalized
+}
@@ -0,0 +1,30 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/reecepbcups/docci/types"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeTypography(t *testing.T) {
+	require.Equal(t, `echo "hello" 'world'...`, normalizeTypography("echo “hello” ‘world’…"))
+	require.Equal(t, "ls --all --color=auto", normalizeTypography("ls –all —color=auto"))
+	require.Equal(t, "git commit --message=x", normalizeTypography("git commit –message=x"))
+	// dashes between words are punctuation, not flags
+	require.Equal(t, "echo 'a – b'", normalizeTypography("echo ‘a – b’"))
+}
+
+func TestFixTypographyBlocks(t *testing.T) {
+	blocks, err := ParseCodeBlocks("```bash docci-fix-typography\necho “fixed”\n```\n```bash\necho “kept”\n```\n")
+	require.NoError(t, err)
+
+	script, _, _ := BuildExecutableScriptWithOptions(blocks, types.DocciOpts{})
+	require.Contains(t, script, `echo "fixed"`)
+	require.Contains(t, script, "echo “kept”")
+	// the caller's blocks are left as written
+	require.Equal(t, "echo “fixed”\n", blocks[0].Content)
+
+	script, _, _ = BuildExecutableScriptWithOptions(blocks, types.DocciOpts{FixTypography: true})
+	require.Contains(t, script, `echo "kept"`)
+}
@@ -0,0 +1,113 @@
+package parser
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TagUsage is how often a tag is used across a set of markdown files
+type TagUsage struct {
+	Tag     string         `json:"tag"`
+	Count   int            `json:"count"`             // uses under any name
+	Aliases map[string]int `json:"aliases,omitempty"` // uses written as an alias, by alias
+}
+
+// CountTagUsage adds the tags on each code fence in markdown to counts, keyed by the tag name or
+// alias as written. Fences in docci-disable regions are skipped, and a fence whose tags do not
+// parse is an error so the counts only cover valid documents.
+func CountTagUsage(markdown string, counts map[string]int) error {
+	return countTagUsage(markdown, nil, counts)
+}
+
+// CountTagUsageWithIncludes is CountTagUsage for the markdown read from filePath. The fences of each
+// docci-include fragment are counted too, once for every directive that includes it.
+func CountTagUsageWithIncludes(markdown string, filePath string, counts map[string]int) error {
+	path, err := filepath.Abs(filePath)
+	if err != nil {
+		return fmt.Errorf("resolve %s: %w", filePath, err)
+	}
+	return countTagUsage(markdown, &includeContext{path: path}, counts)
+}
+
+// countTagUsage counts the tags in markdown, following docci-include directives when inc is set
+func countTagUsage(markdown string, inc *includeContext, counts map[string]int) error {
+	inBlock := false
+	disabled := false
+
+	for idx, line := range splitIntoLines(markdown) {
+		if inBlock {
+			if strings.Trim(line, " ") == "```" {
+				inBlock = false
+			}
+			continue
+		}
+
+		if state, ok := regionDirective(line); ok {
+			disabled = state
+			continue
+		}
+		if target, ok := includeDirective(line); ok && !disabled && inc != nil {
+			fragment, fragmentInc, err := readInclude(target, inc)
+			if err != nil {
+				return fmt.Errorf("line %d: %w", idx+1, err)
+			}
+			if err := countTagUsage(fragment, fragmentInc, counts); err != nil {
+				return fmt.Errorf("line %d: docci-include %s: %w", idx+1, target, err)
+			}
+			continue
+		}
+		if !strings.HasPrefix(line, "```") {
+			continue
+		}
+		inBlock = true
+		if disabled {
+			continue
+		}
+
+		if _, err := ParseTags(line); err != nil {
+			return fmt.Errorf("line %d: %w", idx+1, err)
+		}
+		for _, tag := range tagRe.FindAllString(stripAttributeBrace(line), -1) {
+			name, _, _ := strings.Cut(tag, "=")
+			counts[strings.TrimSpace(name)]++
+		}
+	}
+	return nil
+}
+
+// SummarizeTagUsage groups counts from CountTagUsage by tag, most used first
+func SummarizeTagUsage(counts map[string]int) []TagUsage {
+	byTag := make(map[string]*TagUsage)
+	for name, count := range counts {
+		tag, err := TagAlias(name)
+		if err != nil {
+			continue
+		}
+		usage, ok := byTag[tag]
+		if !ok {
+			usage = &TagUsage{Tag: tag}
+			byTag[tag] = usage
+		}
+		usage.Count += count
+		if name != tag {
+			if usage.Aliases == nil {
+				usage.Aliases = make(map[string]int)
+			}
+			usage.Aliases[name] += count
+		}
+	}
+
+	summary := make([]TagUsage, 0, len(byTag))
+	for _, usage := range byTag {
+		summary = append(summary, *usage)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].Count != summary[j].Count {
+			return summary[i].Count > summary[j].Count
+		}
+		return summary[i].Tag < summary[j].Tag
+	})
+	return summary
+}
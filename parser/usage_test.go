@@ -0,0 +1,39 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCountTagUsage(t *testing.T) {
+	counts := make(map[string]int)
+	require.NoError(t, CountTagUsage("```bash docci-output-contains=\"a b\" docci-retry=2\necho a b\n```\n"+
+		"```bash docci-contains=x\necho x\n```\n"+
+		"<!-- docci-disable -->\n```bash docci-bg\nsleep 1\n```\n<!-- docci-enable -->\n", counts))
+	require.NoError(t, CountTagUsage("```{.bash docci-retry=1}\necho\n```\n", counts))
+	require.Equal(t, map[string]int{"docci-output-contains": 1, "docci-contains": 1, "docci-retry": 2}, counts)
+
+	require.Equal(t, []TagUsage{
+		{Tag: "docci-output-contains", Count: 2, Aliases: map[string]int{"docci-contains": 1}},
+		{Tag: "docci-retry", Count: 2},
+	}, SummarizeTagUsage(counts))
+
+	err := CountTagUsage("text\n```bash docci-bad-tag\necho\n```\n", counts)
+	require.ErrorContains(t, err, "line 2: unknown tag / alias: docci-bad-tag")
+}
+
+func TestCountTagUsageWithIncludes(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "setup.md"), []byte("```bash docci-retry=2\necho setup\n```\n"), 0644))
+	path := filepath.Join(dir, "guide.md")
+
+	counts := make(map[string]int)
+	require.NoError(t, CountTagUsageWithIncludes("<!-- docci-include: setup.md -->\n```bash docci-retry=1\necho guide\n```\n", path, counts))
+	require.Equal(t, map[string]int{"docci-retry": 2}, counts)
+
+	err := CountTagUsageWithIncludes("<!-- docci-include: missing.md -->\n", path, counts)
+	require.ErrorContains(t, err, "line 1: docci-include missing.md")
+}
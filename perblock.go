@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	"github.com/reecepbcups/docci/logger"
+	"github.com/reecepbcups/docci/parser"
+	"github.com/reecepbcups/docci/types"
+)
+
+// runEachBlock runs every block as its own script for --per-block and --step, instead of merging
+// them into one. Exported variables, docci-name results and the working directory are saved after
+// each block and restored before the next. With opts.Step the user is asked before each block
+// whether to run it, skip it or stop the run.
+func runEachBlock(blocks []parser.CodeBlock, opts types.DocciOpts, label string) DocciResult {
+	log := logger.GetLogger()
+
+	if opts.Step && !isInteractive() {
+		return perBlockError(fmt.Errorf("--step needs an interactive terminal to read answers from"))
+	}
+	// a background process is stopped when the script that started it exits, which would be
+	// right after its own block
+	for _, block := range blocks {
+		if block.Background {
+			return perBlockError(fmt.Errorf("docci-background blocks cannot run one block at a time (block %d, line %d)", block.Index, block.LineNumber))
+		}
+	}
+
+	stateFile, err := os.CreateTemp("", "docci-state-*.env")
+	if err != nil {
+		return perBlockError(fmt.Errorf("create block state file: %w", err))
+	}
+	stateFile.Close()
+	defer os.Remove(stateFile.Name())
+
+	var reader *bufio.Reader
+	if opts.Step {
+		reader = bufio.NewReader(confirmInput)
+	}
+
+	result := DocciResult{Success: true, BlockStdout: make(map[int]string), BlockStderr: make(map[int]string), BlockOutput: make(map[int]string)}
+	for _, block := range runOrder(blocks) {
+		if opts.Step {
+			answer, err := promptStep(reader, block)
+			if err != nil {
+				return perBlockError(err)
+			}
+			switch answer {
+			case stepSkip:
+				log.Info("Skipping block", "block", block.Index, "line", block.LineNumber)
+				continue
+			case stepQuit:
+				log.Info("Stopping the run before block", "block", block.Index, "line", block.LineNumber)
+				return result
+			}
+		}
+
+		// before-all and after-all only change where a block goes in the script, which runOrder did already
+		block.BeforeAll, block.AfterAll = false, false
+		blockResult := runBlocks([]parser.CodeBlock{block}, opts, label, stateFile.Name())
+		addBlockResult(&result, blockResult)
+		if !blockResult.Success || blockResult.BailedAt != 0 {
+			return result
+		}
+	}
+	return result
+}
+
+// runOrder returns blocks in the order the merged script would run them: docci-before-all blocks
+// first and docci-after-all blocks last, each keeping their document order
+func runOrder(blocks []parser.CodeBlock) []parser.CodeBlock {
+	var beforeAll, regular, afterAll []parser.CodeBlock
+	for _, block := range blocks {
+		switch {
+		case block.BeforeAll:
+			beforeAll = append(beforeAll, block)
+		case block.AfterAll:
+			afterAll = append(afterAll, block)
+		default:
+			regular = append(regular, block)
+		}
+	}
+	return append(append(beforeAll, regular...), afterAll...)
+}
+
+// wrapBlockScript makes a block's script pick up where the previous block left off and save its
+// own state for the next one. Only exported variables carry over, along with docci-name results
+// for docci-skip-on-failure-of. A block that fails stops the run, so its state is never needed.
+func wrapBlockScript(script string, statePath string) string {
+	quoted := "'" + strings.ReplaceAll(statePath, "'", `'\''`) + "'"
+	return "# Restore the variables and directory the previous block left behind\n" +
+		"if [ -s " + quoted + " ]; then . " + quoted + "; fi\n\n" +
+		script +
+		"\n# Save the variables and directory for the next block\n" +
+		"{ export -p; for docci_var in ${!DOCCI_BLOCK_OK_@}; do echo \"export $docci_var=1\"; done; printf 'cd %q\\n' \"$PWD\"; } > " + quoted + "\n"
+}
+
+// addBlockResult adds the result of one block's script to the result of the whole run. The last
+// block's failure, if any, becomes the run's.
+func addBlockResult(result *DocciResult, block DocciResult) {
+	result.Stdout += block.Stdout
+	result.Stderr += block.Stderr
+	maps.Copy(result.BlockStdout, block.BlockStdout)
+	maps.Copy(result.BlockStderr, block.BlockStderr)
+	maps.Copy(result.BlockOutput, block.BlockOutput)
+	if len(block.OutputEnv) > 0 {
+		if result.OutputEnv == nil {
+			result.OutputEnv = make(map[string]string)
+		}
+		maps.Copy(result.OutputEnv, block.OutputEnv)
+	}
+	if len(block.Warnings) > 0 {
+		if result.Warnings == nil {
+			result.Warnings = make(map[int]int)
+		}
+		maps.Copy(result.Warnings, block.Warnings)
+	}
+
+	result.Success = block.Success
+	result.ExitCode = block.ExitCode
+	result.ValidationErrors = block.ValidationErrors
+	result.ExecError = block.ExecError
+	result.BailedAt = block.BailedAt
+}
+
+// perBlockError is the result of a --per-block or --step run that could not start
+func perBlockError(err error) DocciResult {
+	return DocciResult{
+		Success:  false,
+		ExitCode: ExitCodeExecutionError,
+		Stderr:   fmt.Sprintf("Error running code blocks one at a time: %s", err.Error()),
+	}
+}
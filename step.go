@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/reecepbcups/docci/parser"
+)
+
+// Answers to a --step prompt
+const (
+	stepRun = iota
+	stepSkip
+	stepQuit
+)
+
+// promptStep shows the block about to run and reads what to do with it, asking again on an
+// answer it does not know. Answers are read from confirmInput like docci-confirm prompts.
+func promptStep(reader *bufio.Reader, block parser.CodeBlock) (int, error) {
+	fmt.Fprintf(os.Stderr, "\nBlock %d (line %d%s):\n%s", block.Index, block.LineNumber, formatFileName(block.FileName), block.Content)
+	for {
+		fmt.Fprint(os.Stderr, "[enter] run, [s] skip, [q] quit: ")
+		answer, err := reader.ReadString('\n')
+		if err != nil && answer == "" {
+			return 0, fmt.Errorf("read --step answer for block %d: %w", block.Index, err)
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "":
+			return stepRun, nil
+		case "s", "skip":
+			return stepSkip, nil
+		case "q", "quit":
+			return stepQuit, nil
+		}
+	}
+}
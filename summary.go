@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// fileSummary is how one markdown file did in a --summary-only run
+type fileSummary struct {
+	path   string
+	status string // "passed", "failed" or "not run"
+	blocks []int  // indexes of the file's blocks, in run order
+}
+
+// fileSummaries groups a run's blocks by the file they came from, in the order the files ran. A
+// file failed when one of its blocks stopped the run or failed a validation, and did not run when
+// none of its blocks started.
+func fileSummaries(result DocciResult) []fileSummary {
+	var indexes []int
+	for index := range result.BlockFiles {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	failed := make(map[int]bool)
+	if result.ExecError != nil && result.ExecError.Block != 0 {
+		failed[result.ExecError.Block] = true
+	}
+	for _, verr := range result.ValidationErrors {
+		failed[verr.BlockIndex] = true
+	}
+
+	var summaries []fileSummary
+	byPath := make(map[string]int)
+	for _, index := range indexes {
+		path := result.BlockFiles[index]
+		i, ok := byPath[path]
+		if !ok {
+			i = len(summaries)
+			byPath[path] = i
+			summaries = append(summaries, fileSummary{path: path, status: "not run"})
+		}
+		summary := &summaries[i]
+		summary.blocks = append(summary.blocks, index)
+		if failed[index] {
+			summary.status = "failed"
+		} else if _, started := result.BlockOutput[index]; started && summary.status == "not run" {
+			summary.status = "passed"
+		}
+	}
+	return summaries
+}
+
+// printRunSummary writes a pass/fail line per file, then the output of the files that failed and
+// the run's errors
+func printRunSummary(w io.Writer, result DocciResult) {
+	summaries := fileSummaries(result)
+	counts := make(map[string]int)
+	for _, summary := range summaries {
+		counts[summary.status]++
+	}
+
+	fmt.Fprintf(w, "\n=== Summary: %d passed, %d failed, %d not run ===\n", counts["passed"], counts["failed"], counts["not run"])
+	for _, summary := range summaries {
+		icon := "✅"
+		switch summary.status {
+		case "failed":
+			icon = "❌"
+		case "not run":
+			icon = "⏭️"
+		}
+		fmt.Fprintf(w, "%s %-7s  %s\n", icon, summary.status, summary.path)
+	}
+
+	for _, summary := range summaries {
+		if summary.status != "failed" {
+			continue
+		}
+		fmt.Fprintf(w, "\n=== Output of %s ===\n", summary.path)
+		for _, index := range summary.blocks {
+			if output, ok := result.BlockOutput[index]; ok {
+				fmt.Fprintf(w, "--- block %d ---\n%s", index, output)
+			}
+		}
+	}
+
+	if !result.Success && strings.TrimSpace(result.Stderr) != "" {
+		fmt.Fprintf(w, "\n=== Errors ===\n%s\n", strings.TrimSpace(result.Stderr))
+	}
+}
@@ -1,7 +1,66 @@
 package types
 
+import (
+	"io"
+
+	"github.com/reecepbcups/docci/hooks"
+)
+
 type DocciOpts struct {
 	HideBackgroundLogs bool
 	KeepRunning        bool
 	DebugMode          bool
+	AssumeYes          bool        // auto-confirm docci-confirm blocks without prompting
+	Verbose            bool        // print a structured section for each block
+	ContainerImage     string      // run the script inside this docker image instead of locally
+	RemoteHost         string      // run the script over ssh on this user@host instead of locally
+	PrintScriptOnFail  bool        // dump the generated script with line numbers to stderr when the run fails
+	KeepTempFiles      bool        // keep background output files and save the generated script to a temp file
+	MergeOutput        bool        // read stdout and tagged stderr lines from one pipe so they keep the order they were written in
+	ArtifactDir        string      // directory docci-artifact files are copied into after the run
+	FixTypography      bool        // convert smart quotes and dashes in every block back to ASCII before running
+	MaxRetriesGlobal   int         // cap on docci-retry attempts across all blocks, 0 for no cap
+	RetryAll           int         // docci-retry count for every block without its own retry tags, 0 to leave them alone
+	StripANSI          bool        // remove ANSI escape sequences from every block's output before validating it
+	ForceColor         bool        // set FORCE_COLOR and CLICOLOR_FORCE for the script so tools print colors when piped
+	NoColor            bool        // set NO_COLOR for the script so tools print plain text
+	Sandbox            bool        // run every block in a fresh temp directory that is removed when the script exits
+	BaseURL            string      // substituted for ${BASE_URL} in block content and endpoint tags
+	Shell              string      // bash binary that runs the script locally, "bash" from PATH when empty
+	PowerShell         bool        // run PowerShell blocks with pwsh instead of bash blocks with bash
+	PerBlock           bool        // run every block as its own script instead of merging them into one
+	Step               bool        // run blocks one at a time like PerBlock, asking before each whether to run, skip or quit
+	InputTimeoutSecs   int         // stop the script once it has written no output for this many seconds, 0 to wait forever
+	AllowClear         bool        // let docci-clear-screen blocks clear the terminal, ignored otherwise
+	Hooks              hooks.Hooks // optional callbacks fired for each block as results are processed
+	Stdout             io.Writer   // where the blocks' output is streamed while the script runs, os.Stdout when nil
+	Stderr             io.Writer   // where the blocks' error output is streamed while the script runs, os.Stderr when nil
+
+	// Around the run
+	LogLevel             string   // log level for the run, the current logger is kept when empty and put back after it
+	WorkingDir           string   // directory the script and the pre/cleanup/on-failure commands run in, file paths stay relative to the process's
+	PreCommands          []string // commands run before the blocks, a failing one is logged and ignored
+	CleanupCommands      []string // commands run after the blocks, with DOCCI_SUCCESS and DOCCI_EXIT_CODE set
+	OnFailureCommands    []string // commands run before cleanup when the run failed, with DOCCI_FAILED_* set
+	SkipCleanupOnSuccess bool     // leave CleanupCommands out when the run succeeded
+}
+
+// OutputCount is a docci-output-contains-count expectation: Text must appear exactly Count times
+type OutputCount struct {
+	Text  string
+	Count int
+}
+
+// OutputBounds is a block's docci-output-starts-with and docci-output-ends-with expectations, checked
+// against the trimmed output. An empty field is not checked.
+type OutputBounds struct {
+	Prefix string
+	Suffix string
+}
+
+// LineCount is a docci-assert-line-count expectation: the output's non-empty lines compared with
+// Count using Op, one of ==, <, <=, > or >=
+type LineCount struct {
+	Op    string
+	Count int
 }